@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// assignment sources describe why a reviewer was picked for a reviewee
+const (
+	sourceTeam      = "team"
+	sourceOrg       = "org"
+	sourceCrossTeam = "cross_team"
+)
+
+// ErrInvalidAssignment is returned when committing an assignment that names an unknown or deactivated user, assigns a
+// user to themselves, or has an unknown source
+var ErrInvalidAssignment = errors.New("invalid assignment")
+
+// queryer is what planning needs, so it can run against the db or inside a transaction
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Assignment is a reviewer that was picked to review a reviewee during a cycle
+type Assignment struct {
+	RevieweeEmail string `json:"reviewee_email"`
+	ReviewerEmail string `json:"reviewer_email"`
+	Source        string `json:"source"`
+}
+
+// AssignmentOptions controls how many reviewers each user gets.
+// CrossTeamPerUser of the ReviewersPerUser slots are filled from people who share no team with the reviewee.
+type AssignmentOptions struct {
+	ReviewersPerUser int `json:"reviewers_per_user"`
+	CrossTeamPerUser int `json:"cross_team_per_user"`
+}
+
+// assignee is what the planner knows about a user
+type assignee struct {
+	id        int
+	email     string
+	managerID int
+	teams     map[int]bool
+}
+
+// PlanAssignments works out reviewer assignments for every user in a cycle without writing anything.
+// Reviewers come from the reviewee's teams, the org structure (manager, reports, and peers with the same manager),
+// and people on other teams. Candidates with the fewest open requests are picked first so load is balanced.
+// Nobody is assigned to themselves, existing requests in the cycle are not duplicated and count towards
+// ReviewersPerUser, and the cycle's per reviewer request limit is respected.
+func PlanAssignments(db queryer, cycle string, opts AssignmentOptions) ([]Assignment, error) {
+	var cycleID, reviewerCap int
+	err := db.QueryRow("select id, max_requests_per_reviewer from review_cycles where name=? limit 1", cycle).Scan(&cycleID, &reviewerCap)
+	if err == sql.ErrNoRows {
+		return nil, ErrCycleNotFound
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to look up cycle in PlanAssignments")
+	}
+
+	users, err := loadAssignees(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// existing holds reviewee -> reviewer pairs that already exist this cycle. Declined, withdrawn, and rejected requests
+	// are left out so that a reviewer who declined is not assigned again, but they do not count as a reviewer either.
+	existing := make(map[int]map[int]bool)
+	declined := make(map[int]map[int]bool)
+	load := make(map[int]int)
+	q := "select recipient_id, reviewer_id, status from review_requests where cycle_id=?"
+	rows, err := db.Query(q, cycleID)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query review requests in PlanAssignments")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var revieweeID, reviewerID int
+		var status string
+		if err = rows.Scan(&revieweeID, &reviewerID, &status); err != nil {
+			return nil, errors.Wrap(err, "unable to scan review requests in PlanAssignments")
+		}
+		pairs := existing
+		if status == requestDeclined || status == requestWithdrawn || status == requestRejected {
+			pairs = declined
+		} else {
+			load[reviewerID]++
+		}
+		if pairs[revieweeID] == nil {
+			pairs[revieweeID] = make(map[int]bool)
+		}
+		pairs[revieweeID][reviewerID] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in PlanAssignments")
+	}
+
+	var assignments []Assignment
+	for _, reviewee := range users {
+		need := opts.ReviewersPerUser - len(existing[reviewee.id])
+		if need <= 0 {
+			continue
+		}
+		crossNeed := opts.CrossTeamPerUser
+		if crossNeed > need {
+			crossNeed = need
+		}
+
+		// pick assigns up to n eligible candidates with the lowest load. Ties go to the earliest source listed,
+		// so team mates and the org are preferred, but never at the cost of piling onto a busy reviewer.
+		pick := func(n int, sources ...string) {
+			priority := make(map[string]int)
+			for i, source := range sources {
+				priority[source] = i
+			}
+			var candidates []*assignee
+			for _, u := range users {
+				if u.id == reviewee.id || existing[reviewee.id][u.id] || declined[reviewee.id][u.id] {
+					continue
+				}
+				if reviewerCap > 0 && load[u.id] >= reviewerCap {
+					continue
+				}
+				if inList(relation(reviewee, u), sources) {
+					candidates = append(candidates, u)
+				}
+			}
+			// users are sorted by email, so a stable sort keeps ties deterministic
+			sort.SliceStable(candidates, func(i, j int) bool {
+				if load[candidates[i].id] != load[candidates[j].id] {
+					return load[candidates[i].id] < load[candidates[j].id]
+				}
+				return priority[relation(reviewee, candidates[i])] < priority[relation(reviewee, candidates[j])]
+			})
+			for _, u := range candidates {
+				if n <= 0 {
+					break
+				}
+				assignments = append(assignments, Assignment{RevieweeEmail: reviewee.email, ReviewerEmail: u.email, Source: relation(reviewee, u)})
+				if existing[reviewee.id] == nil {
+					existing[reviewee.id] = make(map[int]bool)
+				}
+				existing[reviewee.id][u.id] = true
+				load[u.id]++
+				n--
+				need--
+			}
+		}
+
+		pick(crossNeed, sourceCrossTeam)
+		pick(need, sourceTeam, sourceOrg, sourceCrossTeam)
+	}
+	return assignments, nil
+}
+
+// relation describes how a candidate reviewer is related to a reviewee
+func relation(reviewee, reviewer *assignee) string {
+	for team := range reviewee.teams {
+		if reviewer.teams[team] {
+			return sourceTeam
+		}
+	}
+	if reviewee.managerID != 0 && (reviewee.managerID == reviewer.id || reviewee.managerID == reviewer.managerID) {
+		return sourceOrg
+	}
+	if reviewer.managerID != 0 && reviewer.managerID == reviewee.id {
+		return sourceOrg
+	}
+	return sourceCrossTeam
+}
+
+// loadAssignees returns all active users with their teams and managers, sorted by email
+func loadAssignees(db queryer) ([]*assignee, error) {
+	rows, err := db.Query("select id, email, coalesce(manager_id, 0) from users where is_active=1 order by email")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query users in loadAssignees")
+	}
+	defer rows.Close()
+
+	var users []*assignee
+	byID := make(map[int]*assignee)
+	for rows.Next() {
+		u := &assignee{teams: make(map[int]bool)}
+		if err = rows.Scan(&u.id, &u.email, &u.managerID); err != nil {
+			return nil, errors.Wrap(err, "unable to scan users in loadAssignees")
+		}
+		users = append(users, u)
+		byID[u.id] = u
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of users in loadAssignees")
+	}
+
+	rows, err = db.Query("select user_id, team_id from user_teams")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query user teams in loadAssignees")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID, teamID int
+		if err = rows.Scan(&userID, &teamID); err != nil {
+			return nil, errors.Wrap(err, "unable to scan user teams in loadAssignees")
+		}
+		if u, ok := byID[userID]; ok {
+			u.teams[teamID] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of user teams in loadAssignees")
+	}
+	return users, nil
+}
+
+// CommitAssignments writes assignments, such as those a dry run previewed, as accepted review requests in a single
+// transaction. Each is checked again: ErrInvalidAssignment is returned for unknown or deactivated users, self
+// assignments, and unknown sources, ErrDuplicateRequest if the pair already has a request in the cycle (including one
+// created since the preview), and a RequestCapError if the reviewer would go over the cycle's per reviewer request
+// limit. Nothing is written on error.
+func CommitAssignments(db *sql.DB, cycle string, assignments []Assignment) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for CommitAssignments")
+	}
+
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on CommitAssignments")
+		}
+	}()
+
+	return insertAssignments(tx, cycle, assignments)
+}
+
+// PlanAndCommitAssignments plans assignments like PlanAssignments and writes them in the same transaction, so requests
+// made in between can not change the plan
+func PlanAndCommitAssignments(db *sql.DB, cycle string, opts AssignmentOptions) (assignments []Assignment, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to begin tx for PlanAndCommitAssignments")
+	}
+
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on PlanAndCommitAssignments")
+		}
+	}()
+
+	if assignments, err = PlanAssignments(tx, cycle, opts); err != nil {
+		return nil, err
+	}
+	if err = insertAssignments(tx, cycle, assignments); err != nil {
+		return nil, err
+	}
+	return assignments, nil
+}
+
+// insertAssignments checks and writes assignments for CommitAssignments and PlanAndCommitAssignments
+func insertAssignments(tx *sql.Tx, cycle string, assignments []Assignment) error {
+	var reviewerCap int
+	err := tx.QueryRow("select max_requests_per_reviewer from review_cycles where name=? limit 1", cycle).Scan(&reviewerCap)
+	if err == sql.ErrNoRows {
+		return ErrCycleNotFound
+	} else if err != nil {
+		return errors.Wrap(err, "unable to look up cycle limits in insertAssignments")
+	}
+
+	q := `
+    INSERT INTO review_requests
+                (recipient_id,
+                reviewer_id,
+                cycle_id,
+                status)
+    VALUES      ((SELECT id
+                FROM   users
+                WHERE  email =?
+                LIMIT  1),
+                (SELECT id
+                FROM   users
+                WHERE  email =?
+                LIMIT  1),
+                (SELECT id
+                FROM   review_cycles
+                WHERE  name =?
+                LIMIT  1),
+                ?)
+    `
+	for _, assignment := range assignments {
+		if err = checkAssignment(tx, cycle, assignment); err != nil {
+			return err
+		}
+		if reviewerCap > 0 {
+			n, err := countOpenRequests(tx, "reviewer_id", assignment.ReviewerEmail, cycle)
+			if err != nil {
+				return err
+			}
+			if n >= reviewerCap {
+				return RequestCapError{Cycle: cycle, Email: assignment.ReviewerEmail, Limit: reviewerCap, IsReviewer: true}
+			}
+		}
+		if _, err = tx.Exec(q, assignment.RevieweeEmail, assignment.ReviewerEmail, cycle, requestAccepted); err != nil {
+			return errors.Wrap(err, "unable to insert assignment")
+		}
+	}
+	return nil
+}
+
+// checkAssignment returns an error if assignment can not be written as a new request
+func checkAssignment(tx *sql.Tx, cycle string, assignment Assignment) error {
+	if !inList(assignment.Source, []string{sourceTeam, sourceOrg, sourceCrossTeam}) {
+		return errors.Wrapf(ErrInvalidAssignment, "unknown source %q", assignment.Source)
+	}
+	if strings.EqualFold(assignment.RevieweeEmail, assignment.ReviewerEmail) {
+		return errors.Wrapf(ErrInvalidAssignment, "%s can not review themselves", assignment.ReviewerEmail)
+	}
+	var active int
+	q := "select count(*) from users where email in (?, ?) and is_active=1"
+	if err := tx.QueryRow(q, assignment.RevieweeEmail, assignment.ReviewerEmail).Scan(&active); err != nil {
+		return errors.Wrap(err, "unable to look up assigned users")
+	}
+	if active != 2 {
+		return errors.Wrapf(ErrInvalidAssignment, "%s or %s is unknown or deactivated", assignment.RevieweeEmail, assignment.ReviewerEmail)
+	}
+	var existing int
+	q = `
+    SELECT count(*)
+    FROM   review_requests
+    WHERE  recipient_id = (SELECT id
+                           FROM   users
+                           WHERE  email = ?
+                           LIMIT  1)
+           AND reviewer_id = (SELECT id
+                              FROM   users
+                              WHERE  email = ?
+                              LIMIT  1)
+           AND cycle_id = (SELECT id
+                           FROM   review_cycles
+                           WHERE  name = ?
+                           LIMIT  1)
+    `
+	if err := tx.QueryRow(q, assignment.RevieweeEmail, assignment.ReviewerEmail, cycle).Scan(&existing); err != nil {
+		return errors.Wrap(err, "unable to look up existing requests for assignment")
+	}
+	if existing > 0 {
+		return errors.Wrapf(ErrDuplicateRequest, "%s already has a request to review %s", assignment.ReviewerEmail, assignment.RevieweeEmail)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/pkg/errors"
+)
+
+/*
+ The audit log records every change made through the admin api or by the SCIM client: who made it, what it was, what
+ it was made to, the values before and after, and the request id and ip it came from. A change that fails to be
+ audited fails its request. Triggers make audit_log append only, so not even a bug here can rewrite history. Changes made by the background jobs have their own records (ldap_sync_runs and
+ retention_purges).
+*/
+
+// audit actions
+const (
+	auditCycleCreated         = "cycle.created"
+	auditCycleUpdated         = "cycle.updated"
+	auditCycleDeleted         = "cycle.deleted"
+	auditCycleSettingsUpdated = "cycle.settings_updated"
+	auditAssignmentsCreated   = "cycle.assignments_created"
+	auditTeamCreated          = "team.created"
+	auditTeamDeleted          = "team.deleted"
+	auditJobRetried           = "job.retried"
+	auditWebhookCreated       = "webhook.created"
+	auditWebhookDeleted       = "webhook.deleted"
+	auditUsersImported        = "users.imported"
+	auditUserDeactivated      = "user.deactivated"
+	auditUserReactivated      = "user.reactivated"
+	auditUserManagerChanged   = "user.manager_changed"
+	auditTeamMembersChanged   = "team.members_changed"
+	auditLDAPSynced           = "ldap.synced"
+	auditRetentionPurged      = "retention.purged"
+	auditBackupCreated        = "backup.created"
+)
+
+// scimActor is the actor recorded for changes made by the SCIM client, which has a token rather than an email
+const scimActor = "scim"
+
+// AuditEntry is a change made by an admin. Before and After are json and are null when there is nothing to show, such
+// as before a create or after a delete.
+type AuditEntry struct {
+	ID        int             `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	RequestID string          `json:"request_id"`
+	IP        string          `json:"ip"`
+}
+
+// AuditFilter narrows the audit log. Empty fields match everything. Entries with an id of Cursor or more are skipped,
+// which pages backwards through the log.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Cursor int
+	Limit  int
+}
+
+// AddAuditEntry appends to the audit log. Before and after are marshaled to json.
+func AddAuditEntry(db execer, e AuditEntry, before interface{}, after interface{}) error {
+	b, err := json.Marshal(before)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal audit before value")
+	}
+	af, err := json.Marshal(after)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal audit after value")
+	}
+	q := `
+    INSERT INTO audit_log
+                (created_at,
+                 actor,
+                 action,
+                 target,
+                 before,
+                 after,
+                 request_id,
+                 ip)
+    VALUES      (?, ?, ?, ?, ?, ?, ?, ?)
+    `
+	if _, err = db.Exec(q, e.CreatedAt.Unix(), e.Actor, e.Action, e.Target, string(b), string(af), e.RequestID, e.IP); err != nil {
+		return errors.Wrap(err, "unable to insert audit entry")
+	}
+	return nil
+}
+
+// GetAuditEntries returns the entries matching f, newest first
+func GetAuditEntries(db *sql.DB, f AuditFilter) ([]AuditEntry, error) {
+	var where []string
+	var args []interface{}
+	for _, c := range []struct {
+		column string
+		value  string
+	}{{"actor", f.Actor}, {"action", f.Action}, {"target", f.Target}} {
+		if c.value != "" {
+			// column is never user input
+			where = append(where, c.column+" = ?")
+			args = append(args, c.value)
+		}
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since.Unix())
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until.Unix())
+	}
+	if f.Cursor > 0 {
+		where = append(where, "id < ?")
+		args = append(args, f.Cursor)
+	}
+	q := "select id, created_at, actor, action, target, before, after, request_id, ip from audit_log"
+	if len(where) > 0 {
+		q += " where " + strings.Join(where, " and ")
+	}
+	q += " order by id desc"
+	if f.Limit > 0 {
+		q += " limit ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query GetAuditEntries")
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var createdAt int64
+		var before, after string
+		if err = rows.Scan(&e.ID, &createdAt, &e.Actor, &e.Action, &e.Target, &before, &after, &e.RequestID, &e.IP); err != nil {
+			return nil, errors.Wrap(err, "unable to scan GetAuditEntries")
+		}
+		e.CreatedAt = time.Unix(createdAt, 0).UTC()
+		e.Before = json.RawMessage(before)
+		e.After = json.RawMessage(after)
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetAuditEntries")
+	}
+	return entries, nil
+}
+
+// WriteAuditCSV writes entries as csv with a header row
+func WriteAuditCSV(w io.Writer, entries []AuditEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "created_at", "actor", "action", "target", "before", "after", "request_id", "ip"})
+	for _, e := range entries {
+		cw.Write([]string{
+			strconv.Itoa(e.ID),
+			e.CreatedAt.Format(time.RFC3339),
+			e.Actor,
+			e.Action,
+			e.Target,
+			string(e.Before),
+			string(e.After),
+			e.RequestID,
+			e.IP,
+		})
+	}
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "unable to write audit csv")
+}
+
+// parseAuditFilter reads an AuditFilter from the query string
+func parseAuditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	f := AuditFilter{Actor: query.Get("actor"), Action: query.Get("action"), Target: query.Get("target")}
+	var err error
+	for _, t := range []struct {
+		param string
+		value *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if v := query.Get(t.param); v != "" {
+			if *t.value, err = time.Parse(time.RFC3339, v); err != nil {
+				return f, errors.Errorf("%s must be an RFC 3339 time", t.param)
+			}
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		if f.Cursor, err = strconv.Atoi(v); err != nil || f.Cursor < 1 {
+			return f, errors.New("cursor must be a positive number")
+		}
+	}
+	return f, nil
+}
+
+// audit records a change made by the signed in admin. A change that can't be audited must not look like it succeeded,
+// so callers fail the request when this errors.
+func (a app) audit(r *http.Request, action string, target string, before interface{}, after interface{}) error {
+	actor, _ := r.Context().Value(ctxEmail).(string)
+	return a.auditAs(r, actor, action, target, before, after)
+}
+
+// auditAs records a change made by actor, for changes that don't come from a signed in admin, like those made by the
+// SCIM client
+func (a app) auditAs(r *http.Request, actor string, action string, target string, before interface{}, after interface{}) error {
+	e := AuditEntry{
+		CreatedAt: time.Now(),
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		RequestID: middleware.GetReqID(r.Context()),
+		IP:        r.RemoteAddr,
+	}
+	// RemoteAddr is host:port unless middleware.RealIP replaced it with a forwarded address
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.IP = host
+	}
+	return errors.Wrapf(AddAuditEntry(a.db, e, before, after), "unable to record %s audit entry for %s", action, target)
+}
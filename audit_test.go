@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIAdminAudit(t *testing.T) {
+	/*
+		Verify admin changes are recorded with the actor, before and after values, request id, and ip
+		Verify the log can be filtered, paged, and exported as csv
+		Verify the log can not be changed or deleted
+		Verify a change that can not be audited fails its request
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.EditCycle("cycle_1", false), "closing cycle")
+	NoErr(t, cli.InsertTeam("team_1"), "adding team")
+	NoErr(t, cli.AssignTeamToUser("team_1"), "joining team")
+	NoErr(t, cli.DeleteTeam("team_1"), "deleting team")
+	NoErr(t, cli.DeleteCycle("cycle_1"), "deleting cycle")
+
+	entries, next, err := cli.GetAuditLog(nil)
+	NoErr(t, err, "getting audit log")
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+		if e.Actor != cli.userEmail || e.IP != "127.0.0.1" || e.RequestID == "" {
+			t.Errorf("got %+v, want the test user's request from 127.0.0.1", e)
+		}
+	}
+	want := []string{auditCycleDeleted, auditTeamDeleted, auditTeamCreated, auditCycleUpdated, auditCycleCreated}
+	if strings.Join(actions, ",") != strings.Join(want, ",") || next != 0 {
+		t.Errorf("got actions %v and cursor %d, want %v on one page", actions, next, want)
+	}
+
+	entries, _, err = cli.GetAuditLog(url.Values{"action": {auditCycleUpdated}, "target": {"cycle_1"}})
+	NoErr(t, err, "filtering audit log")
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want the 1 cycle update", len(entries))
+	}
+	var before, after Cycle
+	NoErr(t, json.Unmarshal(entries[0].Before, &before), "decoding before")
+	NoErr(t, json.Unmarshal(entries[0].After, &after), "decoding after")
+	if !before.IsOpen || after.IsOpen {
+		t.Errorf("got before %+v and after %+v, want the cycle closed", before, after)
+	}
+
+	entries, _, err = cli.GetAuditLog(url.Values{"action": {auditTeamDeleted}})
+	NoErr(t, err, "filtering audit log")
+	if len(entries) != 1 || !strings.Contains(string(entries[0].Before), cli.userEmail) || string(entries[0].After) != "null" {
+		t.Errorf("got %+v, want the deleted team's members before and nothing after", entries)
+	}
+
+	var paged []string
+	query := url.Values{"limit": {"2"}}
+	for page := 0; page < 5; page++ {
+		entries, next, err = cli.GetAuditLog(query)
+		NoErr(t, err, "paging audit log")
+		for _, e := range entries {
+			paged = append(paged, e.Action)
+		}
+		if next == 0 {
+			break
+		}
+		query.Set("cursor", strconv.Itoa(next))
+	}
+	if strings.Join(paged, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v paging, want %v", paged, want)
+	}
+
+	entries, _, err = cli.GetAuditLog(url.Values{"since": {time.Now().Add(time.Hour).Format(time.RFC3339)}})
+	NoErr(t, err, "filtering audit log by time")
+	if len(entries) != 0 {
+		t.Errorf("got %d entries, want none from the future", len(entries))
+	}
+	if _, _, err = cli.GetAuditLog(url.Values{"since": {"yesterday"}}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for a bad since", err)
+	}
+
+	export, err := cli.ExportAuditLog(url.Values{"actor": {cli.userEmail}})
+	NoErr(t, err, "exporting audit log")
+	records, err := csv.NewReader(strings.NewReader(export)).ReadAll()
+	NoErr(t, err, "parsing audit csv")
+	if len(records) != len(want)+1 || records[0][3] != "action" || records[1][3] != auditCycleDeleted {
+		t.Errorf("got %v, want a header and %d entries", records, len(want))
+	}
+
+	if _, err := cli.db.Exec("update audit_log set actor='someone else'"); err == nil {
+		t.Error("got no error updating the audit log")
+	}
+	if _, err := cli.db.Exec("delete from audit_log"); err == nil {
+		t.Error("got no error deleting from the audit log")
+	}
+
+	_, err = cli.db.Exec("create trigger audit_log_down before insert on audit_log begin select raise(fail, 'audit log down'); end")
+	NoErr(t, err, "breaking the audit log")
+	if err := cli.AddCycle("cycle_2"); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("got %v, want a 500 when the change can not be audited", err)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -56,3 +58,29 @@ func PruneAuth() {
 	}
 	auths.keys = keys
 }
+
+// RevokeAuth removes every key belonging to email, signing them out everywhere
+func RevokeAuth(email string) {
+	auths.mu.Lock()
+	defer auths.mu.Unlock()
+	for k, v := range auths.keys {
+		if strings.EqualFold(v.email, email) {
+			delete(auths.keys, k)
+		}
+	}
+}
+
+// AuthExpirations returns when each of email's unexpired sessions expires, soonest first
+func AuthExpirations(email string) []time.Time {
+	auths.mu.Lock()
+	defer auths.mu.Unlock()
+	var expirations []time.Time
+	now := time.Now().Unix()
+	for _, v := range auths.keys {
+		if strings.EqualFold(v.email, email) && v.expire.Unix() > now {
+			expirations = append(expirations, v.expire)
+		}
+	}
+	sort.Slice(expirations, func(i, j int) bool { return expirations[i].Before(expirations[j]) })
+	return expirations
+}
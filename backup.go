@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+/*
+ Backups use sqlite's online backup api, so each one is a consistent snapshot taken while the app keeps serving. With
+ -backup-dir set, a backup is taken every -backup-interval and only the newest -backup-keep are kept. Admins can take
+ one now with POST /api/admin/backups, and `peerreview backup [path]` takes one from the command line.
+
+ `peerreview restore path` checks that a backup is intact and has this version's schema before swapping it in for
+ -sqlite-path. Run it while the app is stopped. The database it replaces is renamed, not deleted.
+*/
+
+const backupPrefix = "peerreview-"
+const backupSuffix = ".db"
+const backupTimeFormat = "20060102T150405.000000Z"
+
+type backupConfig struct {
+	// Dir is where scheduled backups go. Scheduled backups are off when it is empty.
+	Dir      string
+	Interval time.Duration
+	// Keep is how many backups to keep in Dir. Older ones are removed.
+	Keep int
+}
+
+func (c backupConfig) enabled() bool {
+	return c.Dir != ""
+}
+
+// Backup is a backup file in the backup dir
+type Backup struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BackupDB writes a consistent snapshot of db to path. db stays usable while the backup runs.
+func BackupDB(db *sql.DB, path string) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := backupTo(db, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return errors.Wrap(os.Rename(tmp, path), "unable to move backup into place")
+}
+
+// backupTo copies db into a new sqlite file at path
+func backupTo(db *sql.DB, path string) error {
+	ctx := context.Background()
+	dest, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return errors.Wrap(err, "unable to open backup file")
+	}
+	defer dest.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to backup file")
+	}
+	defer destConn.Close()
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to db for backup")
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			destSQLite, ok := d.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("backup file is not a sqlite connection")
+			}
+			srcSQLite, ok := s.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("db is not a sqlite connection")
+			}
+			b, err := destSQLite.Backup("main", srcSQLite, "main")
+			if err != nil {
+				return errors.Wrap(err, "unable to start backup")
+			}
+			// -1 copies every page in one step, which keeps the snapshot consistent
+			if _, err = b.Step(-1); err != nil {
+				b.Finish()
+				return errors.Wrap(err, "unable to copy db")
+			}
+			return errors.Wrap(b.Finish(), "unable to finish backup")
+		})
+	})
+}
+
+// CreateBackup takes a backup into the backup dir and removes the oldest backups past Keep
+func CreateBackup(db *sql.DB, c backupConfig, now time.Time) (Backup, error) {
+	var b Backup
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return b, errors.Wrap(err, "unable to create backup dir")
+	}
+	b.CreatedAt = now.UTC()
+	b.Name = backupPrefix + b.CreatedAt.Format(backupTimeFormat) + backupSuffix
+	path := filepath.Join(c.Dir, b.Name)
+	if err := BackupDB(db, path); err != nil {
+		return b, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return b, errors.Wrap(err, "unable to stat backup")
+	}
+	b.Size = info.Size()
+	return b, pruneBackups(c)
+}
+
+// ListBackups returns the backups in dir, newest first
+func ListBackups(dir string) ([]Backup, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Backup{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read backup dir")
+	}
+	backups := []Backup{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		createdAt, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+		if err != nil {
+			// not one of ours
+			continue
+		}
+		backups = append(backups, Backup{Name: name, Size: f.Size(), CreatedAt: createdAt})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// pruneBackups removes all but the newest Keep backups
+func pruneBackups(c backupConfig) error {
+	backups, err := ListBackups(c.Dir)
+	if err != nil {
+		return err
+	}
+	if c.Keep < 1 || len(backups) <= c.Keep {
+		return nil
+	}
+	for _, b := range backups[c.Keep:] {
+		if err := os.Remove(filepath.Join(c.Dir, b.Name)); err != nil {
+			return errors.Wrap(err, "unable to remove old backup")
+		}
+	}
+	return nil
+}
+
+// RestoreDB replaces the database at dbfile with the backup at backupPath, once the backup passes an integrity check and
+// has this version's schema. The replaced database is renamed and its new path returned, or "" if there was none.
+func RestoreDB(backupPath string, dbfile string, now time.Time) (string, error) {
+	if _, err := os.Stat(backupPath); err != nil {
+		return "", errors.Wrap(err, "unable to find backup")
+	}
+	if err := checkBackup(backupPath); err != nil {
+		return "", err
+	}
+
+	tmp := dbfile + ".restoring"
+	if err := copyFile(backupPath, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	var replaced string
+	if _, err := os.Stat(dbfile); err == nil {
+		replaced = dbfile + ".pre-restore-" + now.UTC().Format(backupTimeFormat)
+		if err = os.Rename(dbfile, replaced); err != nil {
+			os.Remove(tmp)
+			return "", errors.Wrap(err, "unable to move aside the current db")
+		}
+	}
+	if err := os.Rename(tmp, dbfile); err != nil {
+		return replaced, errors.Wrap(err, "unable to move backup into place")
+	}
+	return replaced, nil
+}
+
+// checkBackup makes sure the sqlite file at path is intact and has this version's schema
+func checkBackup(path string) error {
+	db, err := OpenDB(path)
+	if err != nil {
+		return errors.Wrap(err, "unable to open backup")
+	}
+	defer db.Close()
+	var result string
+	if err = db.QueryRow("pragma integrity_check").Scan(&result); err != nil {
+		return errors.Wrap(err, "unable to check backup integrity")
+	}
+	if result != "ok" {
+		return errors.Errorf("backup failed its integrity check: %s", result)
+	}
+	return errors.Wrap(verifyDB(db), "backup can not be restored")
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return errors.Wrap(err, "unable to open backup")
+	}
+	defer src.Close()
+	dest, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "unable to create restored db")
+	}
+	if _, err = io.Copy(dest, src); err != nil {
+		dest.Close()
+		return errors.Wrap(err, "unable to copy backup")
+	}
+	if err = dest.Sync(); err != nil {
+		dest.Close()
+		return errors.Wrap(err, "unable to sync restored db")
+	}
+	return errors.Wrap(dest.Close(), "unable to close restored db")
+}
+
+// backupTask takes a scheduled backup once the newest is older than the interval
+func backupTask(a app, now time.Time) error {
+	if !a.backups.enabled() {
+		return nil
+	}
+	backups, err := ListBackups(a.backups.Dir)
+	if err != nil {
+		return err
+	}
+	if len(backups) > 0 && now.Sub(backups[0].CreatedAt) < a.backups.Interval {
+		return nil
+	}
+	b, err := CreateBackup(a.db, a.backups, now)
+	if err != nil {
+		return err
+	}
+	log.Printf("backed up the db to %s", filepath.Join(a.backups.Dir, b.Name))
+	return nil
+}
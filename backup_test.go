@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIAdminBackups(t *testing.T) {
+	/*
+		Verify a backup is a usable copy of the db taken while serving
+		Verify only the newest backups are kept
+		Verify the scheduled backup waits for the interval
+	*/
+	dir, err := ioutil.TempDir("", "peerreview_backups")
+	NoErr(t, err, "creating backup dir")
+	defer os.RemoveAll(dir)
+	var a app
+	cli, teardown := setupInstanceWith(func(inst *app) {
+		inst.backups = backupConfig{Dir: dir, Interval: 24 * time.Hour, Keep: 2}
+		a = *inst
+	})
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "backed up", "backedup@example.com"), "creating user")
+	var names []string
+	for i := 0; i < 3; i++ {
+		b, err := cli.CreateBackup()
+		NoErr(t, err, "creating backup")
+		if b.Size == 0 || !strings.HasPrefix(b.Name, backupPrefix) {
+			t.Errorf("got %+v, want a named, non empty backup", b)
+		}
+		names = append(names, b.Name)
+	}
+	backups, err := cli.GetBackups()
+	NoErr(t, err, "listing backups")
+	if len(backups) != 2 || backups[0].Name != names[2] || backups[1].Name != names[1] {
+		t.Errorf("got %+v, want the newest 2 of %v", backups, names)
+	}
+
+	db, err := OpenDB(filepath.Join(dir, backups[0].Name))
+	NoErr(t, err, "opening backup")
+	defer db.Close()
+	NoErr(t, verifyDB(db), "verifying backup")
+	exists, err := UserExists(db, "backedup@example.com")
+	NoErr(t, err, "looking up user in backup")
+	if !exists {
+		t.Error("got no user in the backup, want the user created before it")
+	}
+
+	NoErr(t, backupTask(a, time.Now()), "running periodic task")
+	if backups, _ = ListBackups(dir); backups[0].Name != names[2] {
+		t.Errorf("got newest backup %s, want no scheduled backup within the interval", backups[0].Name)
+	}
+	NoErr(t, backupTask(a, time.Now().Add(25*time.Hour)), "running periodic task")
+	if backups, _ = ListBackups(dir); len(backups) != 2 || backups[0].Name == names[2] {
+		t.Errorf("got %+v, want a scheduled backup once the interval passed", backups)
+	}
+}
+
+func TestRestoreDB(t *testing.T) {
+	/*
+		Verify a restore swaps in the backup and keeps the replaced db
+		Verify a backup with a different schema version is refused
+	*/
+	dir, err := ioutil.TempDir("", "peerreview_restore")
+	NoErr(t, err, "creating dir")
+	defer os.RemoveAll(dir)
+
+	cli, teardown := setupInstance()
+	defer teardown()
+	NoErr(t, CreateUser(cli.db, "restored", "restored@example.com"), "creating user")
+	backup := filepath.Join(dir, "backup.db")
+	NoErr(t, BackupDB(cli.db, backup), "backing up")
+
+	dbfile := filepath.Join(dir, "peerreview.db")
+	NoErr(t, InitDB(dbfile), "creating db to restore over")
+	replaced, err := RestoreDB(backup, dbfile, time.Now())
+	NoErr(t, err, "restoring")
+	if _, err = os.Stat(replaced); err != nil {
+		t.Errorf("got %v, want the replaced db kept at %s", err, replaced)
+	}
+	db, err := OpenDB(dbfile)
+	NoErr(t, err, "opening restored db")
+	exists, err := UserExists(db, "restored@example.com")
+	db.Close()
+	NoErr(t, err, "looking up user in restored db")
+	if !exists {
+		t.Error("got no user in the restored db, want the backup's users")
+	}
+
+	db, err = OpenDB(backup)
+	NoErr(t, err, "opening backup")
+	_, err = db.Exec("update schema_version set version='1999-01-01-00:00'")
+	db.Close()
+	NoErr(t, err, "changing backup schema version")
+	if _, err = RestoreDB(backup, dbfile, time.Now()); err == nil || !strings.Contains(err.Error(), "schema version") {
+		t.Errorf("got %v, want a schema version error", err)
+	}
+	if _, err = os.Stat(dbfile); err != nil {
+		t.Errorf("got %v, want the db left in place after a refused restore", err)
+	}
+}
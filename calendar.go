@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ Each user has a secret calendar token so calendar apps, which can not sign in, can subscribe to
+ /calendar/{token}.ics. The feed has an event for every cycle with a close date, and for open cycles the event lists
+ who the user still owes feedback. Regenerating the token breaks the old url.
+*/
+
+// icsTime is the UTC date-time format used in iCalendar
+const icsTime = "20060102T150405Z"
+
+// newCalendarToken returns a random, url safe token
+func newCalendarToken() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "unable to generate calendar token")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GetCalendarToken returns a user's calendar token, creating one if they do not have one yet
+func GetCalendarToken(db *sql.DB, email string) (string, error) {
+	var token sql.NullString
+	err := db.QueryRow("select calendar_token from users where email=?", email).Scan(&token)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get calendar token")
+	}
+	if token.Valid && token.String != "" {
+		return token.String, nil
+	}
+	return RegenerateCalendarToken(db, email)
+}
+
+// RegenerateCalendarToken gives a user a new calendar token. Their old calendar url stops working.
+func RegenerateCalendarToken(db *sql.DB, email string) (string, error) {
+	token, err := newCalendarToken()
+	if err != nil {
+		return "", err
+	}
+	res, err := db.Exec("update users set calendar_token=? where email=?", token, email)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to set calendar token")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", errors.Wrap(err, "unable to determine if calendar token was set")
+	} else if n == 0 {
+		return "", ErrUserNotFound
+	}
+	return token, nil
+}
+
+// GetCalendarUser returns the email of the active user with a calendar token. Deactivated users' feeds are not found.
+func GetCalendarUser(db *sql.DB, token string) (string, error) {
+	var email string
+	err := db.QueryRow("select email from users where calendar_token=? and is_active=1 limit 1", token).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to look up calendar token")
+	}
+	return email, nil
+}
+
+// calendarURL is where a calendar app can subscribe to a token's feed
+func (a app) calendarURL(token string) string {
+	return strings.TrimRight(a.baseURL, "/") + "/calendar/" + token + ".ics"
+}
+
+// BuildCalendar returns an iCalendar (RFC 5545) feed of cycle deadlines for a user
+func BuildCalendar(db *sql.DB, email string, baseURL string, now time.Time) ([]byte, error) {
+	rows, err := db.Query("select id, name, is_open, closes_at from review_cycles where closes_at is not null and closes_at != '' order by closes_at")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query cycles for calendar")
+	}
+	type cycle struct {
+		id       int
+		name     string
+		isOpen   bool
+		closesAt time.Time
+	}
+	var cycles []cycle
+	for rows.Next() {
+		var c cycle
+		var closesAt string
+		if err = rows.Scan(&c.id, &c.name, &c.isOpen, &closesAt); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "unable to scan cycles for calendar")
+		}
+		if c.closesAt, err = time.Parse(time.RFC3339, closesAt); err != nil {
+			rows.Close()
+			return nil, errors.Wrapf(err, "unable to parse closes_at for cycle %s", c.name)
+		}
+		cycles = append(cycles, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of cycles for calendar")
+	}
+
+	host := "peerreview"
+	if u, err := url.Parse(baseURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+
+	var b bytes.Buffer
+	line := func(name string, value string) {
+		writeICSLine(&b, name+":"+value)
+	}
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//peerreview//cycle deadlines//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	line("X-WR-CALNAME", "Peer review deadlines")
+	for _, c := range cycles {
+		description := "The " + c.name + " review cycle closes."
+		if c.isOpen {
+			outstanding, err := GetOutstandingReviewees(db, email, c.name)
+			if err != nil {
+				return nil, err
+			}
+			if len(outstanding) == 0 {
+				description += "\nYou have given all the feedback you can."
+			} else {
+				description += "\nYou still owe feedback to:"
+				for _, reviewee := range outstanding {
+					description += fmt.Sprintf("\n- %s (%s)", reviewee.Name, reviewee.Email)
+				}
+			}
+		}
+		description += "\n" + strings.TrimRight(baseURL, "/") + "/dash"
+
+		line("BEGIN", "VEVENT")
+		line("UID", fmt.Sprintf("cycle-%d-closes@%s", c.id, host))
+		line("DTSTAMP", now.UTC().Format(icsTime))
+		// with no DTEND, the event is the moment the cycle closes
+		line("DTSTART", c.closesAt.UTC().Format(icsTime))
+		line("SUMMARY", escapeICSText(c.name+" review cycle closes"))
+		line("DESCRIPTION", escapeICSText(description))
+		line("URL", strings.TrimRight(baseURL, "/")+"/dash")
+		if c.isOpen {
+			line("BEGIN", "VALARM")
+			line("ACTION", "DISPLAY")
+			line("TRIGGER", "-P1D")
+			line("DESCRIPTION", escapeICSText(c.name+" review cycle closes tomorrow"))
+			line("END", "VALARM")
+		}
+		line("END", "VEVENT")
+	}
+	line("END", "VCALENDAR")
+	return b.Bytes(), nil
+}
+
+// escapeICSText escapes a TEXT value as described in RFC 5545 section 3.3.11
+func escapeICSText(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, ";", `\;`, -1)
+	s = strings.Replace(s, ",", `\,`, -1)
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+// writeICSLine writes a content line ending in CRLF, folded so no line is longer than 75 octets (RFC 5545 section
+// 3.1). Folds never split a multi-byte character.
+func writeICSLine(b *bytes.Buffer, s string) {
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+		// continuation lines start with a space, which counts towards their length
+		limit = 74
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+}
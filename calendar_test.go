@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendarFeed(t *testing.T) {
+	/*
+		Verify the feed is valid iCalendar: CRLF line endings, folded lines, and escaped text
+		Verify it has an event for each cycle with a close date that lists outstanding reviewees
+		Verify the token is stable until regenerated, and the old url stops working after
+		Verify a deactivated user's feed is not found
+	*/
+	cli, teardown := setupInstanceWith(func(a *app) {
+		a.baseURL = "http://placeholder"
+	})
+	defer teardown()
+
+	longName := "Someone With A Really Quite Remarkably Long Name That Goes On And On, Ünïcödé"
+	NoErr(t, CreateUser(cli.db, longName, "user_1@example.com"), "creating user")
+	NoErr(t, cli.InsertTeam("team_a"), "adding team")
+	NoErr(t, cli.AssignTeamToUser("team_a"), "joining team")
+	NoErr(t, cli.as("user_1@example.com").AssignTeamToUser("team_a"), "joining team")
+	NoErr(t, cli.AddCycle("2026; Q1, part 1"), "adding cycle")
+	NoErr(t, cli.AddCycle("no close date"), "adding cycle")
+	closesAt := time.Date(2026, 3, 31, 17, 0, 0, 0, time.UTC)
+	NoErr(t, cli.UpdateCycleSettings("2026; Q1, part 1", CycleSettings{ClosesAt: &closesAt}), "setting close date")
+
+	feedURL, err := cli.GetCalendarURL()
+	NoErr(t, err, "getting calendar url")
+	again, err := cli.GetCalendarURL()
+	NoErr(t, err, "getting calendar url again")
+	if feedURL != again || !strings.HasPrefix(feedURL, "http://placeholder/calendar/") || !strings.HasSuffix(feedURL, ".ics") {
+		t.Fatalf("got %q and %q, want the same calendar url", feedURL, again)
+	}
+	path := strings.TrimPrefix(feedURL, "http://placeholder")
+
+	code, contentType, body := getCalendar(t, cli.addr+path)
+	if code != http.StatusOK || contentType != "text/calendar; charset=utf-8" {
+		t.Fatalf("got %d %q, want 200 text/calendar", code, contentType)
+	}
+	if !strings.HasPrefix(body, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n") || !strings.HasSuffix(body, "END:VCALENDAR\r\n") {
+		t.Errorf("got\n%s\nwant a VCALENDAR", body)
+	}
+	if strings.Count(body, "BEGIN:VEVENT") != 1 {
+		t.Errorf("got\n%s\nwant one event for the cycle with a close date", body)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\r\n"), "\r\n") {
+		if strings.Contains(line, "\n") || len(line) > 75 {
+			t.Errorf("got line %q, want CRLF separated lines of at most 75 octets", line)
+		}
+	}
+	for _, want := range []string{
+		"DTSTART:20260331T170000Z\r\n",
+		`SUMMARY:2026\; Q1\, part 1 review cycle closes` + "\r\n",
+		"TRIGGER:-P1D\r\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("got\n%s\nwant it to contain %q", body, want)
+		}
+	}
+	unfolded := strings.Replace(body, "\r\n ", "", -1)
+	if !strings.Contains(unfolded, `You still owe feedback to:\n- Someone With A Really Quite Remarkably Long Name That Goes On And On\, Ünïcödé (user_1@example.com)`) {
+		t.Errorf("got\n%s\nwant the outstanding reviewee in the description", unfolded)
+	}
+
+	newURL, err := cli.RegenerateCalendarURL()
+	NoErr(t, err, "regenerating calendar url")
+	if newURL == feedURL {
+		t.Error("got the same url after regenerating")
+	}
+	if code, _, _ := getCalendar(t, cli.addr+path); code != http.StatusNotFound {
+		t.Errorf("got %d, want 404 for the old calendar url", code)
+	}
+	if code, _, _ := getCalendar(t, cli.addr+strings.TrimPrefix(newURL, "http://placeholder")); code != http.StatusOK {
+		t.Errorf("got %d, want 200 for the new calendar url", code)
+	}
+
+	_, err = DeactivateUser(cli.db, cli.userEmail, false)
+	NoErr(t, err, "deactivating user")
+	if code, _, _ := getCalendar(t, cli.addr+strings.TrimPrefix(newURL, "http://placeholder")); code != http.StatusNotFound {
+		t.Errorf("got %d, want 404 for a deactivated user's calendar url", code)
+	}
+}
+
+// getCalendar fetches a calendar without signing in, as a calendar app would
+func getCalendar(t *testing.T, url string) (int, string, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("unable to get calendar - %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read calendar - %v", err)
+	}
+	return resp.StatusCode, resp.Header.Get("Content-Type"), string(b)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ The chat integration accepts Slack compatible slash commands at POST /chat/slash. Requests are verified with the
+ signing secret (Slack's v0 signature scheme). Chat users are matched to peerreview users by email, which is looked up
+ with the users.info API and cached in chat_identities for chatIdentityTTL, so a changed email is picked up.
+
+ Commands:
+   request @user cycle   ask @user to review you during cycle
+   todo                  list who you still owe feedback in open cycles
+   cycles                list review cycles
+*/
+
+// slackConfig is how we talk to Slack. The integration is disabled when SigningSecret is empty.
+type slackConfig struct {
+	SigningSecret string
+	// Token is a bot token with the users:read.email scope, used to look up chat users' emails
+	Token string
+	// APIBase is where the Slack Web API lives. It is overridable for testing.
+	APIBase string
+}
+
+func (c slackConfig) enabled() bool {
+	return c.SigningSecret != ""
+}
+
+// chatIdentityTTL is how long a chat user's email is cached before it is looked up again
+const chatIdentityTTL = 24 * time.Hour
+
+// maxSlashAge is how old a signed request can be before it is rejected as a possible replay
+const maxSlashAge = 5 * time.Minute
+
+// slackClient calls the Slack Web API. Slack expects a slash command response within 3 seconds.
+var slackClient = &http.Client{Timeout: 2 * time.Second}
+
+// mentionRe matches a Slack user mention such as <@U024BE7LH> or <@U024BE7LH|bob>
+var mentionRe = regexp.MustCompile(`^<@([A-Z0-9]+)(\|[^>]*)?>$`)
+
+const chatUsage = "Usage:\n" +
+	"`request @user cycle` ask @user to review you during cycle\n" +
+	"`todo` list who you still owe feedback in open cycles\n" +
+	"`cycles` list review cycles"
+
+// verifySlackSignature checks the v0 signature Slack sends with each request
+func verifySlackSignature(secret string, header http.Header, body []byte, now time.Time) error {
+	ts := header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("missing or bad request timestamp")
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > maxSlashAge || age < -maxSlashAge {
+		return errors.New("request timestamp is too old")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", ts)
+	mac.Write(body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(header.Get("X-Slack-Signature"))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// chatEmail returns the email of a chat user, looking it up with users.info when the user is new or their cached email
+// is older than chatIdentityTTL
+func (a app) chatEmail(chatUserID string) (string, error) {
+	var email string
+	var updatedAt int64
+	err := a.db.QueryRow("select email, updated_at from chat_identities where chat_user_id=?", chatUserID).Scan(&email, &updatedAt)
+	if err == nil && time.Since(time.Unix(updatedAt, 0)) < chatIdentityTTL {
+		return email, nil
+	} else if err != nil && err != sql.ErrNoRows {
+		return "", errors.Wrap(err, "unable to look up chat identity")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(a.slack.APIBase, "/")+"/users.info?user="+url.QueryEscape(chatUserID), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to create users.info request")
+	}
+	req.Header.Set("Authorization", "Bearer "+a.slack.Token)
+	resp, err := slackClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to call users.info")
+	}
+	defer resp.Body.Close()
+	var info struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		User  struct {
+			Profile struct {
+				Email string `json:"email"`
+			} `json:"profile"`
+		} `json:"user"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", errors.Wrap(err, "unable to decode users.info response")
+	}
+	if !info.OK {
+		return "", fmt.Errorf("users.info failed: %s", info.Error)
+	}
+	email = strings.ToLower(info.User.Profile.Email)
+	if email == "" {
+		return "", errors.New("users.info did not include an email. The token needs the users:read.email scope")
+	}
+
+	q := "insert or replace into chat_identities (chat_user_id, email, updated_at) values (?, ?, ?)"
+	if _, err = a.db.Exec(q, chatUserID, email, time.Now().Unix()); err != nil {
+		return "", errors.Wrap(err, "unable to cache chat identity")
+	}
+	return email, nil
+}
+
+// chatSlash handles a slash command. Problems with the command itself are reported back to the chat user with a 200
+// so they show up in chat. Only bad signatures and server errors get error codes.
+func (a app) chatSlash(w http.ResponseWriter, r *http.Request) {
+	if !a.slack.enabled() {
+		handleErr(w, r, nil, "chat integration is not configured", http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	if err = verifySlackSignature(a.slack.SigningSecret, r.Header, body, time.Now()); err != nil {
+		handleErr(w, r, err, "invalid request signature", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		handleErr(w, r, err, "unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	email, err := a.chatEmail(form.Get("user_id"))
+	if err != nil {
+		log.Printf("error resolving chat user %s: %v", form.Get("user_id"), err)
+		chatReply(w, "Sorry, I could not work out who you are.")
+		return
+	}
+	if exists, err := UserExists(a.db, email); err != nil {
+		handleErr(w, r, err, "unable to look up user", http.StatusInternalServerError)
+		return
+	} else if !exists {
+		chatReply(w, fmt.Sprintf("%s has not signed in to peerreview yet. Sign in at %s first.", email, a.baseURL))
+		return
+	}
+	if active, err := UserIsActive(a.db, email); err != nil {
+		handleErr(w, r, err, "unable to look up user", http.StatusInternalServerError)
+		return
+	} else if !active {
+		chatReply(w, email+" has been deactivated.")
+		return
+	}
+
+	text := strings.TrimSpace(form.Get("text"))
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		chatReply(w, chatUsage)
+		return
+	}
+	var reply string
+	switch strings.ToLower(args[0]) {
+	case "request":
+		reply, err = a.chatRequest(email, text[len(args[0]):])
+	case "todo":
+		reply, err = a.chatTodo(email)
+	case "cycles":
+		reply, err = a.chatCycles()
+	default:
+		reply = chatUsage
+	}
+	if err != nil {
+		handleErr(w, r, err, "unable to run chat command", http.StatusInternalServerError)
+		return
+	}
+	chatReply(w, reply)
+}
+
+// chatReply responds to a slash command with a message only the sender sees
+func chatReply(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]string{"response_type": "ephemeral", "text": text})
+	if err != nil {
+		log.Printf("error encoding chat reply: %v", err)
+	}
+}
+
+// chatRequest handles `request @user cycle`, given the text after `request`. The reviewer can be a mention or an email,
+// and everything after the reviewer is the cycle name, which can contain spaces.
+func (a app) chatRequest(email string, text string) (string, error) {
+	text = strings.TrimSpace(text)
+	i := strings.IndexFunc(text, unicode.IsSpace)
+	if i < 0 {
+		return "Usage: `request @user cycle`", nil
+	}
+	mention := text[:i]
+	cycle := strings.TrimSpace(text[i:])
+
+	reviewer := mention
+	if m := mentionRe.FindStringSubmatch(reviewer); m != nil {
+		var err error
+		reviewer, err = a.chatEmail(m[1])
+		if err != nil {
+			log.Printf("error resolving chat user %s: %v", m[1], err)
+			return "Sorry, I could not work out who " + mention + " is.", nil
+		}
+	} else if !strings.Contains(reviewer, "@") || strings.HasPrefix(reviewer, "@") {
+		return "Mention the reviewer (so it turns into a link) or use their email.", nil
+	}
+
+	exists, err := UserExists(a.db, reviewer)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return reviewer + " has not signed in to peerreview yet.", nil
+	}
+
+	err = a.requestReviewer(email, reviewer, cycle, "")
+	if capErr, ok := errors.Cause(err).(RequestCapError); ok {
+		return capErr.Error(), nil
+	} else if errors.Cause(err) == ErrCycleNotFound {
+		return "There is no cycle named " + cycle + ". Try `cycles`.", nil
+	} else if errors.Cause(err) == ErrUserInactive {
+		return reviewer + " has been deactivated.", nil
+	} else if errors.Cause(err) == ErrSelfRequest {
+		return "You can not ask yourself for a review.", nil
+	} else if errors.Cause(err) == ErrNoManager {
+		return cycle + " requires your manager to approve requests, and you have no manager. Ask an admin to set one.", nil
+	} else if errors.Cause(err) == ErrDuplicateRequest {
+		return fmt.Sprintf("You already asked %s to review you during %s.", reviewer, cycle), nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Asked %s to review you during %s.", reviewer, cycle), nil
+}
+
+// chatTodo handles `todo`
+func (a app) chatTodo(email string) (string, error) {
+	cycles, err := GetCycles(a.db)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	for _, cycle := range cycles {
+		if !cycle.IsOpen {
+			continue
+		}
+		outstanding, err := GetOutstandingReviewees(a.db, email, cycle.Name)
+		if err != nil {
+			return "", err
+		}
+		if len(outstanding) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "*%s*\n", cycle.Name)
+		for _, reviewee := range outstanding {
+			fmt.Fprintf(&b, "• %s (%s)\n", reviewee.Name, reviewee.Email)
+		}
+	}
+	if b.Len() == 0 {
+		return "You are all caught up.", nil
+	}
+	return "You still owe feedback to:\n" + b.String(), nil
+}
+
+// chatCycles handles `cycles`
+func (a app) chatCycles() (string, error) {
+	cycles, err := GetCycles(a.db)
+	if err != nil {
+		return "", err
+	}
+	if len(cycles) == 0 {
+		return "There are no review cycles.", nil
+	}
+	var b bytes.Buffer
+	for _, cycle := range cycles {
+		state := "closed"
+		if cycle.IsOpen {
+			state = "open"
+			if cycle.ClosesAt != nil {
+				state += ", closes " + cycle.ClosesAt.Format("Mon Jan 2 15:04 MST")
+			}
+		}
+		fmt.Fprintf(&b, "• %s (%s)\n", cycle.Name, state)
+	}
+	return b.String(), nil
+}
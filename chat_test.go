@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChatSlashCommands(t *testing.T) {
+	/*
+		Verify requests without a valid, recent signature are rejected
+		Verify chat users are mapped to users by email and the lookup is cached until it goes stale
+		Verify request, todo, and cycles commands, including cycle names with spaces
+		Verify deactivated users can not run commands
+		Verify chat users are found when their email was stored with capitals
+	*/
+	var lookups int32
+	slackAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		if r.URL.Path != "/users.info" || r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			w.Write([]byte(`{"ok":false,"error":"invalid_auth"}`))
+			return
+		}
+		emails := map[string]string{"U1": "", "U2": "user_1@example.com", "U3": "nobody@example.com", "U4": "user_2@example.com"}
+		email, ok := emails[r.URL.Query().Get("user")]
+		if !ok {
+			w.Write([]byte(`{"ok":false,"error":"user_not_found"}`))
+			return
+		}
+		fmt.Fprintf(w, `{"ok":true,"user":{"id":%q,"profile":{"email":%q}}}`, r.URL.Query().Get("user"), email)
+	}))
+	defer slackAPI.Close()
+
+	cli, teardown := setupInstanceWith(func(a *app) {
+		a.slack = slackConfig{SigningSecret: "shh", Token: "xoxb-test", APIBase: slackAPI.URL}
+	})
+	defer teardown()
+	// U1 is the signed in test user. Cache it directly as its email is only known once the instance is up.
+	_, err := cli.db.Exec("insert into chat_identities (chat_user_id, email, updated_at) values ('U1', ?, ?)", cli.userEmail, time.Now().Unix())
+	NoErr(t, err, "caching test user's chat identity")
+
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	NoErr(t, cli.InsertTeam("team_a"), "adding team")
+	NoErr(t, cli.AssignTeamToUser("team_a"), "joining team")
+	NoErr(t, cli.as("user_1@example.com").AssignTeamToUser("team_a"), "joining team")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.AddCycle("cycle_2"), "adding cycle")
+	NoErr(t, cli.EditCycle("cycle_2", false), "closing cycle")
+	NoErr(t, cli.AddCycle("Q3 2026 review"), "adding cycle")
+
+	now := time.Now()
+	if code, _ := slash(t, cli, "wrong", "U1", "cycles", now); code != http.StatusUnauthorized {
+		t.Errorf("got %d, want 401 for a bad signature", code)
+	}
+	if code, _ := slash(t, cli, "shh", "U1", "cycles", now.Add(-10*time.Minute)); code != http.StatusUnauthorized {
+		t.Errorf("got %d, want 401 for a stale request", code)
+	}
+
+	code, reply := slash(t, cli, "shh", "U1", "cycles", now)
+	if code != http.StatusOK || !strings.Contains(reply, "cycle_1 (open)") || !strings.Contains(reply, "cycle_2 (closed)") {
+		t.Errorf("got %d %q, want both cycles", code, reply)
+	}
+
+	_, reply = slash(t, cli, "shh", "U1", "todo", now)
+	if !strings.Contains(reply, "user_1@example.com") || strings.Contains(reply, "cycle_2") {
+		t.Errorf("got %q, want user_1 outstanding in cycle_1 only", reply)
+	}
+
+	_, reply = slash(t, cli, "shh", "U2", "request <@U1|test> cycle_1", now)
+	if !strings.Contains(reply, "Asked "+cli.userEmail) {
+		t.Errorf("got %q, want the request to be made", reply)
+	}
+	incoming, _, err := cli.GetReviewRequests("cycle_1")
+	NoErr(t, err, "getting requests")
+	if len(incoming) != 1 || incoming[0].RequesterEmail != "user_1@example.com" {
+		t.Errorf("got %+v, want a request from user_1", incoming)
+	}
+
+	_, reply = slash(t, cli, "shh", "U2", "request <@U1> no_such_cycle", now)
+	if !strings.Contains(reply, "no cycle named no_such_cycle") {
+		t.Errorf("got %q, want an unknown cycle message", reply)
+	}
+	_, reply = slash(t, cli, "shh", "U2", "request <@U1>  Q3 2026 review ", now)
+	if !strings.Contains(reply, "Asked "+cli.userEmail+" to review you during Q3 2026 review.") {
+		t.Errorf("got %q, want the request to be made in the cycle with spaces", reply)
+	}
+	_, reply = slash(t, cli, "shh", "U2", "request <@U1>", now)
+	if !strings.Contains(reply, "Usage") {
+		t.Errorf("got %q, want usage without a cycle", reply)
+	}
+	_, reply = slash(t, cli, "shh", "U2", "request @test cycle_1", now)
+	if !strings.Contains(reply, "Mention the reviewer") {
+		t.Errorf("got %q, want to be told to use a mention", reply)
+	}
+	_, reply = slash(t, cli, "shh", "U3", "todo", now)
+	if !strings.Contains(reply, "has not signed in") {
+		t.Errorf("got %q, want to be told to sign in", reply)
+	}
+	_, reply = slash(t, cli, "shh", "U2", "", now)
+	if !strings.Contains(reply, "Usage") {
+		t.Errorf("got %q, want usage", reply)
+	}
+
+	// U2 and U3 were each looked up once
+	if n := atomic.LoadInt32(&lookups); n != 2 {
+		t.Errorf("got %d users.info calls, want 2", n)
+	}
+
+	_, err = cli.db.Exec("update chat_identities set updated_at=? where chat_user_id='U2'", now.Add(-chatIdentityTTL).Unix())
+	NoErr(t, err, "aging chat identity")
+	_, reply = slash(t, cli, "shh", "U2", "cycles", now)
+	if !strings.Contains(reply, "cycle_1") {
+		t.Errorf("got %q, want the cycles", reply)
+	}
+	if n := atomic.LoadInt32(&lookups); n != 3 {
+		t.Errorf("got %d users.info calls, want a stale identity to be looked up again", n)
+	}
+
+	NoErr(t, CreateUser(cli.db, "user_2", "User_2@Example.com"), "creating user")
+	_, reply = slash(t, cli, "shh", "U4", "request <@U1> cycle_1", now)
+	if !strings.Contains(reply, "Asked "+cli.userEmail) {
+		t.Errorf("got %q, want a user with capitals in their email to be found", reply)
+	}
+
+	_, err = DeactivateUser(cli.db, "user_1@example.com", false)
+	NoErr(t, err, "deactivating user")
+	_, reply = slash(t, cli, "shh", "U2", "request <@U1> cycle_1", now)
+	if !strings.Contains(reply, "has been deactivated") {
+		t.Errorf("got %q, want a deactivated user to be turned away", reply)
+	}
+}
+
+// slash sends a signed slash command as chatUserID and returns the status code and reply text
+func slash(t *testing.T, cli *testClient, secret string, chatUserID string, text string, at time.Time) (int, string) {
+	body := url.Values{"command": {"/peerreview"}, "user_id": {chatUserID}, "text": {text}}.Encode()
+	ts := fmt.Sprint(at.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":" + body))
+
+	req, err := http.NewRequest("POST", cli.addr+"/chat/slash", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unable to create request - %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to send slash command - %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	var reply struct {
+		Text string `json:"text"`
+	}
+	json.Unmarshal(b, &reply)
+	return resp.StatusCode, reply.Text
+}
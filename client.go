@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -45,6 +46,11 @@ type reviewPayload struct {
 	Reviews []Review `json:"reviews"`
 }
 
+type reviewRequestsPayload struct {
+	Incoming []ReviewRequest `json:"incoming"`
+	Outgoing []ReviewRequest `json:"outgoing"`
+}
+
 // NewClient creates a new *Client that eases test developement and potential interactions from other Go code bases
 func NewClient(addr string, authkey string) *Client {
 	return &Client{addr: addr, authkey: authkey}
@@ -63,7 +69,7 @@ func (c *Client) InsertTeam(team string) error {
 	return err
 }
 
-// DeleteTeam removes a team. This will not work if a foreign key is violated.
+// DeleteTeam removes a team and its memberships
 func (c *Client) DeleteTeam(team string) error {
 	verb := "DELETE"
 	expectedCode := http.StatusOK
@@ -89,6 +95,179 @@ func (c *Client) GetTeams() ([]string, error) {
 	return data.Teams, nil
 }
 
+// **********
+// api/admin/ldap
+// *********
+
+// SyncLDAP syncs users and teams from the directory now
+func (c *Client) SyncLDAP(dryRun bool) (LDAPSyncRun, error) {
+	var data struct {
+		Run LDAPSyncRun `json:"run"`
+	}
+	b, err := c.clientDo("POST", fmt.Sprintf("/api/admin/ldap/sync?dry_run=%t", dryRun), http.StatusCreated, "")
+	if err != nil {
+		return data.Run, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data.Run, err
+}
+
+// GetLDAPSyncRuns returns the most recent ldap syncs first
+func (c *Client) GetLDAPSyncRuns(limit int) ([]LDAPSyncRun, error) {
+	var data struct {
+		Runs []LDAPSyncRun `json:"runs"`
+	}
+	b, err := c.clientDo("GET", fmt.Sprintf("/api/admin/ldap/runs?limit=%d", limit), http.StatusOK, "")
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data.Runs, err
+}
+
+// **********
+// api/admin/audit
+// *********
+
+// GetAuditLog returns a page of the audit log, newest first, and the cursor for the next page. query holds the filters,
+// such as url.Values{"action": {"cycle.deleted"}}.
+func (c *Client) GetAuditLog(query url.Values) ([]AuditEntry, int, error) {
+	var data struct {
+		Entries    []AuditEntry `json:"entries"`
+		NextCursor int          `json:"next_cursor"`
+	}
+	b, err := c.clientDo("GET", "/api/admin/audit?"+query.Encode(), http.StatusOK, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data.Entries, data.NextCursor, err
+}
+
+// ExportAuditLog returns the audit log entries matching query as csv
+func (c *Client) ExportAuditLog(query url.Values) (string, error) {
+	b, err := c.clientDo("GET", "/api/admin/audit/export?"+query.Encode(), http.StatusOK, "")
+	return string(b), err
+}
+
+// **********
+// api/admin/retention
+// *********
+
+// PurgeExpiredFeedback applies the retention policy now. A dry run reports what would be purged.
+func (c *Client) PurgeExpiredFeedback(dryRun bool) (RetentionReport, error) {
+	var data struct {
+		Report RetentionReport `json:"report"`
+	}
+	expectedCode := http.StatusCreated
+	if dryRun {
+		expectedCode = http.StatusOK
+	}
+	b, err := c.clientDo("POST", fmt.Sprintf("/api/admin/retention/purge?dry_run=%t", dryRun), expectedCode, "")
+	if err != nil {
+		return data.Report, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data.Report, err
+}
+
+// GetRetentionPurges returns the most recent purges first
+func (c *Client) GetRetentionPurges(limit int) ([]RetentionPurge, error) {
+	var data struct {
+		Purges []RetentionPurge `json:"purges"`
+	}
+	b, err := c.clientDo("GET", fmt.Sprintf("/api/admin/retention/purges?limit=%d", limit), http.StatusOK, "")
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data.Purges, err
+}
+
+// **********
+// api/admin/backups
+// *********
+
+// CreateBackup backs up the db into the backup dir now
+func (c *Client) CreateBackup() (Backup, error) {
+	var data struct {
+		Backup Backup `json:"backup"`
+	}
+	b, err := c.clientDo("POST", "/api/admin/backups", http.StatusCreated, "")
+	if err != nil {
+		return data.Backup, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data.Backup, err
+}
+
+// GetBackups returns the backups in the backup dir, newest first
+func (c *Client) GetBackups() ([]Backup, error) {
+	var data struct {
+		Backups []Backup `json:"backups"`
+	}
+	b, err := c.clientDo("GET", "/api/admin/backups", http.StatusOK, "")
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data.Backups, err
+}
+
+// **********
+// api/admin/users
+// *********
+
+// ImportUsers imports a users csv. The report is also returned when rows are invalid, along with an error.
+func (c *Client) ImportUsers(csv string, dryRun bool) (UserImportReport, error) {
+	var report UserImportReport
+	expectedCode := http.StatusCreated
+	if dryRun {
+		expectedCode = http.StatusOK
+	}
+	uri := fmt.Sprintf("/api/admin/users/import?dry_run=%t", dryRun)
+	code, b, err := c.httpDo("POST", uri, csv)
+	if err != nil {
+		return report, err
+	}
+	json.Unmarshal(b, &report)
+	if code != expectedCode {
+		return report, fmt.Errorf("got %d, want %d on %s - body: %s", code, expectedCode, uri, string(b))
+	}
+	return report, nil
+}
+
+// ExportUsers returns every user as csv
+func (c *Client) ExportUsers() (string, error) {
+	b, err := c.clientDo("GET", "/api/admin/users/export", http.StatusOK, "")
+	return string(b), err
+}
+
+// DeactivateUser deactivates a user, optionally purging the feedback they received
+func (c *Client) DeactivateUser(email string, purgeFeedback bool) (Deactivation, error) {
+	var d Deactivation
+	uri := fmt.Sprintf("/api/admin/users/%s/deactivate", url.PathEscape(email))
+	b, err := c.clientDo("POST", uri, http.StatusOK, fmt.Sprintf(`{"purge_feedback":%t}`, purgeFeedback))
+	if err != nil {
+		return d, err
+	}
+	err = json.Unmarshal(b, &d)
+	return d, err
+}
+
+// SetUserManager records who a user reports to. An empty managerEmail clears it.
+func (c *Client) SetUserManager(email string, managerEmail string) error {
+	uri := fmt.Sprintf("/api/admin/users/%s/manager", url.PathEscape(email))
+	_, err := c.clientDo("POST", uri, http.StatusCreated, fmt.Sprintf(`{"manager_email":"%s"}`, managerEmail))
+	return err
+}
+
+// ReactivateUser lets a deactivated user sign in again
+func (c *Client) ReactivateUser(email string) error {
+	_, err := c.clientDo("POST", fmt.Sprintf("/api/admin/users/%s/reactivate", url.PathEscape(email)), http.StatusOK, "")
+	return err
+}
+
 // **********
 // api/admin/cycles
 // *********
@@ -139,6 +318,217 @@ func (c *Client) EditCycle(cycle string, IsOpen bool) error {
 	return err
 }
 
+// UpdateCycleSettings changes the non-nil settings of a cycle
+func (c *Client) UpdateCycleSettings(cycle string, settings CycleSettings) error {
+	verb := "PUT"
+	expectedCode := http.StatusOK
+	uri := "/api/admin/cycles/settings"
+	var payload struct {
+		Cycle string `json:"cycle"`
+		CycleSettings
+	}
+	payload.Cycle = cycle
+	payload.CycleSettings = settings
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = c.clientDo(verb, uri, expectedCode, string(b))
+	return err
+}
+
+// AssignReviewers plans reviewer assignments for a cycle. Unless dryRun is set, they are also written as review requests.
+func (c *Client) AssignReviewers(cycle string, opts AssignmentOptions, dryRun bool) ([]Assignment, error) {
+	verb := "POST"
+	expectedCode := http.StatusCreated
+	if dryRun {
+		expectedCode = http.StatusOK
+	}
+	uri := "/api/admin/cycles/assignments"
+	var payload struct {
+		Cycle  string `json:"cycle"`
+		DryRun bool   `json:"dry_run"`
+		AssignmentOptions
+	}
+	payload.Cycle = cycle
+	payload.DryRun = dryRun
+	payload.AssignmentOptions = opts
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	b, err = c.clientDo(verb, uri, expectedCode, string(b))
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Assignments []Assignment `json:"assignments"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Assignments, nil
+}
+
+// CommitAssignments writes assignments previewed with AssignReviewers as review requests
+func (c *Client) CommitAssignments(cycle string, assignments []Assignment) error {
+	b, err := json.Marshal(map[string]interface{}{"cycle": cycle, "assignments": assignments})
+	if err != nil {
+		return err
+	}
+	_, err = c.clientDo("POST", "/api/admin/cycles/assignments", http.StatusCreated, string(b))
+	return err
+}
+
+// **********
+// api/admin/reports
+// *********
+
+// GetMostRequestedReviewers returns the reviewers with the most review requests in a cycle
+func (c *Client) GetMostRequestedReviewers(cycle string, limit int) ([]RequestedReviewer, error) {
+	expectedCode := http.StatusOK
+	verb := "GET"
+	uri := fmt.Sprintf("/api/admin/reports/requested-reviewers/%s?limit=%d", cycle, limit)
+	b, err := c.clientDo(verb, uri, expectedCode, "")
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Reviewers []RequestedReviewer `json:"reviewers"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Reviewers, nil
+}
+
+// GetTeamCompletion returns how far each team is with their reviews in a cycle
+func (c *Client) GetTeamCompletion(cycle string) ([]TeamCompletion, error) {
+	expectedCode := http.StatusOK
+	verb := "GET"
+	uri := "/api/admin/reports/completion/" + cycle
+	b, err := c.clientDo(verb, uri, expectedCode, "")
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Teams []TeamCompletion `json:"teams"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Teams, nil
+}
+
+// **********
+// api/admin/jobs
+// *********
+
+// GetJobs returns the most recent background jobs, optionally only those in the given status
+func (c *Client) GetJobs(status string) ([]Job, error) {
+	expectedCode := http.StatusOK
+	verb := "GET"
+	uri := "/api/admin/jobs?status=" + url.QueryEscape(status)
+	b, err := c.clientDo(verb, uri, expectedCode, "")
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Jobs []Job `json:"jobs"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Jobs, nil
+}
+
+// RetryJob requeues a failed job to run now
+func (c *Client) RetryJob(id int) error {
+	verb := "POST"
+	expectedCode := http.StatusOK
+	uri := fmt.Sprintf("/api/admin/jobs/%d/retry", id)
+	_, err := c.clientDo(verb, uri, expectedCode, "")
+	return err
+}
+
+// **********
+// api/admin/webhooks
+// *********
+
+// AddWebhook registers a url for events. The returned webhook includes its secret.
+func (c *Client) AddWebhook(url string, events []string, secret string) (Webhook, error) {
+	expectedCode := http.StatusCreated
+	verb := "POST"
+	uri := "/api/admin/webhooks"
+	payload, err := json.Marshal(map[string]interface{}{"url": url, "events": events, "secret": secret})
+	if err != nil {
+		return Webhook{}, err
+	}
+	b, err := c.clientDo(verb, uri, expectedCode, string(payload))
+	if err != nil {
+		return Webhook{}, err
+	}
+	var data struct {
+		Webhook Webhook `json:"webhook"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return Webhook{}, err
+	}
+	return data.Webhook, nil
+}
+
+// GetWebhooks returns the registered webhooks
+func (c *Client) GetWebhooks() ([]Webhook, error) {
+	expectedCode := http.StatusOK
+	verb := "GET"
+	uri := "/api/admin/webhooks"
+	b, err := c.clientDo(verb, uri, expectedCode, "")
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Webhooks, nil
+}
+
+// DeleteWebhook removes a webhook
+func (c *Client) DeleteWebhook(id int) error {
+	verb := "DELETE"
+	expectedCode := http.StatusOK
+	uri := fmt.Sprintf("/api/admin/webhooks/%d", id)
+	_, err := c.clientDo(verb, uri, expectedCode, "")
+	return err
+}
+
+// GetWebhookDeliveries returns a webhook's delivery log, newest first
+func (c *Client) GetWebhookDeliveries(id int) ([]WebhookDelivery, error) {
+	expectedCode := http.StatusOK
+	verb := "GET"
+	uri := fmt.Sprintf("/api/admin/webhooks/%d/deliveries", id)
+	b, err := c.clientDo(verb, uri, expectedCode, "")
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Deliveries []WebhookDelivery `json:"deliveries"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Deliveries, nil
+}
+
 // **********
 // api/user/team
 // *********
@@ -199,6 +589,95 @@ func (c *Client) GetUserInfo() (UserInfo, error) {
 	return data.User, nil
 }
 
+// **********
+// /api/user/email-preferences
+// *********
+
+// SetEmailOptOut turns email notifications off (true) or back on (false) for the signed in user
+func (c *Client) SetEmailOptOut(optOut bool) error {
+	verb := "POST"
+	expectedCode := http.StatusOK
+	uri := "/api/user/email-preferences"
+	_, err := c.clientDo(verb, uri, expectedCode, fmt.Sprintf(`{"opt_out":%t}`, optOut))
+	return err
+}
+
+// **********
+// /api/user/export
+// *********
+
+// ExportPersonalData returns the zip of everything held about the signed in user
+func (c *Client) ExportPersonalData() ([]byte, error) {
+	return c.clientDo("GET", "/api/user/export", http.StatusOK, "")
+}
+
+// **********
+// /api/user/calendar
+// *********
+
+// GetCalendarURL returns the url of the signed in user's calendar feed
+func (c *Client) GetCalendarURL() (string, error) {
+	return c.calendarURL("GET", "/api/user/calendar")
+}
+
+// RegenerateCalendarURL replaces the signed in user's calendar token and returns the new feed url
+func (c *Client) RegenerateCalendarURL() (string, error) {
+	return c.calendarURL("POST", "/api/user/calendar/regenerate")
+}
+
+func (c *Client) calendarURL(verb string, uri string) (string, error) {
+	expectedCode := http.StatusOK
+	b, err := c.clientDo(verb, uri, expectedCode, "")
+	if err != nil {
+		return "", err
+	}
+	var data struct {
+		URL string `json:"url"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return "", err
+	}
+	return data.URL, nil
+}
+
+// **********
+// /api/user/notifications
+// *********
+
+// GetNotifications returns the signed in user's feed, newest first, and how many notifications are unread
+func (c *Client) GetNotifications(unreadOnly bool) ([]Notification, int, error) {
+	expectedCode := http.StatusOK
+	verb := "GET"
+	uri := fmt.Sprintf("/api/user/notifications?unread=%t", unreadOnly)
+	b, err := c.clientDo(verb, uri, expectedCode, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	var data struct {
+		Notifications []Notification `json:"notifications"`
+		Unread        int            `json:"unread"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data.Notifications, data.Unread, nil
+}
+
+// MarkNotificationsRead marks the given notifications read, or all of them if none are given
+func (c *Client) MarkNotificationsRead(ids ...int) error {
+	verb := "POST"
+	expectedCode := http.StatusOK
+	uri := "/api/user/notifications/read"
+	payload, err := json.Marshal(map[string][]int{"ids": ids})
+	if err != nil {
+		return err
+	}
+	_, err = c.clientDo(verb, uri, expectedCode, string(payload))
+	return err
+}
+
 // **********
 // /api/user/goal
 // *********
@@ -221,6 +700,63 @@ func (c *Client) SetUserGoal(goal string) error {
 	return err
 }
 
+// **********
+// /api/user/goals
+// *********
+
+// AddGoal adds an active goal for the signed in user. cycle is optional.
+func (c *Client) AddGoal(title string, description string, cycle string) (Goal, error) {
+	var data struct {
+		Goal Goal `json:"goal"`
+	}
+	payload, err := json.Marshal(map[string]string{"title": title, "description": description, "cycle": cycle})
+	if err != nil {
+		return data.Goal, err
+	}
+	b, err := c.clientDo("POST", "/api/user/goals", http.StatusCreated, string(payload))
+	if err != nil {
+		return data.Goal, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data.Goal, err
+}
+
+// GetGoals returns the signed in user's goals, oldest first. An empty status returns every goal.
+func (c *Client) GetGoals(status string) ([]Goal, error) {
+	var data struct {
+		Goals []Goal `json:"goals"`
+	}
+	b, err := c.clientDo("GET", "/api/user/goals?status="+url.QueryEscape(status), http.StatusOK, "")
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data.Goals, err
+}
+
+// UpdateGoal changes one of the signed in user's goals. Nil fields are left unchanged.
+func (c *Client) UpdateGoal(id int, changes GoalChanges) (Goal, error) {
+	var data struct {
+		Goal Goal `json:"goal"`
+	}
+	payload, err := json.Marshal(changes)
+	if err != nil {
+		return data.Goal, err
+	}
+	b, err := c.clientDo("PUT", fmt.Sprintf("/api/user/goals/%d", id), http.StatusOK, string(payload))
+	if err != nil {
+		return data.Goal, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data.Goal, err
+}
+
+// DeleteGoal removes one of the signed in user's goals
+func (c *Client) DeleteGoal(id int) error {
+	_, err := c.clientDo("DELETE", fmt.Sprintf("/api/user/goals/%d", id), http.StatusOK, "")
+	return err
+}
+
 // **********
 // /api/user/reviewees
 // *********
@@ -242,6 +778,23 @@ func (c *Client) GetUserReviewees(cycle string) ([]UserInfoLite, error) {
 	return data.Reviewees, nil
 }
 
+// GetOutstandingReviewees returns the reviewees the signed in user has not submitted feedback for in the given cycle
+func (c *Client) GetOutstandingReviewees(cycle string) ([]UserInfoLite, error) {
+	var data revieweesPayload
+	expectedCode := http.StatusOK
+	verb := "GET"
+	uri := "/api/user/outstanding/" + cycle
+	b, err := c.clientDo(verb, uri, expectedCode, "")
+	if err != nil {
+		return data.Reviewees, err
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return data.Reviewees, err
+	}
+	return data.Reviewees, nil
+}
+
 // **********
 // /api/user/reviewer
 // *********
@@ -255,6 +808,113 @@ func (c *Client) AddReviewer(email string, cycleName string) error {
 	return err
 }
 
+// AddReviewerWithPrompt is AddReviewer, asking the reviewer the question in prompt
+func (c *Client) AddReviewerWithPrompt(email string, cycleName string, prompt string) error {
+	b, err := json.Marshal(map[string]string{"user_email": email, "cycle": cycleName, "prompt": prompt})
+	if err != nil {
+		return err
+	}
+	_, err = c.clientDo("POST", "/api/user/reviewer", http.StatusCreated, string(b))
+	return err
+}
+
+// **********
+// /api/user/review-requests
+// *********
+
+// GetReviewRequests returns the review requests the signed in user received and sent. An empty cycle returns all cycles.
+func (c *Client) GetReviewRequests(cycle string) ([]ReviewRequest, []ReviewRequest, error) {
+	var data reviewRequestsPayload
+	expectedCode := http.StatusOK
+	verb := "GET"
+	uri := "/api/user/review-requests?cycle=" + url.QueryEscape(cycle)
+	b, err := c.clientDo(verb, uri, expectedCode, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data.Incoming, data.Outgoing, nil
+}
+
+// AcceptReviewRequest accepts a review request the signed in user received
+func (c *Client) AcceptReviewRequest(id int) error {
+	verb := "POST"
+	expectedCode := http.StatusOK
+	uri := fmt.Sprintf("/api/user/review-requests/%d/accept", id)
+	_, err := c.clientDo(verb, uri, expectedCode, "")
+	return err
+}
+
+// DeclineReviewRequest declines a review request the signed in user received. The reason is shown to the requester.
+func (c *Client) DeclineReviewRequest(id int, reason string) error {
+	verb := "POST"
+	expectedCode := http.StatusOK
+	uri := fmt.Sprintf("/api/user/review-requests/%d/decline", id)
+	b, err := json.Marshal(map[string]string{"reason": reason})
+	if err != nil {
+		return err
+	}
+	_, err = c.clientDo(verb, uri, expectedCode, string(b))
+	return err
+}
+
+// WithdrawReviewRequest withdraws a review request the signed in user sent
+func (c *Client) WithdrawReviewRequest(id int) error {
+	verb := "POST"
+	expectedCode := http.StatusOK
+	uri := fmt.Sprintf("/api/user/review-requests/%d/withdraw", id)
+	_, err := c.clientDo(verb, uri, expectedCode, "")
+	return err
+}
+
+// **********
+// /api/user/approvals
+// *********
+
+// GetApprovals returns the review requests from the signed in user's reports that are waiting for approval
+func (c *Client) GetApprovals() ([]ReviewRequest, error) {
+	expectedCode := http.StatusOK
+	verb := "GET"
+	uri := "/api/user/approvals"
+	b, err := c.clientDo(verb, uri, expectedCode, "")
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Requests []ReviewRequest `json:"requests"`
+	}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Requests, nil
+}
+
+// ApproveReviewRequest approves a review request from one of the signed in user's reports
+func (c *Client) ApproveReviewRequest(id int) error {
+	verb := "POST"
+	expectedCode := http.StatusOK
+	uri := fmt.Sprintf("/api/user/approvals/%d/approve", id)
+	_, err := c.clientDo(verb, uri, expectedCode, "")
+	return err
+}
+
+// RejectReviewRequest rejects a review request from one of the signed in user's reports. The reason is shown to the requester.
+func (c *Client) RejectReviewRequest(id int, reason string) error {
+	verb := "POST"
+	expectedCode := http.StatusOK
+	uri := fmt.Sprintf("/api/user/approvals/%d/reject", id)
+	b, err := json.Marshal(map[string]string{"reason": reason})
+	if err != nil {
+		return err
+	}
+	_, err = c.clientDo(verb, uri, expectedCode, string(b))
+	return err
+}
+
 // **********
 // /api/user/reviews
 // *********
@@ -296,6 +956,21 @@ func (c *Client) AddReviewForUser(email string, cycle string, strengths []string
 	return err
 }
 
+// AddReviewItemsForUser creates a review for the given user where feedback can be about the user's goals
+func (c *Client) AddReviewItemsForUser(email string, cycle string, strengths []FeedbackItem, opportunities []FeedbackItem) error {
+	b, err := json.Marshal(map[string]interface{}{
+		"reviewee_email":       email,
+		"strengths":            strengths,
+		"growth_opportunities": opportunities,
+		"cycle":                cycle,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.clientDo("POST", "/api/user/reviews", http.StatusCreated, string(b))
+	return err
+}
+
 // **********
 // helpers
 // *********
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ Feedback text, goals (users.goals and the goals table), and review request prompts are encrypted at rest when a key is
+ set with -encryption-key or -encryption-key-file. This is envelope encryption: every value gets its own random data key, which encrypts the
+ value with AES-256-GCM, and the data key is stored alongside it encrypted (wrapped) by the master key. Stored values
+ look like
+
+   enc:v1:<master key id>:<wrapped data key>:<ciphertext>
+
+ with the last two in base64. The key id is derived from the master key, so several keys can be configured at once: the
+ first encrypts and the rest only decrypt. To rotate, put a new key first, run `peerreview reencrypt`, and then drop the
+ old key. Values without the prefix are plaintext from before encryption was turned on and are read as is until
+ reencrypt encrypts them. Empty values, such as purged feedback, are never encrypted.
+*/
+
+const encryptedPrefix = "enc:v1:"
+
+// ErrUnknownEncryptionKey is returned when a value was encrypted with a master key that is not configured
+var ErrUnknownEncryptionKey = errors.New("value was encrypted with an unknown key")
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var encryptionKeys struct {
+	mu      sync.RWMutex
+	current *masterKey
+	byID    map[string]*masterKey
+}
+
+// SetEncryptionKeys configures the master keys from base64 encoded 32 byte keys separated by commas or newlines. The
+// first key encrypts. Empty keys turn encryption off, though values encrypted earlier then can not be read.
+func SetEncryptionKeys(keys string) error {
+	var current *masterKey
+	byID := make(map[string]*masterKey)
+	for _, encoded := range strings.FieldsFunc(keys, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		encoded = strings.TrimSpace(encoded)
+		if encoded == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(raw) != 32 {
+			return errors.New("encryption keys must be 32 random bytes in base64, such as from `head -c 32 /dev/urandom | base64`")
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(raw)
+		k := &masterKey{id: hex.EncodeToString(sum[:4]), aead: aead}
+		byID[k.id] = k
+		if current == nil {
+			current = k
+		}
+	}
+
+	encryptionKeys.mu.Lock()
+	defer encryptionKeys.mu.Unlock()
+	encryptionKeys.current = current
+	encryptionKeys.byID = byID
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create gcm")
+	}
+	return aead, nil
+}
+
+// seal encrypts plaintext with aead, prefixing the random nonce
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "unable to generate nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts what seal returned
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	return plaintext, errors.Wrap(err, "unable to decrypt")
+}
+
+// encryptField returns the value to store for plaintext. It is plaintext when no key is configured or plaintext is empty.
+func encryptField(plaintext string) (string, error) {
+	encryptionKeys.mu.RLock()
+	k := encryptionKeys.current
+	encryptionKeys.mu.RUnlock()
+	if k == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", errors.Wrap(err, "unable to generate data key")
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(aead, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + k.id + ":" + base64.StdEncoding.EncodeToString(wrapped) + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decryptField returns the plaintext of a stored value. Values that are not encrypted are returned as is.
+func decryptField(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		return stored, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(stored, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	encryptionKeys.mu.RLock()
+	k, ok := encryptionKeys.byID[parts[0]]
+	encryptionKeys.mu.RUnlock()
+	if !ok {
+		return "", errors.Wrapf(ErrUnknownEncryptionKey, "key %s", parts[0])
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "unable to decode data key")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, "unable to decode ciphertext")
+	}
+	dataKey, err := open(k.aead, wrapped)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to unwrap data key")
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// isCurrentlyEncrypted reports if stored was encrypted with the current key
+func isCurrentlyEncrypted(stored string) bool {
+	encryptionKeys.mu.RLock()
+	defer encryptionKeys.mu.RUnlock()
+	return encryptionKeys.current != nil && strings.HasPrefix(stored, encryptedPrefix+encryptionKeys.current.id+":")
+}
+
+// Reencryption counts the values reencrypt rewrote. Goal titles and descriptions are counted separately.
+type Reencryption struct {
+	Reviews int `json:"reviews"`
+	Goals   int `json:"goals"`
+	Prompts int `json:"prompts"`
+}
+
+// ReencryptFields rewrites every feedback text, goal, and prompt not yet encrypted with the current key, decrypting with any
+// configured key. It is all or nothing.
+func ReencryptFields(db *sql.DB) (result Reencryption, err error) {
+	encryptionKeys.mu.RLock()
+	enabled := encryptionKeys.current != nil
+	encryptionKeys.mu.RUnlock()
+	if !enabled {
+		return result, errors.New("no encryption key is set")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, errors.Wrap(err, "unable to begin tx for ReencryptFields")
+	}
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on ReencryptFields")
+		}
+	}()
+
+	if result.Reviews, err = reencryptColumn(tx, "reviews", "feedback"); err != nil {
+		return result, err
+	}
+	for _, c := range []struct {
+		table  string
+		column string
+	}{{"users", "goals"}, {"goals", "title"}, {"goals", "description"}} {
+		var n int
+		if n, err = reencryptColumn(tx, c.table, c.column); err != nil {
+			return result, err
+		}
+		result.Goals += n
+	}
+	if result.Prompts, err = reencryptColumn(tx, "prompts", "text"); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// reencryptColumn reencrypts the non empty values of table.column. table and column are never user input.
+func reencryptColumn(tx *sql.Tx, table string, column string) (int, error) {
+	rows, err := tx.Query("select id, " + column + " from " + table + " where " + column + " != ''")
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to query %s for reencryption", table)
+	}
+	stale := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var stored string
+		if err = rows.Scan(&id, &stored); err != nil {
+			rows.Close()
+			return 0, errors.Wrapf(err, "unable to scan %s for reencryption", table)
+		}
+		if !isCurrentlyEncrypted(stored) {
+			stale[id] = stored
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, errors.Wrapf(err, "error post scan of %s for reencryption", table)
+	}
+
+	for id, stored := range stale {
+		plaintext, err := decryptField(stored)
+		if err != nil {
+			return 0, errors.Wrapf(err, "unable to decrypt %s %d", table, id)
+		}
+		encrypted, err := encryptField(plaintext)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = tx.Exec("update "+table+" set "+column+"=? where id=?", encrypted, id); err != nil {
+			return 0, errors.Wrapf(err, "unable to update %s %d", table, id)
+		}
+	}
+	return len(stale), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestEncryptionAtRest(t *testing.T) {
+	/*
+		Verify feedback and goals are encrypted in the db and read back as plaintext
+		Verify plaintext from before encryption is still readable
+		Verify reencrypt moves everything to a new key, after which the old key can be dropped
+	*/
+	oldKey := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	newKey := "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+	NoErr(t, SetEncryptionKeys(oldKey), "setting key")
+	defer SetEncryptionKeys("")
+
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "reviewee", "reviewee@example.com"), "creating user")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.AddReviewForUser("reviewee@example.com", "cycle_1", []string{"secret strength"}, []string{"secret opportunity"}), "adding review")
+	NoErr(t, cli.SetUserGoal("secret goal"), "setting goal")
+	_, err := cli.db.Exec("insert into reviews (recipient_id, review_cycle_id, feedback, is_strength, is_growth_opportunity) select id, 1, 'legacy strength', 1, 0 from users where email='reviewee@example.com'")
+	NoErr(t, err, "adding plaintext review")
+
+	stored := storedSecrets(t, cli)
+	for _, s := range stored {
+		if s == "legacy strength" {
+			continue
+		}
+		if !strings.HasPrefix(s, encryptedPrefix) || strings.Contains(s, "secret") {
+			t.Errorf("got %q stored, want it encrypted", s)
+		}
+	}
+
+	assertReadable := func(when string) {
+		t.Helper()
+		got := reviewsByCycle(t, cli, "reviewee@example.com")["cycle_1"]
+		if strings.Join(got.Strengths, ",") != "secret strength,legacy strength" || strings.Join(got.Opportunities, ",") != "secret opportunity" {
+			t.Errorf("got %+v %s, want the plaintext feedback", got, when)
+		}
+		goal, err := cli.GetUsersGoal()
+		NoErr(t, err, "getting goal")
+		if goal != "secret goal" {
+			t.Errorf("got goal %q %s, want the plaintext goal", goal, when)
+		}
+	}
+	assertReadable("after encrypting")
+
+	NoErr(t, SetEncryptionKeys(newKey+"\n"+oldKey+"\n"), "adding new key")
+	assertReadable("after adding a key")
+	result, err := ReencryptFields(cli.db)
+	NoErr(t, err, "reencrypting")
+	if result.Reviews != 3 || result.Goals != 1 {
+		t.Errorf("got %+v, want 3 reviews and 1 goal reencrypted", result)
+	}
+	for _, s := range storedSecrets(t, cli) {
+		if !isCurrentlyEncrypted(s) {
+			t.Errorf("got %q stored, want it encrypted with the new key", s)
+		}
+	}
+	result, err = ReencryptFields(cli.db)
+	NoErr(t, err, "reencrypting again")
+	if result.Reviews != 0 || result.Goals != 0 {
+		t.Errorf("got %+v, want nothing left to reencrypt", result)
+	}
+
+	NoErr(t, SetEncryptionKeys(newKey), "dropping old key")
+	assertReadable("after dropping the old key")
+
+	NoErr(t, SetEncryptionKeys(oldKey), "using only the old key")
+	if _, err = GetUserReviews(cli.db, "reviewee@example.com"); errors.Cause(err) != ErrUnknownEncryptionKey {
+		t.Errorf("got %v, want ErrUnknownEncryptionKey reading with the wrong key", err)
+	}
+
+	if err = SetEncryptionKeys("too short"); err == nil {
+		t.Error("got no error for an invalid key")
+	}
+}
+
+// storedSecrets returns the raw feedback and goals in the db
+func storedSecrets(t *testing.T, cli *testClient) []string {
+	rows, err := cli.db.Query("select feedback from reviews union all select goals from users where goals != ''")
+	NoErr(t, err, "reading stored values")
+	defer rows.Close()
+	var stored []string
+	for rows.Next() {
+		var s string
+		NoErr(t, rows.Scan(&s), "scanning stored value")
+		stored = append(stored, s)
+	}
+	if len(stored) != 4 {
+		t.Fatalf("got %d stored values, want 3 reviews and 1 goal", len(stored))
+	}
+	return stored
+}
@@ -11,10 +11,12 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -35,6 +37,27 @@ func InitDB(dbfile string) error {
 	return nil
 }
 
+// UserExists reports whether a user has signed in before
+func UserExists(db *sql.DB, email string) (bool, error) {
+	var n int
+	if err := db.QueryRow("select count(*) from users where email=?", email).Scan(&n); err != nil {
+		return false, errors.Wrap(err, "unable to look up user")
+	}
+	return n > 0, nil
+}
+
+// UserIsActive reports whether a user can sign in. Users that do not exist yet are active.
+func UserIsActive(db *sql.DB, email string) (bool, error) {
+	var active bool
+	err := db.QueryRow("select is_active from users where email=?", email).Scan(&active)
+	if err == sql.ErrNoRows {
+		return true, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "unable to look up whether user is active")
+	}
+	return active, nil
+}
+
 // CreateUser idempotently creates a user. If the user already exists, nothing happens.
 func CreateUser(db *sql.DB, name, email string) (err error) {
 	tx, err := db.Begin()
@@ -99,16 +122,41 @@ func GetUsersTeams(db *sql.DB, email string) ([]string, error) {
 
 // UserInfo contains basic user information
 type UserInfo struct {
-	Name  string   `json:"name"`
-	Email string   `json:"email"`
-	Goals string   `json:"goal"`
-	Teams []string `json:"teams"`
+	Name    string   `json:"name"`
+	Email   string   `json:"email"`
+	Goals   string   `json:"goal"`
+	Teams   []string `json:"teams"`
+	Manager string   `json:"manager"`
+	IsAdmin bool     `json:"is_admin"`
+	// IsActive is false once the user is deactivated
+	IsActive bool `json:"is_active"`
+	// EmailOptOut is set when the user does not want email notifications
+	EmailOptOut bool `json:"email_opt_out"`
 }
 
+// ErrUserNotFound is returned when acting on a user that does not exist
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUserInactive is returned when acting on a user that has been deactivated
+var ErrUserInactive = errors.New("user has been deactivated")
+
+// ErrSelfRequest is returned when a user asks themselves for a review
+var ErrSelfRequest = errors.New("can not request a review from yourself")
+
+// ErrNoManager is returned when a user without a manager requests a review in a cycle that requires manager approval
+var ErrNoManager = errors.New("a manager must approve requests this cycle, and the user has none")
+
+// ErrDuplicateRequest is returned when the requester already has an open request to the reviewer during the cycle
+var ErrDuplicateRequest = errors.New("an open review request already exists")
+
 // UserInfoLite is a subset of UserInfo
 type UserInfoLite struct {
 	Name  string `json:"name"`
 	Email string `json:"email"`
+	// Goals are the user's active goals for the cycle, shown to reviewers. Only set by GetReviewees.
+	Goals []Goal `json:"goals,omitempty"`
+	// Prompts are the questions the user asked the reviewer in their review requests. Only set by GetReviewees.
+	Prompts []Prompt `json:"prompts,omitempty"`
 }
 
 // queryPP is a query (pretty) printer, helpful for logging/deubbing.
@@ -127,24 +175,38 @@ func GetUser(db *sql.DB, email string) (UserInfo, error) {
 	// In this application, saving a new query to the db wont mean much, so, "meh."
 	info := UserInfo{}
 	q := `
-        SELECT name,
-               goals
+        SELECT users.name,
+               users.goals,
+               coalesce(managers.email, ""),
+               users.email_opt_out,
+               users.is_admin,
+               users.is_active
         FROM   users
-        WHERE  email=?;
+               LEFT JOIN users managers
+                      ON users.manager_id = managers.id
+        WHERE  users.email=?;
 	`
 
-	rows, err := db.Query(q, email, email)
+	rows, err := db.Query(q, email)
 	if err != nil {
 		return info, errors.Wrap(err, "unable to query GetUser")
 	}
 	for rows.Next() {
-		var name, goals string
-		if err = rows.Scan(&name, &goals); err != nil {
+		var name, goals, manager string
+		var optOut, isAdmin, isActive bool
+		if err = rows.Scan(&name, &goals, &manager, &optOut, &isAdmin, &isActive); err != nil {
 			return info, errors.Wrap(err, "unable to scan GetUser first result set")
 		}
+		if goals, err = decryptField(goals); err != nil {
+			return info, errors.Wrap(err, "unable to decrypt goals in GetUser")
+		}
 		info.Name = name
 		info.Email = email
 		info.Goals = goals
+		info.Manager = manager
+		info.EmailOptOut = optOut
+		info.IsAdmin = isAdmin
+		info.IsActive = isActive
 	}
 	if rows.Err() != nil {
 		return info, errors.Wrap(err, "error post scan in GetUser")
@@ -220,6 +282,10 @@ func RemoveTeamFromUser(db *sql.DB, email string, team string) error {
 
 // AssignGoalToUser sets the goal that the user wishes other reviewers to know about themselves
 func AssignGoalToUser(db *sql.DB, email string, goal string) error {
+	goal, err := encryptField(goal)
+	if err != nil {
+		return errors.Wrap(err, "unable to encrypt goal in AssignGoalToUser")
+	}
 	q := "update users set goals=? where email=?"
 	if _, err := db.Exec(q, goal, email); err != nil {
 		return errors.Wrap(err, "unable to set user goal in AssignGoalToUser")
@@ -227,15 +293,353 @@ func AssignGoalToUser(db *sql.DB, email string, goal string) error {
 	return nil
 }
 
+// SetUserManager records who a user reports to. This is the org structure used when assigning reviewers.
+// An empty managerEmail clears the user's manager.
+func SetUserManager(db *sql.DB, email string, managerEmail string) error {
+	var managerID sql.NullInt64
+	if managerEmail != "" {
+		err := db.QueryRow("select id from users where email=? limit 1", managerEmail).Scan(&managerID)
+		if err == sql.ErrNoRows {
+			return ErrUserNotFound
+		} else if err != nil {
+			return errors.Wrap(err, "unable to look up manager in SetUserManager")
+		}
+	}
+	if _, err := db.Exec("update users set manager_id=? where email=?", managerID, email); err != nil {
+		return errors.Wrap(err, "unable to set manager in SetUserManager")
+	}
+	return nil
+}
+
+// SetEmailOptOut sets whether a user wants to receive email notifications
+func SetEmailOptOut(db *sql.DB, email string, optOut bool) error {
+	if _, err := db.Exec("update users set email_opt_out=? where email=?", bool2int(optOut), email); err != nil {
+		return errors.Wrap(err, "unable to set email opt out")
+	}
+	return nil
+}
+
+// SetUserName updates a user's display name
+func SetUserName(db *sql.DB, email string, name string) error {
+	if _, err := db.Exec("update users set name=? where email=?", name, email); err != nil {
+		return errors.Wrap(err, "unable to set user name")
+	}
+	return nil
+}
+
+// SetUserAdmin sets whether a user is an admin
+func SetUserAdmin(db *sql.DB, email string, isAdmin bool) error {
+	if _, err := db.Exec("update users set is_admin=? where email=?", bool2int(isAdmin), email); err != nil {
+		return errors.Wrap(err, "unable to set user admin flag")
+	}
+	return nil
+}
+
+// GetAdminEmails returns the email address of every user flagged as an admin
+func GetAdminEmails(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("select email from users where is_admin=1 order by email")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query GetAdminEmails")
+	}
+	defer rows.Close()
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return nil, errors.Wrap(err, "unable to scan GetAdminEmails")
+		}
+		emails = append(emails, email)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetAdminEmails")
+	}
+	return emails, nil
+}
+
+// GetUserEmails returns the email address of every user
+func GetUserEmails(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("select email from users order by email")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query GetUserEmails")
+	}
+	defer rows.Close()
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return nil, errors.Wrap(err, "unable to scan GetUserEmails")
+		}
+		emails = append(emails, email)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetUserEmails")
+	}
+	return emails, nil
+}
+
+// GetActiveUserEmails returns the email address of every user who has not been deactivated
+func GetActiveUserEmails(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("select email from users where is_active=1 order by email")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query GetActiveUserEmails")
+	}
+	defer rows.Close()
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return nil, errors.Wrap(err, "unable to scan GetActiveUserEmails")
+		}
+		emails = append(emails, email)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetActiveUserEmails")
+	}
+	return emails, nil
+}
+
+// Deactivation describes what happened when a user was deactivated
+type Deactivation struct {
+	Email             string `json:"email"`
+	RequestsWithdrawn int    `json:"requests_withdrawn"`
+	FeedbackPurged    int    `json:"feedback_purged"`
+	// wasActive is read in the deactivation's tx so the audit log and events see what it changed
+	wasActive bool
+}
+
+// DeactivateUser stops a user from signing in and being reviewed. Their open review requests, sent or received, are
+// withdrawn. The feedback they received is kept unless purgeFeedback is set, in which case its text is purged the same
+// way the retention policy purges it. Their sessions are revoked once the deactivation commits.
+func DeactivateUser(db *sql.DB, email string, purgeFeedback bool) (d Deactivation, err error) {
+	d.Email = email
+	tx, err := db.Begin()
+	if err != nil {
+		return d, errors.Wrap(err, "unable to begin tx for DeactivateUser")
+	}
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on DeactivateUser")
+			return
+		}
+		RevokeAuth(email)
+	}()
+
+	var id int
+	err = tx.QueryRow("select id, is_active from users where email=?", email).Scan(&id, &d.wasActive)
+	if err == sql.ErrNoRows {
+		return d, ErrUserNotFound
+	} else if err != nil {
+		return d, errors.Wrap(err, "unable to look up user in DeactivateUser")
+	}
+	if d.RequestsWithdrawn, err = deactivateUser(tx, id); err != nil {
+		return d, err
+	}
+	if !purgeFeedback {
+		return d, nil
+	}
+	res, err := tx.Exec(`update reviews set feedback="", purged_at=? where recipient_id=? and purged_at is null`, time.Now().Unix(), id)
+	if err != nil {
+		return d, errors.Wrap(err, "unable to purge feedback in DeactivateUser")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return d, errors.Wrap(err, "unable to count purged feedback in DeactivateUser")
+	}
+	d.FeedbackPurged = int(n)
+	return d, nil
+}
+
+// ReactivateUser lets a deactivated user sign in and be reviewed again, returning whether they were already active.
+// Withdrawn requests stay withdrawn.
+func ReactivateUser(db *sql.DB, email string) (wasActive bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, "unable to begin tx for ReactivateUser")
+	}
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on ReactivateUser")
+		}
+	}()
+
+	err = tx.QueryRow("select is_active from users where email=?", email).Scan(&wasActive)
+	if err == sql.ErrNoRows {
+		return false, ErrUserNotFound
+	} else if err != nil {
+		return false, errors.Wrap(err, "unable to look up user in ReactivateUser")
+	}
+	if _, err = tx.Exec("update users set is_active=1 where email=?", email); err != nil {
+		return false, errors.Wrap(err, "unable to reactivate user")
+	}
+	return wasActive, nil
+}
+
+// deactivateUser is the part of offboarding that DeactivateUser, SCIM, and LDAP sync share: it marks the user inactive
+// and withdraws their open requests, returning how many were withdrawn. Sessions are held in memory and can't be
+// rolled back, so callers revoke them with RevokeAuth once tx commits.
+func deactivateUser(tx *sql.Tx, id int) (int, error) {
+	if _, err := tx.Exec("update users set is_active=0 where id=?", id); err != nil {
+		return 0, errors.Wrap(err, "unable to deactivate user")
+	}
+	return withdrawOpenRequests(tx, id)
+}
+
+// withdrawOpenRequests withdraws every review request a user sent or received that is still waiting on someone,
+// returning how many were withdrawn
+func withdrawOpenRequests(tx *sql.Tx, userID int) (int, error) {
+	q := `
+    UPDATE review_requests
+    SET    status = ?
+    WHERE  ( recipient_id = ?
+              OR reviewer_id = ? )
+           AND status IN (?, ?, ?)
+    `
+	res, err := tx.Exec(q, requestWithdrawn, userID, userID, requestPendingApproval, requestPending, requestAccepted)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to withdraw open review requests")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count withdrawn review requests")
+	}
+	return int(n), nil
+}
+
 // SetUserReviewer allows a user to be reviewed by a given reviewer during a given cycle
 // This link will allow a reviewer to see other potential reviewees than just team members.
 // This allows for cross team reviews.
-func SetUserReviewer(db *sql.DB, userEmail string, eligibleReviewer string, cycle string) error {
-	q := `
+// If the cycle limits how many open requests a reviewer can receive or a requester can send, a RequestCapError is returned
+// once the limit is reached. If the cycle requires manager approval, the request waits for the user's manager to approve
+// it before the reviewer sees it, and users without a manager get ErrNoManager. ErrUserInactive is returned if either user has been deactivated,
+// ErrUserNotFound if either does not exist, ErrSelfRequest if they are the same user, and ErrDuplicateRequest if the
+// requester already has an open request (pending approval, pending, or accepted) to the reviewer this cycle.
+// The request can ask the reviewer a question with prompt, which can be empty. The new request's id is returned.
+func SetUserReviewer(db *sql.DB, userEmail string, eligibleReviewer string, cycle string, prompt string) (id int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to begin tx for SetUserReviewer")
+	}
+
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on SetUserReviewer")
+		}
+	}()
+
+	var reviewerCap, requesterCap int
+	var requireApproval bool
+	q := "select max_requests_per_reviewer, max_requests_per_requester, require_manager_approval from review_cycles where name=? limit 1"
+	err = tx.QueryRow(q, cycle).Scan(&reviewerCap, &requesterCap, &requireApproval)
+	if err == sql.ErrNoRows {
+		return 0, ErrCycleNotFound
+	} else if err != nil {
+		return 0, errors.Wrap(err, "unable to look up cycle limits in SetUserReviewer")
+	}
+
+	if strings.EqualFold(userEmail, eligibleReviewer) {
+		return 0, ErrSelfRequest
+	}
+
+	var found, inactive int
+	q = "select count(*), coalesce(sum(is_active=0), 0) from users where email in (?, ?)"
+	if err = tx.QueryRow(q, userEmail, eligibleReviewer).Scan(&found, &inactive); err != nil {
+		return 0, errors.Wrap(err, "unable to look up whether users are active in SetUserReviewer")
+	}
+	if found < 2 {
+		return 0, ErrUserNotFound
+	}
+	if inactive > 0 {
+		return 0, ErrUserInactive
+	}
+
+	var open int
+	q = `
+    SELECT count(*)
+    FROM   review_requests
+    WHERE  recipient_id = (SELECT id
+                           FROM   users
+                           WHERE  email = ?
+                           LIMIT  1)
+           AND reviewer_id = (SELECT id
+                              FROM   users
+                              WHERE  email = ?
+                              LIMIT  1)
+           AND cycle_id = (SELECT id
+                           FROM   review_cycles
+                           WHERE  name = ?
+                           LIMIT  1)
+           AND status IN (?, ?, ?)
+    `
+	if err = tx.QueryRow(q, userEmail, eligibleReviewer, cycle, requestPendingApproval, requestPending, requestAccepted).Scan(&open); err != nil {
+		return 0, errors.Wrap(err, "unable to look up open requests in SetUserReviewer")
+	}
+	if open > 0 {
+		return 0, ErrDuplicateRequest
+	}
+
+	if reviewerCap > 0 {
+		n, err := countOpenRequests(tx, "reviewer_id", eligibleReviewer, cycle)
+		if err != nil {
+			return 0, err
+		}
+		if n >= reviewerCap {
+			return 0, RequestCapError{Cycle: cycle, Email: eligibleReviewer, Limit: reviewerCap, IsReviewer: true}
+		}
+	}
+	if requesterCap > 0 {
+		n, err := countOpenRequests(tx, "recipient_id", userEmail, cycle)
+		if err != nil {
+			return 0, err
+		}
+		if n >= requesterCap {
+			return 0, RequestCapError{Cycle: cycle, Email: userEmail, Limit: requesterCap}
+		}
+	}
+
+	status := requestPending
+	if requireApproval {
+		var hasManager bool
+		err = tx.QueryRow("select manager_id is not null from users where email=? limit 1", userEmail).Scan(&hasManager)
+		if err != nil {
+			return 0, errors.Wrap(err, "unable to look up manager in SetUserReviewer")
+		}
+		// without a manager nobody could approve the request, and skipping approval would defeat it
+		if !hasManager {
+			return 0, ErrNoManager
+		}
+		status = requestPendingApproval
+	}
+
+	promptID, err := addPrompt(tx, userEmail, cycle, prompt, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	q = `
     INSERT INTO review_requests
                 (recipient_id,
                 reviewer_id,
-                cycle_id)
+                cycle_id,
+                status,
+                prompt_id)
     VALUES      ((SELECT id
                 FROM   users
                 WHERE  email =?
@@ -247,16 +651,68 @@ func SetUserReviewer(db *sql.DB, userEmail string, eligibleReviewer string, cycl
                 (SELECT id
                 FROM   review_cycles
                 WHERE  name =?
-                LIMIT  1))
+                LIMIT  1),
+                ?,
+                ?)
     `
-	if _, err := db.Exec(q, userEmail, eligibleReviewer, cycle); err != nil {
-		return errors.Wrap(err, "unable to set review request in SetUserReviewer")
+	res, err := tx.Exec(q, userEmail, eligibleReviewer, cycle, status, promptID)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to set review request in SetUserReviewer")
 	}
-	return nil
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to get review request id in SetUserReviewer")
+	}
+	return int(lastID), nil
+}
+
+// RequestCapError is returned when a review request would go over one of the cycle's request limits
+type RequestCapError struct {
+	Cycle string
+	Email string
+	Limit int
+	// IsReviewer is true when the reviewer's limit was reached and false when the requester's limit was reached
+	IsReviewer bool
+}
+
+func (e RequestCapError) Error() string {
+	if e.IsReviewer {
+		return fmt.Sprintf("%s already has %d open review requests in %s, which is the most a reviewer can receive this cycle", e.Email, e.Limit, e.Cycle)
+	}
+	return fmt.Sprintf("%s already has %d open review requests in %s, which is the most a requester can send this cycle", e.Email, e.Limit, e.Cycle)
+}
+
+// countOpenRequests counts the requests awaiting approval, pending and accepted in a cycle for the user in the given column (reviewer_id or recipient_id).
+// Each person on the other side of the requests is counted once, so one requester can not use up a reviewer's limit alone.
+func countOpenRequests(tx *sql.Tx, column string, email string, cycle string) (int, error) {
+	other := "recipient_id"
+	if column == "recipient_id" {
+		other = "reviewer_id"
+	}
+	// column and other are never user input; they are our own column names
+	q := fmt.Sprintf(`
+    SELECT count(DISTINCT %s)
+    FROM   review_requests
+    WHERE  %s = (SELECT id
+                 FROM   users
+                 WHERE  email = ?
+                 LIMIT  1)
+           AND cycle_id = (SELECT id
+                           FROM   review_cycles
+                           WHERE  name = ?
+                           LIMIT  1)
+           AND status IN (?, ?, ?)
+    `, other, column)
+	var n int
+	if err := tx.QueryRow(q, email, cycle, requestPendingApproval, requestPending, requestAccepted).Scan(&n); err != nil {
+		return 0, errors.Wrap(err, "unable to count open review requests")
+	}
+	return n, nil
 }
 
 // GetReviewees returns a list of people for which a given user can enter a review.
 // This is the user's team and any any person who has requested a review in the current cycle.
+// Requests that were declined or withdrawn do not make the requester eligible, and deactivated users are never listed.
 func GetReviewees(db *sql.DB, email string, cycle string) ([]UserInfoLite, error) {
 	var uil []UserInfoLite
 	q := `
@@ -272,6 +728,7 @@ func GetReviewees(db *sql.DB, email string, cycle string) ([]UserInfoLite, error
                         WHERE  users.email = ?
                         )
 			    AND email <> ?
+			    AND users.is_active = 1
 	`
 
 	rows, err := db.Query(q, email, email)
@@ -294,16 +751,18 @@ func GetReviewees(db *sql.DB, email string, cycle string) ([]UserInfoLite, error
                users.email
         FROM   users
                JOIN review_requests
-                 ON reviewer_id = users.id
+                 ON recipient_id = users.id
                JOIN review_cycles
                  ON review_requests.cycle_id = review_cycles.id
-        WHERE  review_requests.recipient_id = (SELECT id
-                                               FROM   users
-                                               WHERE  email =?
-                                              )
-               AND review_cycles.name =?;
+        WHERE  review_requests.reviewer_id = (SELECT id
+                                              FROM   users
+                                              WHERE  email =?
+                                             )
+               AND review_cycles.name =?
+               AND review_requests.status IN (?, ?)
+               AND users.is_active = 1;
     `
-	rows, err = db.Query(q, email, cycle)
+	rows, err = db.Query(q, email, cycle, requestPending, requestAccepted)
 	if err != nil {
 		return uil, errors.Wrap(err, "unable to query for reviewers in GetReviewees")
 	}
@@ -319,14 +778,328 @@ func GetReviewees(db *sql.DB, email string, cycle string) ([]UserInfoLite, error
 		return uil, errors.Wrap(err, "error post scan q2 in GetReviewees")
 	}
 
+	for i := range uil {
+		if uil[i].Goals, err = getActiveGoals(db, uil[i].Email, cycle); err != nil {
+			return uil, err
+		}
+		if uil[i].Prompts, err = getRequestPrompts(db, uil[i].Email, email, cycle); err != nil {
+			return uil, err
+		}
+	}
+
 	return uil, nil
 }
 
+// review request statuses. A request starts out pending and the reviewer can accept or decline it.
+// The requester can withdraw a request that has not been declined.
+// When a cycle requires manager approval, a request starts out pending approval and the requester's manager
+// approves it (making it pending) or rejects it. Reviewers do not see requests until they are approved.
+const (
+	requestPendingApproval = "pending_approval"
+	requestPending         = "pending"
+	requestAccepted        = "accepted"
+	requestDeclined        = "declined"
+	requestWithdrawn       = "withdrawn"
+	requestRejected        = "rejected"
+)
+
+// conditions for transitionReviewRequest limiting which user can act on a request. Each takes the acting user's email.
+const (
+	ownedByReviewer          = "reviewer_id = (SELECT id FROM users WHERE email = ? LIMIT 1)"
+	ownedByRequester         = "recipient_id = (SELECT id FROM users WHERE email = ? LIMIT 1)"
+	ownedByRequestersManager = "recipient_id IN (SELECT id FROM users WHERE manager_id = (SELECT id FROM users WHERE email = ? LIMIT 1))"
+)
+
+// ErrRequestNotFound is returned when a review request does not exist or does not belong to the acting user
+var ErrRequestNotFound = errors.New("review request not found")
+
+// ErrRequestState is returned when a review request cannot move to the requested status from its current status
+var ErrRequestState = errors.New("review request cannot change to that status")
+
+// ReviewRequest describes a request from a requester (the person to be reviewed) for a reviewer's feedback during a cycle
+type ReviewRequest struct {
+	ID             int    `json:"id"`
+	Cycle          string `json:"cycle"`
+	RequesterName  string `json:"requester_name"`
+	RequesterEmail string `json:"requester_email"`
+	ReviewerName   string `json:"reviewer_name"`
+	ReviewerEmail  string `json:"reviewer_email"`
+	Status         string `json:"status"`
+	DeclineReason  string `json:"decline_reason"`
+	// Prompt is the question the requester asked the reviewer, if any
+	Prompt string `json:"prompt,omitempty"`
+}
+
+// GetReviewRequests returns the requests a user has received as a reviewer (incoming) and sent as a requester (outgoing).
+// If cycle is empty, requests from all cycles are returned.
+func GetReviewRequests(db *sql.DB, email string, cycle string) ([]ReviewRequest, []ReviewRequest, error) {
+	q := `
+    SELECT review_requests.id,
+           review_cycles.name,
+           requester.name,
+           requester.email,
+           reviewer.name,
+           reviewer.email,
+           review_requests.status,
+           review_requests.decline_reason,
+           coalesce(prompts.text, "")
+    FROM   review_requests
+           JOIN users requester
+             ON review_requests.recipient_id = requester.id
+           JOIN users reviewer
+             ON review_requests.reviewer_id = reviewer.id
+           JOIN review_cycles
+             ON review_requests.cycle_id = review_cycles.id
+           LEFT JOIN prompts
+                  ON review_requests.prompt_id = prompts.id
+    WHERE  ( requester.email = ?
+              OR reviewer.email = ? )
+           AND ( ? = ""
+                  OR review_cycles.name = ? )
+    ORDER  BY review_requests.id;
+    `
+	rows, err := db.Query(q, email, email, cycle, cycle)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to query GetReviewRequests")
+	}
+	defer rows.Close()
+
+	var incoming, outgoing []ReviewRequest
+	for rows.Next() {
+		var rr ReviewRequest
+		if err = rows.Scan(&rr.ID, &rr.Cycle, &rr.RequesterName, &rr.RequesterEmail, &rr.ReviewerName, &rr.ReviewerEmail, &rr.Status, &rr.DeclineReason, &rr.Prompt); err != nil {
+			return nil, nil, errors.Wrap(err, "unable to scan GetReviewRequests")
+		}
+		if rr.Prompt, err = decryptField(rr.Prompt); err != nil {
+			return nil, nil, errors.Wrap(err, "unable to decrypt prompt in GetReviewRequests")
+		}
+		// reviewers only see requests once a manager approved them
+		if strings.EqualFold(rr.ReviewerEmail, email) && rr.Status != requestPendingApproval && rr.Status != requestRejected {
+			incoming = append(incoming, rr)
+		}
+		if strings.EqualFold(rr.RequesterEmail, email) {
+			outgoing = append(outgoing, rr)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, "error post scan in GetReviewRequests")
+	}
+	return incoming, outgoing, nil
+}
+
+// GetReviewRequest returns a single review request by id
+func GetReviewRequest(db *sql.DB, id int) (ReviewRequest, error) {
+	q := `
+    SELECT review_requests.id,
+           review_cycles.name,
+           requester.name,
+           requester.email,
+           reviewer.name,
+           reviewer.email,
+           review_requests.status,
+           review_requests.decline_reason,
+           coalesce(prompts.text, "")
+    FROM   review_requests
+           JOIN users requester
+             ON review_requests.recipient_id = requester.id
+           JOIN users reviewer
+             ON review_requests.reviewer_id = reviewer.id
+           JOIN review_cycles
+             ON review_requests.cycle_id = review_cycles.id
+           LEFT JOIN prompts
+                  ON review_requests.prompt_id = prompts.id
+    WHERE  review_requests.id = ?
+    `
+	var rr ReviewRequest
+	err := db.QueryRow(q, id).Scan(&rr.ID, &rr.Cycle, &rr.RequesterName, &rr.RequesterEmail, &rr.ReviewerName, &rr.ReviewerEmail, &rr.Status, &rr.DeclineReason, &rr.Prompt)
+	if err == sql.ErrNoRows {
+		return rr, ErrRequestNotFound
+	} else if err != nil {
+		return rr, errors.Wrap(err, "unable to query GetReviewRequest")
+	}
+	if rr.Prompt, err = decryptField(rr.Prompt); err != nil {
+		return rr, errors.Wrap(err, "unable to decrypt prompt in GetReviewRequest")
+	}
+	return rr, nil
+}
+
+// AcceptReviewRequest marks a pending request as accepted by its reviewer
+func AcceptReviewRequest(db *sql.DB, id int, reviewerEmail string) error {
+	return transitionReviewRequest(db, id, ownedByReviewer, reviewerEmail, []string{requestPending}, requestAccepted, "")
+}
+
+// DeclineReviewRequest marks a pending or accepted request as declined by its reviewer. The reason is visible to the requester.
+func DeclineReviewRequest(db *sql.DB, id int, reviewerEmail string, reason string) error {
+	return transitionReviewRequest(db, id, ownedByReviewer, reviewerEmail, []string{requestPending, requestAccepted}, requestDeclined, reason)
+}
+
+// WithdrawReviewRequest allows the requester to take back a request that has not been declined or rejected
+func WithdrawReviewRequest(db *sql.DB, id int, requesterEmail string) error {
+	return transitionReviewRequest(db, id, ownedByRequester, requesterEmail, []string{requestPendingApproval, requestPending, requestAccepted}, requestWithdrawn, "")
+}
+
+// ApproveReviewRequest allows a manager to approve a request from one of their reports. The reviewer can then see it.
+func ApproveReviewRequest(db *sql.DB, id int, managerEmail string) error {
+	return transitionReviewRequest(db, id, ownedByRequestersManager, managerEmail, []string{requestPendingApproval}, requestPending, "")
+}
+
+// RejectReviewRequest allows a manager to reject a request from one of their reports. The reason is visible to the requester.
+func RejectReviewRequest(db *sql.DB, id int, managerEmail string, reason string) error {
+	return transitionReviewRequest(db, id, ownedByRequestersManager, managerEmail, []string{requestPendingApproval}, requestRejected, reason)
+}
+
+// GetApprovalQueue returns the requests from a manager's reports that are waiting for the manager's approval
+func GetApprovalQueue(db *sql.DB, managerEmail string) ([]ReviewRequest, error) {
+	q := `
+    SELECT review_requests.id,
+           review_cycles.name,
+           requester.name,
+           requester.email,
+           reviewer.name,
+           reviewer.email,
+           review_requests.status,
+           review_requests.decline_reason,
+           coalesce(prompts.text, "")
+    FROM   review_requests
+           JOIN users requester
+             ON review_requests.recipient_id = requester.id
+           JOIN users reviewer
+             ON review_requests.reviewer_id = reviewer.id
+           JOIN review_cycles
+             ON review_requests.cycle_id = review_cycles.id
+           LEFT JOIN prompts
+                  ON review_requests.prompt_id = prompts.id
+    WHERE  requester.manager_id = (SELECT id
+                                   FROM   users
+                                   WHERE  email = ?
+                                   LIMIT  1)
+           AND review_requests.status = ?
+    ORDER  BY review_requests.id;
+    `
+	rows, err := db.Query(q, managerEmail, requestPendingApproval)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query GetApprovalQueue")
+	}
+	defer rows.Close()
+
+	var queue []ReviewRequest
+	for rows.Next() {
+		var rr ReviewRequest
+		if err = rows.Scan(&rr.ID, &rr.Cycle, &rr.RequesterName, &rr.RequesterEmail, &rr.ReviewerName, &rr.ReviewerEmail, &rr.Status, &rr.DeclineReason, &rr.Prompt); err != nil {
+			return nil, errors.Wrap(err, "unable to scan GetApprovalQueue")
+		}
+		if rr.Prompt, err = decryptField(rr.Prompt); err != nil {
+			return nil, errors.Wrap(err, "unable to decrypt prompt in GetApprovalQueue")
+		}
+		queue = append(queue, rr)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetApprovalQueue")
+	}
+	return queue, nil
+}
+
+// transitionReviewRequest moves a request to a new status. The owner condition (one of the ownedBy constants) must
+// match the acting user and the request must currently be in one of the from statuses.
+func transitionReviewRequest(db *sql.DB, id int, owner string, email string, from []string, to string, reason string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for transitionReviewRequest")
+	}
+
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on transitionReviewRequest")
+		}
+	}()
+
+	// owner is never user input; it is one of the ownedBy constants
+	q := fmt.Sprintf(`
+    SELECT status
+    FROM   review_requests
+    WHERE  id = ?
+           AND %s
+    `, owner)
+	var status string
+	err = tx.QueryRow(q, id, email).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrRequestNotFound
+	} else if err != nil {
+		return errors.Wrap(err, "unable to look up review request")
+	}
+	if !inList(status, from) {
+		return errors.Wrapf(ErrRequestState, "request is %s", status)
+	}
+
+	if _, err = tx.Exec("update review_requests set status=?, decline_reason=? where id=?", to, reason, id); err != nil {
+		return errors.Wrap(err, "unable to update review request status")
+	}
+	return nil
+}
+
 // Review holds the information needed for displaying reviews
 type Review struct {
 	Cycle         string   `json:"cycle"`
 	Strengths     []string `json:"strengths"`
 	Opportunities []string `json:"growth_opportunities"`
+	// Goals groups the feedback that is about one of the reviewee's goals, and Prompts the feedback answering one of
+	// their prompts. Strengths and Opportunities hold the rest.
+	Goals   []GoalFeedback   `json:"goals,omitempty"`
+	Prompts []PromptFeedback `json:"prompts,omitempty"`
+	// PurgedStrengths and PurgedOpportunities count feedback whose text was removed by the retention policy, or when the
+	// reviewee was deactivated
+	PurgedStrengths     int `json:"purged_strengths,omitempty"`
+	PurgedOpportunities int `json:"purged_growth_opportunities,omitempty"`
+}
+
+// GoalFeedback is the feedback about one goal
+type GoalFeedback struct {
+	GoalID        int      `json:"goal_id"`
+	Title         string   `json:"title"`
+	Status        string   `json:"status"`
+	Strengths     []string `json:"strengths"`
+	Opportunities []string `json:"growth_opportunities"`
+}
+
+// FeedbackItem is a strength or growth opportunity being submitted, optionally about one of the reviewee's goals or
+// answering one of their prompts, but not both. In json it is either the feedback text or
+// {"text":$text, "goal_id":int} or {"text":$text, "prompt_id":int}.
+type FeedbackItem struct {
+	Text     string `json:"text"`
+	GoalID   int    `json:"goal_id,omitempty"`
+	PromptID int    `json:"prompt_id,omitempty"`
+}
+
+// UnmarshalJSON accepts a string or an object
+func (f *FeedbackItem) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*f = FeedbackItem{Text: text}
+		return nil
+	}
+	// plain has no UnmarshalJSON, so this does not recurse
+	type plain FeedbackItem
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return errors.New(`feedback must be a string, {"text":"feedback", "goal_id":id}, or {"text":"feedback", "prompt_id":id}`)
+	}
+	*f = FeedbackItem(p)
+	return nil
+}
+
+// feedbackItems turns feedback text into items that are not about a goal
+func feedbackItems(texts []string) []FeedbackItem {
+	items := make([]FeedbackItem, 0, len(texts))
+	for _, text := range texts {
+		items = append(items, FeedbackItem{Text: text})
+	}
+	return items
 }
 
 // GetUserReviews gets all the reviews for a user
@@ -335,7 +1108,10 @@ func GetUserReviews(db *sql.DB, email string) ([]Review, error) {
     SELECT review_cycles.name,
            reviews.feedback,
            reviews.is_strength,
-           reviews.is_growth_opportunity
+           reviews.is_growth_opportunity,
+           reviews.purged_at IS NOT NULL,
+           reviews.goal_id,
+           reviews.prompt_id
     FROM   reviews
            JOIN users
              ON reviews.recipient_id = users.id
@@ -343,6 +1119,11 @@ func GetUserReviews(db *sql.DB, email string) ([]Review, error) {
              ON review_cycles.id = reviews.review_cycle_id
     WHERE  users.email = ?;
     `
+	// answers to prompts too few reviewers answered stay in Strengths and Opportunities, see groupedPrompts
+	grouped, err := groupedPrompts(db, email)
+	if err != nil {
+		return nil, err
+	}
 	rows, err := db.Query(q, email)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to query reviews")
@@ -355,16 +1136,69 @@ func GetUserReviews(db *sql.DB, email string) ([]Review, error) {
 	// m allows for easier record keeping as we scan multiple rows back
 	// it will be read into the reviews slice after we've collected all feedback
 	m := make(map[string]Review)
+	// byGoal is the feedback about goals, by cycle and then goal id. byPrompt is the same for prompts.
+	byGoal := make(map[string]map[int]*GoalFeedback)
+	byPrompt := make(map[string]map[int]*PromptFeedback)
 
 	for rows.Next() {
 		var cycleName, feedback string
-		var isStrength, isOpportunity bool
+		var isStrength, isOpportunity, purged bool
+		var goalID, promptID sql.NullInt64
 		// might have to read in int and treat as bool
-		if err = rows.Scan(&cycleName, &feedback, &isStrength, &isOpportunity); err != nil {
+		if err = rows.Scan(&cycleName, &feedback, &isStrength, &isOpportunity, &purged, &goalID, &promptID); err != nil {
 			return nil, errors.Wrap(err, "unable to scan reviews")
 		}
 		r := m[cycleName]
 		r.Cycle = cycleName
+		if purged {
+			if isStrength {
+				r.PurgedStrengths++
+			}
+			if isOpportunity {
+				r.PurgedOpportunities++
+			}
+			m[cycleName] = r
+			continue
+		}
+		if feedback, err = decryptField(feedback); err != nil {
+			return nil, errors.Wrap(err, "unable to decrypt review")
+		}
+		if goalID.Valid {
+			if byGoal[cycleName] == nil {
+				byGoal[cycleName] = make(map[int]*GoalFeedback)
+			}
+			g := byGoal[cycleName][int(goalID.Int64)]
+			if g == nil {
+				g = &GoalFeedback{GoalID: int(goalID.Int64)}
+				byGoal[cycleName][g.GoalID] = g
+			}
+			if isStrength {
+				g.Strengths = append(g.Strengths, feedback)
+			}
+			if isOpportunity {
+				g.Opportunities = append(g.Opportunities, feedback)
+			}
+			m[cycleName] = r
+			continue
+		}
+		if promptID.Valid && grouped[int(promptID.Int64)] {
+			if byPrompt[cycleName] == nil {
+				byPrompt[cycleName] = make(map[int]*PromptFeedback)
+			}
+			p := byPrompt[cycleName][int(promptID.Int64)]
+			if p == nil {
+				p = &PromptFeedback{PromptID: int(promptID.Int64)}
+				byPrompt[cycleName][p.PromptID] = p
+			}
+			if isStrength {
+				p.Strengths = append(p.Strengths, feedback)
+			}
+			if isOpportunity {
+				p.Opportunities = append(p.Opportunities, feedback)
+			}
+			m[cycleName] = r
+			continue
+		}
 		if isStrength {
 			r.Strengths = append(r.Strengths, feedback)
 		}
@@ -377,6 +1211,41 @@ func GetUserReviews(db *sql.DB, email string) ([]Review, error) {
 		return nil, errors.Wrap(err, "error post scan in GetUserReviews")
 	}
 
+	if len(byGoal) > 0 {
+		goals, err := GetGoals(db, email, "")
+		if err != nil {
+			return nil, err
+		}
+		// goals are oldest first, so feedback is grouped in the order the goals were set
+		for cycleName, feedback := range byGoal {
+			r := m[cycleName]
+			for _, goal := range goals {
+				if g, ok := feedback[goal.ID]; ok {
+					g.Title = goal.Title
+					g.Status = goal.Status
+					r.Goals = append(r.Goals, *g)
+				}
+			}
+			m[cycleName] = r
+		}
+	}
+	if len(byPrompt) > 0 {
+		prompts, err := getPrompts(db, email)
+		if err != nil {
+			return nil, err
+		}
+		for cycleName, feedback := range byPrompt {
+			r := m[cycleName]
+			for _, prompt := range prompts {
+				if p, ok := feedback[prompt.ID]; ok {
+					p.Prompt = prompt.Text
+					r.Prompts = append(r.Prompts, *p)
+				}
+			}
+			m[cycleName] = r
+		}
+	}
+
 	for _, v := range m {
 		reviews = append(reviews, v)
 	}
@@ -387,13 +1256,81 @@ func GetUserReviews(db *sql.DB, email string) ([]Review, error) {
 // AddUserReview inserts a new review into the system for a given cycle for the given recipient
 // Note that there is no link to the reviewer. This ensures that we have anonymous feedback.
 func AddUserReview(db *sql.DB, revieweeEmail string, strengths []string, opportunities []string, cycle string) error {
+	return AddUserReviewItems(db, "", revieweeEmail, feedbackItems(strengths), feedbackItems(opportunities), cycle)
+}
+
+// AddUserReviewItems is AddUserReview for feedback that can be about the reviewee's goals or answer their prompts. Every
+// goal must be one of the reviewee's active goals for cycle, the ones reviewers are shown, or ErrInvalidGoal is returned,
+// and every prompt must have been asked of reviewerEmail in an open request from the reviewee during cycle, or
+// ErrInvalidPrompt is returned. Nothing is added on error. reviewerEmail is only used for prompts, and is not stored
+// with the feedback. Answers to a prompt asked of too few reviewers are stored as plain feedback, see prompts.go.
+func AddUserReviewItems(db *sql.DB, reviewerEmail string, revieweeEmail string, strengths []FeedbackItem, opportunities []FeedbackItem, cycle string) error {
+	var activeGoals map[int]bool
+	answered := make(map[int]bool)
+	for _, item := range append(append([]FeedbackItem(nil), strengths...), opportunities...) {
+		if item.PromptID != 0 {
+			if item.GoalID != 0 {
+				return errors.Wrap(ErrInvalidPrompt, "feedback can be about a goal or answer a prompt, not both")
+			}
+			if !answered[item.PromptID] {
+				if err := checkPrompt(db, reviewerEmail, revieweeEmail, cycle, item.PromptID); err != nil {
+					return err
+				}
+			}
+			answered[item.PromptID] = true
+		}
+		if item.GoalID == 0 {
+			continue
+		}
+		if activeGoals == nil {
+			goals, err := getActiveGoals(db, revieweeEmail, cycle)
+			if err != nil {
+				return err
+			}
+			activeGoals = make(map[int]bool)
+			for _, goal := range goals {
+				activeGoals[goal.ID] = true
+			}
+		}
+		if !activeGoals[item.GoalID] {
+			return errors.Wrapf(ErrInvalidGoal, "goal %d is not one of the reviewee's active goals this cycle", item.GoalID)
+		}
+	}
+
+	// answered is narrowed to the prompts whose answers can be stored as answers
+	for id := range answered {
+		enough, err := promptAskedOfEnough(db, id)
+		if err != nil {
+			return err
+		}
+		if !enough {
+			delete(answered, id)
+		}
+	}
+	storedPromptID := func(id int) sql.NullInt64 {
+		if !answered[id] {
+			id = 0
+		}
+		return promptIDOrNull(id)
+	}
+	// answers are counted once per reviewer, with their first submission for the reviewee
+	submitted := false
+	if len(answered) > 0 {
+		var err error
+		if submitted, err = hasSubmitted(db, reviewerEmail, revieweeEmail, cycle); err != nil {
+			return err
+		}
+	}
+
 	q := `
     INSERT INTO reviews
             (recipient_id,
              review_cycle_id,
              feedback,
              is_strength,
-             is_growth_opportunity)
+             is_growth_opportunity,
+             goal_id,
+             prompt_id)
     VALUES  ((SELECT id
               FROM   users
               WHERE  email =?
@@ -403,43 +1340,78 @@ func AddUserReview(db *sql.DB, revieweeEmail string, strengths []string, opportu
               WHERE  name =? ),
              ?,
              ?,
+             ?,
+             ?,
              ?) ;
     `
 	// could make some uber query, but it is just easier to iterate
 	for _, strength := range strengths {
-		if _, err := db.Exec(q, revieweeEmail, cycle, strength, true, false); err != nil {
+		text, err := encryptField(strength.Text)
+		if err != nil {
+			return errors.Wrap(err, "unable to encrypt strength")
+		}
+		if _, err := db.Exec(q, revieweeEmail, cycle, text, true, false, goalIDOrNull(strength.GoalID), storedPromptID(strength.PromptID)); err != nil {
 			return errors.Wrap(err, "unable to insert strengths in reviews")
 		}
 	}
 	for _, opportunity := range opportunities {
-		if _, err := db.Exec(q, revieweeEmail, cycle, opportunity, false, true); err != nil {
+		text, err := encryptField(opportunity.Text)
+		if err != nil {
+			return errors.Wrap(err, "unable to encrypt opportunity")
+		}
+		if _, err := db.Exec(q, revieweeEmail, cycle, text, false, true, goalIDOrNull(opportunity.GoalID), storedPromptID(opportunity.PromptID)); err != nil {
 			return errors.Wrap(err, "unable to insert opportunity in reviews")
 		}
 	}
-	return nil
+	if submitted {
+		return nil
+	}
+	return countPromptAnswers(db, answered)
 }
 
-// Cycle holds basic info about a cycle (name / is open)
+// Cycle holds basic info about a cycle (name / is open) and its settings
 type Cycle struct {
-	Name   string `json:"name"`
-	IsOpen bool   `json:"is_open"`
+	Name                    string `json:"name"`
+	IsOpen                  bool   `json:"is_open"`
+	MaxRequestsPerReviewer  int    `json:"max_requests_per_reviewer"`
+	MaxRequestsPerRequester int    `json:"max_requests_per_requester"`
+	RequireManagerApproval  bool   `json:"require_manager_approval"`
+	// ClosesAt is when the cycle is expected to close. It drives "closing soon" notifications.
+	ClosesAt *time.Time `json:"closes_at,omitempty"`
+	// CreatedAt is when the cycle was added. Retention is measured from it.
+	CreatedAt time.Time `json:"created_at"`
 }
 
+// ErrCycleNotFound is returned when acting on a cycle that does not exist
+var ErrCycleNotFound = errors.New("cycle not found")
+
+// ErrTeamNotFound is returned when acting on a team that does not exist
+var ErrTeamNotFound = errors.New("team not found")
+
 // GetCycles returns all cycles
 func GetCycles(db *sql.DB) ([]Cycle, error) {
 	var cycles []Cycle
-	q := `select name, is_open from review_cycles`
+	q := `select name, is_open, max_requests_per_reviewer, max_requests_per_requester, require_manager_approval, closes_at, created_at from review_cycles`
 	rows, err := db.Query(q)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to query review cycles")
 	}
 	for rows.Next() {
-		var name string
-		var isOpen bool
-		if err = rows.Scan(&name, &isOpen); err != nil {
+		var c Cycle
+		var closesAt sql.NullString
+		var createdAt int64
+		if err = rows.Scan(&c.Name, &c.IsOpen, &c.MaxRequestsPerReviewer, &c.MaxRequestsPerRequester, &c.RequireManagerApproval, &closesAt, &createdAt); err != nil {
 			return nil, errors.Wrap(err, "unable to scan review cycles")
 		}
-		cycles = append(cycles, Cycle{Name: name, IsOpen: isOpen})
+		c.CreatedAt = time.Unix(createdAt, 0).UTC()
+		if closesAt.Valid {
+			t, err := time.Parse(time.RFC3339, closesAt.String)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to parse closes_at for cycle %s", c.Name)
+			}
+			c.ClosesAt = &t
+		}
+		cycles = append(cycles, c)
 	}
 	if rows.Err() != nil {
 		return cycles, errors.Wrap(rows.Err(), "error post scan in GetCycles")
@@ -447,6 +1419,119 @@ func GetCycles(db *sql.DB) ([]Cycle, error) {
 	return cycles, nil
 }
 
+// GetCycle returns a single cycle by name
+func GetCycle(db *sql.DB, cycleName string) (Cycle, error) {
+	cycles, err := GetCycles(db)
+	if err != nil {
+		return Cycle{}, err
+	}
+	for _, cycle := range cycles {
+		if cycle.Name == cycleName {
+			return cycle, nil
+		}
+	}
+	return Cycle{}, ErrCycleNotFound
+}
+
+// CycleSettings are the adjustable settings of a cycle. Nil fields are left unchanged when updating.
+// A limit of zero means there is no limit.
+type CycleSettings struct {
+	MaxRequestsPerReviewer  *int       `json:"max_requests_per_reviewer"`
+	MaxRequestsPerRequester *int       `json:"max_requests_per_requester"`
+	RequireManagerApproval  *bool      `json:"require_manager_approval"`
+	ClosesAt                *time.Time `json:"closes_at"`
+}
+
+// UpdateCycleSettings changes the non-nil settings of a cycle
+func UpdateCycleSettings(db *sql.DB, cycleName string, settings CycleSettings) error {
+	var sets []string
+	var args []interface{}
+	if settings.MaxRequestsPerReviewer != nil {
+		sets = append(sets, "max_requests_per_reviewer=?")
+		args = append(args, *settings.MaxRequestsPerReviewer)
+	}
+	if settings.MaxRequestsPerRequester != nil {
+		sets = append(sets, "max_requests_per_requester=?")
+		args = append(args, *settings.MaxRequestsPerRequester)
+	}
+	if settings.RequireManagerApproval != nil {
+		sets = append(sets, "require_manager_approval=?")
+		args = append(args, bool2int(*settings.RequireManagerApproval))
+	}
+	if settings.ClosesAt != nil {
+		// moving the close date means people should hear about the new one
+		sets = append(sets, "closes_at=?", "closing_notice_sent=0")
+		args = append(args, settings.ClosesAt.UTC().Format(time.RFC3339))
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	args = append(args, cycleName)
+	q := "update review_cycles set " + strings.Join(sets, ", ") + " where name=?"
+	res, err := db.Exec(q, args...)
+	if err != nil {
+		return errors.Wrap(err, "unable to update cycle settings")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "unable to determine updated cycles")
+	} else if n == 0 {
+		return ErrCycleNotFound
+	}
+	return nil
+}
+
+// RequestedReviewer is a reviewer and how often they were asked for feedback during a cycle
+type RequestedReviewer struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Requests int    `json:"requests"`
+	Pending  int    `json:"pending"`
+	Accepted int    `json:"accepted"`
+	Declined int    `json:"declined"`
+}
+
+// GetMostRequestedReviewers returns up to limit reviewers with the most review requests in a cycle, most requested first.
+// Withdrawn and rejected requests are not counted.
+func GetMostRequestedReviewers(db *sql.DB, cycleName string, limit int) ([]RequestedReviewer, error) {
+	q := `
+    SELECT users.name,
+           users.email,
+           count(*),
+           sum(review_requests.status = ?),
+           sum(review_requests.status = ?),
+           sum(review_requests.status = ?)
+    FROM   review_requests
+           JOIN users
+             ON review_requests.reviewer_id = users.id
+           JOIN review_cycles
+             ON review_requests.cycle_id = review_cycles.id
+    WHERE  review_cycles.name = ?
+           AND review_requests.status NOT IN (?, ?)
+    GROUP  BY users.id
+    ORDER  BY count(*) DESC,
+              users.email
+    LIMIT  ?;
+    `
+	rows, err := db.Query(q, requestPending, requestAccepted, requestDeclined, cycleName, requestWithdrawn, requestRejected, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query GetMostRequestedReviewers")
+	}
+	defer rows.Close()
+
+	var reviewers []RequestedReviewer
+	for rows.Next() {
+		var rr RequestedReviewer
+		if err = rows.Scan(&rr.Name, &rr.Email, &rr.Requests, &rr.Pending, &rr.Accepted, &rr.Declined); err != nil {
+			return nil, errors.Wrap(err, "unable to scan GetMostRequestedReviewers")
+		}
+		reviewers = append(reviewers, rr)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetMostRequestedReviewers")
+	}
+	return reviewers, nil
+}
+
 // AddCycle adds it if it does not yet exist
 func AddCycle(db *sql.DB, cycleName string) error {
 	cycles, err := GetCycles(db)
@@ -463,8 +1548,8 @@ func AddCycle(db *sql.DB, cycleName string) error {
 	if found {
 		return nil
 	}
-	q := "insert into review_cycles (name, is_open) values (?, ?)"
-	if _, err := db.Exec(q, cycleName, true); err != nil {
+	q := "insert into review_cycles (name, is_open, created_at) values (?, ?, ?)"
+	if _, err := db.Exec(q, cycleName, true, time.Now().Unix()); err != nil {
 		return errors.Wrap(err, "unable to insert new review cycle")
 	}
 	return nil
@@ -496,7 +1581,12 @@ func DeleteCycle(db *sql.DB, cycleName string) error {
 	if !found {
 		return nil
 	}
-	q := "delete from review_cycles where name=?"
+	// goals outlive their cycle
+	q := "update goals set cycle_id=NULL where cycle_id=(select id from review_cycles where name=?)"
+	if _, err := db.Exec(q, cycleName); err != nil {
+		return errors.Wrap(err, "unable to untie goals from review cycle")
+	}
+	q = "delete from review_cycles where name=?"
 	if _, err := db.Exec(q, cycleName, true); err != nil {
 		return errors.Wrap(err, "unable to delete review cycle")
 	}
@@ -524,6 +1614,37 @@ func GetTeams(db *sql.DB) ([]string, error) {
 	return teams, nil
 }
 
+// GetTeamMembers returns the emails of a team's members
+func GetTeamMembers(db *sql.DB, teamName string) ([]string, error) {
+	q := `
+    SELECT users.email
+    FROM   users
+           JOIN user_teams
+             ON user_teams.user_id = users.id
+           JOIN teams
+             ON user_teams.team_id = teams.id
+    WHERE  teams.name = ?
+    ORDER  BY users.email
+    `
+	rows, err := db.Query(q, teamName)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query GetTeamMembers")
+	}
+	defer rows.Close()
+	members := []string{}
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return nil, errors.Wrap(err, "unable to scan GetTeamMembers")
+		}
+		members = append(members, email)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetTeamMembers")
+	}
+	return members, nil
+}
+
 // AddTeam adds it if it does not yet exist
 func AddTeam(db *sql.DB, teamName string) error {
 	teams, err := GetTeams(db)
@@ -540,18 +1661,31 @@ func AddTeam(db *sql.DB, teamName string) error {
 	return nil
 }
 
-// DeleteTeam removes a Team. Due to foreign key constraints, it will fail if it is in use.
-func DeleteTeam(db *sql.DB, teamName string) error {
-	teams, err := GetTeams(db)
+// DeleteTeam removes a Team and its memberships
+func DeleteTeam(db *sql.DB, teamName string) (err error) {
+	tx, err := db.Begin()
 	if err != nil {
-		return errors.Wrap(err, "unable to get teams for comparison when deleting")
+		return errors.Wrap(err, "unable to begin tx for DeleteTeam")
 	}
-	if !inList(teamName, teams) {
-		// if it is not there, don't need to delete it
-		return nil
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on DeleteTeam")
+		}
+	}()
+
+	// if it is not there, don't need to delete it
+	q := "delete from user_teams where team_id in (select id from teams where name=?)"
+	if _, err = tx.Exec(q, teamName); err != nil {
+		return errors.Wrap(err, "unable to delete team memberships")
 	}
-	q := "delete from teams where name=?"
-	if _, err := db.Exec(q, teamName, true); err != nil {
+	q = "delete from teams where name=?"
+	if _, err = tx.Exec(q, teamName); err != nil {
 		return errors.Wrap(err, "unable to delete review team")
 	}
 	return nil
@@ -572,6 +1706,12 @@ func verifyDB(db *sql.DB) error {
 	return nil
 }
 
+// OpenDB opens the sqlite db at path. Transactions take the write lock when they begin, so that background jobs writing
+// at the same time make a transaction wait its turn instead of failing with "database is locked" part way through.
+func OpenDB(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", "file:"+path+"?_txlock=immediate&_busy_timeout=5000")
+}
+
 // createDB initialized the schema. It also sets the schema version used for later validation when the service starts and the db already exists.
 func createDB(path string) error {
 	var db *sql.DB
@@ -596,12 +1736,20 @@ func createDB(path string) error {
     create table users (
 		id integer not null primary key,
 		name text not null default "",
-		email text not null,
-		goals text not null default ""
+		email text not null COLLATE NOCASE,
+		goals text not null default "",
+		manager_id integer,
+		email_opt_out boolean not null default 0,
+		is_admin boolean not null default 0,
+		is_active boolean not null default 1,
+		ldap_dn text,
+		calendar_token text UNIQUE,
+		FOREIGN KEY(manager_id) REFERENCES users(id)
 	);
     create table teams (
 		id integer not null primary key,
-		name text not null
+		name text not null,
+		ldap_dn text
 	);
     create table user_teams (
         id integer not null primary key,
@@ -613,7 +1761,13 @@ func createDB(path string) error {
     create table review_cycles (
 		id integer not null primary key,
 		name text not null,
-		is_open boolean not null
+		is_open boolean not null,
+		max_requests_per_reviewer integer not null default 0,
+		max_requests_per_requester integer not null default 0,
+		require_manager_approval boolean not null default 0,
+		closes_at text,
+		closing_notice_sent boolean not null default 0,
+		created_at integer not null
 	);
     create table reviews (
         id integer not null primary key,
@@ -622,18 +1776,153 @@ func createDB(path string) error {
         feedback text not null,
         is_strength boolean not null,
         is_growth_opportunity boolean not null,
+        purged_at integer,
+        goal_id integer,
+        prompt_id integer,
         FOREIGN KEY(recipient_id) REFERENCES users(id),
-        FOREIGN KEY(review_cycle_id) REFERENCES review_cycles(id)
+        FOREIGN KEY(review_cycle_id) REFERENCES review_cycles(id),
+        FOREIGN KEY(goal_id) REFERENCES goals(id),
+        FOREIGN KEY(prompt_id) REFERENCES prompts(id)
     );
     create table review_requests (
         id integer not null primary key,
         recipient_id integer not null,
         reviewer_id integer not null,
         cycle_id integer not null,
+        status text not null default "pending",
+        decline_reason text not null default "",
+        prompt_id integer,
         FOREIGN KEY (recipient_id) REFERENCES users(id),
         FOREIGN KEY (reviewer_id) REFERENCES users(id),
+        FOREIGN KEY (cycle_id) REFERENCES review_cycles(id),
+        FOREIGN KEY (prompt_id) REFERENCES prompts(id)
+    );
+    create table prompts (
+        id integer not null primary key,
+        recipient_id integer not null,
+        cycle_id integer not null,
+        text text not null,
+        created_at integer not null,
+        answers integer not null default 0,
+        FOREIGN KEY (recipient_id) REFERENCES users(id),
         FOREIGN KEY (cycle_id) REFERENCES review_cycles(id)
     );
+    create table jobs (
+        id integer not null primary key,
+        kind text not null,
+        payload text not null default "",
+        status text not null default "queued",
+        attempts integer not null default 0,
+        max_attempts integer not null default 5,
+        last_error text not null default "",
+        run_at integer not null,
+        created_at integer not null,
+        updated_at integer not null
+    );
+    create index jobs_status_run_at on jobs (status, run_at);
+    create table notifications (
+        id integer not null primary key,
+        user_id integer not null,
+        kind text not null,
+        message text not null,
+        cycle text not null default "",
+        created_at integer not null,
+        read_at integer,
+        FOREIGN KEY (user_id) REFERENCES users(id)
+    );
+    create index notifications_user_id on notifications (user_id, read_at);
+    create table sent_digests (
+        id integer not null primary key,
+        kind text not null,
+        recipient text not null,
+        cycle text not null default "",
+        period text not null,
+        sent_at integer not null,
+        UNIQUE (kind, recipient, cycle, period)
+    );
+    create table ldap_sync_runs (
+        id integer not null primary key,
+        started_at integer not null,
+        finished_at integer not null,
+        dry_run boolean not null default 0,
+        status text not null,
+        error text not null default "",
+        report text not null
+    );
+    create table retention_purges (
+        id integer not null primary key,
+        purged_at integer not null,
+        cutoff integer not null,
+        reviews_purged integer not null,
+        report text not null
+    );
+    create table audit_log (
+        id integer not null primary key,
+        created_at integer not null,
+        actor text not null,
+        action text not null,
+        target text not null,
+        before text not null,
+        after text not null,
+        request_id text not null,
+        ip text not null
+    );
+    create trigger audit_log_no_update before update on audit_log
+    begin
+        select raise(abort, 'audit_log is append only');
+    end;
+    create trigger audit_log_no_delete before delete on audit_log
+    begin
+        select raise(abort, 'audit_log is append only');
+    end;
+    create table chat_identities (
+        chat_user_id text not null primary key,
+        email text not null,
+        updated_at integer not null
+    );
+    create table webhooks (
+        id integer not null primary key,
+        url text not null,
+        secret text not null,
+        events text not null,
+        created_at integer not null
+    );
+    create table webhook_deliveries (
+        id integer not null primary key,
+        webhook_id integer not null,
+        event text not null,
+        payload text not null,
+        status text not null default "pending",
+        attempts integer not null default 0,
+        response_code integer not null default 0,
+        last_error text not null default "",
+        created_at integer not null,
+        delivered_at integer,
+        FOREIGN KEY (webhook_id) REFERENCES webhooks(id)
+    );
+    create table goals (
+        id integer not null primary key,
+        user_id integer not null,
+        title text not null,
+        description text not null default "",
+        status text not null default "active",
+        cycle_id integer,
+        created_at integer not null,
+        updated_at integer not null,
+        FOREIGN KEY (user_id) REFERENCES users(id),
+        FOREIGN KEY (cycle_id) REFERENCES review_cycles(id)
+    );
+    create index goals_user_id on goals (user_id, status);
+    create table review_submissions (
+        reviewer_id integer not null,
+        reviewee_id integer not null,
+        cycle_id integer not null,
+        submitted_on text not null,
+        PRIMARY KEY (reviewer_id, reviewee_id, cycle_id),
+        FOREIGN KEY (reviewer_id) REFERENCES users(id),
+        FOREIGN KEY (reviewee_id) REFERENCES users(id),
+        FOREIGN KEY (cycle_id) REFERENCES review_cycles(id)
+    ) WITHOUT ROWID;
     `
 	_, err = db.Exec(q, schemaVersion)
 	if err != nil {
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ A personal export is everything peerreview holds about a user, for when someone asks for their data. It is a zip with
+ the data as JSON and as a readable HTML page. Feedback is anonymous, so the export must not say who gave it: feedback
+ is sorted instead of kept in the order it was written, and the submissions ledger only appears for feedback the user
+ gave, never for feedback they received. Session keys and the calendar token are secrets and are left out.
+*/
+
+// PersonalExport is the data held about a user
+type PersonalExport struct {
+	ExportedAt       time.Time            `json:"exported_at"`
+	Profile          UserInfo             `json:"profile"`
+	Goals            []Goal               `json:"goals"`
+	FeedbackReceived []Review             `json:"feedback_received"`
+	FeedbackGiven    []ExportedSubmission `json:"feedback_given"`
+	RequestsSent     []ReviewRequest      `json:"review_requests_sent"`
+	RequestsReceived []ReviewRequest      `json:"review_requests_received"`
+	Notifications    []Notification       `json:"notifications"`
+	Sessions         []ExportedSession    `json:"sessions"`
+	ChatUserIDs      []string             `json:"chat_user_ids"`
+}
+
+// ExportedSubmission is a reviewee the user gave feedback to during a cycle. The feedback itself is anonymous and can not
+// be traced back to the user.
+type ExportedSubmission struct {
+	Cycle         string `json:"cycle"`
+	RevieweeName  string `json:"reviewee_name"`
+	RevieweeEmail string `json:"reviewee_email"`
+	SubmittedOn   string `json:"submitted_on"`
+}
+
+// ExportedSession is a signed in session
+type ExportedSession struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ExportUser gathers everything held about a user
+func ExportUser(db *sql.DB, email string, now time.Time) (PersonalExport, error) {
+	e := PersonalExport{ExportedAt: now.UTC()}
+	exists, err := UserExists(db, email)
+	if err != nil {
+		return e, err
+	}
+	if !exists {
+		return e, ErrUserNotFound
+	}
+
+	if e.Profile, err = GetUser(db, email); err != nil {
+		return e, err
+	}
+	if e.Goals, err = GetGoals(db, email, ""); err != nil {
+		return e, err
+	}
+
+	if e.FeedbackReceived, err = GetUserReviews(db, email); err != nil {
+		return e, err
+	}
+	sort.Slice(e.FeedbackReceived, func(i, j int) bool { return e.FeedbackReceived[i].Cycle < e.FeedbackReceived[j].Cycle })
+	for _, r := range e.FeedbackReceived {
+		sort.Strings(r.Strengths)
+		sort.Strings(r.Opportunities)
+		for _, g := range r.Goals {
+			sort.Strings(g.Strengths)
+			sort.Strings(g.Opportunities)
+		}
+		for _, p := range r.Prompts {
+			sort.Strings(p.Strengths)
+			sort.Strings(p.Opportunities)
+		}
+	}
+
+	if e.FeedbackGiven, err = getExportedSubmissions(db, email); err != nil {
+		return e, err
+	}
+	if e.RequestsReceived, e.RequestsSent, err = GetReviewRequests(db, email, ""); err != nil {
+		return e, err
+	}
+	// a negative limit is no limit
+	if e.Notifications, _, err = GetNotifications(db, email, false, -1); err != nil {
+		return e, err
+	}
+	for _, expires := range AuthExpirations(email) {
+		e.Sessions = append(e.Sessions, ExportedSession{ExpiresAt: expires.UTC()})
+	}
+	if e.ChatUserIDs, err = getChatUserIDs(db, email); err != nil {
+		return e, err
+	}
+	return e, nil
+}
+
+// getExportedSubmissions returns who a user gave feedback to, by cycle
+func getExportedSubmissions(db *sql.DB, email string) ([]ExportedSubmission, error) {
+	q := `
+    SELECT review_cycles.name,
+           reviewee.name,
+           reviewee.email,
+           review_submissions.submitted_on
+    FROM   review_submissions
+           JOIN users reviewee
+             ON review_submissions.reviewee_id = reviewee.id
+           JOIN review_cycles
+             ON review_submissions.cycle_id = review_cycles.id
+    WHERE  review_submissions.reviewer_id = (SELECT id
+                                             FROM   users
+                                             WHERE  email = ?
+                                             LIMIT  1)
+    ORDER  BY review_cycles.name,
+              reviewee.email
+    `
+	rows, err := db.Query(q, email)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query getExportedSubmissions")
+	}
+	defer rows.Close()
+	var submissions []ExportedSubmission
+	for rows.Next() {
+		var s ExportedSubmission
+		if err = rows.Scan(&s.Cycle, &s.RevieweeName, &s.RevieweeEmail, &s.SubmittedOn); err != nil {
+			return nil, errors.Wrap(err, "unable to scan getExportedSubmissions")
+		}
+		submissions = append(submissions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in getExportedSubmissions")
+	}
+	return submissions, nil
+}
+
+// getChatUserIDs returns the chat accounts matched to a user
+func getChatUserIDs(db *sql.DB, email string) ([]string, error) {
+	rows, err := db.Query("select chat_user_id from chat_identities where email=? order by chat_user_id", email)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query getChatUserIDs")
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "unable to scan getChatUserIDs")
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in getChatUserIDs")
+	}
+	return ids, nil
+}
+
+// WriteExportArchive writes an export as a zip holding data.json and data.html
+func WriteExportArchive(w io.Writer, e PersonalExport) error {
+	z := zip.NewWriter(w)
+
+	f, err := z.CreateHeader(&zip.FileHeader{Name: "data.json", Method: zip.Deflate, Modified: e.ExportedAt})
+	if err != nil {
+		return errors.Wrap(err, "unable to add data.json to export")
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(e); err != nil {
+		return errors.Wrap(err, "unable to write data.json to export")
+	}
+
+	f, err = z.CreateHeader(&zip.FileHeader{Name: "data.html", Method: zip.Deflate, Modified: e.ExportedAt})
+	if err != nil {
+		return errors.Wrap(err, "unable to add data.html to export")
+	}
+	if err = exportTemplate.Execute(f, e); err != nil {
+		return errors.Wrap(err, "unable to write data.html to export")
+	}
+
+	return errors.Wrap(z.Close(), "unable to finish export")
+}
+
+var exportTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Your peerreview data</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Your peerreview data</h1>
+<p>Exported {{.ExportedAt.Format "2006-01-02 15:04 MST"}}. Feedback is anonymous, so who gave it is not included.</p>
+
+<h2>Profile</h2>
+<table>
+<tr><th>Name</th><td>{{.Profile.Name}}</td></tr>
+<tr><th>Email</th><td>{{.Profile.Email}}</td></tr>
+<tr><th>Goal</th><td>{{.Profile.Goals}}</td></tr>
+<tr><th>Manager</th><td>{{.Profile.Manager}}</td></tr>
+<tr><th>Teams</th><td>{{range $i, $t := .Profile.Teams}}{{if $i}}, {{end}}{{$t}}{{end}}</td></tr>
+<tr><th>Admin</th><td>{{.Profile.IsAdmin}}</td></tr>
+<tr><th>Active</th><td>{{.Profile.IsActive}}</td></tr>
+<tr><th>Email opt out</th><td>{{.Profile.EmailOptOut}}</td></tr>
+{{range .ChatUserIDs}}<tr><th>Chat account</th><td>{{.}}</td></tr>
+{{end}}</table>
+
+<h2>Goals</h2>
+{{range .Goals}}<h3>{{.Title}}</h3>
+<p>{{.Status}}{{if .Cycle}} for {{.Cycle}}{{end}}, added {{.CreatedAt.Format "2006-01-02"}}, last changed {{.UpdatedAt.Format "2006-01-02"}}</p>
+{{if .Description}}<p>{{.Description}}</p>
+{{end}}{{else}}<p>None</p>
+{{end}}
+<h2>Feedback received</h2>
+{{range .FeedbackReceived}}<h3>{{.Cycle}}</h3>
+<h4>Strengths</h4>
+<ul>{{range .Strengths}}<li>{{.}}</li>{{end}}</ul>
+<h4>Growth opportunities</h4>
+<ul>{{range .Opportunities}}<li>{{.}}</li>{{end}}</ul>
+{{range .Goals}}<h4>About your goal: {{.Title}}</h4>
+<ul>{{range .Strengths}}<li>Strength: {{.}}</li>{{end}}{{range .Opportunities}}<li>Growth opportunity: {{.}}</li>{{end}}</ul>
+{{end}}{{range .Prompts}}<h4>You asked: {{.Prompt}}</h4>
+<ul>{{range .Strengths}}<li>Strength: {{.}}</li>{{end}}{{range .Opportunities}}<li>Growth opportunity: {{.}}</li>{{end}}</ul>
+{{end}}{{if or .PurgedStrengths .PurgedOpportunities}}<p>{{.PurgedStrengths}} strengths and {{.PurgedOpportunities}} growth opportunities were removed by the retention policy.</p>
+{{end}}{{else}}<p>None</p>
+{{end}}
+<h2>Feedback given</h2>
+<table>
+<tr><th>Cycle</th><th>To</th><th>Submitted on</th></tr>
+{{range .FeedbackGiven}}<tr><td>{{.Cycle}}</td><td>{{.RevieweeName}} &lt;{{.RevieweeEmail}}&gt;</td><td>{{.SubmittedOn}}</td></tr>
+{{end}}</table>
+
+<h2>Review requests sent</h2>
+<table>
+<tr><th>Cycle</th><th>Reviewer</th><th>Status</th><th>Prompt</th></tr>
+{{range .RequestsSent}}<tr><td>{{.Cycle}}</td><td>{{.ReviewerName}} &lt;{{.ReviewerEmail}}&gt;</td><td>{{.Status}}</td><td>{{.Prompt}}</td></tr>
+{{end}}</table>
+
+<h2>Review requests received</h2>
+<table>
+<tr><th>Cycle</th><th>From</th><th>Status</th><th>Prompt</th></tr>
+{{range .RequestsReceived}}<tr><td>{{.Cycle}}</td><td>{{.RequesterName}} &lt;{{.RequesterEmail}}&gt;</td><td>{{.Status}}</td><td>{{.Prompt}}</td></tr>
+{{end}}</table>
+
+<h2>Notifications</h2>
+<table>
+<tr><th>Sent</th><th>Message</th></tr>
+{{range .Notifications}}<tr><td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+
+<h2>Sessions</h2>
+<table>
+<tr><th>Expires</th></tr>
+{{range .Sessions}}<tr><td>{{.ExpiresAt.Format "2006-01-02 15:04 MST"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIUserExport(t *testing.T) {
+	/*
+		Verify the export is a zip of data.json and data.html with the user's profile, feedback, requests, and sessions
+		Verify nothing in it identifies who gave the user feedback, and session keys are left out
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, cli.InsertTeam("team_1"), "creating team")
+	NoErr(t, cli.AssignTeamToUser("team_1"), "joining team")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.SetUserGoal("grow <fast>"), "setting goal")
+	goal, err := cli.AddGoal("ship <it>", "", "cycle_1")
+	NoErr(t, err, "adding goal")
+	achieved := goalAchieved
+	_, err = cli.UpdateGoal(goal.ID, GoalChanges{Status: &achieved})
+	NoErr(t, err, "achieving goal")
+	for _, email := range []string{"requested@example.com", "anonymous@example.com", "teammate@example.com"} {
+		NoErr(t, CreateUser(cli.db, email, email), "creating user")
+		NoErr(t, AssignTeamToUser(cli.db, email, "team_1"), "setting up team")
+	}
+	NoErr(t, cli.AddReviewer("requested@example.com", "cycle_1"), "requesting a reviewer")
+	NoErr(t, cli.as("anonymous@example.com").AddReviewForUser(cli.userEmail, "cycle_1", []string{"zealous"}, []string{"listening"}), "adding review")
+	NoErr(t, cli.as("teammate@example.com").AddReviewForUser(cli.userEmail, "cycle_1", []string{"attentive"}, []string{"delegating"}), "adding review")
+	NoErr(t, cli.AddReviewForUser("teammate@example.com", "cycle_1", []string{"calm"}, []string{"docs"}), "reviewing a team mate")
+	SetAuth("export-session-key", cli.userEmail, time.Now().Add(time.Hour))
+
+	b, err := cli.ExportPersonalData()
+	NoErr(t, err, "exporting")
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	NoErr(t, err, "reading zip")
+	files := make(map[string]string)
+	for _, f := range z.File {
+		r, err := f.Open()
+		NoErr(t, err, "opening "+f.Name)
+		content, err := ioutil.ReadAll(r)
+		NoErr(t, err, "reading "+f.Name)
+		files[f.Name] = string(content)
+	}
+	if len(files) != 2 || files["data.json"] == "" || files["data.html"] == "" {
+		t.Fatalf("got files %v, want data.json and data.html", z.File)
+	}
+
+	var e PersonalExport
+	NoErr(t, json.Unmarshal([]byte(files["data.json"]), &e), "decoding data.json")
+	if e.Profile.Email != cli.userEmail || strings.Join(e.Profile.Teams, ",") != "team_1" || e.Profile.Goals != "grow <fast>" || len(e.Goals) != 1 || e.Goals[0].Status != goalAchieved {
+		t.Errorf("got profile %+v and goals %v, want the user's team and goal", e.Profile, e.Goals)
+	}
+	if len(e.FeedbackReceived) != 1 || strings.Join(e.FeedbackReceived[0].Strengths, ",") != "attentive,zealous" {
+		t.Errorf("got feedback %+v, want both strengths sorted", e.FeedbackReceived)
+	}
+	if len(e.FeedbackGiven) != 1 || e.FeedbackGiven[0].RevieweeEmail != "teammate@example.com" {
+		t.Errorf("got feedback given %+v, want the team mate", e.FeedbackGiven)
+	}
+	if len(e.RequestsSent) != 1 || e.RequestsSent[0].ReviewerEmail != "requested@example.com" {
+		t.Errorf("got requests sent %+v, want the request to the reviewer", e.RequestsSent)
+	}
+	// the client's own session and the one above
+	if len(e.Sessions) != 2 {
+		t.Errorf("got sessions %+v, want 2", e.Sessions)
+	}
+	if !strings.Contains(files["data.html"], "grow &lt;fast&gt;") || !strings.Contains(files["data.html"], "ship &lt;it&gt;") || !strings.Contains(files["data.html"], "<li>zealous</li>") {
+		t.Errorf("got html %s, want the escaped goal and feedback", files["data.html"])
+	}
+
+	for name, content := range files {
+		for _, secret := range []string{"anonymous@example.com", "export-session-key"} {
+			if strings.Contains(content, secret) {
+				t.Errorf("got %q in %s, want it left out", secret, name)
+			}
+		}
+	}
+}
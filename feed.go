@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ The feed shows users what happened while they were away when they load /dash. Every notification is added to the
+ feed, whether or not the user gets email, using the email subject as the message.
+*/
+
+// Notification is an entry in a user's feed
+type Notification struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Message   string    `json:"message"`
+	Cycle     string    `json:"cycle,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Read      bool      `json:"read"`
+}
+
+// feedNotifier adds notifications to each recipient's feed
+type feedNotifier struct {
+	db *sql.DB
+}
+
+func (n feedNotifier) Notify(kind string, recipients []string, data map[string]interface{}) (err error) {
+	message, _, err := renderEmail(kind, data)
+	if err != nil {
+		return err
+	}
+	cycle, _ := data["Cycle"].(string)
+
+	tx, err := n.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for feedNotifier")
+	}
+
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on feedNotifier")
+		}
+	}()
+
+	q := `
+    INSERT INTO notifications
+                (user_id,
+                kind,
+                message,
+                cycle,
+                created_at)
+    SELECT id,
+           ?,
+           ?,
+           ?,
+           ?
+    FROM   users
+    WHERE  email = ?
+    `
+	now := time.Now().Unix()
+	for _, recipient := range recipients {
+		if _, err = tx.Exec(q, kind, message, cycle, now, recipient); err != nil {
+			return errors.Wrap(err, "unable to insert notification")
+		}
+	}
+	return nil
+}
+
+// multiNotifier sends each notification with every notifier in it. All are tried even if one fails.
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(kind string, recipients []string, data map[string]interface{}) error {
+	var first error
+	for _, n := range m {
+		if err := n.Notify(kind, recipients, data); err != nil {
+			log.Printf("error sending %s notification: %v", kind, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// GetNotifications returns a user's most recent notifications, newest first, and how many are unread
+func GetNotifications(db *sql.DB, email string, unreadOnly bool, limit int) ([]Notification, int, error) {
+	q := `
+    SELECT notifications.id,
+           notifications.kind,
+           notifications.message,
+           notifications.cycle,
+           notifications.created_at,
+           notifications.read_at IS NOT NULL
+    FROM   notifications
+           JOIN users
+             ON notifications.user_id = users.id
+    WHERE  users.email = ?
+           AND ( ? = 0
+                  OR notifications.read_at IS NULL )
+    ORDER  BY notifications.id DESC
+    LIMIT  ?
+    `
+	rows, err := db.Query(q, email, unreadOnly, limit)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "unable to query notifications")
+	}
+	defer rows.Close()
+	var notifications []Notification
+	for rows.Next() {
+		var n Notification
+		var createdAt int64
+		if err = rows.Scan(&n.ID, &n.Kind, &n.Message, &n.Cycle, &createdAt, &n.Read); err != nil {
+			return nil, 0, errors.Wrap(err, "unable to scan notifications")
+		}
+		n.CreatedAt = time.Unix(createdAt, 0).UTC()
+		notifications = append(notifications, n)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, errors.Wrap(err, "error post scan of notifications")
+	}
+
+	var unread int
+	q = `
+    SELECT count(*)
+    FROM   notifications
+           JOIN users
+             ON notifications.user_id = users.id
+    WHERE  users.email = ?
+           AND notifications.read_at IS NULL
+    `
+	if err = db.QueryRow(q, email).Scan(&unread); err != nil {
+		return nil, 0, errors.Wrap(err, "unable to count unread notifications")
+	}
+	return notifications, unread, nil
+}
+
+// MarkNotificationsRead marks a user's notifications as read. If ids is empty, all of them are marked.
+func MarkNotificationsRead(db *sql.DB, email string, ids []int) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for MarkNotificationsRead")
+	}
+
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on MarkNotificationsRead")
+		}
+	}()
+
+	q := `
+    UPDATE notifications
+    SET    read_at = ?
+    WHERE  user_id = (SELECT id
+                      FROM   users
+                      WHERE  email = ?
+                      LIMIT  1)
+           AND read_at IS NULL
+    `
+	now := time.Now().Unix()
+	if len(ids) == 0 {
+		if _, err = tx.Exec(q, now, email); err != nil {
+			return errors.Wrap(err, "unable to mark notifications read")
+		}
+		return nil
+	}
+	for _, id := range ids {
+		// scoped to the user so nobody can mark someone else's notifications
+		if _, err = tx.Exec(q+" AND id = ?", now, email, id); err != nil {
+			return errors.Wrap(err, "unable to mark notification read")
+		}
+	}
+	return nil
+}
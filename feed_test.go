@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAPIUserNotifications(t *testing.T) {
+	/*
+		Verify review requests, responses to them, and cycle changes show in the feed
+		Verify notifications can be marked read one at a time or all at once, only by their owner
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	reviewer := cli.as("user_1@example.com")
+
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.AddReviewer("user_1@example.com", "cycle_1"), "requesting review")
+	incoming, _, err := reviewer.GetReviewRequests("cycle_1")
+	NoErr(t, err, "getting requests")
+	if len(incoming) != 1 {
+		t.Fatalf("got %d incoming requests, want 1", len(incoming))
+	}
+	NoErr(t, reviewer.DeclineReviewRequest(incoming[0].ID, "too busy"), "declining")
+	NoErr(t, cli.EditCycle("cycle_1", false), "closing cycle")
+
+	feed, unread, err := cli.GetNotifications(false)
+	NoErr(t, err, "getting feed")
+	wantKinds := []string{emailResultsReleased, emailRequestDeclined, emailCycleOpened}
+	if len(feed) != len(wantKinds) || unread != len(wantKinds) {
+		t.Fatalf("got %d notifications (%d unread), want %d unread: %+v", len(feed), unread, len(wantKinds), feed)
+	}
+	for i, kind := range wantKinds {
+		if feed[i].Kind != kind || feed[i].Cycle != "cycle_1" || feed[i].Read {
+			t.Errorf("got %+v, want an unread %s notification", feed[i], kind)
+		}
+	}
+	if feed[1].Message != "user_1 declined your review request for cycle_1" {
+		t.Errorf("got message %q", feed[1].Message)
+	}
+
+	reviewerFeed, _, err := reviewer.GetNotifications(false)
+	NoErr(t, err, "getting reviewer's feed")
+	if len(reviewerFeed) != 3 || reviewerFeed[1].Kind != emailReviewRequest {
+		t.Errorf("got %+v, want the review request between the cycle opening and closing", reviewerFeed)
+	}
+
+	NoErr(t, reviewer.MarkNotificationsRead(feed[0].ID), "marking someone else's notification read")
+	NoErr(t, cli.MarkNotificationsRead(feed[1].ID), "marking one read")
+	feed, unread, err = cli.GetNotifications(true)
+	NoErr(t, err, "getting unread feed")
+	if len(feed) != 2 || unread != 2 || feed[0].Kind != emailResultsReleased || feed[1].Kind != emailCycleOpened {
+		t.Errorf("got %+v (%d unread), want the two notifications that were not marked read", feed, unread)
+	}
+
+	NoErr(t, cli.MarkNotificationsRead(), "marking all read")
+	feed, unread, err = cli.GetNotifications(true)
+	NoErr(t, err, "getting unread feed")
+	if len(feed) != 0 || unread != 0 {
+		t.Errorf("got %+v (%d unread), want nothing unread", feed, unread)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ Goals are what a user is working on and wants feedback about. A user can have any number of them, each with a status
+ and optionally tied to a cycle. Finishing or giving up on a goal changes its status instead of replacing it, so the
+ history is kept. Reviewers see a reviewee's active goals for the cycle they are reviewing, next to each reviewee, and
+ each strength or growth opportunity they give can be about one of them (reviews.goal_id). The reviewee then sees that
+ feedback grouped by goal. Titles and descriptions are encrypted at rest like feedback (see crypto.go).
+
+ users.goals is the older single free text goal set with POST /api/user/goal. It is still the profile's "goal".
+*/
+
+// goal statuses
+const (
+	goalActive   = "active"
+	goalAchieved = "achieved"
+	goalDropped  = "dropped"
+)
+
+// ErrGoalNotFound is returned when acting on a goal that does not exist or belongs to someone else
+var ErrGoalNotFound = errors.New("goal not found")
+
+// ErrInvalidGoal is returned when a goal is missing its title, or has an unknown status or cycle, or feedback is about a
+// goal that is not one of the reviewee's active goals
+var ErrInvalidGoal = errors.New("invalid goal")
+
+// Goal is something a user is working on
+type Goal struct {
+	ID          int       `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	Cycle       string    `json:"cycle,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// GoalChanges are the changes to make to a goal. Nil fields are left unchanged. An empty Cycle unties the goal from its
+// cycle.
+type GoalChanges struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	Status      *string `json:"status"`
+	Cycle       *string `json:"cycle"`
+}
+
+// AddGoal adds an active goal for the user. Only the title, description, and cycle of g are used.
+func AddGoal(db *sql.DB, email string, g Goal, now time.Time) (Goal, error) {
+	g.Title = strings.TrimSpace(g.Title)
+	if g.Title == "" {
+		return g, errors.Wrap(ErrInvalidGoal, "title can not be empty")
+	}
+	cycleID, err := goalCycleID(db, g.Cycle)
+	if err != nil {
+		return g, err
+	}
+	title, err := encryptField(g.Title)
+	if err != nil {
+		return g, errors.Wrap(err, "unable to encrypt goal title")
+	}
+	description, err := encryptField(g.Description)
+	if err != nil {
+		return g, errors.Wrap(err, "unable to encrypt goal description")
+	}
+
+	q := `
+    INSERT INTO goals
+                (user_id,
+                 title,
+                 description,
+                 status,
+                 cycle_id,
+                 created_at,
+                 updated_at)
+    VALUES      ((SELECT id
+                  FROM   users
+                  WHERE  email = ?
+                  LIMIT  1), ?, ?, ?, ?, ?, ?)
+    `
+	res, err := db.Exec(q, email, title, description, goalActive, cycleID, now.Unix(), now.Unix())
+	if err != nil {
+		return g, errors.Wrap(err, "unable to insert goal")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return g, errors.Wrap(err, "unable to get goal id")
+	}
+	return getGoal(db, email, int(id))
+}
+
+// GetGoals returns the user's goals, oldest first. An empty status returns goals of every status.
+func GetGoals(db *sql.DB, email string, status string) ([]Goal, error) {
+	if status == "" {
+		return queryGoals(db, "", email)
+	}
+	return queryGoals(db, "AND goals.status = ?", email, status)
+}
+
+// getActiveGoals returns the user's active goals that are for cycle or for no cycle in particular
+func getActiveGoals(db *sql.DB, email string, cycle string) ([]Goal, error) {
+	return queryGoals(db, "AND goals.status = ? AND (goals.cycle_id IS NULL OR review_cycles.name = ?)", email, goalActive, cycle)
+}
+
+func getGoal(db *sql.DB, email string, id int) (Goal, error) {
+	goals, err := queryGoals(db, "AND goals.id = ?", email, id)
+	if err != nil {
+		return Goal{}, err
+	}
+	if len(goals) == 0 {
+		return Goal{}, ErrGoalNotFound
+	}
+	return goals[0], nil
+}
+
+// queryGoals returns the goals of the user with email that also match where
+func queryGoals(db *sql.DB, where string, email string, args ...interface{}) ([]Goal, error) {
+	q := `
+    SELECT goals.id,
+           goals.title,
+           goals.description,
+           goals.status,
+           coalesce(review_cycles.name, ""),
+           goals.created_at,
+           goals.updated_at
+    FROM   goals
+           JOIN users
+             ON goals.user_id = users.id
+           LEFT JOIN review_cycles
+                  ON goals.cycle_id = review_cycles.id
+    WHERE  users.email = ?
+           ` + where + `
+    ORDER  BY goals.id
+    `
+	rows, err := db.Query(q, append([]interface{}{email}, args...)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query goals")
+	}
+	defer rows.Close()
+	goals := []Goal{}
+	for rows.Next() {
+		var g Goal
+		var createdAt, updatedAt int64
+		if err = rows.Scan(&g.ID, &g.Title, &g.Description, &g.Status, &g.Cycle, &createdAt, &updatedAt); err != nil {
+			return nil, errors.Wrap(err, "unable to scan goals")
+		}
+		if g.Title, err = decryptField(g.Title); err != nil {
+			return nil, errors.Wrap(err, "unable to decrypt goal title")
+		}
+		if g.Description, err = decryptField(g.Description); err != nil {
+			return nil, errors.Wrap(err, "unable to decrypt goal description")
+		}
+		g.CreatedAt = time.Unix(createdAt, 0).UTC()
+		g.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+		goals = append(goals, g)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in queryGoals")
+	}
+	return goals, nil
+}
+
+// UpdateGoal changes one of the user's goals
+func UpdateGoal(db *sql.DB, email string, id int, c GoalChanges, now time.Time) (Goal, error) {
+	if _, err := getGoal(db, email, id); err != nil {
+		return Goal{}, err
+	}
+
+	sets := []string{"updated_at=?"}
+	args := []interface{}{now.Unix()}
+	if c.Title != nil {
+		title := strings.TrimSpace(*c.Title)
+		if title == "" {
+			return Goal{}, errors.Wrap(ErrInvalidGoal, "title can not be empty")
+		}
+		encrypted, err := encryptField(title)
+		if err != nil {
+			return Goal{}, errors.Wrap(err, "unable to encrypt goal title")
+		}
+		sets = append(sets, "title=?")
+		args = append(args, encrypted)
+	}
+	if c.Description != nil {
+		encrypted, err := encryptField(*c.Description)
+		if err != nil {
+			return Goal{}, errors.Wrap(err, "unable to encrypt goal description")
+		}
+		sets = append(sets, "description=?")
+		args = append(args, encrypted)
+	}
+	if c.Status != nil {
+		if !inList(*c.Status, []string{goalActive, goalAchieved, goalDropped}) {
+			return Goal{}, errors.Wrap(ErrInvalidGoal, "status must be one of active, achieved, or dropped")
+		}
+		sets = append(sets, "status=?")
+		args = append(args, *c.Status)
+	}
+	if c.Cycle != nil {
+		cycleID, err := goalCycleID(db, *c.Cycle)
+		if err != nil {
+			return Goal{}, err
+		}
+		sets = append(sets, "cycle_id=?")
+		args = append(args, cycleID)
+	}
+
+	args = append(args, id)
+	if _, err := db.Exec("update goals set "+strings.Join(sets, ", ")+" where id=?", args...); err != nil {
+		return Goal{}, errors.Wrap(err, "unable to update goal")
+	}
+	return getGoal(db, email, id)
+}
+
+// DeleteGoal removes one of the user's goals. Changing its status keeps it in the user's history instead. Feedback about
+// the goal is kept, no longer grouped under it.
+func DeleteGoal(db *sql.DB, email string, id int) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for DeleteGoal")
+	}
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on DeleteGoal")
+		}
+	}()
+
+	q := "delete from goals where id=? and user_id=(select id from users where email=? limit 1)"
+	res, err := tx.Exec(q, id, email)
+	if err != nil {
+		return errors.Wrap(err, "unable to delete goal")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to get rows affected in DeleteGoal")
+	}
+	if n == 0 {
+		return ErrGoalNotFound
+	}
+	if _, err = tx.Exec("update reviews set goal_id=NULL where goal_id=?", id); err != nil {
+		return errors.Wrap(err, "unable to ungroup feedback about goal")
+	}
+	return nil
+}
+
+// goalIDOrNull stores a goal id of 0, meaning no goal, as NULL
+func goalIDOrNull(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// goalCycleID returns the id of the named cycle, or NULL for no cycle
+func goalCycleID(db *sql.DB, cycle string) (sql.NullInt64, error) {
+	var id sql.NullInt64
+	if cycle == "" {
+		return id, nil
+	}
+	err := db.QueryRow("select id from review_cycles where name=?", cycle).Scan(&id)
+	if err == sql.ErrNoRows {
+		return id, errors.Wrapf(ErrInvalidGoal, "cycle %q does not exist", cycle)
+	}
+	if err != nil {
+		return id, errors.Wrap(err, "unable to look up goal cycle")
+	}
+	return id, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestAPIUserGoals(t *testing.T) {
+	/*
+		Verify a user can hold several goals, and changing a goal's status keeps it in their history
+		Verify reviewers see a reviewee's active goals for the cycle next to the reviewee
+		Verify goals are checked, and one user can not change another's goals
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, cli.InsertTeam("team_1"), "adding team")
+	NoErr(t, cli.AssignTeamToUser("team_1"), "joining team")
+	NoErr(t, CreateUser(cli.db, "teammate", "teammate@example.com"), "creating user")
+	NoErr(t, AssignTeamToUser(cli.db, "teammate@example.com", "team_1"), "joining team")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.AddCycle("cycle_2"), "adding cycle")
+
+	anytime, err := cli.AddGoal("write more docs", "design docs especially", "")
+	NoErr(t, err, "adding goal")
+	thisCycle, err := cli.AddGoal("lead a launch", "", "cycle_1")
+	NoErr(t, err, "adding goal")
+	_, err = cli.AddGoal("mentor", "", "cycle_2")
+	NoErr(t, err, "adding goal")
+	done, err := cli.AddGoal("learn go", "", "")
+	NoErr(t, err, "adding goal")
+	if anytime.Status != goalActive || thisCycle.Cycle != "cycle_1" || anytime.Description != "design docs especially" {
+		t.Errorf("got %+v and %+v, want active goals with their cycle and description", anytime, thisCycle)
+	}
+
+	achieved := goalAchieved
+	updated, err := cli.UpdateGoal(done.ID, GoalChanges{Status: &achieved})
+	NoErr(t, err, "achieving goal")
+	if updated.Status != goalAchieved || updated.Title != "learn go" || updated.UpdatedAt.Before(updated.CreatedAt) {
+		t.Errorf("got %+v, want only the status changed", updated)
+	}
+	goals, err := cli.GetGoals("")
+	NoErr(t, err, "getting goals")
+	if len(goals) != 4 {
+		t.Errorf("got %d goals, want all 4 kept", len(goals))
+	}
+	goals, err = cli.GetGoals(goalAchieved)
+	NoErr(t, err, "getting achieved goals")
+	if len(goals) != 1 || goals[0].ID != done.ID {
+		t.Errorf("got %+v, want the achieved goal", goals)
+	}
+
+	reviewees, err := cli.as("teammate@example.com").GetUserReviewees("cycle_1")
+	NoErr(t, err, "getting reviewees")
+	if len(reviewees) != 1 {
+		t.Fatalf("got %+v, want the test user", reviewees)
+	}
+	var titles []string
+	for _, g := range reviewees[0].Goals {
+		titles = append(titles, g.Title)
+	}
+	if strings.Join(titles, ",") != "write more docs,lead a launch" {
+		t.Errorf("got goals %v, want the active goals for cycle_1 or no cycle", titles)
+	}
+
+	if _, err = cli.AddGoal(" ", "", ""); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for an empty title", err)
+	}
+	if _, err = cli.AddGoal("goal", "", "no_such_cycle"); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for an unknown cycle", err)
+	}
+	unknown := "finished"
+	if _, err = cli.UpdateGoal(anytime.ID, GoalChanges{Status: &unknown}); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for an unknown status", err)
+	}
+	if err = cli.as("teammate@example.com").DeleteGoal(anytime.ID); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want a 404 deleting someone else's goal", err)
+	}
+
+	NoErr(t, cli.DeleteCycle("cycle_1"), "deleting cycle")
+	goals, err = GetGoals(cli.db, cli.userEmail, goalActive)
+	NoErr(t, err, "getting goals")
+	if len(goals) != 3 || goals[1].ID != thisCycle.ID || goals[1].Cycle != "" {
+		t.Errorf("got %+v, want the goal kept without its deleted cycle", goals)
+	}
+
+	NoErr(t, cli.DeleteGoal(anytime.ID), "deleting goal")
+	if err = DeleteGoal(cli.db, cli.userEmail, anytime.ID); errors.Cause(err) != ErrGoalNotFound {
+		t.Errorf("got %v, want ErrGoalNotFound deleting twice", err)
+	}
+}
+
+func TestAPIUserReviewGoals(t *testing.T) {
+	/*
+		Verify feedback about a reviewee's goal is grouped under it, and the rest is not
+		Verify feedback can only be about the reviewee's own active goals for the cycle
+		Verify deleting a goal keeps its feedback, ungrouped
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "reviewee", "reviewee@example.com"), "creating user")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	reviewee := cli.as("reviewee@example.com")
+	goal, err := reviewee.AddGoal("lead a launch", "", "")
+	NoErr(t, err, "adding goal")
+	mine, err := cli.AddGoal("learn go", "", "")
+	NoErr(t, err, "adding goal")
+
+	NoErr(t, cli.AddReviewItemsForUser("reviewee@example.com", "cycle_1",
+		[]FeedbackItem{{Text: "ran the launch well", GoalID: goal.ID}, {Text: "kind"}},
+		[]FeedbackItem{{Text: "write the launch plan earlier", GoalID: goal.ID}}), "adding review")
+	err = cli.AddReviewItemsForUser("reviewee@example.com", "cycle_1", []FeedbackItem{{Text: "great", GoalID: mine.ID}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for feedback about someone else's goal", err)
+	}
+	NoErr(t, cli.AddCycle("cycle_2"), "adding cycle")
+	later, err := reviewee.AddGoal("mentor", "", "cycle_2")
+	NoErr(t, err, "adding goal")
+	done, err := reviewee.AddGoal("learn go", "", "")
+	NoErr(t, err, "adding goal")
+	achieved := goalAchieved
+	_, err = reviewee.UpdateGoal(done.ID, GoalChanges{Status: &achieved})
+	NoErr(t, err, "achieving goal")
+	for _, id := range []int{later.ID, done.ID} {
+		err = cli.AddReviewItemsForUser("reviewee@example.com", "cycle_1", []FeedbackItem{{Text: "great", GoalID: id}}, nil)
+		if err == nil || !strings.Contains(err.Error(), "400") {
+			t.Errorf("got %v, want a 400 for feedback about goal %d, which reviewers are not shown", err, id)
+		}
+	}
+
+	got := reviewsByCycle(t, cli, "reviewee@example.com")["cycle_1"]
+	if strings.Join(got.Strengths, ",") != "kind" || len(got.Opportunities) != 0 {
+		t.Errorf("got %+v, want only the feedback not about a goal at the top level", got)
+	}
+	if len(got.Goals) != 1 || got.Goals[0].GoalID != goal.ID || got.Goals[0].Title != "lead a launch" ||
+		strings.Join(got.Goals[0].Strengths, ",") != "ran the launch well" || strings.Join(got.Goals[0].Opportunities, ",") != "write the launch plan earlier" {
+		t.Errorf("got %+v, want the feedback about the goal grouped under it", got.Goals)
+	}
+
+	NoErr(t, reviewee.DeleteGoal(goal.ID), "deleting goal")
+	got = reviewsByCycle(t, cli, "reviewee@example.com")["cycle_1"]
+	if len(got.Strengths) != 2 || len(got.Opportunities) != 1 || len(got.Goals) != 0 {
+		t.Errorf("got %+v, want the goal's feedback kept at the top level", got)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -8,10 +9,13 @@ import (
 	"log"
 	"net/http"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aymerick/raymond"
 	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
 )
 
 func (a app) rootHandler(w http.ResponseWriter, r *http.Request) {
@@ -88,6 +92,20 @@ func (a app) tokenHandler(w http.ResponseWriter, r *http.Request) {
 		handleErr(w, r, nil, "bad client id", http.StatusBadRequest)
 		return
 	}
+	existed, err := UserExists(a.db, info.Email)
+	if err != nil {
+		handleErr(w, r, err, "unable to look up user", http.StatusInternalServerError)
+		return
+	}
+	active, err := UserIsActive(a.db, info.Email)
+	if err != nil {
+		handleErr(w, r, err, "unable to look up user", http.StatusInternalServerError)
+		return
+	}
+	if !active {
+		handleErr(w, r, nil, "this account has been deactivated", http.StatusForbidden)
+		return
+	}
 	key := RandStringRunes(keyLength)
 	SetAuth(key, info.Email, time.Now().Add(24*time.Hour))
 	err = CreateUser(a.db, info.Name, info.Email)
@@ -96,6 +114,9 @@ func (a app) tokenHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !existed {
+		a.emitEvent(eventUserCreated, userEvent{Email: info.Email, Name: info.Name})
+	}
 	w.Write([]byte(key))
 }
 
@@ -172,6 +193,7 @@ func (a app) apiUserTeam(w http.ResponseWriter, r *http.Request) {
 			handleErr(w, r, err, "unable to assign team to user", http.StatusInternalServerError)
 			return
 		}
+		a.emitEvent(eventTeamChanged, teamEvent{Team: payload.Team, Change: "member_added", UserEmail: email})
 		w.WriteHeader(http.StatusCreated)
 		return
 	} else if r.Method == "DELETE" {
@@ -180,6 +202,7 @@ func (a app) apiUserTeam(w http.ResponseWriter, r *http.Request) {
 			handleErr(w, r, err, "unable to remove team from user", http.StatusInternalServerError)
 			return
 		}
+		a.emitEvent(eventTeamChanged, teamEvent{Team: payload.Team, Change: "member_removed", UserEmail: email})
 		return
 	} else {
 		handleErr(w, r, nil, "unexpected method: "+r.Method, http.StatusBadRequest)
@@ -220,21 +243,108 @@ func (a app) apiUserGoal(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (a app) apiUserReviewees(w http.ResponseWriter, r *http.Request) {
+// apiAdminUserManager sets who a user reports to. It is admin only because managers approve review requests. An empty
+// manager_email clears the manager.
+func (a app) apiAdminUserManager(w http.ResponseWriter, r *http.Request) {
+	email := chi.URLParam(r, "email")
+	var payload struct {
+		ManagerEmail string `json:"manager_email"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		handleErr(w, r, err, `unable to marshal body. Should be {"manager_email":"email"}`, http.StatusBadRequest)
+		return
+	}
+	if strings.EqualFold(payload.ManagerEmail, email) {
+		handleErr(w, r, nil, "a user cannot be their own manager", http.StatusBadRequest)
+		return
+	}
+
+	if exists, err := UserExists(a.db, email); err != nil {
+		handleErr(w, r, err, "unable to look up user", http.StatusInternalServerError)
+		return
+	} else if !exists {
+		handleErr(w, r, nil, "user not found", http.StatusNotFound)
+		return
+	}
+	before, err := GetUser(a.db, email)
+	if err != nil {
+		handleErr(w, r, err, "unable to get user", http.StatusInternalServerError)
+		return
+	}
+	err = SetUserManager(a.db, email, payload.ManagerEmail)
+	if errors.Cause(err) == ErrUserNotFound {
+		handleErr(w, r, err, "manager not found. They must sign in at least once", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to set manager", http.StatusInternalServerError)
+		return
+	}
+	if err := a.audit(r, auditUserManagerChanged, email, map[string]string{"manager": before.Manager}, map[string]string{"manager": payload.ManagerEmail}); err != nil {
+		handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (a app) apiUserEmailPreferences(w http.ResponseWriter, r *http.Request) {
 	email := r.Context().Value(ctxEmail).(string)
 	if email == "" {
 		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
 		return
 	}
-	cycle := chi.URLParam(r, "cycleName")
+
+	var payload struct {
+		OptOut *bool `json:"opt_out"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil || payload.OptOut == nil {
+		handleErr(w, r, err, `unable to marshal body. Should be {"opt_out":bool}`, http.StatusBadRequest)
+		return
+	}
+
+	err = SetEmailOptOut(a.db, email, *payload.OptOut)
+	if err != nil {
+		handleErr(w, r, err, "unable to set email preferences", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiUserNotifications(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
+		return
+	}
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			handleErr(w, r, err, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
 
 	var data struct {
-		Reviewees []UserInfoLite `json:"reviewees"`
+		Notifications []Notification `json:"notifications"`
+		Unread        int            `json:"unread"`
 	}
 	var err error
-	data.Reviewees, err = GetReviewees(a.db, email, cycle)
+	data.Notifications, data.Unread, err = GetNotifications(a.db, email, unreadOnly, limit)
 	if err != nil {
-		handleErr(w, r, err, "unable to get reviewees", http.StatusInternalServerError)
+		handleErr(w, r, err, "unable to get notifications", http.StatusInternalServerError)
 		return
 	}
 	err = json.NewEncoder(w).Encode(data)
@@ -244,129 +354,143 @@ func (a app) apiUserReviewees(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (a app) apiUserReviews(w http.ResponseWriter, r *http.Request) {
+func (a app) apiUserNotificationsRead(w http.ResponseWriter, r *http.Request) {
 	email := r.Context().Value(ctxEmail).(string)
 	if email == "" {
 		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
 		return
 	}
 
-	if r.Method == "GET" {
-		var data struct {
-			Reviews []Review `json:"reviews"`
-		}
-		var err error
-		data.Reviews, err = GetUserReviews(a.db, email)
-		if err != nil {
-			handleErr(w, r, err, "unable to get reviews", http.StatusInternalServerError)
-			return
-		}
-		err = json.NewEncoder(w).Encode(data)
-		if err != nil {
-			handleErr(w, r, err, "unable to encode response", http.StatusInternalServerError)
-			return
-		}
+	// no ids marks everything read
+	var payload struct {
+		IDs []int `json:"ids"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
 		return
-	} else if r.Method == "POST" {
-		var payload struct {
-			RevieweeEmail string   `json:"reviewee_email"`
-			Strengths     []string `json:"strengths"`
-			Opportunities []string `json:"growth_opportunities"`
-			Cycle         string   `json:"cycle"`
-		}
-		b, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
-			return
-		}
+	}
+	if len(b) > 0 {
 		err = json.Unmarshal(b, &payload)
 		if err != nil {
-			handleErr(w, r, err, `unable to marshal body. Should be {"goal":"description"}`, http.StatusBadRequest)
-			return
-		}
-		if payload.RevieweeEmail == "" || len(payload.Strengths) == 0 || len(payload.Opportunities) == 0 || payload.Cycle == "" {
-			handleErr(w, r, nil, "reviewee_email, strengths, growth_opportunies, and/or cycle cannot be empty", http.StatusBadRequest)
+			handleErr(w, r, err, `unable to marshal body. Should be {"ids":[int]} or empty to mark all read`, http.StatusBadRequest)
 			return
 		}
+	}
 
-		err = AddUserReview(a.db, payload.RevieweeEmail, payload.Strengths, payload.Opportunities, payload.Cycle)
-		if err != nil {
-			handleErr(w, r, err, "unable to add review", http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusCreated)
-	} else {
-		handleErr(w, r, nil, "unexpected method "+r.Method, http.StatusBadRequest)
+	err = MarkNotificationsRead(a.db, email, payload.IDs)
+	if err != nil {
+		handleErr(w, r, err, "unable to mark notifications read", http.StatusInternalServerError)
 		return
 	}
 }
 
-func (a app) apiUserReviewer(w http.ResponseWriter, r *http.Request) {
+func (a app) apiUserCalendar(w http.ResponseWriter, r *http.Request) {
 	email := r.Context().Value(ctxEmail).(string)
 	if email == "" {
 		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
 		return
 	}
 
-	var payload struct {
-		UserEmail string `json:"user_email"`
-		Cycle     string `json:"cycle"`
+	var token string
+	var err error
+	if r.Method == "POST" {
+		token, err = RegenerateCalendarToken(a.db, email)
+	} else {
+		token, err = GetCalendarToken(a.db, email)
 	}
-	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		handleErr(w, r, err, "unable to get calendar token", http.StatusInternalServerError)
 		return
 	}
-	err = json.Unmarshal(b, &payload)
+	err = json.NewEncoder(w).Encode(map[string]string{"url": a.calendarURL(token)})
 	if err != nil {
-		handleErr(w, r, err, `unable to marshal body. Should be {"user_email":"email", "cycle":"cycle name"}`, http.StatusBadRequest)
+		handleErr(w, r, err, "unable to encode response", http.StatusInternalServerError)
 		return
 	}
-	if payload.UserEmail == "" {
-		handleErr(w, r, nil, "user_email cannot be empty", http.StatusBadRequest)
+}
+
+func (a app) apiUserExport(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
 		return
 	}
 
-	if payload.Cycle == "" {
-		handleErr(w, r, nil, "cycle cannot be empty", http.StatusBadRequest)
+	e, err := ExportUser(a.db, email, time.Now())
+	if err != nil {
+		handleErr(w, r, err, "unable to gather your data", http.StatusInternalServerError)
 		return
 	}
-
-	if r.Method != "POST" {
-		handleErr(w, r, nil, "unexpected method "+r.Method, http.StatusBadRequest)
+	var buf bytes.Buffer
+	if err = WriteExportArchive(&buf, e); err != nil {
+		handleErr(w, r, err, "unable to build export", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="peerreview-export-%s.zip"`, e.ExportedAt.Format("2006-01-02")))
+	buf.WriteTo(w)
+}
 
-	err = SetUserReviewer(a.db, email, payload.UserEmail, payload.Cycle)
+// calendarHandler serves a user's calendar feed. The token in the url is the only authentication, as calendar apps
+// can not sign in.
+func (a app) calendarHandler(w http.ResponseWriter, r *http.Request) {
+	file := chi.URLParam(r, "file")
+	if !strings.HasSuffix(file, ".ics") {
+		handleErr(w, r, nil, "calendar not found", http.StatusNotFound)
+		return
+	}
+	email, err := GetCalendarUser(a.db, strings.TrimSuffix(file, ".ics"))
+	if errors.Cause(err) == ErrUserNotFound {
+		handleErr(w, r, err, "calendar not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to look up calendar", http.StatusInternalServerError)
+		return
+	}
+	cal, err := BuildCalendar(a.db, email, a.baseURL, time.Now())
 	if err != nil {
-		handleErr(w, r, err, "unable to set reviewer", http.StatusInternalServerError)
+		handleErr(w, r, err, "unable to build calendar", http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(cal)
 }
 
-func (a app) apiAdminCycles(w http.ResponseWriter, r *http.Request) {
+func (a app) apiUserGoals(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
+		return
+	}
+
 	if r.Method == "GET" {
+		status := r.URL.Query().Get("status")
+		if status != "" && !inList(status, []string{goalActive, goalAchieved, goalDropped}) {
+			handleErr(w, r, nil, "status must be one of active, achieved, or dropped", http.StatusBadRequest)
+			return
+		}
 		var data struct {
-			Cycles []Cycle `json:"cycles"`
+			Goals []Goal `json:"goals"`
 		}
 		var err error
-		data.Cycles, err = GetCycles(a.db)
+		data.Goals, err = GetGoals(a.db, email, status)
 		if err != nil {
-			handleErr(w, r, err, "unable to get cycles", http.StatusInternalServerError)
+			handleErr(w, r, err, "unable to get goals", http.StatusInternalServerError)
 			return
 		}
 		err = json.NewEncoder(w).Encode(data)
 		if err != nil {
-			handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+			handleErr(w, r, err, "unable to encode response", http.StatusInternalServerError)
 			return
 		}
 		return
 	}
 
 	var payload struct {
-		Cycle  string `json:"cycle"`
-		IsOpen bool   `json:"is_open"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Cycle       string `json:"cycle"`
 	}
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -375,112 +499,1350 @@ func (a app) apiAdminCycles(w http.ResponseWriter, r *http.Request) {
 	}
 	err = json.Unmarshal(b, &payload)
 	if err != nil {
-		handleErr(w, r, err, `unable to marshal body. Should be {"cycle":"cycle name", "is_open":bool} (note, is_open is for PUT calls only)`, http.StatusBadRequest)
-		return
-	}
-	if payload.Cycle == "" {
-		handleErr(w, r, nil, "cycle cannot be empty", http.StatusBadRequest)
+		handleErr(w, r, err, `unable to marshal body. Should be {"title":"title", "description":"optional", "cycle":"optional cycle"}`, http.StatusBadRequest)
 		return
 	}
 
-	if r.Method == "POST" {
-		err = AddCycle(a.db, payload.Cycle)
-		if err != nil {
-			handleErr(w, r, err, "unable to add cycle", http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusCreated)
+	var data struct {
+		Goal Goal `json:"goal"`
+	}
+	data.Goal, err = AddGoal(a.db, email, Goal{Title: payload.Title, Description: payload.Description, Cycle: payload.Cycle}, time.Now())
+	if errors.Cause(err) == ErrInvalidGoal {
+		handleErr(w, r, err, err.Error(), http.StatusBadRequest)
 		return
-	} else if r.Method == "PUT" {
-		err = UpdateCycle(a.db, payload.Cycle, payload.IsOpen)
-		if err != nil {
-			handleErr(w, r, err, "unable to update cycle", http.StatusInternalServerError)
-			return
-		}
+	} else if err != nil {
+		handleErr(w, r, err, "unable to add goal", http.StatusInternalServerError)
 		return
-	} else if r.Method == "DELETE" {
-		err = DeleteCycle(a.db, payload.Cycle)
-		if err != nil {
-			handleErr(w, r, err, "unable to delete cycle", http.StatusInternalServerError)
-			return
-		}
+	}
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Printf("error encoding goal response: %v", err)
+	}
+}
+
+func (a app) apiUserGoalEdit(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
 		return
-	} else {
-		handleErr(w, r, nil, "unexpected method "+r.Method, http.StatusBadRequest)
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "goalID"))
+	if err != nil {
+		handleErr(w, r, err, "goal id must be a number", http.StatusBadRequest)
 		return
 	}
-}
 
-func (a app) apiAdminTeams(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
-		var data struct {
-			Teams []string `json:"teams"`
-		}
-		var err error
-		data.Teams, err = GetTeams(a.db)
-		if err != nil {
-			handleErr(w, r, err, "unable to get teams", http.StatusInternalServerError)
+	if r.Method == "DELETE" {
+		err = DeleteGoal(a.db, email, id)
+		if errors.Cause(err) == ErrGoalNotFound {
+			handleErr(w, r, err, "goal not found", http.StatusNotFound)
 			return
-		}
-		err = json.NewEncoder(w).Encode(data)
-		if err != nil {
-			// note, this will give an error of status code already written.
-			// TODO: have a new handler that does nto set status code?
-			handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+		} else if err != nil {
+			handleErr(w, r, err, "unable to delete goal", http.StatusInternalServerError)
 			return
 		}
 		return
 	}
 
-	var payload struct {
-		Team string `json:"team"`
-	}
+	var changes GoalChanges
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
 		return
 	}
-	err = json.Unmarshal(b, &payload)
+	err = json.Unmarshal(b, &changes)
 	if err != nil {
-		handleErr(w, r, err, `unable to marshal body. Should be {"team":"team name"}`, http.StatusBadRequest)
-		return
-	}
-	if payload.Team == "" {
-		handleErr(w, r, nil, "team cannot be empty", http.StatusBadRequest)
+		handleErr(w, r, err, `unable to marshal body. Should be {"title":"optional", "description":"optional", "status":"active|achieved|dropped", "cycle":"optional"}`, http.StatusBadRequest)
 		return
 	}
 
-	if r.Method == "POST" {
-		err = AddTeam(a.db, payload.Team)
-		if err != nil {
-			handleErr(w, r, err, "unable to add team", http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusCreated)
+	var data struct {
+		Goal Goal `json:"goal"`
+	}
+	data.Goal, err = UpdateGoal(a.db, email, id, changes, time.Now())
+	if errors.Cause(err) == ErrGoalNotFound {
+		handleErr(w, r, err, "goal not found", http.StatusNotFound)
 		return
-	} else if r.Method == "DELETE" {
-		err = DeleteTeam(a.db, payload.Team)
-		if err != nil {
-			handleErr(w, r, err, "unable to delete team", http.StatusInternalServerError)
-			return
-		}
+	} else if errors.Cause(err) == ErrInvalidGoal {
+		handleErr(w, r, err, err.Error(), http.StatusBadRequest)
 		return
-	} else {
-		handleErr(w, r, nil, "unexpected method "+r.Method, http.StatusBadRequest)
+	} else if err != nil {
+		handleErr(w, r, err, "unable to update goal", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to encode response", http.StatusInternalServerError)
 		return
 	}
 }
 
-// handleErr is a unified way to handle all errors that need to be logged and presented to the user.
-// The err is logged internally and the msg is presented to the user.
-// TODO: if handleErr is called after w.Write(), we will get an error of multiple response.WriteHeader calls.
-// See for workarounds: https://stackoverflow.com/questions/39415827/golang-http-check-if-responsewriter-has-been-written
-func handleErr(w http.ResponseWriter, r *http.Request, err error, msg string, code int) {
-	// TODO get access to app's logger to get req id, path, etc for free
-	_, fn, line, _ := runtime.Caller(1)
-	entry := fmt.Sprintf("[ %s:%d ] %s", fn, line, msg)
-	if err == nil {
-		log.Printf("error: %s", entry)
+func (a app) apiUserReviewees(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
+		return
+	}
+	cycle := chi.URLParam(r, "cycleName")
+
+	var data struct {
+		Reviewees []UserInfoLite `json:"reviewees"`
+	}
+	var err error
+	data.Reviewees, err = GetReviewees(a.db, email, cycle)
+	if err != nil {
+		handleErr(w, r, err, "unable to get reviewees", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiUserOutstanding(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
+		return
+	}
+	cycle := chi.URLParam(r, "cycleName")
+
+	var data struct {
+		Reviewees []UserInfoLite `json:"reviewees"`
+	}
+	var err error
+	data.Reviewees, err = GetOutstandingReviewees(a.db, email, cycle)
+	if err != nil {
+		handleErr(w, r, err, "unable to get outstanding reviews", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiUserReviews(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "GET" {
+		var data struct {
+			Reviews []Review `json:"reviews"`
+		}
+		var err error
+		data.Reviews, err = GetUserReviews(a.db, email)
+		if err != nil {
+			handleErr(w, r, err, "unable to get reviews", http.StatusInternalServerError)
+			return
+		}
+		err = json.NewEncoder(w).Encode(data)
+		if err != nil {
+			handleErr(w, r, err, "unable to encode response", http.StatusInternalServerError)
+			return
+		}
+		return
+	} else if r.Method == "POST" {
+		var payload struct {
+			RevieweeEmail string         `json:"reviewee_email"`
+			Strengths     []FeedbackItem `json:"strengths"`
+			Opportunities []FeedbackItem `json:"growth_opportunities"`
+			Cycle         string         `json:"cycle"`
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+			return
+		}
+		err = json.Unmarshal(b, &payload)
+		if err != nil {
+			handleErr(w, r, err, `unable to marshal body. Should be {"reviewee_email":"email", "strengths":["feedback" or {"text":"feedback", "goal_id":id}], "growth_opportunities":[...], "cycle":"cycle name"}`, http.StatusBadRequest)
+			return
+		}
+		if payload.RevieweeEmail == "" || len(payload.Strengths) == 0 || len(payload.Opportunities) == 0 || payload.Cycle == "" {
+			handleErr(w, r, nil, "reviewee_email, strengths, growth_opportunies, and/or cycle cannot be empty", http.StatusBadRequest)
+			return
+		}
+
+		err = AddUserReviewItems(a.db, email, payload.RevieweeEmail, payload.Strengths, payload.Opportunities, payload.Cycle)
+		if errors.Cause(err) == ErrInvalidGoal || errors.Cause(err) == ErrInvalidPrompt {
+			handleErr(w, r, err, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			handleErr(w, r, err, "unable to add review", http.StatusInternalServerError)
+			return
+		}
+		// the review is saved at this point. Failing the request would invite a duplicate submission, so only log.
+		if err = RecordSubmission(a.db, email, payload.RevieweeEmail, payload.Cycle); err != nil {
+			log.Printf("error recording submission: %v", err)
+		}
+		// no feedback and no reviewer, only that the reviewee got something
+		a.emitEvent(eventReviewSubmitted, reviewSubmittedEvent{Cycle: payload.Cycle, RevieweeEmail: payload.RevieweeEmail})
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		handleErr(w, r, nil, "unexpected method "+r.Method, http.StatusBadRequest)
+		return
+	}
+}
+
+func (a app) apiUserReviewer(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
+		return
+	}
+
+	var payload struct {
+		UserEmail string `json:"user_email"`
+		Cycle     string `json:"cycle"`
+		Prompt    string `json:"prompt"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		handleErr(w, r, err, `unable to marshal body. Should be {"user_email":"email", "cycle":"cycle name", "prompt":"optional question"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.UserEmail == "" {
+		handleErr(w, r, nil, "user_email cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	if payload.Cycle == "" {
+		handleErr(w, r, nil, "cycle cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != "POST" {
+		handleErr(w, r, nil, "unexpected method "+r.Method, http.StatusBadRequest)
+		return
+	}
+
+	err = a.requestReviewer(email, payload.UserEmail, payload.Cycle, payload.Prompt)
+	if capErr, ok := errors.Cause(err).(RequestCapError); ok {
+		handleErr(w, r, err, capErr.Error(), http.StatusConflict)
+		return
+	} else if errors.Cause(err) == ErrInvalidPrompt {
+		handleErr(w, r, err, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Cause(err) == ErrSelfRequest {
+		handleErr(w, r, err, "you can not request a review from yourself", http.StatusBadRequest)
+		return
+	} else if errors.Cause(err) == ErrNoManager {
+		handleErr(w, r, err, "this cycle requires your manager to approve requests, and you have no manager. Ask an admin to set one", http.StatusConflict)
+		return
+	} else if errors.Cause(err) == ErrUserNotFound {
+		handleErr(w, r, err, "user not found", http.StatusNotFound)
+		return
+	} else if errors.Cause(err) == ErrDuplicateRequest {
+		handleErr(w, r, err, "you already have an open review request to that user this cycle", http.StatusConflict)
+		return
+	} else if errors.Cause(err) == ErrCycleNotFound {
+		handleErr(w, r, err, "cycle not found", http.StatusNotFound)
+		return
+	} else if errors.Cause(err) == ErrUserInactive {
+		handleErr(w, r, err, "that user has been deactivated", http.StatusConflict)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to set reviewer", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// requestReviewer asks reviewerEmail to review requesterEmail during a cycle, optionally with a prompt, and tells whoever
+// needs to know. It is shared by the api and chat commands.
+func (a app) requestReviewer(requesterEmail string, reviewerEmail string, cycle string, prompt string) error {
+	id, err := SetUserReviewer(a.db, requesterEmail, reviewerEmail, cycle, prompt)
+	if err != nil {
+		return err
+	}
+	a.notifyReviewRequest(id)
+	a.emitReviewRequestCreated(id)
+	return nil
+}
+
+func (a app) apiUserReviewRequests(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		Incoming []ReviewRequest `json:"incoming"`
+		Outgoing []ReviewRequest `json:"outgoing"`
+	}
+	var err error
+	data.Incoming, data.Outgoing, err = GetReviewRequests(a.db, email, r.URL.Query().Get("cycle"))
+	if err != nil {
+		handleErr(w, r, err, "unable to get review requests", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiUserReviewRequestAction(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "requestID"))
+	if err != nil {
+		handleErr(w, r, err, "request id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	// the reason is optional and only used when declining
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &payload)
+		if err != nil {
+			handleErr(w, r, err, `unable to marshal body. Should be {"reason":"optional reason for declining"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch chi.URLParam(r, "action") {
+	case "accept":
+		err = AcceptReviewRequest(a.db, id, email)
+		if err == nil {
+			a.notifyRequestResponse(id)
+		}
+	case "decline":
+		err = DeclineReviewRequest(a.db, id, email, payload.Reason)
+		if err == nil {
+			a.notifyRequestResponse(id)
+		}
+	case "withdraw":
+		err = WithdrawReviewRequest(a.db, id, email)
+	default:
+		handleErr(w, r, nil, "action must be one of accept, decline, or withdraw", http.StatusNotFound)
+		return
+	}
+	switch errors.Cause(err) {
+	case nil:
+	case ErrRequestNotFound:
+		handleErr(w, r, err, "review request not found", http.StatusNotFound)
+		return
+	case ErrRequestState:
+		handleErr(w, r, err, err.Error(), http.StatusConflict)
+		return
+	default:
+		handleErr(w, r, err, "unable to update review request", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiUserApprovals(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		Requests []ReviewRequest `json:"requests"`
+	}
+	var err error
+	data.Requests, err = GetApprovalQueue(a.db, email)
+	if err != nil {
+		handleErr(w, r, err, "unable to get approval queue", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiUserApprovalAction(w http.ResponseWriter, r *http.Request) {
+	email := r.Context().Value(ctxEmail).(string)
+	if email == "" {
+		handleErr(w, r, nil, "missing email context", http.StatusInternalServerError)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "requestID"))
+	if err != nil {
+		handleErr(w, r, err, "request id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	// the reason is optional and only used when rejecting
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &payload)
+		if err != nil {
+			handleErr(w, r, err, `unable to marshal body. Should be {"reason":"optional reason for rejecting"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch chi.URLParam(r, "action") {
+	case "approve":
+		err = ApproveReviewRequest(a.db, id, email)
+		if err == nil {
+			a.notifyReviewRequest(id)
+		}
+	case "reject":
+		err = RejectReviewRequest(a.db, id, email, payload.Reason)
+	default:
+		handleErr(w, r, nil, "action must be one of approve or reject", http.StatusNotFound)
+		return
+	}
+	switch errors.Cause(err) {
+	case nil:
+	case ErrRequestNotFound:
+		handleErr(w, r, err, "review request not found", http.StatusNotFound)
+		return
+	case ErrRequestState:
+		handleErr(w, r, err, err.Error(), http.StatusConflict)
+		return
+	default:
+		handleErr(w, r, err, "unable to update review request", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminCycles(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		var data struct {
+			Cycles []Cycle `json:"cycles"`
+		}
+		var err error
+		data.Cycles, err = GetCycles(a.db)
+		if err != nil {
+			handleErr(w, r, err, "unable to get cycles", http.StatusInternalServerError)
+			return
+		}
+		err = json.NewEncoder(w).Encode(data)
+		if err != nil {
+			handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	var payload struct {
+		Cycle  string `json:"cycle"`
+		IsOpen bool   `json:"is_open"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		handleErr(w, r, err, `unable to marshal body. Should be {"cycle":"cycle name", "is_open":bool} (note, is_open is for PUT calls only)`, http.StatusBadRequest)
+		return
+	}
+	if payload.Cycle == "" {
+		handleErr(w, r, nil, "cycle cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	// the cycle as it was before this request, used to tell people when it opens or closes
+	before, err := GetCycle(a.db, payload.Cycle)
+	existed := err == nil
+	if err != nil && errors.Cause(err) != ErrCycleNotFound {
+		handleErr(w, r, err, "unable to get cycle", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "POST" {
+		err = AddCycle(a.db, payload.Cycle)
+		if err != nil {
+			handleErr(w, r, err, "unable to add cycle", http.StatusInternalServerError)
+			return
+		}
+		if !existed {
+			// new cycles start out open
+			a.notifyCycleChange(payload.Cycle, false, true)
+			a.emitEvent(eventCycleChanged, cycleEvent{Cycle: payload.Cycle, Change: "created", IsOpen: true})
+			after, _ := GetCycle(a.db, payload.Cycle)
+			if err := a.audit(r, auditCycleCreated, payload.Cycle, nil, after); err != nil {
+				handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	} else if r.Method == "PUT" {
+		err = UpdateCycle(a.db, payload.Cycle, payload.IsOpen)
+		if err != nil {
+			handleErr(w, r, err, "unable to update cycle", http.StatusInternalServerError)
+			return
+		}
+		if existed && before.IsOpen != payload.IsOpen {
+			a.notifyCycleChange(payload.Cycle, before.IsOpen, payload.IsOpen)
+			change := "opened"
+			if !payload.IsOpen {
+				change = "closed"
+			}
+			a.emitEvent(eventCycleChanged, cycleEvent{Cycle: payload.Cycle, Change: change, IsOpen: payload.IsOpen})
+		}
+		if existed {
+			after, _ := GetCycle(a.db, payload.Cycle)
+			if err := a.audit(r, auditCycleUpdated, payload.Cycle, before, after); err != nil {
+				handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+				return
+			}
+		}
+		return
+	} else if r.Method == "DELETE" {
+		err = DeleteCycle(a.db, payload.Cycle)
+		if err != nil {
+			handleErr(w, r, err, "unable to delete cycle", http.StatusInternalServerError)
+			return
+		}
+		if existed {
+			a.emitEvent(eventCycleChanged, cycleEvent{Cycle: payload.Cycle, Change: "deleted", IsOpen: false})
+			if err := a.audit(r, auditCycleDeleted, payload.Cycle, before, nil); err != nil {
+				handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+				return
+			}
+		}
+		return
+	} else {
+		handleErr(w, r, nil, "unexpected method "+r.Method, http.StatusBadRequest)
+		return
+	}
+}
+
+func (a app) apiAdminCyclesSettings(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Cycle string `json:"cycle"`
+		CycleSettings
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		handleErr(w, r, err, `unable to marshal body. Should be {"cycle":"cycle name", "max_requests_per_reviewer":int, "max_requests_per_requester":int, "require_manager_approval":bool, "closes_at":"RFC 3339 time"} (omitted settings are unchanged)`, http.StatusBadRequest)
+		return
+	}
+	if payload.Cycle == "" {
+		handleErr(w, r, nil, "cycle cannot be empty", http.StatusBadRequest)
+		return
+	}
+	for _, limit := range []*int{payload.MaxRequestsPerReviewer, payload.MaxRequestsPerRequester} {
+		if limit != nil && *limit < 0 {
+			handleErr(w, r, nil, "request limits cannot be negative. Use 0 for no limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	before, err := GetCycle(a.db, payload.Cycle)
+	if err == nil {
+		err = UpdateCycleSettings(a.db, payload.Cycle, payload.CycleSettings)
+	}
+	if errors.Cause(err) == ErrCycleNotFound {
+		handleErr(w, r, err, "cycle not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to update cycle settings", http.StatusInternalServerError)
+		return
+	}
+	if payload.ClosesAt != nil {
+		a.scheduleClosingNotice(payload.Cycle, *payload.ClosesAt)
+	}
+	after, _ := GetCycle(a.db, payload.Cycle)
+	if err := a.audit(r, auditCycleSettingsUpdated, payload.Cycle, before, after); err != nil {
+		handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminCyclesAssignments(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Cycle  string `json:"cycle"`
+		DryRun bool   `json:"dry_run"`
+		AssignmentOptions
+		// Assignments are the assignments a dry run previewed. When set, exactly these are committed instead of a new plan.
+		Assignments []Assignment `json:"assignments"`
+	}
+	payload.ReviewersPerUser = 3
+	payload.CrossTeamPerUser = 1
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		handleErr(w, r, err, `unable to marshal body. Should be {"cycle":"cycle name", "reviewers_per_user":int, "cross_team_per_user":int, "dry_run":bool, "assignments":[previewed assignment]}`, http.StatusBadRequest)
+		return
+	}
+	if payload.Cycle == "" {
+		handleErr(w, r, nil, "cycle cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if payload.ReviewersPerUser < 1 || payload.CrossTeamPerUser < 0 {
+		handleErr(w, r, nil, "reviewers_per_user must be positive and cross_team_per_user cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		Assignments []Assignment `json:"assignments"`
+		Committed   bool         `json:"committed"`
+	}
+	switch {
+	case payload.DryRun:
+		data.Assignments, err = PlanAssignments(a.db, payload.Cycle, payload.AssignmentOptions)
+	case len(payload.Assignments) > 0:
+		data.Assignments = payload.Assignments
+		err = CommitAssignments(a.db, payload.Cycle, payload.Assignments)
+	default:
+		data.Assignments, err = PlanAndCommitAssignments(a.db, payload.Cycle, payload.AssignmentOptions)
+	}
+	if capErr, ok := errors.Cause(err).(RequestCapError); ok {
+		handleErr(w, r, err, capErr.Error(), http.StatusConflict)
+		return
+	} else if errors.Cause(err) == ErrDuplicateRequest {
+		handleErr(w, r, err, err.Error()+". Preview the assignments again", http.StatusConflict)
+		return
+	} else if errors.Cause(err) == ErrInvalidAssignment {
+		handleErr(w, r, err, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Cause(err) == ErrCycleNotFound {
+		handleErr(w, r, err, "cycle not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to assign reviewers", http.StatusInternalServerError)
+		return
+	}
+
+	if !payload.DryRun {
+		data.Committed = true
+		for _, assignment := range data.Assignments {
+			a.emitEvent(eventReviewRequestCreated, reviewRequestEvent{
+				Cycle:          payload.Cycle,
+				RequesterEmail: assignment.RevieweeEmail,
+				ReviewerEmail:  assignment.ReviewerEmail,
+				Status:         requestAccepted,
+				Source:         assignment.Source,
+			})
+		}
+		err = a.audit(r, auditAssignmentsCreated, payload.Cycle, nil, map[string]interface{}{
+			"reviewers_per_user":  payload.ReviewersPerUser,
+			"cross_team_per_user": payload.CrossTeamPerUser,
+			"assignments":         len(data.Assignments),
+			"previewed":           len(payload.Assignments) > 0,
+		})
+		if err != nil {
+			handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Printf("error encoding assignments response: %v", err)
+	}
+}
+
+func (a app) apiAdminReportsRequestedReviewers(w http.ResponseWriter, r *http.Request) {
+	cycle := chi.URLParam(r, "cycleName")
+	limit := 10
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			handleErr(w, r, err, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var data struct {
+		Reviewers []RequestedReviewer `json:"reviewers"`
+	}
+	var err error
+	data.Reviewers, err = GetMostRequestedReviewers(a.db, cycle, limit)
+	if err != nil {
+		handleErr(w, r, err, "unable to get requested reviewers", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminReportsCompletion(w http.ResponseWriter, r *http.Request) {
+	cycle := chi.URLParam(r, "cycleName")
+
+	var data struct {
+		Teams []TeamCompletion `json:"teams"`
+	}
+	var err error
+	data.Teams, err = GetTeamCompletion(a.db, cycle)
+	if err != nil {
+		handleErr(w, r, err, "unable to get completion", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminJobs(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !inList(status, []string{jobQueued, jobRunning, jobDone, jobDead}) {
+		handleErr(w, r, nil, "status must be one of queued, running, done, or dead", http.StatusBadRequest)
+		return
+	}
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			handleErr(w, r, err, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var data struct {
+		Jobs []Job `json:"jobs"`
+	}
+	var err error
+	data.Jobs, err = GetJobs(a.db, status, limit)
+	if err != nil {
+		handleErr(w, r, err, "unable to get jobs", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminJobRetry(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "jobID"))
+	if err != nil {
+		handleErr(w, r, err, "job id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	err = RetryJob(a.db, id)
+	switch errors.Cause(err) {
+	case nil:
+		if err := a.audit(r, auditJobRetried, strconv.Itoa(id), nil, nil); err != nil {
+			handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+			return
+		}
+	case ErrJobNotFound:
+		handleErr(w, r, err, "job not found", http.StatusNotFound)
+	case ErrJobState:
+		handleErr(w, r, err, "only failed jobs can be retried", http.StatusConflict)
+	default:
+		handleErr(w, r, err, "unable to retry job", http.StatusInternalServerError)
+	}
+}
+
+func (a app) apiAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		var data struct {
+			Webhooks []Webhook `json:"webhooks"`
+		}
+		var err error
+		data.Webhooks, err = GetWebhooks(a.db)
+		if err != nil {
+			handleErr(w, r, err, "unable to get webhooks", http.StatusInternalServerError)
+			return
+		}
+		err = json.NewEncoder(w).Encode(data)
+		if err != nil {
+			handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	var payload struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		handleErr(w, r, err, `unable to marshal body. Should be {"url":"https://...", "events":["event" or "*"], "secret":"optional"}`, http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		Webhook Webhook `json:"webhook"`
+	}
+	data.Webhook, err = AddWebhook(a.db, payload.URL, payload.Events, payload.Secret)
+	if errors.Cause(err) == ErrInvalidWebhook {
+		handleErr(w, r, err, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to add webhook", http.StatusInternalServerError)
+		return
+	}
+	// the secret stays out of the audit log
+	after := data.Webhook
+	after.Secret = ""
+	if err := a.audit(r, auditWebhookCreated, strconv.Itoa(after.ID), nil, after); err != nil {
+		handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Printf("error encoding webhook response: %v", err)
+	}
+}
+
+func (a app) apiAdminWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "webhookID"))
+	if err != nil {
+		handleErr(w, r, err, "webhook id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	webhooks, err := GetWebhooks(a.db)
+	if err != nil {
+		handleErr(w, r, err, "unable to get webhooks", http.StatusInternalServerError)
+		return
+	}
+	var before Webhook
+	for _, webhook := range webhooks {
+		if webhook.ID == id {
+			before = webhook
+		}
+	}
+
+	err = DeleteWebhook(a.db, id)
+	if errors.Cause(err) == ErrWebhookNotFound {
+		handleErr(w, r, err, "webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	if err := a.audit(r, auditWebhookDeleted, strconv.Itoa(id), before, nil); err != nil {
+		handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "webhookID"))
+	if err != nil {
+		handleErr(w, r, err, "webhook id must be a number", http.StatusBadRequest)
+		return
+	}
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			handleErr(w, r, err, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var data struct {
+		Deliveries []WebhookDelivery `json:"deliveries"`
+	}
+	data.Deliveries, err = GetWebhookDeliveries(a.db, id, limit)
+	if errors.Cause(err) == ErrWebhookNotFound {
+		handleErr(w, r, err, "webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to get webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminAudit(w http.ResponseWriter, r *http.Request) {
+	f, err := parseAuditFilter(r)
+	if err != nil {
+		handleErr(w, r, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Limit = 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		f.Limit, err = strconv.Atoi(l)
+		if err != nil || f.Limit < 1 {
+			handleErr(w, r, err, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var data struct {
+		Entries []AuditEntry `json:"entries"`
+		// NextCursor fetches the next page as ?cursor=. It is 0 on the last page.
+		NextCursor int `json:"next_cursor"`
+	}
+	data.Entries, err = GetAuditEntries(a.db, f)
+	if err != nil {
+		handleErr(w, r, err, "unable to get audit log", http.StatusInternalServerError)
+		return
+	}
+	if len(data.Entries) == f.Limit {
+		data.NextCursor = data.Entries[len(data.Entries)-1].ID
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminAuditExport(w http.ResponseWriter, r *http.Request) {
+	f, err := parseAuditFilter(r)
+	if err != nil {
+		handleErr(w, r, err, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := GetAuditEntries(a.db, f)
+	if err != nil {
+		handleErr(w, r, err, "unable to get audit log", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err = WriteAuditCSV(&buf, entries); err != nil {
+		handleErr(w, r, err, "unable to export audit log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	buf.WriteTo(w)
+}
+
+func (a app) apiAdminRetentionPurge(w http.ResponseWriter, r *http.Request) {
+	if a.retention == 0 {
+		handleErr(w, r, nil, "no retention policy is configured", http.StatusNotFound)
+		return
+	}
+	var dryRun bool
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			handleErr(w, r, err, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	report, err := PurgeExpiredFeedback(a.db, a.retention, time.Now(), dryRun)
+	if err != nil {
+		handleErr(w, r, err, "unable to purge expired feedback", http.StatusInternalServerError)
+		return
+	}
+	if !dryRun {
+		if err := a.audit(r, auditRetentionPurged, "reviews", nil, report); err != nil {
+			handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"report": report})
+	if err != nil {
+		log.Printf("error encoding retention purge response: %v", err)
+	}
+}
+
+func (a app) apiAdminRetentionPurges(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			handleErr(w, r, err, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var data struct {
+		Purges []RetentionPurge `json:"purges"`
+	}
+	var err error
+	data.Purges, err = GetRetentionPurges(a.db, limit)
+	if err != nil {
+		handleErr(w, r, err, "unable to get retention purges", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminBackups(w http.ResponseWriter, r *http.Request) {
+	if !a.backups.enabled() {
+		handleErr(w, r, nil, "no backup dir is configured", http.StatusNotFound)
+		return
+	}
+	var data struct {
+		Backups []Backup `json:"backups"`
+	}
+	var err error
+	data.Backups, err = ListBackups(a.backups.Dir)
+	if err != nil {
+		handleErr(w, r, err, "unable to list backups", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminBackupCreate(w http.ResponseWriter, r *http.Request) {
+	if !a.backups.enabled() {
+		handleErr(w, r, nil, "no backup dir is configured", http.StatusNotFound)
+		return
+	}
+	b, err := CreateBackup(a.db, a.backups, time.Now())
+	if err != nil {
+		handleErr(w, r, err, "unable to back up the db", http.StatusInternalServerError)
+		return
+	}
+	if err := a.audit(r, auditBackupCreated, b.Name, nil, b); err != nil {
+		handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"backup": b})
+	if err != nil {
+		log.Printf("error encoding backup response: %v", err)
+	}
+}
+
+func (a app) apiAdminLDAPSync(w http.ResponseWriter, r *http.Request) {
+	if !a.ldap.enabled() {
+		handleErr(w, r, nil, "ldap sync is not configured", http.StatusNotFound)
+		return
+	}
+	var dryRun bool
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			handleErr(w, r, err, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	run, err := runLDAPSync(a, dryRun)
+	if run.Status == ldapSyncFailed {
+		handleErr(w, r, err, "unable to sync with ldap: "+run.Error, http.StatusBadGateway)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to store ldap sync run", http.StatusInternalServerError)
+		return
+	}
+	if !dryRun {
+		if err := a.audit(r, auditLDAPSynced, a.ldap.URL, nil, run); err != nil {
+			handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"run": run})
+	if err != nil {
+		log.Printf("error encoding ldap sync response: %v", err)
+	}
+}
+
+func (a app) apiAdminLDAPRuns(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			handleErr(w, r, err, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var data struct {
+		Runs []LDAPSyncRun `json:"runs"`
+	}
+	var err error
+	data.Runs, err = GetLDAPSyncRuns(a.db, limit)
+	if err != nil {
+		handleErr(w, r, err, "unable to get ldap sync runs", http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+		return
+	}
+}
+
+// maxImportSize is the largest user import accepted, which is plenty for tens of thousands of users
+const maxImportSize = 10 << 20
+
+func (a app) apiAdminUsersImport(w http.ResponseWriter, r *http.Request) {
+	var dryRun bool
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			handleErr(w, r, err, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	report, err := ImportUsers(a.db, http.MaxBytesReader(w, r.Body, maxImportSize), dryRun)
+	if errors.Cause(err) == ErrInvalidImport {
+		handleErr(w, r, err, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to import users", http.StatusInternalServerError)
+		return
+	}
+
+	if report.Committed {
+		for _, team := range report.TeamsCreated {
+			a.emitEvent(eventTeamChanged, teamEvent{Team: team, Change: "created"})
+		}
+		for _, row := range report.Rows {
+			if row.Action == "create" {
+				a.emitEvent(eventUserCreated, userEvent{Email: row.Email, Name: row.name})
+			}
+			for _, team := range row.TeamsAdded {
+				a.emitEvent(eventTeamChanged, teamEvent{Team: team, Change: "member_added", UserEmail: row.Email})
+			}
+		}
+		if err := a.audit(r, auditUsersImported, "users", nil, report); err != nil {
+			handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	} else if report.Invalid > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("error encoding import report: %v", err)
+	}
+}
+
+func (a app) apiAdminUsersExport(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := ExportUsers(a.db, &buf); err != nil {
+		handleErr(w, r, err, "unable to export users", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+	buf.WriteTo(w)
+}
+
+func (a app) apiAdminUserDeactivate(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PurgeFeedback bool `json:"purge_feedback"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, &payload); err != nil {
+			handleErr(w, r, err, `unable to marshal body. Should be {"purge_feedback":false}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	email := chi.URLParam(r, "email")
+	before, err := GetUser(a.db, email)
+	if err != nil {
+		handleErr(w, r, err, "unable to get user", http.StatusInternalServerError)
+		return
+	}
+	d, err := DeactivateUser(a.db, email, payload.PurgeFeedback)
+	if errors.Cause(err) == ErrUserNotFound {
+		handleErr(w, r, err, "user not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to deactivate user", http.StatusInternalServerError)
+		return
+	}
+	if d.wasActive {
+		a.emitEvent(eventUserDeactivated, userEvent{Email: email, Name: before.Name})
+	}
+	if err := a.audit(r, auditUserDeactivated, email, map[string]bool{"is_active": d.wasActive}, d); err != nil {
+		handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(d)
+	if err != nil {
+		log.Printf("error encoding deactivation response: %v", err)
+	}
+}
+
+func (a app) apiAdminUserReactivate(w http.ResponseWriter, r *http.Request) {
+	email := chi.URLParam(r, "email")
+	before, err := GetUser(a.db, email)
+	if err != nil {
+		handleErr(w, r, err, "unable to get user", http.StatusInternalServerError)
+		return
+	}
+	wasActive, err := ReactivateUser(a.db, email)
+	if errors.Cause(err) == ErrUserNotFound {
+		handleErr(w, r, err, "user not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleErr(w, r, err, "unable to reactivate user", http.StatusInternalServerError)
+		return
+	}
+	if !wasActive {
+		a.emitEvent(eventUserReactivated, userEvent{Email: email, Name: before.Name})
+	}
+	if err := a.audit(r, auditUserReactivated, email, map[string]bool{"is_active": wasActive}, map[string]bool{"is_active": true}); err != nil {
+		handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (a app) apiAdminTeams(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		var data struct {
+			Teams []string `json:"teams"`
+		}
+		var err error
+		data.Teams, err = GetTeams(a.db)
+		if err != nil {
+			handleErr(w, r, err, "unable to get teams", http.StatusInternalServerError)
+			return
+		}
+		err = json.NewEncoder(w).Encode(data)
+		if err != nil {
+			// note, this will give an error of status code already written.
+			// TODO: have a new handler that does nto set status code?
+			handleErr(w, r, err, "unable to marshal payload", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	var payload struct {
+		Team string `json:"team"`
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleErr(w, r, err, "unable to read request body", http.StatusBadRequest)
+		return
+	}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		handleErr(w, r, err, `unable to marshal body. Should be {"team":"team name"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.Team == "" {
+		handleErr(w, r, nil, "team cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	teams, err := GetTeams(a.db)
+	if err != nil {
+		handleErr(w, r, err, "unable to get teams", http.StatusInternalServerError)
+		return
+	}
+	existed := inList(payload.Team, teams)
+
+	if r.Method == "POST" {
+		err = AddTeam(a.db, payload.Team)
+		if err != nil {
+			handleErr(w, r, err, "unable to add team", http.StatusInternalServerError)
+			return
+		}
+		if !existed {
+			a.emitEvent(eventTeamChanged, teamEvent{Team: payload.Team, Change: "created"})
+			if err := a.audit(r, auditTeamCreated, payload.Team, nil, map[string]string{"team": payload.Team}); err != nil {
+				handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	} else if r.Method == "DELETE" {
+		members, err := GetTeamMembers(a.db, payload.Team)
+		if err != nil {
+			handleErr(w, r, err, "unable to get team members", http.StatusInternalServerError)
+			return
+		}
+		err = DeleteTeam(a.db, payload.Team)
+		if err != nil {
+			handleErr(w, r, err, "unable to delete team", http.StatusInternalServerError)
+			return
+		}
+		if existed {
+			a.emitEvent(eventTeamChanged, teamEvent{Team: payload.Team, Change: "deleted"})
+			if err := a.audit(r, auditTeamDeleted, payload.Team, map[string]interface{}{"team": payload.Team, "members": members}, nil); err != nil {
+				handleErr(w, r, err, "unable to audit change", http.StatusInternalServerError)
+				return
+			}
+		}
+		return
+	} else {
+		handleErr(w, r, nil, "unexpected method "+r.Method, http.StatusBadRequest)
+		return
+	}
+}
+
+// handleErr is a unified way to handle all errors that need to be logged and presented to the user.
+// The err is logged internally and the msg is presented to the user.
+// TODO: if handleErr is called after w.Write(), we will get an error of multiple response.WriteHeader calls.
+// See for workarounds: https://stackoverflow.com/questions/39415827/golang-http-check-if-responsewriter-has-been-written
+func handleErr(w http.ResponseWriter, r *http.Request, err error, msg string, code int) {
+	// TODO get access to app's logger to get req id, path, etc for free
+	_, fn, line, _ := runtime.Caller(1)
+	entry := fmt.Sprintf("[ %s:%d ] %s", fn, line, msg)
+	if err == nil {
+		log.Printf("error: %s", entry)
 	} else {
 		log.Printf("error: %s - %v", entry, err)
 	}
@@ -531,6 +1893,34 @@ func AuthMW(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// AdminMW only lets admins through. It runs after AuthMW. Users flagged as admins and the -admin-emails are admins, so
+// a new instance can be set up before anyone is flagged.
+func (a app) AdminMW(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		email := r.Context().Value(ctxEmail).(string)
+		isAdmin := false
+		for _, adminEmail := range a.adminEmails {
+			if strings.EqualFold(adminEmail, email) {
+				isAdmin = true
+			}
+		}
+		if !isAdmin {
+			info, err := GetUser(a.db, email)
+			if err != nil {
+				handleErr(w, r, err, "unable to look up user", http.StatusInternalServerError)
+				return
+			}
+			isAdmin = info.IsAdmin && info.IsActive
+		}
+		if !isAdmin {
+			handleErr(w, r, nil, "admins only", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
 // JSONConfig is the format of the json file located
 // at https://console.developers.google.com/apis/credentials
 type JSONConfig struct {
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ An instance document is everything needed to move peerreview to another environment or storage backend: users, teams
+ and their members, goals, cycles, prompts, reviews, review requests, review submissions, and prompt answers, as versioned json. Rows refer to
+ each other by email, team name, and cycle name instead of by id. `peerreview export [path]` writes one and
+ `peerreview import path` loads one into an empty database.
+
+ Feedback stays anonymous. Reviews are sorted by recipient, cycle, and text, and are inserted in that order on import, so
+ neither the document nor the new ids say in what order feedback was written, and reviews can not be matched to the
+ submissions and prompt answers that record who gave feedback. Feedback, goals, and prompts are written as plaintext, so treat the document like the
+ database, and they are encrypted again on import if a key is set. Sessions, jobs, notifications, webhooks, chat
+ accounts, and the audit log are left behind.
+*/
+
+const instanceFormat = "peerreview-instance"
+const instanceVersion = 1
+
+// ErrDBNotEmpty is returned when importing into a database that already has users, teams, or cycles
+var ErrDBNotEmpty = errors.New("database is not empty")
+
+// InstanceDocument is a whole instance
+type InstanceDocument struct {
+	Format      string               `json:"format"`
+	Version     int                  `json:"version"`
+	ExportedAt  time.Time            `json:"exported_at"`
+	Users       []InstanceUser       `json:"users"`
+	Teams       []InstanceTeam       `json:"teams"`
+	Goals       []InstanceGoal       `json:"goals"`
+	Cycles      []InstanceCycle      `json:"cycles"`
+	Prompts     []InstancePrompt     `json:"prompts"`
+	Reviews     []InstanceReview     `json:"reviews"`
+	Requests    []InstanceRequest    `json:"review_requests"`
+	Submissions []InstanceSubmission `json:"review_submissions"`
+}
+
+// InstanceUser is a user. Manager is the manager's email.
+type InstanceUser struct {
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	Goals       string `json:"goals"`
+	Manager     string `json:"manager,omitempty"`
+	EmailOptOut bool   `json:"email_opt_out"`
+	IsAdmin     bool   `json:"is_admin"`
+	IsActive    bool   `json:"is_active"`
+	LDAPDN      string `json:"ldap_dn,omitempty"`
+}
+
+// InstanceTeam is a team and the emails of its members
+type InstanceTeam struct {
+	Name    string   `json:"name"`
+	LDAPDN  string   `json:"ldap_dn,omitempty"`
+	Members []string `json:"members"`
+}
+
+// InstanceGoal is a goal and the email of the user it belongs to
+type InstanceGoal struct {
+	Goal
+	User string `json:"user"`
+}
+
+// InstanceCycle is a cycle
+type InstanceCycle struct {
+	Cycle
+	ClosingNoticeSent bool `json:"closing_notice_sent"`
+}
+
+// InstancePrompt is a question a requester asked in their review requests during a cycle. ID is only used within the
+// document.
+type InstancePrompt struct {
+	ID        int       `json:"id"`
+	Recipient string    `json:"recipient"`
+	Cycle     string    `json:"cycle"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+	// Answers is how many reviewers answered the prompt, see prompts.go
+	Answers int `json:"answers"`
+}
+
+// InstanceReview is one strength or growth opportunity. There is no reviewer.
+type InstanceReview struct {
+	Recipient           string     `json:"recipient"`
+	Cycle               string     `json:"cycle"`
+	Feedback            string     `json:"feedback"`
+	IsStrength          bool       `json:"is_strength"`
+	IsGrowthOpportunity bool       `json:"is_growth_opportunity"`
+	PurgedAt            *time.Time `json:"purged_at,omitempty"`
+	// GoalID is the id in this document of the recipient's goal the feedback is about, and PromptID of the prompt it
+	// answers
+	GoalID   int `json:"goal_id,omitempty"`
+	PromptID int `json:"prompt_id,omitempty"`
+}
+
+// InstanceRequest is a review request
+type InstanceRequest struct {
+	Recipient     string `json:"recipient"`
+	Reviewer      string `json:"reviewer"`
+	Cycle         string `json:"cycle"`
+	Status        string `json:"status"`
+	DeclineReason string `json:"decline_reason"`
+	// PromptID is the id in this document of the prompt asked with the request
+	PromptID int `json:"prompt_id,omitempty"`
+}
+
+// InstanceSubmission records that a reviewer gave a reviewee feedback in a cycle
+type InstanceSubmission struct {
+	Reviewer    string `json:"reviewer"`
+	Reviewee    string `json:"reviewee"`
+	Cycle       string `json:"cycle"`
+	SubmittedOn string `json:"submitted_on"`
+}
+
+// ExportInstance reads the whole instance
+func ExportInstance(db *sql.DB, now time.Time) (InstanceDocument, error) {
+	doc := InstanceDocument{Format: instanceFormat, Version: instanceVersion, ExportedAt: now.UTC()}
+	var err error
+	if doc.Users, err = exportInstanceUsers(db); err != nil {
+		return doc, err
+	}
+	if doc.Teams, err = exportInstanceTeams(db); err != nil {
+		return doc, err
+	}
+	cycles, err := GetCycles(db)
+	if err != nil {
+		return doc, err
+	}
+	doc.Cycles = []InstanceCycle{}
+	for _, c := range cycles {
+		ic := InstanceCycle{Cycle: c}
+		if err = db.QueryRow("select closing_notice_sent from review_cycles where name=?", c.Name).Scan(&ic.ClosingNoticeSent); err != nil {
+			return doc, errors.Wrap(err, "unable to read closing_notice_sent")
+		}
+		doc.Cycles = append(doc.Cycles, ic)
+	}
+	if doc.Goals, err = exportInstanceGoals(db); err != nil {
+		return doc, err
+	}
+	if doc.Prompts, err = exportInstancePrompts(db); err != nil {
+		return doc, err
+	}
+	if doc.Reviews, err = exportInstanceReviews(db); err != nil {
+		return doc, err
+	}
+	if doc.Requests, err = exportInstanceRequests(db); err != nil {
+		return doc, err
+	}
+	if doc.Submissions, err = exportInstanceSubmissions(db); err != nil {
+		return doc, err
+	}
+	return doc, nil
+}
+
+func exportInstanceUsers(db *sql.DB) ([]InstanceUser, error) {
+	q := `
+    SELECT users.name,
+           users.email,
+           users.goals,
+           coalesce(managers.email, ""),
+           users.email_opt_out,
+           users.is_admin,
+           users.is_active,
+           coalesce(users.ldap_dn, "")
+    FROM   users
+           LEFT JOIN users managers
+                  ON users.manager_id = managers.id
+    ORDER  BY users.email
+    `
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query users for export")
+	}
+	defer rows.Close()
+	users := []InstanceUser{}
+	for rows.Next() {
+		var u InstanceUser
+		if err = rows.Scan(&u.Name, &u.Email, &u.Goals, &u.Manager, &u.EmailOptOut, &u.IsAdmin, &u.IsActive, &u.LDAPDN); err != nil {
+			return nil, errors.Wrap(err, "unable to scan users for export")
+		}
+		if u.Goals, err = decryptField(u.Goals); err != nil {
+			return nil, errors.Wrapf(err, "unable to decrypt goals for %s", u.Email)
+		}
+		users = append(users, u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of users for export")
+	}
+	return users, nil
+}
+
+func exportInstanceTeams(db *sql.DB) ([]InstanceTeam, error) {
+	rows, err := db.Query(`select name, coalesce(ldap_dn, "") from teams order by name`)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query teams for export")
+	}
+	teams := []InstanceTeam{}
+	for rows.Next() {
+		var t InstanceTeam
+		if err = rows.Scan(&t.Name, &t.LDAPDN); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "unable to scan teams for export")
+		}
+		teams = append(teams, t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of teams for export")
+	}
+	for i := range teams {
+		if teams[i].Members, err = GetTeamMembers(db, teams[i].Name); err != nil {
+			return nil, err
+		}
+		sort.Strings(teams[i].Members)
+	}
+	return teams, nil
+}
+
+func exportInstanceGoals(db *sql.DB) ([]InstanceGoal, error) {
+	rows, err := db.Query("select email from users where id in (select user_id from goals) order by email")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query goal owners for export")
+	}
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "unable to scan goal owners for export")
+		}
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of goal owners for export")
+	}
+
+	goals := []InstanceGoal{}
+	for _, email := range emails {
+		userGoals, err := GetGoals(db, email, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range userGoals {
+			goals = append(goals, InstanceGoal{Goal: g, User: email})
+		}
+	}
+	return goals, nil
+}
+
+func exportInstancePrompts(db *sql.DB) ([]InstancePrompt, error) {
+	q := `
+    SELECT prompts.id,
+           users.email,
+           review_cycles.name,
+           prompts.text,
+           prompts.created_at,
+           prompts.answers
+    FROM   prompts
+           JOIN users
+             ON prompts.recipient_id = users.id
+           JOIN review_cycles
+             ON prompts.cycle_id = review_cycles.id
+    ORDER  BY prompts.id
+    `
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query prompts for export")
+	}
+	defer rows.Close()
+	prompts := []InstancePrompt{}
+	for rows.Next() {
+		var p InstancePrompt
+		var createdAt int64
+		if err = rows.Scan(&p.ID, &p.Recipient, &p.Cycle, &p.Text, &createdAt, &p.Answers); err != nil {
+			return nil, errors.Wrap(err, "unable to scan prompts for export")
+		}
+		if p.Text, err = decryptField(p.Text); err != nil {
+			return nil, errors.Wrap(err, "unable to decrypt prompt for export")
+		}
+		p.CreatedAt = time.Unix(createdAt, 0).UTC()
+		prompts = append(prompts, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of prompts for export")
+	}
+	return prompts, nil
+}
+
+func exportInstanceReviews(db *sql.DB) ([]InstanceReview, error) {
+	q := `
+    SELECT users.email,
+           review_cycles.name,
+           reviews.feedback,
+           reviews.is_strength,
+           reviews.is_growth_opportunity,
+           reviews.purged_at,
+           coalesce(reviews.goal_id, 0),
+           coalesce(reviews.prompt_id, 0)
+    FROM   reviews
+           JOIN users
+             ON reviews.recipient_id = users.id
+           JOIN review_cycles
+             ON reviews.review_cycle_id = review_cycles.id
+    `
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query reviews for export")
+	}
+	defer rows.Close()
+	reviews := []InstanceReview{}
+	for rows.Next() {
+		var r InstanceReview
+		var purgedAt sql.NullInt64
+		if err = rows.Scan(&r.Recipient, &r.Cycle, &r.Feedback, &r.IsStrength, &r.IsGrowthOpportunity, &purgedAt, &r.GoalID, &r.PromptID); err != nil {
+			return nil, errors.Wrap(err, "unable to scan reviews for export")
+		}
+		if r.Feedback, err = decryptField(r.Feedback); err != nil {
+			return nil, errors.Wrap(err, "unable to decrypt review for export")
+		}
+		if purgedAt.Valid {
+			t := time.Unix(purgedAt.Int64, 0).UTC()
+			r.PurgedAt = &t
+		}
+		reviews = append(reviews, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of reviews for export")
+	}
+	sortInstanceReviews(reviews)
+	return reviews, nil
+}
+
+// sortInstanceReviews puts reviews in an order that says nothing about when they were written
+func sortInstanceReviews(reviews []InstanceReview) {
+	sort.Slice(reviews, func(i, j int) bool {
+		a, b := reviews[i], reviews[j]
+		if a.Recipient != b.Recipient {
+			return a.Recipient < b.Recipient
+		}
+		if a.Cycle != b.Cycle {
+			return a.Cycle < b.Cycle
+		}
+		if a.IsStrength != b.IsStrength {
+			return a.IsStrength
+		}
+		return a.Feedback < b.Feedback
+	})
+}
+
+func exportInstanceRequests(db *sql.DB) ([]InstanceRequest, error) {
+	q := `
+    SELECT recipient.email,
+           reviewer.email,
+           review_cycles.name,
+           review_requests.status,
+           review_requests.decline_reason,
+           coalesce(review_requests.prompt_id, 0)
+    FROM   review_requests
+           JOIN users recipient
+             ON review_requests.recipient_id = recipient.id
+           JOIN users reviewer
+             ON review_requests.reviewer_id = reviewer.id
+           JOIN review_cycles
+             ON review_requests.cycle_id = review_cycles.id
+    ORDER  BY review_requests.id
+    `
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query review requests for export")
+	}
+	defer rows.Close()
+	requests := []InstanceRequest{}
+	for rows.Next() {
+		var r InstanceRequest
+		if err = rows.Scan(&r.Recipient, &r.Reviewer, &r.Cycle, &r.Status, &r.DeclineReason, &r.PromptID); err != nil {
+			return nil, errors.Wrap(err, "unable to scan review requests for export")
+		}
+		requests = append(requests, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of review requests for export")
+	}
+	return requests, nil
+}
+
+func exportInstanceSubmissions(db *sql.DB) ([]InstanceSubmission, error) {
+	q := `
+    SELECT reviewer.email,
+           reviewee.email,
+           review_cycles.name,
+           review_submissions.submitted_on
+    FROM   review_submissions
+           JOIN users reviewer
+             ON review_submissions.reviewer_id = reviewer.id
+           JOIN users reviewee
+             ON review_submissions.reviewee_id = reviewee.id
+           JOIN review_cycles
+             ON review_submissions.cycle_id = review_cycles.id
+    ORDER  BY review_cycles.name,
+              reviewer.email,
+              reviewee.email
+    `
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query review submissions for export")
+	}
+	defer rows.Close()
+	submissions := []InstanceSubmission{}
+	for rows.Next() {
+		var s InstanceSubmission
+		if err = rows.Scan(&s.Reviewer, &s.Reviewee, &s.Cycle, &s.SubmittedOn); err != nil {
+			return nil, errors.Wrap(err, "unable to scan review submissions for export")
+		}
+		submissions = append(submissions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of review submissions for export")
+	}
+	return submissions, nil
+}
+
+// WriteInstance writes doc as indented json
+func WriteInstance(w io.Writer, doc InstanceDocument) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return errors.Wrap(enc.Encode(doc), "unable to write instance document")
+}
+
+// ReadInstance reads an instance document, checking it is one this version understands
+func ReadInstance(r io.Reader) (InstanceDocument, error) {
+	var doc InstanceDocument
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return doc, errors.Wrap(err, "unable to read instance document")
+	}
+	if doc.Format != instanceFormat {
+		return doc, errors.Errorf("not an instance document. Got format %q", doc.Format)
+	}
+	if doc.Version != instanceVersion {
+		return doc, errors.Errorf("unsupported instance document version %d. This version reads %d", doc.Version, instanceVersion)
+	}
+	return doc, nil
+}
+
+// ImportInstance loads doc into an empty database. It is all or nothing.
+func ImportInstance(db *sql.DB, doc InstanceDocument) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for ImportInstance")
+	}
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on ImportInstance")
+		}
+	}()
+
+	var n int
+	if err = tx.QueryRow("select (select count(*) from users) + (select count(*) from teams) + (select count(*) from review_cycles)").Scan(&n); err != nil {
+		return errors.Wrap(err, "unable to check the database is empty")
+	}
+	if n > 0 {
+		return ErrDBNotEmpty
+	}
+
+	userIDs := make(map[string]int64)
+	for _, u := range doc.Users {
+		if _, ok := userIDs[u.Email]; ok || u.Email == "" {
+			return errors.Errorf("user %q is missing or repeated", u.Email)
+		}
+		goals, err := encryptField(u.Goals)
+		if err != nil {
+			return errors.Wrapf(err, "unable to encrypt goals for %s", u.Email)
+		}
+		res, err := tx.Exec("insert into users (name, email, goals, email_opt_out, is_admin, is_active, ldap_dn) values (?, ?, ?, ?, ?, ?, ?)",
+			u.Name, u.Email, goals, u.EmailOptOut, u.IsAdmin, u.IsActive, nullIfEmpty(u.LDAPDN))
+		if err != nil {
+			return errors.Wrapf(err, "unable to import user %s", u.Email)
+		}
+		if userIDs[u.Email], err = res.LastInsertId(); err != nil {
+			return errors.Wrap(err, "unable to get imported user id")
+		}
+	}
+	userID := func(email string) (int64, error) {
+		id, ok := userIDs[email]
+		if !ok {
+			return 0, errors.Errorf("unknown user %q", email)
+		}
+		return id, nil
+	}
+	// managers are set once everyone exists
+	for _, u := range doc.Users {
+		if u.Manager == "" {
+			continue
+		}
+		managerID, err := userID(u.Manager)
+		if err != nil {
+			return errors.Wrapf(err, "manager of %s", u.Email)
+		}
+		if _, err = tx.Exec("update users set manager_id=? where id=?", managerID, userIDs[u.Email]); err != nil {
+			return errors.Wrapf(err, "unable to import manager of %s", u.Email)
+		}
+	}
+
+	for _, t := range doc.Teams {
+		res, err := tx.Exec("insert into teams (name, ldap_dn) values (?, ?)", t.Name, nullIfEmpty(t.LDAPDN))
+		if err != nil {
+			return errors.Wrapf(err, "unable to import team %s", t.Name)
+		}
+		teamID, err := res.LastInsertId()
+		if err != nil {
+			return errors.Wrap(err, "unable to get imported team id")
+		}
+		for _, email := range t.Members {
+			id, err := userID(email)
+			if err != nil {
+				return errors.Wrapf(err, "member of %s", t.Name)
+			}
+			if _, err = tx.Exec("insert into user_teams (user_id, team_id) values (?, ?)", id, teamID); err != nil {
+				return errors.Wrapf(err, "unable to import member of %s", t.Name)
+			}
+		}
+	}
+
+	cycleIDs := make(map[string]int64)
+	for _, c := range doc.Cycles {
+		if _, ok := cycleIDs[c.Name]; ok || c.Name == "" {
+			return errors.Errorf("cycle %q is missing or repeated", c.Name)
+		}
+		var closesAt sql.NullString
+		if c.ClosesAt != nil {
+			closesAt = sql.NullString{String: c.ClosesAt.UTC().Format(time.RFC3339), Valid: true}
+		}
+		q := `
+        INSERT INTO review_cycles
+                    (name,
+                     is_open,
+                     max_requests_per_reviewer,
+                     max_requests_per_requester,
+                     require_manager_approval,
+                     closes_at,
+                     closing_notice_sent,
+                     created_at)
+        VALUES      (?, ?, ?, ?, ?, ?, ?, ?)
+        `
+		res, err := tx.Exec(q, c.Name, c.IsOpen, c.MaxRequestsPerReviewer, c.MaxRequestsPerRequester, c.RequireManagerApproval, closesAt, c.ClosingNoticeSent, c.CreatedAt.Unix())
+		if err != nil {
+			return errors.Wrapf(err, "unable to import cycle %s", c.Name)
+		}
+		if cycleIDs[c.Name], err = res.LastInsertId(); err != nil {
+			return errors.Wrap(err, "unable to get imported cycle id")
+		}
+	}
+	cycleID := func(name string) (int64, error) {
+		id, ok := cycleIDs[name]
+		if !ok {
+			return 0, errors.Errorf("unknown cycle %q", name)
+		}
+		return id, nil
+	}
+
+	// goal ids in the document are mapped to their new ids for the reviews about them
+	goalIDs := make(map[int]int64)
+	for _, g := range doc.Goals {
+		id, err := userID(g.User)
+		if err != nil {
+			return errors.Wrap(err, "goal")
+		}
+		var cID sql.NullInt64
+		if g.Cycle != "" {
+			if cID.Int64, err = cycleID(g.Cycle); err != nil {
+				return errors.Wrap(err, "goal cycle")
+			}
+			cID.Valid = true
+		}
+		title, err := encryptField(g.Title)
+		if err != nil {
+			return errors.Wrap(err, "unable to encrypt goal title")
+		}
+		description, err := encryptField(g.Description)
+		if err != nil {
+			return errors.Wrap(err, "unable to encrypt goal description")
+		}
+		q := "insert into goals (user_id, title, description, status, cycle_id, created_at, updated_at) values (?, ?, ?, ?, ?, ?, ?)"
+		res, err := tx.Exec(q, id, title, description, g.Status, cID, g.CreatedAt.Unix(), g.UpdatedAt.Unix())
+		if err != nil {
+			return errors.Wrapf(err, "unable to import goal for %s", g.User)
+		}
+		if goalIDs[g.ID], err = res.LastInsertId(); err != nil {
+			return errors.Wrap(err, "unable to get imported goal id")
+		}
+	}
+
+	// prompt ids in the document are mapped to their new ids for the requests and reviews that use them
+	promptIDs := make(map[int]int64)
+	for _, p := range doc.Prompts {
+		id, err := userID(p.Recipient)
+		if err != nil {
+			return errors.Wrap(err, "prompt recipient")
+		}
+		cID, err := cycleID(p.Cycle)
+		if err != nil {
+			return errors.Wrap(err, "prompt cycle")
+		}
+		text, err := encryptField(p.Text)
+		if err != nil {
+			return errors.Wrap(err, "unable to encrypt prompt")
+		}
+		q := "insert into prompts (recipient_id, cycle_id, text, created_at, answers) values (?, ?, ?, ?, ?)"
+		res, err := tx.Exec(q, id, cID, text, p.CreatedAt.Unix(), p.Answers)
+		if err != nil {
+			return errors.Wrapf(err, "unable to import prompt for %s", p.Recipient)
+		}
+		if promptIDs[p.ID], err = res.LastInsertId(); err != nil {
+			return errors.Wrap(err, "unable to get imported prompt id")
+		}
+	}
+	promptID := func(id int) (sql.NullInt64, error) {
+		var n sql.NullInt64
+		if id == 0 {
+			return n, nil
+		}
+		if n.Int64, n.Valid = promptIDs[id]; !n.Valid {
+			return n, errors.Errorf("unknown prompt %d", id)
+		}
+		return n, nil
+	}
+
+	// sorted again so that a hand made document can not carry the order feedback was written in into the new ids
+	reviews := append([]InstanceReview(nil), doc.Reviews...)
+	sortInstanceReviews(reviews)
+	for _, r := range reviews {
+		recipientID, err := userID(r.Recipient)
+		if err != nil {
+			return errors.Wrap(err, "review recipient")
+		}
+		cID, err := cycleID(r.Cycle)
+		if err != nil {
+			return errors.Wrap(err, "review cycle")
+		}
+		feedback, err := encryptField(r.Feedback)
+		if err != nil {
+			return errors.Wrap(err, "unable to encrypt review")
+		}
+		var purgedAt sql.NullInt64
+		if r.PurgedAt != nil {
+			purgedAt = sql.NullInt64{Int64: r.PurgedAt.Unix(), Valid: true}
+		}
+		var goalID sql.NullInt64
+		if r.GoalID != 0 {
+			if goalID.Int64, goalID.Valid = goalIDs[r.GoalID]; !goalID.Valid {
+				return errors.Errorf("review is about unknown goal %d", r.GoalID)
+			}
+		}
+		pID, err := promptID(r.PromptID)
+		if err != nil {
+			return errors.Wrap(err, "review prompt")
+		}
+		q := "insert into reviews (recipient_id, review_cycle_id, feedback, is_strength, is_growth_opportunity, purged_at, goal_id, prompt_id) values (?, ?, ?, ?, ?, ?, ?, ?)"
+		if _, err = tx.Exec(q, recipientID, cID, feedback, r.IsStrength, r.IsGrowthOpportunity, purgedAt, goalID, pID); err != nil {
+			return errors.Wrap(err, "unable to import review")
+		}
+	}
+
+	for _, r := range doc.Requests {
+		recipientID, err := userID(r.Recipient)
+		if err != nil {
+			return errors.Wrap(err, "review request recipient")
+		}
+		reviewerID, err := userID(r.Reviewer)
+		if err != nil {
+			return errors.Wrap(err, "review request reviewer")
+		}
+		cID, err := cycleID(r.Cycle)
+		if err != nil {
+			return errors.Wrap(err, "review request cycle")
+		}
+		pID, err := promptID(r.PromptID)
+		if err != nil {
+			return errors.Wrap(err, "review request prompt")
+		}
+		q := "insert into review_requests (recipient_id, reviewer_id, cycle_id, status, decline_reason, prompt_id) values (?, ?, ?, ?, ?, ?)"
+		if _, err = tx.Exec(q, recipientID, reviewerID, cID, r.Status, r.DeclineReason, pID); err != nil {
+			return errors.Wrap(err, "unable to import review request")
+		}
+	}
+
+	for _, s := range doc.Submissions {
+		reviewerID, err := userID(s.Reviewer)
+		if err != nil {
+			return errors.Wrap(err, "review submission reviewer")
+		}
+		revieweeID, err := userID(s.Reviewee)
+		if err != nil {
+			return errors.Wrap(err, "review submission reviewee")
+		}
+		cID, err := cycleID(s.Cycle)
+		if err != nil {
+			return errors.Wrap(err, "review submission cycle")
+		}
+		q := "insert into review_submissions (reviewer_id, reviewee_id, cycle_id, submitted_on) values (?, ?, ?, ?)"
+		if _, err = tx.Exec(q, reviewerID, revieweeID, cID, s.SubmittedOn); err != nil {
+			return errors.Wrap(err, "unable to import review submission")
+		}
+	}
+	return nil
+}
+
+// nullIfEmpty stores "" as NULL, for columns such as ldap_dn where NULL means unset
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestInstanceExportImport(t *testing.T) {
+	/*
+		Verify an export imported into an empty db exports the same document, keeping relationships
+		Verify reviews are sorted and never name a reviewer
+		Verify import refuses a db that is not empty and documents it does not understand
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "reviewee", "reviewee@example.com"), "creating user")
+	NoErr(t, CreateUser(cli.db, "manager", "manager@example.com"), "creating user")
+	NoErr(t, SetUserManager(cli.db, "reviewee@example.com", "manager@example.com"), "setting manager")
+	NoErr(t, cli.InsertTeam("team_1"), "adding team")
+	NoErr(t, cli.AssignTeamToUser("team_1"), "joining team")
+	NoErr(t, AssignTeamToUser(cli.db, "reviewee@example.com", "team_1"), "joining team")
+	NoErr(t, cli.SetUserGoal("my goal"), "setting goal")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	closesAt := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	NoErr(t, UpdateCycleSettings(cli.db, "cycle_1", CycleSettings{ClosesAt: &closesAt}), "setting close date")
+	_, err := cli.AddGoal("my structured goal", "details", "cycle_1")
+	NoErr(t, err, "adding goal")
+	revieweeGoal, err := cli.as("reviewee@example.com").AddGoal("reviewee goal", "", "")
+	NoErr(t, err, "adding goal")
+	NoErr(t, cli.AddReviewerWithPrompt("reviewee@example.com", "cycle_1", "how was my launch?"), "requesting review")
+	NoErr(t, cli.AddReviewForUser("reviewee@example.com", "cycle_1", []string{"zebra strength", "apple strength"}, []string{"growth"}), "adding review")
+	NoErr(t, cli.AddReviewItemsForUser("reviewee@example.com", "cycle_1", []FeedbackItem{{Text: "goal strength", GoalID: revieweeGoal.ID}}, []FeedbackItem{{Text: "more growth"}}), "adding review")
+	prompts, err := getPrompts(cli.db, cli.userEmail)
+	NoErr(t, err, "getting prompts")
+	NoErr(t, cli.as("reviewee@example.com").AddReviewItemsForUser(cli.userEmail, "cycle_1", []FeedbackItem{{Text: "launch strength", PromptID: prompts[0].ID}}, []FeedbackItem{{Text: "launch growth"}}), "answering prompt")
+
+	doc, err := ExportInstance(cli.db, time.Now())
+	NoErr(t, err, "exporting")
+	var order []string
+	for _, r := range doc.Reviews {
+		order = append(order, r.Feedback)
+	}
+	if strings.Join(order, ",") != "launch strength,launch growth,apple strength,goal strength,zebra strength,growth,more growth" {
+		t.Errorf("got reviews %v, want them sorted", order)
+	}
+	if len(doc.Users) != 3 || len(doc.Teams) != 1 || len(doc.Teams[0].Members) != 2 || len(doc.Goals) != 2 || len(doc.Prompts) != 1 || len(doc.Requests) != 1 || doc.Requests[0].PromptID != doc.Prompts[0].ID || len(doc.Submissions) != 2 {
+		t.Errorf("got %+v, want 3 users, a team of 2, 2 goals, a request with a prompt, and 2 submissions", doc)
+	}
+
+	var buf bytes.Buffer
+	NoErr(t, WriteInstance(&buf, doc), "writing document")
+	if strings.Contains(buf.String(), "reviewer_id") {
+		t.Error("got a reviewer id in the document")
+	}
+	read, err := ReadInstance(&buf)
+	NoErr(t, err, "reading document")
+
+	dir, err := ioutil.TempDir("", "peerreview_instance")
+	NoErr(t, err, "creating dir")
+	defer os.RemoveAll(dir)
+	dbfile := filepath.Join(dir, "peerreview.db")
+	NoErr(t, InitDB(dbfile), "creating empty db")
+	db, err := OpenDB(dbfile)
+	NoErr(t, err, "opening empty db")
+	defer db.Close()
+	NoErr(t, ImportInstance(db, read), "importing")
+
+	again, err := ExportInstance(db, doc.ExportedAt)
+	NoErr(t, err, "exporting the import")
+	if !reflect.DeepEqual(normalizedInstance(t, doc), normalizedInstance(t, again)) {
+		t.Errorf("got\n%+v\nwant\n%+v", again, doc)
+	}
+	info, err := GetUser(db, "reviewee@example.com")
+	NoErr(t, err, "getting imported user")
+	if info.Manager != "manager@example.com" || strings.Join(info.Teams, ",") != "team_1" {
+		t.Errorf("got %+v, want the manager and team kept", info)
+	}
+	reviews, err := GetUserReviews(db, "reviewee@example.com")
+	NoErr(t, err, "getting imported reviews")
+	if len(reviews) != 1 || len(reviews[0].Goals) != 1 || reviews[0].Goals[0].Title != "reviewee goal" {
+		t.Errorf("got %+v, want feedback about the goal still grouped under it", reviews)
+	}
+
+	if err = ImportInstance(db, read); errors.Cause(err) != ErrDBNotEmpty {
+		t.Errorf("got %v, want ErrDBNotEmpty importing twice", err)
+	}
+	if _, err = ReadInstance(strings.NewReader(`{"format":"peerreview-instance","version":99}`)); err == nil {
+		t.Error("got no error reading an unknown version")
+	}
+}
+
+// normalizedInstance round trips doc through json, as times lose their monotonic clock and location when written
+func normalizedInstance(t *testing.T, doc InstanceDocument) InstanceDocument {
+	var buf bytes.Buffer
+	NoErr(t, WriteInstance(&buf, doc), "writing document")
+	doc, err := ReadInstance(&buf)
+	NoErr(t, err, "reading document")
+	return doc
+}
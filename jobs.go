@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ jobs is a persistent queue of background work. Anything that should happen outside of a request, or that must not be
+ lost if the process restarts (like sending email), is enqueued as a job. Because jobs live in the db, they can be
+ enqueued in the same transaction as the change that caused them so either both happen or neither does.
+
+ Workers claim due jobs and run the handler registered for the job's kind. A job that fails is retried with an
+ exponential backoff until it runs out of attempts, at which point it is dead lettered and left for an admin to look at
+ and retry.
+*/
+
+// job statuses
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobDead    = "dead"
+)
+
+// job kinds
+const (
+	jobSendEmail     = "send_email"
+	jobClosingNotice = "closing_notice"
+)
+
+// defaultJobAttempts is how many times a job is tried before it is dead lettered
+const defaultJobAttempts = 5
+
+// maxJobBackoff caps how long a failing job waits before its next attempt
+const maxJobBackoff = time.Hour
+
+// ErrJobNotFound is returned when a job does not exist
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrJobState is returned when a job can not be retried because it has not failed
+var ErrJobState = errors.New("job has not failed")
+
+// jobHandler does the work for a job. Returning an error means the job is retried later.
+type jobHandler func(a app, payload []byte) error
+
+// jobHandlers maps each job kind to the function that runs it
+var jobHandlers map[string]jobHandler
+
+// jobRetryHooks reset the state a job kind keeps outside of the jobs table, such as a webhook delivery's attempts, when
+// the job is retried
+var jobRetryHooks = map[string]func(tx *sql.Tx, payload []byte) error{
+	jobWebhookDelivery: resetWebhookDelivery,
+}
+
+func init() {
+	// set in init as handlers can enqueue jobs themselves, which checks this map
+	jobHandlers = map[string]jobHandler{
+		jobSendEmail:       sendEmailJob,
+		jobClosingNotice:   closingNoticeJob,
+		jobWebhookDelivery: webhookDeliveryJob,
+	}
+}
+
+// periodicTask is work the runner does on an interval. Periodic tasks are not persisted; anything that needs retries
+// should enqueue a job.
+type periodicTask struct {
+	name  string
+	every time.Duration
+	run   func(a app) error
+}
+
+var periodicTasks = []periodicTask{
+	{name: "prune_auth", every: 5 * time.Minute, run: func(app) error { PruneAuth(); return nil }},
+	{name: "reminders", every: time.Hour, run: func(a app) error { return sendReminders(a, time.Now()) }},
+	{name: "admin_digest", every: time.Hour, run: func(a app) error { return sendAdminDigest(a, time.Now()) }},
+	{name: "ldap_sync", every: 5 * time.Minute, run: func(a app) error { return ldapSyncTask(a, time.Now()) }},
+	{name: "retention", every: time.Hour, run: func(a app) error { return retentionTask(a, time.Now()) }},
+	{name: "backup", every: 5 * time.Minute, run: func(a app) error { return backupTask(a, time.Now()) }},
+}
+
+// Job is a unit of background work
+type Job struct {
+	ID          int             `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	LastError   string          `json:"last_error"`
+	RunAt       time.Time       `json:"run_at"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx so jobs can be enqueued as part of a caller's transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// EnqueueJob adds a job that will run no earlier than runAt. Payload is stored as json.
+func EnqueueJob(db execer, kind string, payload interface{}, runAt time.Time) (int, error) {
+	if _, ok := jobHandlers[kind]; !ok {
+		return 0, fmt.Errorf("unknown job kind %q", kind)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to marshal job payload")
+	}
+	now := time.Now().Unix()
+	q := `
+    INSERT INTO jobs
+                (kind,
+                payload,
+                status,
+                max_attempts,
+                run_at,
+                created_at,
+                updated_at)
+    VALUES      (?, ?, ?, ?, ?, ?, ?)
+    `
+	res, err := db.Exec(q, kind, string(b), jobQueued, defaultJobAttempts, runAt.Unix(), now, now)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to insert job")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to get job id")
+	}
+	return int(id), nil
+}
+
+const jobColumns = "id, kind, payload, status, attempts, max_attempts, last_error, run_at, created_at, updated_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row rowScanner) (Job, error) {
+	var j Job
+	var payload string
+	var runAt, createdAt, updatedAt int64
+	err := row.Scan(&j.ID, &j.Kind, &payload, &j.Status, &j.Attempts, &j.MaxAttempts, &j.LastError, &runAt, &createdAt, &updatedAt)
+	if err != nil {
+		return j, err
+	}
+	j.Payload = json.RawMessage(payload)
+	j.RunAt = time.Unix(runAt, 0).UTC()
+	j.CreatedAt = time.Unix(createdAt, 0).UTC()
+	j.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+	return j, nil
+}
+
+// GetJob returns a single job
+func GetJob(db *sql.DB, id int) (Job, error) {
+	j, err := scanJob(db.QueryRow("select "+jobColumns+" from jobs where id=?", id))
+	if err == sql.ErrNoRows {
+		return j, ErrJobNotFound
+	} else if err != nil {
+		return j, errors.Wrap(err, "unable to get job")
+	}
+	return j, nil
+}
+
+// GetJobs returns the most recent jobs, newest first. An empty status returns jobs in any status.
+func GetJobs(db *sql.DB, status string, limit int) ([]Job, error) {
+	q := "select " + jobColumns + " from jobs where (?='' or status=?) order by id desc limit ?"
+	rows, err := db.Query(q, status, status, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query jobs")
+	}
+	defer rows.Close()
+	var jobs []Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to scan jobs")
+		}
+		jobs = append(jobs, j)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of jobs")
+	}
+	return jobs, nil
+}
+
+// RetryJob puts a dead job, or one waiting to be retried, back in the queue to run now with a fresh set of attempts
+func RetryJob(db *sql.DB, id int) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for RetryJob")
+	}
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on RetryJob")
+		}
+	}()
+
+	now := time.Now().Unix()
+	q := `
+    UPDATE jobs
+    SET    status = ?,
+           attempts = 0,
+           run_at = ?,
+           updated_at = ?
+    WHERE  id = ?
+           AND ( status = ?
+                  OR ( status = ?
+                       AND attempts > 0 ) )
+    `
+	res, err := tx.Exec(q, jobQueued, now, now, id, jobDead, jobQueued)
+	if err != nil {
+		return errors.Wrap(err, "unable to retry job")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to determine if job was retried")
+	}
+	if n == 0 {
+		var exists bool
+		if err = tx.QueryRow("select count(*) > 0 from jobs where id=?", id).Scan(&exists); err != nil {
+			return errors.Wrap(err, "unable to look up job")
+		}
+		if !exists {
+			return ErrJobNotFound
+		}
+		return ErrJobState
+	}
+
+	var kind, payload string
+	if err = tx.QueryRow("select kind, payload from jobs where id=?", id).Scan(&kind, &payload); err != nil {
+		return errors.Wrap(err, "unable to get retried job")
+	}
+	if hook, ok := jobRetryHooks[kind]; ok {
+		if err = hook(tx, []byte(payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimJob marks the next due job as running and returns it. It returns nil when nothing is due.
+func claimJob(db *sql.DB) (*Job, error) {
+	for {
+		now := time.Now().Unix()
+		var id int
+		err := db.QueryRow("select id from jobs where status=? and run_at<=? order by run_at, id limit 1", jobQueued, now).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "unable to find due job")
+		}
+		res, err := db.Exec("update jobs set status=?, attempts=attempts+1, updated_at=? where id=? and status=?", jobRunning, now, id, jobQueued)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to claim job")
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, errors.Wrap(err, "unable to determine if job was claimed")
+		} else if n == 0 {
+			// another worker claimed it first
+			continue
+		}
+		j, err := GetJob(db, id)
+		if err != nil {
+			return nil, err
+		}
+		return &j, nil
+	}
+}
+
+// jobConfig tunes the job runner. Zero values use the defaults.
+type jobConfig struct {
+	// Workers is how many jobs can run at once
+	Workers int
+	// Poll is how often idle workers look for due jobs
+	Poll time.Duration
+	// Backoff is the delay before a failed job's first retry. It doubles with each attempt.
+	Backoff time.Duration
+}
+
+// jobRunner runs queued jobs and periodic tasks until it is stopped
+type jobRunner struct {
+	a       app
+	workers int
+	poll    time.Duration
+	backoff time.Duration
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newJobRunner(a app) *jobRunner {
+	r := &jobRunner{a: a, workers: a.jobs.Workers, poll: a.jobs.Poll, backoff: a.jobs.Backoff, stop: make(chan struct{})}
+	if r.workers <= 0 {
+		r.workers = 2
+	}
+	if r.poll <= 0 {
+		r.poll = 5 * time.Second
+	}
+	if r.backoff <= 0 {
+		r.backoff = 30 * time.Second
+	}
+	return r
+}
+
+// Start begins running jobs in the background
+func (r *jobRunner) Start() {
+	// jobs that were running when a previous process stopped would otherwise never finish
+	if _, err := r.a.db.Exec("update jobs set status=? where status=?", jobQueued, jobRunning); err != nil {
+		log.Printf("error requeueing interrupted jobs: %v", err)
+	}
+	for i := 0; i < r.workers; i++ {
+		r.wg.Add(1)
+		go r.work()
+	}
+	for _, task := range periodicTasks {
+		r.wg.Add(1)
+		go r.every(task)
+	}
+}
+
+// Stop waits for running jobs to finish and stops the runner
+func (r *jobRunner) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+func (r *jobRunner) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *jobRunner) work() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.poll)
+	defer ticker.Stop()
+	for {
+		// drain everything that is due before waiting again
+		for !r.stopped() && r.runNext() {
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runNext runs the next due job, if any, and reports whether one was run
+func (r *jobRunner) runNext() bool {
+	j, err := claimJob(r.a.db)
+	if err != nil {
+		log.Printf("error claiming job: %v", err)
+		return false
+	}
+	if j == nil {
+		return false
+	}
+	r.finish(j, r.run(j))
+	return true
+}
+
+// run calls the job's handler, turning a panic into an error so one bad job can not take down the runner
+func (r *jobRunner) run(j *Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	handler, ok := jobHandlers[j.Kind]
+	if !ok {
+		return fmt.Errorf("unknown job kind %q", j.Kind)
+	}
+	return handler(r.a, j.Payload)
+}
+
+// finish records the outcome of a job, scheduling a retry or dead lettering it if it failed
+func (r *jobRunner) finish(j *Job, runErr error) {
+	now := time.Now()
+	var err error
+	switch {
+	case runErr == nil:
+		_, err = r.a.db.Exec("update jobs set status=?, last_error='', updated_at=? where id=?", jobDone, now.Unix(), j.ID)
+	case j.Attempts >= j.MaxAttempts:
+		log.Printf("job %d (%s) failed for the last time: %v", j.ID, j.Kind, runErr)
+		_, err = r.a.db.Exec("update jobs set status=?, last_error=?, updated_at=? where id=?", jobDead, runErr.Error(), now.Unix(), j.ID)
+	default:
+		log.Printf("job %d (%s) failed, will retry: %v", j.ID, j.Kind, runErr)
+		backoff := r.backoff << uint(j.Attempts-1)
+		if backoff > maxJobBackoff || backoff <= 0 {
+			backoff = maxJobBackoff
+		}
+		q := "update jobs set status=?, last_error=?, run_at=?, updated_at=? where id=?"
+		_, err = r.a.db.Exec(q, jobQueued, runErr.Error(), now.Add(backoff).Unix(), now.Unix(), j.ID)
+	}
+	if err != nil {
+		log.Printf("error recording result of job %d: %v", j.ID, err)
+	}
+}
+
+func (r *jobRunner) every(task periodicTask) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(task.every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			if err := task.run(r.a); err != nil {
+				log.Printf("error running periodic task %s: %v", task.name, err)
+			}
+		}
+	}
+}
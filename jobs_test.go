@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJobRunner(t *testing.T) {
+	/*
+		Verify failing jobs are retried until they succeed
+		Verify jobs that keep failing are dead lettered and can be retried by an admin
+		Verify only failed jobs can be retried
+		Verify jobs enqueued in a rolled back transaction never run
+	*/
+	var flakyCalls int32
+	var brokenFixed int32
+	jobHandlers["test_flaky"] = func(a app, payload []byte) error {
+		if atomic.AddInt32(&flakyCalls, 1) <= 2 {
+			return errors.New("flaky failure")
+		}
+		return nil
+	}
+	jobHandlers["test_broken"] = func(a app, payload []byte) error {
+		if atomic.LoadInt32(&brokenFixed) == 0 {
+			panic("broken")
+		}
+		return nil
+	}
+	defer delete(jobHandlers, "test_flaky")
+	defer delete(jobHandlers, "test_broken")
+
+	cli, teardown := setupInstanceWith(func(a *app) {
+		a.jobs.Poll = 10 * time.Millisecond
+		a.jobs.Backoff = time.Millisecond
+	})
+	defer teardown()
+
+	flakyID, err := EnqueueJob(cli.db, "test_flaky", nil, time.Now())
+	NoErr(t, err, "enqueueing flaky job")
+	brokenID, err := EnqueueJob(cli.db, "test_broken", map[string]string{"some": "payload"}, time.Now())
+	NoErr(t, err, "enqueueing broken job")
+
+	flaky := waitForJob(t, cli, flakyID, jobDone)
+	if flaky.Attempts != 3 {
+		t.Errorf("got %d attempts for flaky job, want 3", flaky.Attempts)
+	}
+
+	broken := waitForJob(t, cli, brokenID, jobDead)
+	if broken.Attempts != defaultJobAttempts || !strings.Contains(broken.LastError, "broken") {
+		t.Errorf("got %+v, want %d attempts and the panic as the last error", broken, defaultJobAttempts)
+	}
+	if string(broken.Payload) != `{"some":"payload"}` {
+		t.Errorf("got payload %s", broken.Payload)
+	}
+
+	dead, err := cli.GetJobs(jobDead)
+	NoErr(t, err, "getting dead jobs")
+	if len(dead) != 1 || dead[0].ID != brokenID {
+		t.Errorf("got %+v, want only the broken job", dead)
+	}
+
+	atomic.StoreInt32(&brokenFixed, 1)
+	NoErr(t, cli.RetryJob(brokenID), "retrying dead job")
+	waitForJob(t, cli, brokenID, jobDone)
+
+	if err := cli.RetryJob(brokenID); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("got %v, want a 409 retrying a job that is done", err)
+	}
+	if err := cli.RetryJob(9999); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want a 404 retrying a missing job", err)
+	}
+
+	tx, err := cli.db.Begin()
+	NoErr(t, err, "beginning tx")
+	rolledBackID, err := EnqueueJob(tx, "test_flaky", nil, time.Now())
+	NoErr(t, err, "enqueueing in tx")
+	NoErr(t, tx.Rollback(), "rolling back")
+	if _, err := GetJob(cli.db, rolledBackID); err != ErrJobNotFound {
+		t.Errorf("got %v, want the rolled back job to not exist", err)
+	}
+
+	if _, err := EnqueueJob(cli.db, "no_such_kind", nil, time.Now()); err == nil {
+		t.Error("got no error enqueueing an unknown kind of job")
+	}
+}
+
+// waitForJob waits for a job to reach a status, failing the test if it does not get there in time
+func waitForJob(t *testing.T, cli *testClient, id int, status string) Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		jobs, err := cli.GetJobs(status)
+		if err != nil {
+			t.Fatalf("unable to get jobs - %v", err)
+		}
+		for _, j := range jobs {
+			if j.ID == id {
+				return j
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d never reached %s", id, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
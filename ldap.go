@@ -0,0 +1,663 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/ldap.v2"
+)
+
+/*
+ The LDAP sync reads people and groups from a directory and reconciles users, teams, and user_teams with them.
+
+   users     people with an email are created, renamed, and reactivated to match the directory. Users that were synced
+             before and are no longer in the directory are deactivated. Users that only ever signed in are left alone.
+   teams     each group is a team. Teams that were synced before and whose group is gone are deleted.
+   members   a synced team's members are exactly the group's members that are synced users
+   managers  a synced user's manager is the user named by their manager attribute
+
+ Synced users and teams remember their DN so that renames in the directory are followed. Each run is stored with a
+ report of what changed. A dry run reports what would change without changing anything.
+*/
+
+// ldapConfig is how we read the directory. The sync is disabled when URL is empty.
+type ldapConfig struct {
+	// URL is ldap://host:389 or ldaps://host:636
+	URL          string
+	StartTLS     bool
+	BindDN       string
+	BindPassword string
+	UserBase     string
+	UserFilter   string
+	// GroupBase is where groups are searched for. Teams are not synced if it is empty.
+	GroupBase   string
+	GroupFilter string
+	EmailAttr   string
+	NameAttr    string
+	// ManagerAttr holds the DN of a person's manager
+	ManagerAttr string
+	// MemberAttr holds the DNs of a group's members
+	MemberAttr string
+	// Interval is how often the directory is synced
+	Interval time.Duration
+}
+
+func (c ldapConfig) enabled() bool {
+	return c.URL != ""
+}
+
+// ldapTimeout bounds each request to the directory
+const ldapTimeout = 30 * time.Second
+
+// ldapPageSize is how many entries are requested at a time. Active Directory returns at most 1000 without paging.
+const ldapPageSize = 500
+
+// ldap sync run statuses
+const (
+	ldapSyncOK     = "ok"
+	ldapSyncFailed = "failed"
+)
+
+// ldapPerson is a person read from the directory
+type ldapPerson struct {
+	DN        string
+	Email     string
+	Name      string
+	ManagerDN string
+}
+
+// ldapGroup is a group read from the directory
+type ldapGroup struct {
+	DN        string
+	Name      string
+	MemberDNs []string
+}
+
+// ldapDirectory is everything the sync reads from the directory
+type ldapDirectory struct {
+	People []ldapPerson
+	Groups []ldapGroup
+}
+
+// LDAPMembership is a user being added to or removed from a team
+type LDAPMembership struct {
+	Team  string `json:"team"`
+	Email string `json:"email"`
+}
+
+// LDAPManagerChange is a user's manager changing. An empty manager means they no longer have one.
+type LDAPManagerChange struct {
+	Email   string `json:"email"`
+	Manager string `json:"manager"`
+}
+
+// LDAPSyncReport is what a sync changed, or would change in a dry run
+type LDAPSyncReport struct {
+	UsersCreated     []string            `json:"users_created"`
+	UsersUpdated     []string            `json:"users_updated"`
+	UsersDeactivated []string            `json:"users_deactivated"`
+	UsersReactivated []string            `json:"users_reactivated"`
+	TeamsCreated     []string            `json:"teams_created"`
+	TeamsDeleted     []string            `json:"teams_deleted"`
+	MembersAdded     []LDAPMembership    `json:"members_added"`
+	MembersRemoved   []LDAPMembership    `json:"members_removed"`
+	ManagersChanged  []LDAPManagerChange `json:"managers_changed"`
+	Warnings         []string            `json:"warnings"`
+}
+
+// LDAPSyncRun is one run of the sync
+type LDAPSyncRun struct {
+	ID         int            `json:"id"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	DryRun     bool           `json:"dry_run"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error"`
+	Report     LDAPSyncReport `json:"report"`
+}
+
+// normalizeDN puts a DN in a form that can be compared, ignoring case and spacing
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(dn))
+	}
+	var rdns []string
+	for _, rdn := range parsed.RDNs {
+		var parts []string
+		for _, attr := range rdn.Attributes {
+			parts = append(parts, strings.ToLower(attr.Type)+"="+strings.ToLower(attr.Value))
+		}
+		rdns = append(rdns, strings.Join(parts, "+"))
+	}
+	return strings.Join(rdns, ",")
+}
+
+// ldapAttr returns an entry's values for an attribute, ignoring the case of the attribute name
+func ldapAttr(entry *ldap.Entry, name string) []string {
+	for _, attr := range entry.Attributes {
+		if strings.EqualFold(attr.Name, name) {
+			return attr.Values
+		}
+	}
+	return nil
+}
+
+func ldapFirst(entry *ldap.Entry, name string) string {
+	if values := ldapAttr(entry, name); len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+// dialLDAP connects and binds to the directory
+func dialLDAP(c ldapConfig) (*ldap.Conn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse ldap url")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var conn *ldap.Conn
+	switch u.Scheme {
+	case "ldaps":
+		conn, err = ldap.DialTLS("tcp", host, &tls.Config{ServerName: u.Hostname()})
+	case "ldap":
+		conn, err = ldap.Dial("tcp", host)
+	default:
+		return nil, fmt.Errorf("ldap url must start with ldap:// or ldaps://, got %q", c.URL)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to ldap")
+	}
+	conn.SetTimeout(ldapTimeout)
+	if c.StartTLS && u.Scheme == "ldap" {
+		if err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "unable to start tls with ldap")
+		}
+	}
+	if c.BindDN != "" {
+		if err = conn.Bind(c.BindDN, c.BindPassword); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "unable to bind to ldap")
+		}
+	}
+	return conn, nil
+}
+
+// fetchLDAPDirectory reads the people and groups to sync
+func fetchLDAPDirectory(c ldapConfig) (ldapDirectory, error) {
+	var dir ldapDirectory
+	conn, err := dialLDAP(c)
+	if err != nil {
+		return dir, err
+	}
+	defer conn.Close()
+
+	req := ldap.NewSearchRequest(c.UserBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		c.UserFilter, []string{c.EmailAttr, c.NameAttr, c.ManagerAttr}, nil)
+	res, err := conn.SearchWithPaging(req, ldapPageSize)
+	if err != nil {
+		return dir, errors.Wrap(err, "unable to search ldap for people")
+	}
+	for _, entry := range res.Entries {
+		dir.People = append(dir.People, ldapPerson{
+			DN:        entry.DN,
+			Email:     strings.ToLower(ldapFirst(entry, c.EmailAttr)),
+			Name:      ldapFirst(entry, c.NameAttr),
+			ManagerDN: ldapFirst(entry, c.ManagerAttr),
+		})
+	}
+
+	if c.GroupBase == "" {
+		return dir, nil
+	}
+	req = ldap.NewSearchRequest(c.GroupBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		c.GroupFilter, []string{"cn", c.MemberAttr}, nil)
+	res, err = conn.SearchWithPaging(req, ldapPageSize)
+	if err != nil {
+		return dir, errors.Wrap(err, "unable to search ldap for groups")
+	}
+	for _, entry := range res.Entries {
+		dir.Groups = append(dir.Groups, ldapGroup{
+			DN:        entry.DN,
+			Name:      ldapFirst(entry, "cn"),
+			MemberDNs: ldapAttr(entry, c.MemberAttr),
+		})
+	}
+	return dir, nil
+}
+
+// ldapUserRow is a user as the sync sees them
+type ldapUserRow struct {
+	id      int
+	name    string
+	email   string
+	active  bool
+	dn      string
+	manager sql.NullInt64
+}
+
+// syncLDAP reconciles the db with the directory in one transaction, which is rolled back for a dry run
+func syncLDAP(db *sql.DB, dir ldapDirectory, dryRun bool) (report LDAPSyncReport, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return report, errors.Wrap(err, "unable to begin tx for syncLDAP")
+	}
+	defer func() {
+		if err != nil || dryRun {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on syncLDAP")
+			return
+		}
+		for _, email := range report.UsersDeactivated {
+			RevokeAuth(email)
+		}
+	}()
+
+	rows, err := tx.Query("select id, name, email, is_active, coalesce(ldap_dn, ''), manager_id from users")
+	if err != nil {
+		return report, errors.Wrap(err, "unable to query users in syncLDAP")
+	}
+	var users []*ldapUserRow
+	byEmail := make(map[string]*ldapUserRow)
+	byDN := make(map[string]*ldapUserRow)
+	for rows.Next() {
+		u := &ldapUserRow{}
+		if err = rows.Scan(&u.id, &u.name, &u.email, &u.active, &u.dn, &u.manager); err != nil {
+			rows.Close()
+			return report, errors.Wrap(err, "unable to scan users in syncLDAP")
+		}
+		users = append(users, u)
+		byEmail[strings.ToLower(u.email)] = u
+		if u.dn != "" {
+			byDN[u.dn] = u
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return report, errors.Wrap(err, "error post scan of users in syncLDAP")
+	}
+
+	// people, matched by DN first so email changes are followed, then by email
+	inDirectory := make(map[string]bool)
+	for _, p := range dir.People {
+		inDirectory[normalizeDN(p.DN)] = true
+	}
+	synced := make(map[string]*ldapUserRow)
+	for _, p := range dir.People {
+		dn := normalizeDN(p.DN)
+		if p.Email == "" {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s has no email and was skipped", p.DN))
+			continue
+		}
+		if _, ok := synced[dn]; ok {
+			continue
+		}
+		u := byDN[dn]
+		if u == nil {
+			u = byEmail[p.Email]
+		}
+		if other := byEmail[p.Email]; other != nil && other != u || u != nil && u.dn != "" && u.dn != dn && inDirectory[u.dn] {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s has the email %s, which belongs to another user, and was skipped", p.DN, p.Email))
+			continue
+		}
+		name := p.Name
+		if u == nil {
+			res, err := tx.Exec("insert into users (name, email, ldap_dn) values (?, ?, ?)", name, p.Email, dn)
+			if err != nil {
+				return report, errors.Wrap(err, "unable to create user in syncLDAP")
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return report, errors.Wrap(err, "unable to get new user id in syncLDAP")
+			}
+			u = &ldapUserRow{id: int(id), name: name, email: p.Email, active: true, dn: dn}
+			users = append(users, u)
+			byEmail[p.Email] = u
+			report.UsersCreated = append(report.UsersCreated, p.Email)
+		} else {
+			if name == "" {
+				name = u.name
+			}
+			if name != u.name || p.Email != u.email || dn != u.dn {
+				report.UsersUpdated = append(report.UsersUpdated, p.Email)
+			}
+			if !u.active {
+				report.UsersReactivated = append(report.UsersReactivated, p.Email)
+			}
+			q := "update users set name=?, email=?, ldap_dn=?, is_active=1 where id=?"
+			if _, err = tx.Exec(q, name, p.Email, dn, u.id); err != nil {
+				return report, errors.Wrap(err, "unable to update user in syncLDAP")
+			}
+			delete(byEmail, u.email)
+			u.name, u.email, u.dn, u.active = name, p.Email, dn, true
+			byEmail[u.email] = u
+		}
+		synced[dn] = u
+	}
+	for _, u := range users {
+		if u.dn == "" || synced[u.dn] != nil || !u.active {
+			continue
+		}
+		if _, err = deactivateUser(tx, u.id); err != nil {
+			return report, err
+		}
+		report.UsersDeactivated = append(report.UsersDeactivated, u.email)
+	}
+
+	// managers
+	for _, p := range dir.People {
+		u := synced[normalizeDN(p.DN)]
+		if u == nil {
+			continue
+		}
+		var manager *ldapUserRow
+		if p.ManagerDN != "" {
+			if manager = synced[normalizeDN(p.ManagerDN)]; manager == nil {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("the manager of %s, %s, is not a synced user", p.Email, p.ManagerDN))
+			}
+		}
+		var managerID sql.NullInt64
+		var managerEmail string
+		if manager != nil && manager != u {
+			managerID = sql.NullInt64{Int64: int64(manager.id), Valid: true}
+			managerEmail = manager.email
+		}
+		if managerID == u.manager {
+			continue
+		}
+		if _, err = tx.Exec("update users set manager_id=? where id=?", managerID, u.id); err != nil {
+			return report, errors.Wrap(err, "unable to set manager in syncLDAP")
+		}
+		u.manager = managerID
+		report.ManagersChanged = append(report.ManagersChanged, LDAPManagerChange{Email: u.email, Manager: managerEmail})
+	}
+
+	if err = syncLDAPGroups(tx, dir, synced, &report); err != nil {
+		return report, err
+	}
+	report.sort()
+	return report, nil
+}
+
+// syncLDAPGroups reconciles teams and their members with the directory's groups
+func syncLDAPGroups(tx *sql.Tx, dir ldapDirectory, synced map[string]*ldapUserRow, report *LDAPSyncReport) error {
+	type teamRow struct {
+		id   int
+		name string
+		dn   string
+	}
+	rows, err := tx.Query("select id, name, coalesce(ldap_dn, '') from teams")
+	if err != nil {
+		return errors.Wrap(err, "unable to query teams in syncLDAP")
+	}
+	byName := make(map[string]*teamRow)
+	byDN := make(map[string]*teamRow)
+	for rows.Next() {
+		t := &teamRow{}
+		if err = rows.Scan(&t.id, &t.name, &t.dn); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "unable to scan teams in syncLDAP")
+		}
+		byName[t.name] = t
+		if t.dn != "" {
+			byDN[t.dn] = t
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "error post scan of teams in syncLDAP")
+	}
+
+	seen := make(map[string]bool)
+	for _, g := range dir.Groups {
+		dn := normalizeDN(g.DN)
+		if g.Name == "" || seen[dn] {
+			continue
+		}
+		t := byDN[dn]
+		if t == nil {
+			t = byName[g.Name]
+		}
+		if other := byName[g.Name]; other != nil && other != t {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s is named %s, which is another team's name, and was skipped", g.DN, g.Name))
+			continue
+		}
+		if t == nil {
+			res, err := tx.Exec("insert into teams (name, ldap_dn) values (?, ?)", g.Name, dn)
+			if err != nil {
+				return errors.Wrap(err, "unable to create team in syncLDAP")
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return errors.Wrap(err, "unable to get new team id in syncLDAP")
+			}
+			t = &teamRow{id: int(id), name: g.Name, dn: dn}
+			byName[t.name] = t
+			report.TeamsCreated = append(report.TeamsCreated, g.Name)
+		} else if t.name != g.Name || t.dn != dn {
+			if _, err = tx.Exec("update teams set name=?, ldap_dn=? where id=?", g.Name, dn, t.id); err != nil {
+				return errors.Wrap(err, "unable to update team in syncLDAP")
+			}
+			delete(byName, t.name)
+			t.name, t.dn = g.Name, dn
+			byName[t.name] = t
+		}
+		seen[dn] = true
+
+		current := make(map[int]string)
+		memberRows, err := tx.Query("select users.id, users.email from user_teams join users on users.id = user_teams.user_id where user_teams.team_id=?", t.id)
+		if err != nil {
+			return errors.Wrap(err, "unable to query members in syncLDAP")
+		}
+		for memberRows.Next() {
+			var id int
+			var email string
+			if err = memberRows.Scan(&id, &email); err != nil {
+				memberRows.Close()
+				return errors.Wrap(err, "unable to scan members in syncLDAP")
+			}
+			current[id] = email
+		}
+		memberRows.Close()
+		if err = memberRows.Err(); err != nil {
+			return errors.Wrap(err, "error post scan of members in syncLDAP")
+		}
+
+		wanted := make(map[int]bool)
+		var notUsers int
+		for _, memberDN := range g.MemberDNs {
+			u := synced[normalizeDN(memberDN)]
+			if u == nil {
+				notUsers++
+				continue
+			}
+			wanted[u.id] = true
+			if _, ok := current[u.id]; ok {
+				continue
+			}
+			if _, err = tx.Exec("insert into user_teams (user_id, team_id) values (?, ?)", u.id, t.id); err != nil {
+				return errors.Wrap(err, "unable to add member in syncLDAP")
+			}
+			current[u.id] = u.email
+			report.MembersAdded = append(report.MembersAdded, LDAPMembership{Team: t.name, Email: u.email})
+		}
+		if notUsers > 0 {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%d members of %s are not synced users and were skipped", notUsers, g.DN))
+		}
+		for id, email := range current {
+			if wanted[id] {
+				continue
+			}
+			if _, err = tx.Exec("delete from user_teams where user_id=? and team_id=?", id, t.id); err != nil {
+				return errors.Wrap(err, "unable to remove member in syncLDAP")
+			}
+			report.MembersRemoved = append(report.MembersRemoved, LDAPMembership{Team: t.name, Email: email})
+		}
+	}
+
+	for dn, t := range byDN {
+		if seen[dn] {
+			continue
+		}
+		if _, err = tx.Exec("delete from user_teams where team_id=?", t.id); err != nil {
+			return errors.Wrap(err, "unable to remove members of deleted team in syncLDAP")
+		}
+		if _, err = tx.Exec("delete from teams where id=?", t.id); err != nil {
+			return errors.Wrap(err, "unable to delete team in syncLDAP")
+		}
+		report.TeamsDeleted = append(report.TeamsDeleted, t.name)
+	}
+	return nil
+}
+
+// sort orders the report so runs are easy to compare
+func (r *LDAPSyncReport) sort() {
+	for _, list := range [][]string{r.UsersCreated, r.UsersUpdated, r.UsersDeactivated, r.UsersReactivated, r.TeamsCreated, r.TeamsDeleted} {
+		sort.Strings(list)
+	}
+	for _, list := range [][]LDAPMembership{r.MembersAdded, r.MembersRemoved} {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Team != list[j].Team {
+				return list[i].Team < list[j].Team
+			}
+			return list[i].Email < list[j].Email
+		})
+	}
+	sort.Slice(r.ManagersChanged, func(i, j int) bool { return r.ManagersChanged[i].Email < r.ManagersChanged[j].Email })
+}
+
+// AddLDAPSyncRun stores a run
+func AddLDAPSyncRun(db *sql.DB, run LDAPSyncRun) (int, error) {
+	report, err := json.Marshal(run.Report)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to marshal ldap sync report")
+	}
+	q := "insert into ldap_sync_runs (started_at, finished_at, dry_run, status, error, report) values (?, ?, ?, ?, ?, ?)"
+	res, err := db.Exec(q, run.StartedAt.Unix(), run.FinishedAt.Unix(), bool2int(run.DryRun), run.Status, run.Error, string(report))
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to insert ldap sync run")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to get ldap sync run id")
+	}
+	return int(id), nil
+}
+
+// GetLDAPSyncRuns returns the most recent runs first
+func GetLDAPSyncRuns(db *sql.DB, limit int) ([]LDAPSyncRun, error) {
+	q := "select id, started_at, finished_at, dry_run, status, error, report from ldap_sync_runs order by id desc limit ?"
+	rows, err := db.Query(q, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query GetLDAPSyncRuns")
+	}
+	defer rows.Close()
+	runs := []LDAPSyncRun{}
+	for rows.Next() {
+		var run LDAPSyncRun
+		var started, finished int64
+		var report string
+		if err = rows.Scan(&run.ID, &started, &finished, &run.DryRun, &run.Status, &run.Error, &report); err != nil {
+			return nil, errors.Wrap(err, "unable to scan GetLDAPSyncRuns")
+		}
+		run.StartedAt = time.Unix(started, 0).UTC()
+		run.FinishedAt = time.Unix(finished, 0).UTC()
+		if err = json.Unmarshal([]byte(report), &run.Report); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal ldap sync report")
+		}
+		runs = append(runs, run)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetLDAPSyncRuns")
+	}
+	return runs, nil
+}
+
+// runLDAPSync reads the directory, reconciles the db with it, and stores the run. Failures are stored in the run as well
+// as returned.
+func runLDAPSync(a app, dryRun bool) (LDAPSyncRun, error) {
+	run := LDAPSyncRun{StartedAt: time.Now(), DryRun: dryRun, Status: ldapSyncOK}
+	dir, err := fetchLDAPDirectory(a.ldap)
+	if err == nil {
+		run.Report, err = syncLDAP(a.db, dir, dryRun)
+	}
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Status = ldapSyncFailed
+		run.Error = err.Error()
+	}
+	var addErr error
+	run.ID, addErr = AddLDAPSyncRun(a.db, run)
+	if addErr != nil {
+		log.Printf("error storing ldap sync run: %v", addErr)
+	}
+	if err != nil {
+		return run, err
+	}
+	if dryRun {
+		return run, addErr
+	}
+
+	for _, email := range run.Report.UsersDeactivated {
+		a.emitEvent(eventUserDeactivated, userEvent{Email: email})
+	}
+	for _, email := range run.Report.UsersReactivated {
+		a.emitEvent(eventUserReactivated, userEvent{Email: email})
+	}
+	for _, email := range run.Report.UsersCreated {
+		a.emitEvent(eventUserCreated, userEvent{Email: email})
+	}
+	for _, team := range run.Report.TeamsCreated {
+		a.emitEvent(eventTeamChanged, teamEvent{Team: team, Change: "created"})
+	}
+	for _, m := range run.Report.MembersAdded {
+		a.emitEvent(eventTeamChanged, teamEvent{Team: m.Team, Change: "member_added", UserEmail: m.Email})
+	}
+	for _, m := range run.Report.MembersRemoved {
+		a.emitEvent(eventTeamChanged, teamEvent{Team: m.Team, Change: "member_removed", UserEmail: m.Email})
+	}
+	for _, team := range run.Report.TeamsDeleted {
+		a.emitEvent(eventTeamChanged, teamEvent{Team: team, Change: "deleted"})
+	}
+	return run, addErr
+}
+
+// ldapSyncTask runs the sync when the last run is older than the configured interval. Checking the stored runs, rather
+// than keeping a timer, means restarts do not delay or repeat the sync.
+func ldapSyncTask(a app, now time.Time) error {
+	if !a.ldap.enabled() {
+		return nil
+	}
+	var last sql.NullInt64
+	if err := a.db.QueryRow("select max(started_at) from ldap_sync_runs where dry_run=0").Scan(&last); err != nil {
+		return errors.Wrap(err, "unable to look up last ldap sync")
+	}
+	if last.Valid && now.Sub(time.Unix(last.Int64, 0)) < a.ldap.Interval {
+		return nil
+	}
+	_, err := runLDAPSync(a, false)
+	return err
+}
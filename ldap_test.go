@@ -0,0 +1,299 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+func TestLDAPSync(t *testing.T) {
+	/*
+		Verify a dry run reports changes without making them, and signs no one out
+		Verify people become users, groups become teams, and managers are set, following DNs regardless of case
+		Verify users who only signed in, and teams not in the directory, are left alone
+		Verify people and groups leaving the directory deactivate users and delete teams
+		Verify runs are stored, including failures, and the periodic task waits for the interval
+	*/
+	directory := newFakeLDAP(t, "cn=admin,dc=example,dc=com", "secret")
+	defer directory.Close()
+	directory.set(
+		fakeLDAPEntry{"cn=Alice,ou=people,dc=example,dc=com", map[string][]string{
+			"objectClass": {"person"}, "cn": {"Alice Liddell"}, "mail": {"Alice@Example.com"}, "manager": {"CN=Bob, OU=People, DC=example, DC=com"}}},
+		fakeLDAPEntry{"cn=Bob,ou=people,dc=example,dc=com", map[string][]string{
+			"objectClass": {"person"}, "cn": {"Bob Builder"}, "mail": {"bob@example.com"}}},
+		fakeLDAPEntry{"cn=Printer,ou=people,dc=example,dc=com", map[string][]string{
+			"objectClass": {"person"}, "cn": {"Printer"}}},
+		fakeLDAPEntry{"cn=platform,ou=groups,dc=example,dc=com", map[string][]string{
+			"objectClass": {"groupOfNames"}, "cn": {"platform"}, "member": {"cn=alice,ou=people,dc=example,dc=com", "cn=Bob,ou=people,dc=example,dc=com", "cn=ghost,ou=people,dc=example,dc=com"}}},
+	)
+
+	var a app
+	cli, teardown := setupInstanceWith(func(inst *app) {
+		inst.ldap = ldapConfig{
+			URL:          directory.URL(),
+			BindDN:       "cn=admin,dc=example,dc=com",
+			BindPassword: "secret",
+			UserBase:     "ou=people,dc=example,dc=com",
+			UserFilter:   "(objectClass=person)",
+			GroupBase:    "ou=groups,dc=example,dc=com",
+			GroupFilter:  "(objectClass=groupOfNames)",
+			EmailAttr:    "mail",
+			NameAttr:     "cn",
+			ManagerAttr:  "manager",
+			MemberAttr:   "member",
+			Interval:     time.Hour,
+		}
+		a = *inst
+	})
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "alice", "alice@example.com"), "creating user")
+	NoErr(t, cli.InsertTeam("legacy"), "adding team")
+	NoErr(t, cli.AssignTeamToUser("legacy"), "joining team")
+
+	run, err := cli.SyncLDAP(true)
+	NoErr(t, err, "dry run")
+	if !run.DryRun || run.Status != ldapSyncOK {
+		t.Errorf("got %+v, want an ok dry run", run)
+	}
+	report := run.Report
+	if strings.Join(report.UsersCreated, ",") != "bob@example.com" || strings.Join(report.UsersUpdated, ",") != "alice@example.com" {
+		t.Errorf("got created %v and updated %v, want bob created and alice updated", report.UsersCreated, report.UsersUpdated)
+	}
+	if strings.Join(report.TeamsCreated, ",") != "platform" || len(report.MembersAdded) != 2 {
+		t.Errorf("got teams %v and members %v, want platform with two members", report.TeamsCreated, report.MembersAdded)
+	}
+	if len(report.ManagersChanged) != 1 || report.ManagersChanged[0] != (LDAPManagerChange{Email: "alice@example.com", Manager: "bob@example.com"}) {
+		t.Errorf("got manager changes %+v, want bob as alice's manager", report.ManagersChanged)
+	}
+	wantWarnings := []string{
+		"1 members of cn=platform,ou=groups,dc=example,dc=com are not synced users and were skipped",
+		"cn=Printer,ou=people,dc=example,dc=com has no email and was skipped",
+	}
+	sort.Strings(report.Warnings)
+	if strings.Join(report.Warnings, "\n") != strings.Join(wantWarnings, "\n") {
+		t.Errorf("got warnings %q, want %q", report.Warnings, wantWarnings)
+	}
+	if exists, _ := UserExists(cli.db, "bob@example.com"); exists {
+		t.Error("dry run created a user")
+	}
+
+	_, err = cli.SyncLDAP(false)
+	NoErr(t, err, "syncing")
+	alice, err := GetUser(cli.db, "alice@example.com")
+	NoErr(t, err, "getting alice")
+	if alice.Name != "Alice Liddell" || alice.Manager != "bob@example.com" || strings.Join(alice.Teams, ",") != "platform" {
+		t.Errorf("got %+v, want alice renamed, managed by bob, and on platform", alice)
+	}
+	run, err = cli.SyncLDAP(false)
+	NoErr(t, err, "syncing again")
+	if r := run.Report; len(r.UsersCreated)+len(r.UsersUpdated)+len(r.TeamsCreated)+len(r.MembersAdded)+len(r.ManagersChanged) != 0 {
+		t.Errorf("got %+v, want nothing to change syncing twice", r)
+	}
+
+	SetAuth("bob-session", "bob@example.com", time.Now().Add(time.Hour))
+	directory.set(
+		fakeLDAPEntry{"cn=Alice,ou=people,dc=example,dc=com", map[string][]string{
+			"objectClass": {"person"}, "cn": {"Alice Liddell"}, "mail": {"alice@example.com"}, "manager": {"cn=bob,ou=people,dc=example,dc=com"}}},
+		fakeLDAPEntry{"cn=infra,ou=groups,dc=example,dc=com", map[string][]string{
+			"objectClass": {"groupOfNames"}, "cn": {"infra"}, "member": {"cn=alice,ou=people,dc=example,dc=com"}}},
+	)
+	_, err = cli.SyncLDAP(true)
+	NoErr(t, err, "dry run after bob left")
+	if _, ok := IsValidAuth("bob-session"); !ok {
+		t.Error("got bob signed out by a dry run")
+	}
+	run, err = cli.SyncLDAP(false)
+	NoErr(t, err, "syncing after bob left")
+	report = run.Report
+	if strings.Join(report.UsersDeactivated, ",") != "bob@example.com" || strings.Join(report.TeamsDeleted, ",") != "platform" || strings.Join(report.TeamsCreated, ",") != "infra" {
+		t.Errorf("got %+v, want bob deactivated, platform deleted, and infra created", report)
+	}
+	if len(report.ManagersChanged) != 1 || report.ManagersChanged[0].Manager != "" {
+		t.Errorf("got manager changes %+v, want alice's manager cleared", report.ManagersChanged)
+	}
+	if active, _ := UserIsActive(cli.db, "bob@example.com"); active {
+		t.Error("got bob active after leaving the directory")
+	}
+	if _, ok := IsValidAuth("bob-session"); ok {
+		t.Error("got a valid session for bob after leaving the directory")
+	}
+	if active, _ := UserIsActive(cli.db, cli.userEmail); !active {
+		t.Error("got a user who is not in the directory deactivated")
+	}
+	teams, err := GetTeams(cli.db)
+	NoErr(t, err, "getting teams")
+	sort.Strings(teams)
+	if strings.Join(teams, ",") != "infra,legacy" {
+		t.Errorf("got teams %v, want infra and legacy", teams)
+	}
+
+	a.ldap.BindPassword = "wrong"
+	if _, err := runLDAPSync(a, false); err == nil {
+		t.Error("got no error syncing with the wrong password")
+	}
+	runs, err := cli.GetLDAPSyncRuns(10)
+	NoErr(t, err, "getting runs")
+	if len(runs) != 6 || runs[0].Status != ldapSyncFailed || !strings.Contains(runs[0].Error, "Invalid Credentials") || !runs[5].DryRun {
+		t.Errorf("got %+v, want 6 runs, the latest failed and the first a dry run", runs)
+	}
+
+	a.ldap.BindPassword = "secret"
+	NoErr(t, ldapSyncTask(a, time.Now()), "running periodic task")
+	if runs, _ := GetLDAPSyncRuns(cli.db, 10); len(runs) != 6 {
+		t.Errorf("got %d runs, want the periodic task to wait for the interval", len(runs))
+	}
+	NoErr(t, ldapSyncTask(a, time.Now().Add(2*time.Hour)), "running periodic task later")
+	if runs, _ := GetLDAPSyncRuns(cli.db, 10); len(runs) != 7 || runs[0].Status != ldapSyncOK {
+		t.Errorf("got %+v, want the periodic task to sync once the interval passed", runs)
+	}
+}
+
+// fakeLDAPEntry is an entry in a fakeLDAP directory
+type fakeLDAPEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+// fakeLDAP is an in process stand in for an LDAP server. It supports simple binds, and searches with an equality
+// filter such as (objectClass=person).
+type fakeLDAP struct {
+	net.Listener
+	bindDN   string
+	password string
+
+	mu      sync.Mutex
+	entries []fakeLDAPEntry
+}
+
+var fakeLDAPFilterRe = regexp.MustCompile(`^\((\w+)=([^)]*)\)$`)
+
+func newFakeLDAP(t *testing.T, bindDN string, password string) *fakeLDAP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen for fake ldap - %v", err)
+	}
+	f := &fakeLDAP{Listener: l, bindDN: bindDN, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// URL is the ldap:// url of the directory
+func (f *fakeLDAP) URL() string {
+	return "ldap://" + f.Addr().String()
+}
+
+// set replaces the directory's entries
+func (f *fakeLDAP) set(entries ...fakeLDAPEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = entries
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	var bound bool
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			code := ldap.LDAPResultInvalidCredentials
+			if op.Children[1].Data.String() == f.bindDN && op.Children[2].Data.String() == f.password {
+				code = ldap.LDAPResultSuccess
+				bound = true
+			}
+			f.write(conn, id, fakeLDAPResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			if !bound {
+				f.write(conn, id, fakeLDAPResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				continue
+			}
+			base := normalizeDN(op.Children[0].Data.String())
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			m := fakeLDAPFilterRe.FindStringSubmatch(filter)
+			if err != nil || m == nil {
+				f.write(conn, id, fakeLDAPResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultUnwillingToPerform))
+				continue
+			}
+			f.mu.Lock()
+			entries := f.entries
+			f.mu.Unlock()
+			for _, entry := range entries {
+				if strings.HasSuffix(normalizeDN(entry.dn), ","+base) && fakeLDAPMatches(entry, m[1], m[2]) {
+					f.write(conn, id, fakeLDAPSearchEntry(entry))
+				}
+			}
+			f.write(conn, id, fakeLDAPResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			// unbind, or anything this stand in does not do
+			return
+		}
+	}
+}
+
+func (f *fakeLDAP) write(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+func fakeLDAPMatches(entry fakeLDAPEntry, attr string, value string) bool {
+	for name, values := range entry.attrs {
+		if !strings.EqualFold(name, attr) {
+			continue
+		}
+		for _, v := range values {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func fakeLDAPResult(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return op
+}
+
+func fakeLDAPSearchEntry(entry fakeLDAPEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "objectName"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range entry.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return op
+}
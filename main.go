@@ -4,11 +4,16 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/facebookgo/flagenv"
@@ -18,7 +23,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const schemaVersion = "2017-07-03-07:22"
+const schemaVersion = "2026-10-19-08:00"
 const keyLength = 36
 const xSessionHeader = "x-session-token"
 
@@ -31,35 +36,142 @@ func init() {
 		log.Fatal("oauth_config.json not found. Download the file contents from https://console.developers.google.com/apis/credentials. See README.md for more details.")
 	}
 	InitAuth()
-	go func() {
-		for _ = range time.Tick(5 * time.Minute) {
-			PruneAuth()
-		}
-	}()
 }
 
 type app struct {
 	db *sql.DB
+
+	// smtp is used for email notifications. Email is off when no host is set.
+	smtp smtpConfig
+	// baseURL is where users reach this app. It is used in links we send out.
+	baseURL string
+	// closingNotice is how long before a cycle closes that everyone is reminded
+	closingNotice time.Duration
+	// jobs tunes the background job runner started by Serve
+	jobs jobConfig
+	// slack is used for chat slash commands. They are off when no signing secret is set.
+	slack slackConfig
+	// notifier delivers notifications. Serve sets it to the feed and email if it is nil.
+	notifier Notifier
+	// reminderDays is how many days before a cycle closes to remind people of feedback they still owe
+	reminderDays []int
+	// adminEmails are admins whether or not they are flagged, and get the weekly admin digest
+	adminEmails []string
+	// ldap is the directory synced into users and teams. The sync is off when no url is set.
+	ldap ldapConfig
+	// scimToken is the bearer token identity providers use for SCIM provisioning. SCIM is off when it is empty.
+	scimToken string
+	// retention is how long after a cycle is created its feedback text is purged. Feedback is kept forever when zero.
+	retention time.Duration
+	// backups are the scheduled backups of the db. They are off when no dir is set.
+	backups backupConfig
 }
 
 func main() {
+	a := app{}
 	var dbfile string
 	var port int
+	var reminderDays, adminEmails string
+	var retentionDays int
+	var encryptionKey, encryptionKeyFile string
 	flag.StringVar(&dbfile, "sqlite-path", "peerreview.db", "set the path to the sqlite3 db file")
 	// TODO: consider dynamic rewriting of html/js depending on port used
 	flag.IntVar(&port, "port", 3333, "set the port the server runs on. Note: the html/js needs to point to this same address. Best to leave it default.")
+	flag.StringVar(&a.baseURL, "base-url", "http://localhost:3333", "set the address users reach the app at. Used for links in notifications.")
+	flag.StringVar(&a.smtp.Host, "smtp-host", "", "set the SMTP server used to send email notifications. Email is disabled if empty.")
+	flag.IntVar(&a.smtp.Port, "smtp-port", 587, "set the SMTP server port")
+	flag.StringVar(&a.smtp.Username, "smtp-username", "", "set the SMTP username. No authentication is attempted if empty.")
+	flag.StringVar(&a.smtp.Password, "smtp-password", "", "set the SMTP password")
+	flag.StringVar(&a.smtp.From, "smtp-from", "peerreview@localhost", "set the address email notifications are sent from")
+	flag.StringVar(&a.smtp.TLS, "smtp-tls", "starttls", "set how to secure the SMTP connection: starttls, tls, or none")
+	flag.DurationVar(&a.closingNotice, "closing-notice", 48*time.Hour, "set how long before a cycle closes that everyone gets a closing soon email")
+	flag.IntVar(&a.jobs.Workers, "job-workers", 2, "set how many background jobs can run at once")
+	flag.StringVar(&reminderDays, "reminder-days", "7,3,1", "set the comma separated days before a cycle closes to remind people of feedback they still owe. Empty disables reminders.")
+	flag.StringVar(&adminEmails, "admin-emails", "", "set the comma separated emails that are admins and get the weekly admin digest")
+	flag.StringVar(&a.slack.SigningSecret, "slack-signing-secret", "", "set the Slack app signing secret to enable slash commands at /chat/slash")
+	flag.StringVar(&a.slack.Token, "slack-token", "", "set the Slack bot token used to look up users' emails. Needs the users:read.email scope.")
+	flag.StringVar(&a.slack.APIBase, "slack-api", "https://slack.com/api", "set the Slack Web API address")
+	flag.StringVar(&a.ldap.URL, "ldap-url", "", "set the ldap:// or ldaps:// url of the directory to sync users and teams from. The sync is disabled if empty.")
+	flag.BoolVar(&a.ldap.StartTLS, "ldap-starttls", false, "set to upgrade an ldap:// connection with StartTLS")
+	flag.StringVar(&a.ldap.BindDN, "ldap-bind-dn", "", "set the DN to bind to the directory as. Binds anonymously if empty.")
+	flag.StringVar(&a.ldap.BindPassword, "ldap-bind-password", "", "set the password for -ldap-bind-dn")
+	flag.StringVar(&a.ldap.UserBase, "ldap-user-base", "", "set the DN to search for people under")
+	flag.StringVar(&a.ldap.UserFilter, "ldap-user-filter", "(objectClass=person)", "set the filter that finds people")
+	flag.StringVar(&a.ldap.GroupBase, "ldap-group-base", "", "set the DN to search for groups under. Teams are not synced if empty.")
+	flag.StringVar(&a.ldap.GroupFilter, "ldap-group-filter", "(objectClass=groupOfNames)", "set the filter that finds groups")
+	flag.StringVar(&a.ldap.EmailAttr, "ldap-email-attr", "mail", "set the attribute with a person's email")
+	flag.StringVar(&a.ldap.NameAttr, "ldap-name-attr", "cn", "set the attribute with a person's name")
+	flag.StringVar(&a.ldap.ManagerAttr, "ldap-manager-attr", "manager", "set the attribute with the DN of a person's manager")
+	flag.StringVar(&a.ldap.MemberAttr, "ldap-member-attr", "member", "set the attribute with the DNs of a group's members")
+	flag.DurationVar(&a.ldap.Interval, "ldap-sync-interval", time.Hour, "set how often the directory is synced")
+	flag.IntVar(&retentionDays, "retention-days", 0, "set how many days after a cycle is created its feedback text is purged. Counts are kept. 0 keeps feedback forever.")
+	flag.StringVar(&a.scimToken, "scim-token", "", "set the bearer token for SCIM provisioning at /scim/v2. SCIM is disabled if empty.")
+	flag.StringVar(&a.backups.Dir, "backup-dir", "", "set the directory scheduled backups of the db are written to. Scheduled backups are disabled if empty.")
+	flag.DurationVar(&a.backups.Interval, "backup-interval", 24*time.Hour, "set how often the db is backed up")
+	flag.IntVar(&a.backups.Keep, "backup-keep", 7, "set how many backups to keep in -backup-dir. Older ones are removed.")
+	flag.StringVar(&encryptionKey, "encryption-key", "", "set the comma separated base64 keys that encrypt feedback and goals at rest. The first key encrypts and the rest only decrypt. Encryption is disabled if empty.")
+	flag.StringVar(&encryptionKeyFile, "encryption-key-file", "", "set a file with the keys for -encryption-key, one per line")
 	flagenv.Parse()
 	flag.Parse()
 
-	a := app{}
+	if !inList(a.smtp.TLS, []string{"starttls", "tls", "none"}) {
+		log.Fatalf("-smtp-tls must be one of starttls, tls, or none. Got %q", a.smtp.TLS)
+	}
+
 	var err error
+	a.reminderDays, err = parseReminderDays(reminderDays)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if retentionDays < 0 {
+		log.Fatalf("-retention-days can not be negative. Got %d", retentionDays)
+	}
+	a.retention = time.Duration(retentionDays) * 24 * time.Hour
+	if a.backups.Keep < 1 {
+		log.Fatalf("-backup-keep must be at least 1. Got %d", a.backups.Keep)
+	}
+	if encryptionKeyFile != "" {
+		if encryptionKey != "" {
+			log.Fatal("set only one of -encryption-key and -encryption-key-file")
+		}
+		b, err := ioutil.ReadFile(encryptionKeyFile)
+		if err != nil {
+			log.Fatalf("unable to read -encryption-key-file - %v", err)
+		}
+		encryptionKey = string(b)
+	}
+	if err := SetEncryptionKeys(encryptionKey); err != nil {
+		log.Fatal(err)
+	}
+	for _, email := range strings.Split(adminEmails, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			a.adminEmails = append(a.adminEmails, email)
+		}
+	}
+
+	// restore replaces the db file, so it runs before the db is opened
+	if flag.Arg(0) == "restore" {
+		if flag.Arg(1) == "" {
+			log.Fatal("usage: peerreview restore path/to/backup.db")
+		}
+		replaced, err := RestoreDB(flag.Arg(1), dbfile, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if replaced != "" {
+			log.Printf("restored %s to %s. The previous db was moved to %s", flag.Arg(1), dbfile, replaced)
+		} else {
+			log.Printf("restored %s to %s", flag.Arg(1), dbfile)
+		}
+		return
+	}
 
 	err = InitDB(dbfile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	a.db, err = sql.Open("sqlite3", dbfile)
+	a.db, err = OpenDB(dbfile)
 	if err != nil {
 		log.Fatalf("unable to open %s - %v", dbfile, err)
 	}
@@ -74,16 +186,92 @@ func main() {
 		log.Fatal(err)
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "reencrypt":
+		result, err := ReencryptFields(a.db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("reencrypted %d reviews, %d goals, and %d prompts", result.Reviews, result.Goals, result.Prompts)
+		return
+	case "backup":
+		if path := flag.Arg(1); path != "" {
+			if err := BackupDB(a.db, path); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("backed up %s to %s", dbfile, path)
+			return
+		}
+		if !a.backups.enabled() {
+			log.Fatal("usage: peerreview backup path/to/backup.db, or set -backup-dir")
+		}
+		b, err := CreateBackup(a.db, a.backups, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("backed up %s to %s", dbfile, filepath.Join(a.backups.Dir, b.Name))
+		return
+	case "export":
+		doc, err := ExportInstance(a.db, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		out := os.Stdout
+		if path := flag.Arg(1); path != "" {
+			if out, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+				log.Fatalf("unable to create %s - %v", path, err)
+			}
+			defer out.Close()
+		}
+		if err = WriteInstance(out, doc); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("exported %d users, %d teams, %d cycles, and %d reviews", len(doc.Users), len(doc.Teams), len(doc.Cycles), len(doc.Reviews))
+		return
+	case "import":
+		if flag.Arg(1) == "" {
+			log.Fatal("usage: peerreview import path/to/instance.json")
+		}
+		f, err := os.Open(flag.Arg(1))
+		if err != nil {
+			log.Fatalf("unable to open %s - %v", flag.Arg(1), err)
+		}
+		doc, err := ReadInstance(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = ImportInstance(a.db, doc); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("imported %d users, %d teams, %d cycles, and %d reviews into %s", len(doc.Users), len(doc.Teams), len(doc.Cycles), len(doc.Reviews), dbfile)
+		return
+	default:
+		log.Fatalf("unknown command %q. Commands are backup, restore, export, import, and reencrypt.", flag.Arg(0))
+	}
+
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		log.Fatalf("unable to create listener - %v", err)
 	}
+
+	// closing the listener makes Serve return, which waits for running jobs to finish before the db is closed
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("received %s, shutting down", sig)
+		l.Close()
+	}()
+
 	if err := Serve(a, l, true); err != nil {
 		log.Fatal(err)
 	}
+	log.Println("stopped")
 }
 
-// Serve ...
+// Serve serves the app on l until l is closed, then stops the background jobs, waiting for running ones to finish
 func Serve(a app, l net.Listener, showLogs bool) error {
 	logger := logrus.New()
 	logger.Formatter = &logrus.TextFormatter{
@@ -92,6 +280,10 @@ func Serve(a app, l net.Listener, showLogs bool) error {
 	}
 	log.Printf("listening on :%d", l.Addr().(*net.TCPAddr).Port)
 
+	if a.notifier == nil {
+		a.notifier = defaultNotifier(a)
+	}
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
@@ -109,12 +301,21 @@ func Serve(a app, l net.Listener, showLogs bool) error {
 	r.Get("/", a.rootHandler)
 	r.With(AuthMW).Get("/dash", a.dashHandler)
 	r.Post("/tokensignin", a.tokenHandler)
+	// authenticated by request signature rather than session
+	r.Post("/chat/slash", a.chatSlash)
+	// authenticated by the token in the url
+	r.Get("/calendar/{file}", a.calendarHandler)
 
 	r.Mount("/api", apiRouter(a))
+	r.Mount("/scim/v2", scimRouter(a))
 
 	// if you update the port, you have to update the Google Sign In Client
 	// at https://console.developers.google.com/apis/credentials
 
+	runner := newJobRunner(a)
+	runner.Start()
+	defer runner.Stop()
+
 	if err := http.Serve(l, r); err != nil {
 		return nil
 	}
@@ -129,24 +330,80 @@ func apiRouter(a app) http.Handler {
 	r.Delete("/user/team", a.apiUserTeam)
 
 	r.Post("/user/goal", a.apiUserGoal)
+	r.Get("/user/goals", a.apiUserGoals)
+	r.Post("/user/goals", a.apiUserGoals)
+	r.Put("/user/goals/{goalID}", a.apiUserGoalEdit)
+	r.Delete("/user/goals/{goalID}", a.apiUserGoalEdit)
+
+	r.Post("/user/email-preferences", a.apiUserEmailPreferences)
+
+	r.Get("/user/calendar", a.apiUserCalendar)
+	r.Post("/user/calendar/regenerate", a.apiUserCalendar)
+
+	r.Get("/user/notifications", a.apiUserNotifications)
+	r.Post("/user/notifications/read", a.apiUserNotificationsRead)
+
+	r.Get("/user/export", a.apiUserExport)
 
 	r.Get("/user/reviewees/{cycleName}", a.apiUserReviewees)
+	r.Get("/user/outstanding/{cycleName}", a.apiUserOutstanding)
 
 	r.Get("/user/reviews", a.apiUserReviews)
 	r.Post("/user/reviews", a.apiUserReviews)
 
 	r.Post("/user/reviewer", a.apiUserReviewer)
 
+	r.Get("/user/review-requests", a.apiUserReviewRequests)
+	r.Post("/user/review-requests/{requestID}/{action}", a.apiUserReviewRequestAction)
+
+	r.Get("/user/approvals", a.apiUserApprovals)
+	r.Post("/user/approvals/{requestID}/{action}", a.apiUserApprovalAction)
+
 	r.Get("/user", a.apiUser)
 
-	r.Get("/admin/cycles", a.apiAdminCycles)
-	r.Post("/admin/cycles", a.apiAdminCycles)
-	r.Put("/admin/cycles", a.apiAdminCycles)
-	r.Delete("/admin/cycles", a.apiAdminCycles)
+	// every /api/admin route is for admins only
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(a.AdminMW)
+		r.Get("/cycles", a.apiAdminCycles)
+		r.Post("/cycles", a.apiAdminCycles)
+		r.Put("/cycles", a.apiAdminCycles)
+		r.Delete("/cycles", a.apiAdminCycles)
+		r.Put("/cycles/settings", a.apiAdminCyclesSettings)
+		r.Post("/cycles/assignments", a.apiAdminCyclesAssignments)
+
+		r.Get("/reports/requested-reviewers/{cycleName}", a.apiAdminReportsRequestedReviewers)
+		r.Get("/reports/completion/{cycleName}", a.apiAdminReportsCompletion)
+
+		r.Get("/jobs", a.apiAdminJobs)
+		r.Post("/jobs/{jobID}/retry", a.apiAdminJobRetry)
+
+		r.Get("/webhooks", a.apiAdminWebhooks)
+		r.Post("/webhooks", a.apiAdminWebhooks)
+		r.Delete("/webhooks/{webhookID}", a.apiAdminWebhook)
+		r.Get("/webhooks/{webhookID}/deliveries", a.apiAdminWebhookDeliveries)
 
-	r.Get("/admin/teams", a.apiAdminTeams)
-	r.Post("/admin/teams", a.apiAdminTeams)
-	r.Delete("/admin/teams", a.apiAdminTeams)
+		r.Post("/users/import", a.apiAdminUsersImport)
+		r.Get("/users/export", a.apiAdminUsersExport)
+		r.Post("/users/{email}/deactivate", a.apiAdminUserDeactivate)
+		r.Post("/users/{email}/reactivate", a.apiAdminUserReactivate)
+		r.Post("/users/{email}/manager", a.apiAdminUserManager)
+
+		r.Get("/audit", a.apiAdminAudit)
+		r.Get("/audit/export", a.apiAdminAuditExport)
+
+		r.Post("/retention/purge", a.apiAdminRetentionPurge)
+		r.Get("/retention/purges", a.apiAdminRetentionPurges)
+
+		r.Get("/backups", a.apiAdminBackups)
+		r.Post("/backups", a.apiAdminBackupCreate)
+
+		r.Get("/ldap/runs", a.apiAdminLDAPRuns)
+		r.Post("/ldap/sync", a.apiAdminLDAPSync)
+
+		r.Get("/teams", a.apiAdminTeams)
+		r.Post("/teams", a.apiAdminTeams)
+		r.Delete("/teams", a.apiAdminTeams)
+	})
 
 	return r
 }
@@ -164,23 +421,59 @@ func RandStringRunes(n int) string {
 Planning:
 Schemas:
 
-users
-id name email goals
+users (goals are encrypted, see crypto.go)
+id name email goals manager_id email_opt_out is_admin is_active ldap_dn calendar_token
 
 teams
-id name
+id name ldap_dn
 
 user_teams
 id user_id team_id
 
-reviews
-id recipient_id review_cycle_id feedback is_strength is_growth_opportunity
+reviews (feedback is encrypted, see crypto.go)
+id recipient_id review_cycle_id feedback is_strength is_growth_opportunity purged_at goal_id prompt_id
 
 review_cycles
-id name is_open
+id name is_open max_requests_per_reviewer max_requests_per_requester require_manager_approval closes_at closing_notice_sent created_at
+
+jobs (see jobs.go)
+id kind payload status attempts max_attempts last_error run_at created_at updated_at
 
 review_requests
-id recipient_id reviewer_id cycle_id
+id recipient_id reviewer_id cycle_id status decline_reason prompt_id
+
+notifications (see feed.go)
+id user_id kind message cycle created_at read_at
+
+sent_digests (see reminders.go)
+id kind recipient cycle period sent_at
+
+ldap_sync_runs (see ldap.go)
+id started_at finished_at dry_run status error report
+
+retention_purges (see retention.go)
+id purged_at cutoff reviews_purged report
+
+audit_log (append only, see audit.go)
+id created_at actor action target before after request_id ip
+
+chat_identities (see chat.go)
+chat_user_id email updated_at
+
+webhooks (see webhooks.go)
+id url secret events created_at
+
+webhook_deliveries
+id webhook_id event payload status attempts response_code last_error created_at delivered_at
+
+goals (see goals.go)
+id user_id title description status cycle_id created_at updated_at
+
+prompts (see prompts.go)
+id recipient_id cycle_id text created_at answers
+
+review_submissions (never joined to reviews, see submissions.go)
+id reviewer_id reviewee_id cycle_id submitted_on
 
 Workflow:
 user signs in with google.
@@ -196,43 +489,198 @@ GET     /api/user/team                      {"teams":[$team_a, $team_b, $team_c]
 POST    /api/user/team   {"team": $team}    201
 DELETE  /api/user/team   {"team": $team}    200
 POST    /api/user/goal   {"goal": $goal}    201
+POST    /api/user/email-preferences {"opt_out": bool}  200
+
+goals are kept as history: status moves from active to achieved or dropped instead of the goal being replaced.
+A goal can be tied to a cycle. Reviewers see a reviewee's active goals for the cycle, or for no cycle, in their reviewee list.
+
+GET     /api/user/goals?status=active                    {"goals":[{"id":int, "title":$title, "description":$description, "status":"active|achieved|dropped", "cycle":$cycle, "created_at":$time, "updated_at":$time}]}
+POST    /api/user/goals {"title":$title, "description":$description, "cycle":$optional}   201 {"goal":$goal}
+PUT     /api/user/goals/:$id {"title":$title, "description":$description, "status":$status, "cycle":$cycle}   200 {"goal":$goal} # fields are optional
+DELETE  /api/user/goals/:$id                             200
+
+calendar feed of cycle close dates, listing outstanding reviewees. Subscribe to the url in a calendar app.
+Regenerating replaces the token so the old url stops working.
+
+GET     /api/user/calendar                               {"url": $base_url/calendar/$token.ics}
+POST    /api/user/calendar/regenerate                    {"url": $base_url/calendar/$new_token.ics}
+GET     /calendar/:$token.ics                            text/calendar (no session needed)
+
+personal data export: profile, goals, feedback received, who the user gave feedback to, review requests sent and received,
+notifications, and sessions. Nothing that identifies who gave the user feedback is included.
+
+GET     /api/user/export                                 application/zip with data.json and data.html
+
+activity feed shown on /dash. Covers review requests received, accepted, and declined, cycles opening and closing soon,
+results released, and reminders.
+
+GET     /api/user/notifications?unread=true&limit=50     {"notifications":[{"id":int, "kind":$kind, "message":$message, "cycle":$cycle, "created_at":$time, "read":bool}], "unread":int}
+POST    /api/user/notifications/read {"ids":[int]}       200 # no ids marks all read
 
 submit review page
 user can see other team members (name). When they click on a team member, they can enter multiple feedbacks under strength or growth is_growth_opportunity
 they user is told that the feedback is anonymous and after they submit, the cannot edit their feedback, but they can provide additional feedback if they wish. They can choose to sign their name.
 
 Resource                     Payload                                                                                                        Response
-GET     /api/user/reviewees/:$cycle_name                                                                                                    {"reviewees": [{"name": $name, "email": $email}]} # this will populate with anyone on the same team and anyone who has requested a review from this user during this cycle
-POST    /api/user/reviews    {"reviewee_email":$email, "strengths":[$strength], "growth_opportunities":[$opportunity], "cycle": $cycle_name}  201
+GET     /api/user/reviewees/:$cycle_name                                                                                                    {"reviewees": [{"name": $name, "email": $email, "goals": [$goal], "prompts": [{"id":int, "text":$prompt}]}]} # this will populate with anyone on the same team and anyone who has requested a review from this user during this cycle
+POST    /api/user/reviews    {"reviewee_email":$email, "strengths":[$strength], "growth_opportunities":[$opportunity], "cycle": $cycle_name}  201 # 400 if a goal_id is not one of the reviewee's active goals, or a prompt_id was not asked of you
+
+Each strength or growth opportunity is either the feedback text, {"text":$text, "goal_id":int} for feedback about one of
+the reviewee's goals, or {"text":$text, "prompt_id":int} for feedback answering one of their prompts, as listed with the
+reviewee.
 
 they can also view users who have requested that the signed in user review them (good for cross team review)
 
+GET     /api/user/outstanding/:$cycle_name                                                                                                  {"reviewees": [{"name": $name, "email": $email}]} # reviewees the user has not submitted feedback for yet
+
 Request Review
 
 Page will have autocomplete of folks who have signed up. These requests are for those outside your team to give them visability to review you. Pending: notification of review request.
 
 Resource                 Payload                                 Response
-POST /api/user/reviewer  {"user_email": $user, "cycle": $cycle}  201
+POST /api/user/reviewer  {"user_email": $user, "cycle": $cycle, "prompt": $question}  201 # prompt is optional, 400 if over 500 characters or for yourself, 404 for an unknown user, 409 if an open request to them exists this cycle
+
+The prompt is a question for the reviewer, such as "how was my design doc for X?". It is shown with the request and next
+to the requester in the reviewer's reviewees.
+
+Requests can be reviewed in an inbox. The reviewer can accept or decline (with an optional reason the requester can see).
+The requester can withdraw a request that has not been declined. Declined and withdrawn requests no longer grant visibility.
+
+Resource                                             Payload                Response
+GET  /api/user/review-requests?cycle=$cycle_name                            {"incoming":[$request], "outgoing":[$request]}
+POST /api/user/review-requests/:$id/accept                                  200
+POST /api/user/review-requests/:$id/decline          {"reason": $reason}    200
+POST /api/user/review-requests/:$id/withdraw                                200
+
+If a cycle requires manager approval, requests wait in the requester's manager's approval queue, and users without a
+manager can not request reviews (409). The reviewer does not see requests (and the requester is not a reviewee) until
+they are approved. Managers are set by admins, the user import, SCIM, or LDAP, never by the user themselves.
+
+GET  /api/user/approvals                                                    {"requests":[$request]}
+POST /api/user/approvals/:$id/approve                                       200
+POST /api/user/approvals/:$id/reject                 {"reason": $reason}    200
 
 view reviews page
 sorted by review cycle, the shows the reviews by strength or growth opportunity
 
 Resource Payload Response
-GET /api/user/reviews   {"reviews":[{"cycle":$cycle, "strengths":[$strength], "growth_opportunities":[$opportunity]}}
+GET /api/user/reviews   {"reviews":[{"cycle":$cycle, "strengths":[$strength], "growth_opportunities":[$opportunity], "goals":[{"goal_id":int, "title":$title, "status":$status, "strengths":[$strength], "growth_opportunities":[$opportunity]}], "prompts":[{"prompt_id":int, "prompt":$prompt, "strengths":[$strength], "growth_opportunities":[$opportunity]}]}}
+
+Feedback about a goal is only under that goal in "goals". A deleted goal's feedback moves back to the cycle's lists.
+Feedback answering a prompt is under that prompt in "prompts" once at least 2 reviewers were asked it and answered.
+Until then it is in the cycle's lists, so a single reviewer's answers can not be picked out. Answers to a prompt asked
+of only 1 reviewer are stored as plain feedback. Asking several reviewers the same prompt groups all of their answers
+together.
+
+Chat
+Slack compatible slash commands, verified with the signing secret. Replies are only shown to the sender.
+
+POST    /chat/slash   form: user_id, text=request @user cycle | todo | cycles    200 {"response_type":"ephemeral", "text":$reply}
+
+SCIM 2.0 provisioning, authenticated with Authorization: Bearer $scim_token. Users are users (userName is the email)
+and Groups are teams. DELETE of a user deactivates them: they can not sign in, their sessions end, and their reviews stay.
+
+GET    /scim/v2/ServiceProviderConfig
+GET    /scim/v2/Users?filter=userName eq "$email"&startIndex=1&count=100    ListResponse of User
+POST   /scim/v2/Users   User                                                 201 User, 409 if the userName exists
+GET    /scim/v2/Users/:$id                                                   User
+PUT    /scim/v2/Users/:$id   User                                            User
+PATCH  /scim/v2/Users/:$id   PatchOp for active, userName, displayName, name User
+DELETE /scim/v2/Users/:$id                                                   204
+GET    /scim/v2/Groups?filter=displayName eq "$team"&excludedAttributes=members   ListResponse of Group
+POST   /scim/v2/Groups  Group                                                201 Group
+GET    /scim/v2/Groups/:$id                                                  Group
+PUT    /scim/v2/Groups/:$id  Group                                           Group
+PATCH  /scim/v2/Groups/:$id  PatchOp for displayName and members             Group
+DELETE /scim/v2/Groups/:$id                                                  204
 
 Admin stuffs
+Only admins can use /api/admin, others get a 403. Admins are users flagged with is_admin (see the user import) and the
+-admin-emails.
 GET    /api/admin/cycles                                  {"cycles":[{"name":$cycle_name, "is_open":bool}]}
 POST   /api/admin/cycles {"cycle":$name}                  201
 PUT    /api/admin/cycles {"cycle":$name, "is_open":bool}  200
 DELETE /api/admin/cycles {"cycle":$name}                  200
+PUT    /api/admin/cycles/settings {"cycle":$name, "max_requests_per_reviewer":int, "max_requests_per_requester":int, "require_manager_approval":bool, "closes_at":$rfc3339}  200
+
+POST   /api/admin/cycles/assignments {"cycle":$name, "reviewers_per_user":3, "cross_team_per_user":1, "dry_run":bool}  200 (dry run) or 201 {"assignments":[{"reviewee_email":$email, "reviewer_email":$email, "source":"team|org|cross_team"}], "committed":bool}
+
+Assignments are written as accepted review requests. Run with dry_run to preview them first, then send the previewed
+"assignments" back (without dry_run) to commit exactly those. They are checked again when committed, and a pair that
+got a request since the preview is a 409. Without "assignments", a new plan is made and written in one transaction.
+Request limits count the people with pending and accepted requests, so each requester counts once. 0 is no limit.
+Going over a limit when requesting a reviewer, or when committing assignments, is a 409.
+
+GET    /api/admin/reports/completion/:$cycle_name                     {"teams":[{"team":$team_name, "expected":int, "submitted":int, "percent":float}]}
+GET    /api/admin/reports/requested-reviewers/:$cycle_name?limit=10   {"reviewers":[{"name":$name, "email":$email, "requests":int, "pending":int, "accepted":int, "declined":int}]}
+
+GET    /api/admin/jobs?status=dead&limit=50                           {"jobs":[{"id":int, "kind":$kind, "payload":{}, "status":"queued|running|done|dead", "attempts":int, "last_error":$err, ...}]}
+POST   /api/admin/jobs/:$id/retry                                     200 # 409 if the job has not failed
+
+GET    /api/admin/webhooks                                            {"webhooks":[{"id":int, "url":$url, "events":[$event], "created_at":$time}]}
+POST   /api/admin/webhooks {"url":$url, "events":[$event or "*"], "secret":$optional}  201 {"webhook":{..., "secret":$secret}}
+DELETE /api/admin/webhooks/:$id                                       200
+GET    /api/admin/webhooks/:$id/deliveries?limit=50                   {"deliveries":[{"id":int, "event":$event, "payload":{}, "status":"pending|delivered|failed", "attempts":int, "response_code":int, ...}]}
+
+Webhook events: user.created, user.deactivated, user.reactivated, team.changed, cycle.changed, review_request.created,
+review.submitted. Bodies are {"event":$event, "created_at":$time, "data":{}} signed with X-PeerReview-Signature: sha256=hex(hmac_sha256(secret, body)).
+review.submitted's created_at is the start of its UTC day. Retrying a delivery's job resets the delivery's attempts.
 
 GET    /api/admin/teams                                   {"teams":[$team_name]}
 POST   /api/admin/teams  {"team":$team_name}              201
-DELETE /api/admin/teams  {"team":$team_name}              200
+DELETE /api/admin/teams  {"team":$team_name}              200 # members are removed from the team
+
+POST   /api/admin/ldap/sync?dry_run=true                          201 {"run":{"id":int, "started_at":$time, "finished_at":$time, "dry_run":bool, "status":"ok|failed", "error":$err, "report":{"users_created":[$email], "users_updated":[$email], "users_deactivated":[$email], "users_reactivated":[$email], "teams_created":[$team], "teams_deleted":[$team], "members_added":[{"team":$team, "email":$email}], "members_removed":[...], "managers_changed":[{"email":$email, "manager":$email}], "warnings":[$warning]}}} # 502 if the directory could not be synced
+GET    /api/admin/ldap/runs?limit=20                                  {"runs":[$run]}
+
+GET    /api/admin/audit?actor=$email&action=$action&target=$target&since=$rfc3339&until=$rfc3339&cursor=int&limit=50   {"entries":[{"id":int, "created_at":$time, "actor":$email, "action":$action, "target":$target, "before":{}, "after":{}, "request_id":$id, "ip":$ip}], "next_cursor":int}
+GET    /api/admin/audit/export?(same filters)                         text/csv: id,created_at,actor,action,target,before,after,request_id,ip
+
+Every change made through /api/admin, or by the SCIM client with "scim" as the actor, is added to the append only
+audit_log, newest first. A change that can't be added fails with a 500. Pass next_cursor as cursor for the next page;
+it is 0 on the last page.
+
+POST   /api/admin/retention/purge?dry_run=true                    200 (dry run) or 201 {"report":{"cutoff":$time, "dry_run":bool, "cycles":[{"cycle":$cycle, "created_at":$time, "reviews":int}], "reviews_purged":int}} # 404 without -retention-days
+GET    /api/admin/retention/purges?limit=20                           {"purges":[{"id":int, "purged_at":$time, "cutoff":$time, "reviews_purged":int, "cycles":[...]}]}
+
+Retention runs hourly too. Closed cycles created before the cutoff have their feedback text emptied; the rows stay so
+counts are kept, and reviews show them as purged_strengths and purged_growth_opportunities.
+
+POST   /api/admin/backups                                         201 {"backup":{"name":$file, "size":int, "created_at":$time}} # 404 without -backup-dir
+GET    /api/admin/backups                                             {"backups":[$backup]} # newest first
+
+Backups are online snapshots from sqlite's backup api, also taken every -backup-interval. Only the newest -backup-keep
+are kept. `peerreview backup [path]` and `peerreview restore path` work from the command line; restore checks the
+backup's integrity and schema version and keeps the db it replaces.
+
+`peerreview export [path]` writes the whole instance (users, teams and members, cycles, reviews, review requests, and
+review submissions) as a versioned json document, and `peerreview import path` loads one into an empty db. Rows refer to
+each other by email, team, and cycle name. Reviews are sorted, so their order does not show who wrote them.
+
+The directory is also synced every -ldap-sync-interval. Synced users no longer in the directory are deactivated.
+
+POST   /api/admin/users/import?dry_run=true   text/csv: name,email,teams,manager,admin   200 (dry run), 400 (invalid rows) or 201 {"rows":[{"line":int, "email":$email, "action":"create|update|invalid", "teams_added":[$team], "errors":[$err]}], "teams_created":[$team], "created":int, "updated":int, "invalid":int, "committed":bool}
+GET    /api/admin/users/export                                    text/csv, the same columns as the import
+
+Import teams are ";" separated, only ever added, and created if needed. Empty manager or admin cells are left alone.
+Nothing is written if any row is invalid.
+
+POST   /api/admin/users/:$email/deactivate {"purge_feedback":bool}  200 {"email":$email, "requests_withdrawn":int, "feedback_purged":int}
+POST   /api/admin/users/:$email/reactivate                          200
+POST   /api/admin/users/:$email/manager {"manager_email":$email}      201, 404 (user or manager not found). An empty manager_email clears it
+
+Deactivated users can not sign in, their sessions end, they are left out of reviewee lists, assignments, and emails, and
+their open review requests (sent and received) are withdrawn. The feedback they received is kept unless purged,
+which blanks its text like the retention policy does. Their calendar feed and chat commands stop working.
 
 for adding teams... show a list of teams. Have link, team not listed? add it! with form.
 
-Operability: set up db back ups. Capture error logs. v2: email error reports?
+Background work goes through the jobs table. Failed jobs are retried with backoff and dead lettered after max_attempts.
+
+Notifications: when SMTP is configured, send_email jobs are queued for
+new review requests, cycles opening, cycles closing soon (see closes_at), and results being released when a cycle closes.
+
+Operability: capture error logs. v2: email error reports?
 
 whitelabel domains? domains -> teams?
 */
@@ -7,11 +7,14 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 var preserveTestDB bool
@@ -31,13 +34,14 @@ func TestAPIAdminTeams(t *testing.T) {
 	/*
 		Verify we can insert teams into the system
 		Verify we can get teams inserted into the system
-		Verify we can delete teams from the system
+		Verify we can delete teams from the system, even with members
 	*/
 	cli, teardown := setupInstance()
 	defer teardown()
 
 	NoErr(t, cli.InsertTeam("team_a"), "Insert team a")
 	NoErr(t, cli.InsertTeam("team_b"), "Insert team b")
+	NoErr(t, cli.AssignTeamToUser("team_b"), "joining team b")
 
 	teams, err := cli.GetTeams()
 	NoErr(t, err, "Get teams after insert")
@@ -54,6 +58,84 @@ func TestAPIAdminTeams(t *testing.T) {
 	if got, want := len(teams), 1; got != want {
 		t.Errorf("got %d teams, want %d", got, want)
 	}
+	if teams, _ := GetUsersTeams(cli.db, cli.userEmail); len(teams) != 0 {
+		t.Errorf("got user teams %v, want none after the team was deleted", teams)
+	}
+}
+
+func TestAPIAdminUserDeactivation(t *testing.T) {
+	/*
+		Verify deactivating a user withdraws their open requests, hides them from reviewees, and ends their sessions
+		Verify their feedback is kept unless purged
+		Verify deactivated users can not be requested as reviewers, and can be reactivated
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, cli.InsertTeam("team_1"), "creating team")
+	NoErr(t, cli.AssignTeamToUser("team_1"), "joining team")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	for _, email := range []string{"user_1@example.com", "user_2@example.com"} {
+		NoErr(t, CreateUser(cli.db, email, email), "creating user")
+		NoErr(t, AssignTeamToUser(cli.db, email, "team_1"), "setting up team")
+		NoErr(t, cli.AddReviewForUser(email, "cycle_1", []string{"kind"}, []string{"late"}), "adding review")
+	}
+	NoErr(t, cli.as("user_1@example.com").AddReviewer(cli.userEmail, "cycle_1"), "user 1 requesting a review")
+	NoErr(t, cli.AddReviewer("user_2@example.com", "cycle_1"), "requesting user 2")
+	SetAuth("user-1-session", "user_1@example.com", time.Now().Add(time.Hour))
+
+	d, err := cli.DeactivateUser("user_1@example.com", false)
+	NoErr(t, err, "deactivating user 1")
+	if d.RequestsWithdrawn != 1 || d.FeedbackPurged != 0 {
+		t.Errorf("got %+v, want 1 request withdrawn and no feedback purged", d)
+	}
+	if _, ok := IsValidAuth("user-1-session"); ok {
+		t.Error("got a valid session for a deactivated user")
+	}
+	reviewees, err := cli.GetUserReviewees("cycle_1")
+	NoErr(t, err, "getting reviewees")
+	if len(reviewees) != 1 || reviewees[0].Email != "user_2@example.com" {
+		t.Errorf("got reviewees %v, want only user 2", reviewees)
+	}
+	if reviews, _ := GetUserReviews(cli.db, "user_1@example.com"); len(reviews) == 0 {
+		t.Error("got no reviews for user 1, want their feedback kept")
+	}
+	if err := cli.AddReviewer("user_1@example.com", "cycle_1"); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("got %v, want a 409 requesting a deactivated reviewer", err)
+	}
+	info, err := GetUser(cli.db, "user_1@example.com")
+	NoErr(t, err, "getting user 1")
+	if info.IsActive {
+		t.Error("got user 1 active after deactivating")
+	}
+
+	d, err = cli.DeactivateUser("user_2@example.com", true)
+	NoErr(t, err, "deactivating user 2")
+	if d.RequestsWithdrawn != 1 || d.FeedbackPurged != 2 {
+		t.Errorf("got %+v, want 1 request withdrawn and 2 feedback purged", d)
+	}
+	reviews, err := GetUserReviews(cli.db, "user_2@example.com")
+	NoErr(t, err, "getting user 2's reviews")
+	if len(reviews) != 1 || len(reviews[0].Strengths)+len(reviews[0].Opportunities) != 0 ||
+		reviews[0].PurgedStrengths != 1 || reviews[0].PurgedOpportunities != 1 {
+		t.Errorf("got reviews %+v for user 2, want their feedback purged and counted", reviews)
+	}
+	_, outgoing, err := GetReviewRequests(cli.db, cli.userEmail, "cycle_1")
+	NoErr(t, err, "getting review requests")
+	if len(outgoing) != 1 || outgoing[0].Status != requestWithdrawn {
+		t.Errorf("got %+v, want the request to user 2 withdrawn", outgoing)
+	}
+
+	NoErr(t, cli.ReactivateUser("user_1@example.com"), "reactivating user 1")
+	reviewees, err = cli.GetUserReviewees("cycle_1")
+	NoErr(t, err, "getting reviewees")
+	if len(reviewees) != 1 || reviewees[0].Email != "user_1@example.com" {
+		t.Errorf("got reviewees %v, want only user 1", reviewees)
+	}
+
+	if _, err := cli.DeactivateUser("nobody@example.com", false); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want a 404 deactivating an unknown user", err)
+	}
 }
 
 func TestAPIAdminCycles(t *testing.T) {
@@ -104,6 +186,34 @@ func TestAPIAdminCycles(t *testing.T) {
 	}
 
 }
+
+func TestAdminOnly(t *testing.T) {
+	/*
+		Verify users who are not admins get a 403 from the admin endpoints
+		Verify users flagged as admins and the -admin-emails can use them
+	*/
+	cli, teardown := setupInstanceWith(func(a *app) {
+		a.adminEmails = []string{"bootstrap@example.com"}
+	})
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	NoErr(t, CreateUser(cli.db, "bootstrap", "bootstrap@example.com"), "creating user")
+	user1 := cli.as("user_1@example.com")
+
+	err := user1.AddCycle("cycle_1")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got %v, want a 403 for a user who is not an admin", err)
+	}
+	if _, err := user1.GetTeamCompletion("cycle_1"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got %v, want a 403 reading a report as a user who is not an admin", err)
+	}
+	NoErr(t, cli.as("bootstrap@example.com").AddCycle("cycle_1"), "adding cycle as an admin by flag")
+
+	NoErr(t, SetUserAdmin(cli.db, "user_1@example.com", true), "flagging admin")
+	NoErr(t, user1.AddCycle("cycle_2"), "adding cycle as a flagged admin")
+}
+
 func TestAPIUserTeam(t *testing.T) {
 	/*
 		Verify no teams are assigned by default
@@ -182,9 +292,11 @@ func TestAPIUserGoal(t *testing.T) {
 
 func TestAPIUserReviewees_APIUserReviewer(t *testing.T) {
 	/*
-		Verify that reviewees contain all team mates and any registered reviewer
+		Verify that reviewees contain all team mates, and that a requested reviewer sees the requester
 		 - set up two teams. set up team mates on user's team. Set up a user from another team
-		 - set user from other team as a reviewer, make sure everyone shows up as reviewers.
+		 - ask the user from the other team for a review. The user's reviewees are still only their team mates, and the
+		   reviewer's reviewees are only the user.
+		Verify a user can not ask themselves, someone unknown, or the same reviewer twice in a cycle
 	*/
 
 	cli, teardown := setupInstance()
@@ -208,8 +320,133 @@ func TestAPIUserReviewees_APIUserReviewer(t *testing.T) {
 	reviewees, err := cli.GetUserReviewees("cycle_1")
 	NoErr(t, err, "getting reviewees")
 
-	if len(reviewees) != 3 {
-		t.Errorf("got %d reviewees, want %d - %v", len(reviewees), 4, reviewees)
+	if len(reviewees) != 2 {
+		t.Errorf("got %d reviewees, want %d - %v", len(reviewees), 2, reviewees)
+	}
+
+	// the requested reviewer can now review the user even though they are on another team
+	reviewees, err = cli.as("user_3@example.com").GetUserReviewees("cycle_1")
+	NoErr(t, err, "getting reviewer's reviewees")
+
+	if len(reviewees) != 1 || reviewees[0].Email != cli.userEmail {
+		t.Errorf("got reviewees %v, want only %s", reviewees, cli.userEmail)
+	}
+
+	for _, tc := range []struct {
+		reviewer string
+		code     string
+	}{
+		{"user_3@example.com", "409"},
+		{cli.userEmail, "400"},
+		{"nobody@example.com", "404"},
+	} {
+		if err = cli.AddReviewer(tc.reviewer, "cycle_1"); err == nil || !strings.Contains(err.Error(), tc.code) {
+			t.Errorf("got %v requesting %s, want a %s", err, tc.reviewer, tc.code)
+		}
+	}
+	reviewees, err = cli.as("user_3@example.com").GetUserReviewees("cycle_1")
+	NoErr(t, err, "getting reviewer's reviewees")
+	if len(reviewees) != 1 {
+		t.Errorf("got reviewees %v, want the requester once", reviewees)
+	}
+}
+
+func TestAPIUserReviewRequests(t *testing.T) {
+	/*
+		Verify requests show up as outgoing for the requester and incoming for the reviewer
+		Verify the reviewer can accept and decline, and the decline reason is visible to the requester
+		Verify the requester can withdraw a request
+		Verify declined and withdrawn requests no longer make the requester a reviewee
+		Verify users cannot act on requests that are not theirs
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	NoErr(t, CreateUser(cli.db, "user_2", "user_2@example.com"), "creating user")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.AddReviewer("user_1@example.com", "cycle_1"), "add reviewer 1")
+	NoErr(t, cli.AddReviewer("user_2@example.com", "cycle_1"), "add reviewer 2")
+
+	incoming, outgoing, err := cli.GetReviewRequests("cycle_1")
+	NoErr(t, err, "getting requester's requests")
+	if got, want := len(incoming), 0; got != want {
+		t.Errorf("got %d incoming requests, want %d", got, want)
+	}
+	if got, want := len(outgoing), 2; got != want {
+		t.Fatalf("got %d outgoing requests, want %d", got, want)
+	}
+	for _, rr := range outgoing {
+		if rr.Status != requestPending {
+			t.Errorf("got status %q for %s, want %q", rr.Status, rr.ReviewerEmail, requestPending)
+		}
+	}
+
+	reviewer1 := cli.as("user_1@example.com")
+	reviewer2 := cli.as("user_2@example.com")
+
+	incoming, _, err = reviewer1.GetReviewRequests("")
+	NoErr(t, err, "getting reviewer's requests")
+	if len(incoming) != 1 || incoming[0].RequesterEmail != cli.userEmail {
+		t.Fatalf("got incoming %v, want one request from %s", incoming, cli.userEmail)
+	}
+	firstID := incoming[0].ID
+
+	incoming, _, err = reviewer2.GetReviewRequests("")
+	NoErr(t, err, "getting reviewer's requests")
+	if len(incoming) != 1 {
+		t.Fatalf("got %d incoming requests, want 1", len(incoming))
+	}
+	secondID := incoming[0].ID
+
+	// only the reviewer may accept or decline, only the requester may withdraw
+	if err := reviewer2.AcceptReviewRequest(firstID); err == nil {
+		t.Errorf("got no error accepting another reviewer's request")
+	}
+	if err := cli.AcceptReviewRequest(firstID); err == nil {
+		t.Errorf("got no error when the requester accepted their own request")
+	}
+	if err := reviewer1.WithdrawReviewRequest(firstID); err == nil {
+		t.Errorf("got no error when the reviewer withdrew a request")
+	}
+
+	NoErr(t, reviewer1.AcceptReviewRequest(firstID), "accepting request")
+	NoErr(t, reviewer2.DeclineReviewRequest(secondID, "I have not worked with you this cycle"), "declining request")
+
+	if err := reviewer2.AcceptReviewRequest(secondID); err == nil {
+		t.Errorf("got no error accepting a declined request")
+	}
+
+	_, outgoing, err = cli.GetReviewRequests("cycle_1")
+	NoErr(t, err, "getting requester's requests after responses")
+	for _, rr := range outgoing {
+		switch rr.ID {
+		case firstID:
+			if rr.Status != requestAccepted {
+				t.Errorf("got status %q, want %q", rr.Status, requestAccepted)
+			}
+		case secondID:
+			if rr.Status != requestDeclined {
+				t.Errorf("got status %q, want %q", rr.Status, requestDeclined)
+			}
+			if got, want := rr.DeclineReason, "I have not worked with you this cycle"; got != want {
+				t.Errorf("got decline reason %q, want %q", got, want)
+			}
+		}
+	}
+
+	reviewees, err := reviewer2.GetUserReviewees("cycle_1")
+	NoErr(t, err, "getting reviewees after decline")
+	if got, want := len(reviewees), 0; got != want {
+		t.Errorf("got %d reviewees after decline, want %d", got, want)
+	}
+
+	NoErr(t, cli.WithdrawReviewRequest(firstID), "withdrawing request")
+
+	reviewees, err = reviewer1.GetUserReviewees("cycle_1")
+	NoErr(t, err, "getting reviewees after withdraw")
+	if got, want := len(reviewees), 0; got != want {
+		t.Errorf("got %d reviewees after withdraw, want %d", got, want)
 	}
 }
 
@@ -243,6 +480,435 @@ func TestAPIUserReviews(t *testing.T) {
 	}
 }
 
+func TestAPIReviewRequestLimits(t *testing.T) {
+	/*
+		Verify requests are unlimited by default
+		Verify a reviewer cannot receive more open requests than the cycle allows
+		Verify a requester cannot send more open requests than the cycle allows
+		Verify declined requests free up room under the limit
+		Verify the most requested reviewers report
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	for i := 1; i <= 4; i++ {
+		NoErr(t, CreateUser(cli.db, fmt.Sprintf("user_%d", i), fmt.Sprintf("user_%d@example.com", i)), "creating user")
+	}
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+
+	reviewerLimit, requesterLimit := 1, 2
+	NoErr(t, cli.UpdateCycleSettings("cycle_1", CycleSettings{MaxRequestsPerReviewer: &reviewerLimit, MaxRequestsPerRequester: &requesterLimit}), "setting limits")
+
+	cycles, err := cli.GetCycles()
+	NoErr(t, err, "getting cycles")
+	if len(cycles) != 1 || cycles[0].MaxRequestsPerReviewer != 1 || cycles[0].MaxRequestsPerRequester != 2 {
+		t.Errorf("got cycles %+v, want limits of 1 and 2", cycles)
+	}
+
+	user2 := cli.as("user_2@example.com")
+	NoErr(t, cli.AddReviewer("user_1@example.com", "cycle_1"), "first request for user 1")
+	if err := user2.AddReviewer("user_1@example.com", "cycle_1"); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("got %v, want a 409 for going over the reviewer limit", err)
+	}
+
+	NoErr(t, cli.AddReviewer("user_3@example.com", "cycle_1"), "second request from user")
+	if err := cli.AddReviewer("user_4@example.com", "cycle_1"); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("got %v, want a 409 for going over the requester limit", err)
+	}
+
+	// once user_1 declines, they can be asked again
+	reviewer1 := cli.as("user_1@example.com")
+	incoming, _, err := reviewer1.GetReviewRequests("cycle_1")
+	NoErr(t, err, "getting reviewer's requests")
+	if len(incoming) != 1 {
+		t.Fatalf("got %d incoming requests, want 1", len(incoming))
+	}
+	NoErr(t, reviewer1.DeclineReviewRequest(incoming[0].ID, "too busy"), "declining")
+	NoErr(t, user2.AddReviewer("user_1@example.com", "cycle_1"), "request after decline")
+
+	reviewers, err := cli.GetMostRequestedReviewers("cycle_1", 10)
+	NoErr(t, err, "getting most requested reviewers")
+	if len(reviewers) != 2 {
+		t.Fatalf("got %d reviewers, want 2 - %+v", len(reviewers), reviewers)
+	}
+	if got := reviewers[0]; got.Email != "user_1@example.com" || got.Requests != 2 || got.Declined != 1 || got.Pending != 1 {
+		t.Errorf("got top reviewer %+v, want user_1 with 2 requests, 1 declined, 1 pending", got)
+	}
+}
+
+func TestReviewRequestLimitsCountPeople(t *testing.T) {
+	/*
+		Verify one requester can not use up a reviewer's limit alone, even with duplicate requests from before they were refused
+		Verify admin assignments count towards and respect the reviewer limit
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	for i := 1; i <= 3; i++ {
+		NoErr(t, CreateUser(cli.db, fmt.Sprintf("user_%d", i), fmt.Sprintf("user_%d@example.com", i)), "creating user")
+	}
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	reviewerLimit := 2
+	NoErr(t, cli.UpdateCycleSettings("cycle_1", CycleSettings{MaxRequestsPerReviewer: &reviewerLimit}), "setting limits")
+
+	NoErr(t, cli.AddReviewer("user_1@example.com", "cycle_1"), "requesting review")
+	if err := cli.AddReviewer("user_1@example.com", "cycle_1"); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("got %v, want a 409 for a duplicate request", err)
+	}
+	// a duplicate written before duplicates were refused
+	q := "insert into review_requests (recipient_id, reviewer_id, cycle_id, status) select recipient_id, reviewer_id, cycle_id, status from review_requests"
+	_, err := cli.db.Exec(q)
+	NoErr(t, err, "duplicating request")
+	NoErr(t, cli.as("user_2@example.com").AddReviewer("user_1@example.com", "cycle_1"), "requesting review from a second requester")
+
+	err = CommitAssignments(cli.db, "cycle_1", []Assignment{{RevieweeEmail: "user_3@example.com", ReviewerEmail: "user_1@example.com", Source: sourceCrossTeam}})
+	if _, ok := errors.Cause(err).(RequestCapError); !ok {
+		t.Errorf("got %v, want a RequestCapError assigning a reviewer at their limit", err)
+	}
+}
+
+func TestAPIManagerApproval(t *testing.T) {
+	/*
+		Verify requests do not need approval unless the cycle requires it
+		Verify requests wait in the manager's queue and are hidden from the reviewer until approved
+		Verify only the requester's manager can approve or reject
+		Verify approved requests make the requester a reviewee and rejected ones do not
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "manager", "manager@example.com"), "creating manager")
+	NoErr(t, CreateUser(cli.db, "other manager", "other@example.com"), "creating other manager")
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	NoErr(t, CreateUser(cli.db, "user_2", "user_2@example.com"), "creating user")
+	NoErr(t, cli.SetUserManager(cli.userEmail, "manager@example.com"), "setting manager")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.AddCycle("cycle_2"), "adding cycle")
+
+	requireApproval := true
+	NoErr(t, cli.UpdateCycleSettings("cycle_2", CycleSettings{RequireManagerApproval: &requireApproval}), "requiring approval")
+
+	NoErr(t, cli.AddReviewer("user_1@example.com", "cycle_1"), "request without approval")
+	NoErr(t, cli.AddReviewer("user_1@example.com", "cycle_2"), "request needing approval")
+	NoErr(t, cli.AddReviewer("user_2@example.com", "cycle_2"), "request needing approval")
+
+	reviewer1 := cli.as("user_1@example.com")
+	reviewer2 := cli.as("user_2@example.com")
+	manager := cli.as("manager@example.com")
+
+	incoming, _, err := reviewer1.GetReviewRequests("")
+	NoErr(t, err, "getting reviewer's requests")
+	if len(incoming) != 1 || incoming[0].Cycle != "cycle_1" {
+		t.Errorf("got incoming %+v, want only the cycle_1 request", incoming)
+	}
+	reviewees, err := reviewer1.GetUserReviewees("cycle_2")
+	NoErr(t, err, "getting reviewees before approval")
+	if len(reviewees) != 0 {
+		t.Errorf("got reviewees %v before approval, want none", reviewees)
+	}
+
+	queue, err := manager.GetApprovals()
+	NoErr(t, err, "getting approval queue")
+	if len(queue) != 2 {
+		t.Fatalf("got %d requests in the approval queue, want 2", len(queue))
+	}
+	otherQueue, err := cli.as("other@example.com").GetApprovals()
+	NoErr(t, err, "getting other manager's queue")
+	if len(otherQueue) != 0 {
+		t.Errorf("got %d requests in another manager's queue, want none", len(otherQueue))
+	}
+
+	var toUser1, toUser2 int
+	for _, rr := range queue {
+		if rr.Status != requestPendingApproval {
+			t.Errorf("got status %q, want %q", rr.Status, requestPendingApproval)
+		}
+		if rr.ReviewerEmail == "user_1@example.com" {
+			toUser1 = rr.ID
+		} else {
+			toUser2 = rr.ID
+		}
+	}
+
+	if err := cli.as("other@example.com").ApproveReviewRequest(toUser1); err == nil {
+		t.Errorf("got no error when another manager approved")
+	}
+	if err := cli.ApproveReviewRequest(toUser1); err == nil {
+		t.Errorf("got no error when the requester approved their own request")
+	}
+
+	NoErr(t, manager.ApproveReviewRequest(toUser1), "approving")
+	NoErr(t, manager.RejectReviewRequest(toUser2, "you worked together last cycle"), "rejecting")
+
+	reviewees, err = reviewer1.GetUserReviewees("cycle_2")
+	NoErr(t, err, "getting reviewees after approval")
+	if len(reviewees) != 1 || reviewees[0].Email != cli.userEmail {
+		t.Errorf("got reviewees %v after approval, want %s", reviewees, cli.userEmail)
+	}
+	reviewees, err = reviewer2.GetUserReviewees("cycle_2")
+	NoErr(t, err, "getting reviewees after rejection")
+	if len(reviewees) != 0 {
+		t.Errorf("got reviewees %v after rejection, want none", reviewees)
+	}
+
+	_, outgoing, err := cli.GetReviewRequests("cycle_2")
+	NoErr(t, err, "getting requester's requests")
+	for _, rr := range outgoing {
+		if rr.ID == toUser2 && (rr.Status != requestRejected || rr.DeclineReason != "you worked together last cycle") {
+			t.Errorf("got rejected request %+v, want status %q with the manager's reason", rr, requestRejected)
+		}
+	}
+
+	queue, err = manager.GetApprovals()
+	NoErr(t, err, "getting approval queue after acting")
+	if len(queue) != 0 {
+		t.Errorf("got %d requests in the approval queue, want none", len(queue))
+	}
+}
+
+func TestManagerApprovalWithoutManager(t *testing.T) {
+	/*
+		Verify users can not set their own manager
+		Verify a user whose manager was cleared can not request reviews in a cycle requiring approval
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "manager", "manager@example.com"), "creating manager")
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	requireApproval := true
+	NoErr(t, cli.UpdateCycleSettings("cycle_1", CycleSettings{RequireManagerApproval: &requireApproval}), "requiring approval")
+
+	if _, err := cli.clientDo("POST", "/api/user/manager", http.StatusCreated, `{"manager_email":""}`); err == nil {
+		t.Errorf("got no error when a user set their own manager")
+	}
+
+	NoErr(t, cli.SetUserManager(cli.userEmail, "manager@example.com"), "setting manager")
+	NoErr(t, cli.SetUserManager(cli.userEmail, ""), "clearing manager")
+	err := cli.AddReviewer("user_1@example.com", "cycle_1")
+	if err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("got %v, want a 409 for a request without a manager to approve it", err)
+	}
+	reviewees, err := cli.as("user_1@example.com").GetUserReviewees("cycle_1")
+	NoErr(t, err, "getting reviewees")
+	if len(reviewees) != 0 {
+		t.Errorf("got reviewees %v, want none", reviewees)
+	}
+}
+
+func TestAPIAdminCycleAssignments(t *testing.T) {
+	/*
+		Verify an admin can set a user's manager
+		Verify a dry run previews assignments without writing them
+		Verify nobody is assigned to themselves, no pair is duplicated, and existing requests count towards the total
+		Verify load is balanced across reviewers
+		Verify committing writes the assignments and a second plan has nothing left to do
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, cli.InsertTeam("team_a"), "creating team")
+	NoErr(t, cli.InsertTeam("team_b"), "creating team")
+	NoErr(t, cli.AssignTeamToUser("team_a"), "assigning team")
+	for i := 1; i <= 5; i++ {
+		email := fmt.Sprintf("user_%d@example.com", i)
+		team := "team_a"
+		if i > 2 {
+			team = "team_b"
+		}
+		NoErr(t, CreateUser(cli.db, fmt.Sprintf("user_%d", i), email), "creating user")
+		NoErr(t, AssignTeamToUser(cli.db, email, team), "assigning team")
+	}
+	NoErr(t, cli.SetUserManager(cli.userEmail, "user_1@example.com"), "setting manager")
+	NoErr(t, SetUserManager(cli.db, "user_2@example.com", "user_1@example.com"), "setting manager")
+
+	info, err := cli.GetUserInfo()
+	NoErr(t, err, "getting user info")
+	if got, want := info.Manager, "user_1@example.com"; got != want {
+		t.Errorf("got manager %q, want %q", got, want)
+	}
+	if err := cli.SetUserManager(cli.userEmail, "nobody@example.com"); err == nil {
+		t.Errorf("got no error setting a manager that does not exist")
+	}
+
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.AddReviewer("user_3@example.com", "cycle_1"), "adding existing request")
+
+	opts := AssignmentOptions{ReviewersPerUser: 2, CrossTeamPerUser: 1}
+	preview, err := cli.AssignReviewers("cycle_1", opts, true)
+	NoErr(t, err, "previewing assignments")
+
+	reviewers, err := cli.GetMostRequestedReviewers("cycle_1", 10)
+	NoErr(t, err, "getting requested reviewers after dry run")
+	if len(reviewers) != 1 {
+		t.Errorf("got %d requested reviewers after a dry run, want 1", len(reviewers))
+	}
+
+	// 6 users with 2 reviewers each, one of which already exists
+	if got, want := len(preview), 11; got != want {
+		t.Fatalf("got %d assignments, want %d - %+v", got, want, preview)
+	}
+	pairs := map[string]bool{cli.userEmail + ":user_3@example.com": true}
+	perReviewee := map[string]int{cli.userEmail: 1}
+	load := map[string]int{"user_3@example.com": 1}
+	for _, assignment := range preview {
+		if assignment.RevieweeEmail == assignment.ReviewerEmail {
+			t.Errorf("got self assignment %+v", assignment)
+		}
+		pair := assignment.RevieweeEmail + ":" + assignment.ReviewerEmail
+		if pairs[pair] {
+			t.Errorf("got duplicate assignment %+v", assignment)
+		}
+		pairs[pair] = true
+		perReviewee[assignment.RevieweeEmail]++
+		load[assignment.ReviewerEmail]++
+	}
+	for reviewee, n := range perReviewee {
+		if n != 2 {
+			t.Errorf("got %d reviewers for %s, want 2", n, reviewee)
+		}
+	}
+	// 12 requests over 6 reviewers is 2 each when balanced
+	for reviewer, n := range load {
+		if n != 2 {
+			t.Errorf("got load of %d for %s, want 2", n, reviewer)
+		}
+	}
+
+	committed, err := cli.AssignReviewers("cycle_1", opts, false)
+	NoErr(t, err, "committing assignments")
+	if got, want := len(committed), len(preview); got != want {
+		t.Errorf("got %d committed assignments, want %d", got, want)
+	}
+
+	incoming, _, err := cli.as("user_5@example.com").GetReviewRequests("cycle_1")
+	NoErr(t, err, "getting assigned requests")
+	for _, rr := range incoming {
+		if rr.Status != requestAccepted {
+			t.Errorf("got status %q for an assignment, want %q", rr.Status, requestAccepted)
+		}
+	}
+
+	again, err := cli.AssignReviewers("cycle_1", opts, true)
+	NoErr(t, err, "planning again after commit")
+	if len(again) != 0 {
+		t.Errorf("got %d assignments after commit, want none - %+v", len(again), again)
+	}
+}
+
+func TestAPIAdminCommitPreviewedAssignments(t *testing.T) {
+	/*
+		Verify committing previewed assignments writes exactly those
+		Verify a preview made stale by a request created since is refused, and nothing is written
+		Verify previewed assignments are checked
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, cli.InsertTeam("team_a"), "creating team")
+	NoErr(t, cli.AssignTeamToUser("team_a"), "assigning team")
+	for i := 1; i <= 3; i++ {
+		email := fmt.Sprintf("user_%d@example.com", i)
+		NoErr(t, CreateUser(cli.db, fmt.Sprintf("user_%d", i), email), "creating user")
+		NoErr(t, AssignTeamToUser(cli.db, email, "team_a"), "assigning team")
+	}
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+
+	opts := AssignmentOptions{ReviewersPerUser: 1}
+	preview, err := cli.AssignReviewers("cycle_1", opts, true)
+	NoErr(t, err, "previewing assignments")
+	if len(preview) != 4 {
+		t.Fatalf("got %+v, want an assignment for each of the 4 users", preview)
+	}
+
+	// a request made after the preview for one of the previewed pairs
+	stale := preview[0]
+	NoErr(t, cli.as(stale.RevieweeEmail).AddReviewer(stale.ReviewerEmail, "cycle_1"), "requesting review")
+	if err = cli.CommitAssignments("cycle_1", preview); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("got %v, want a 409 committing a stale preview", err)
+	}
+	var n int
+	NoErr(t, cli.db.QueryRow("select count(*) from review_requests").Scan(&n), "counting requests")
+	if n != 1 {
+		t.Errorf("got %d requests, want only the one made by hand", n)
+	}
+
+	self := []Assignment{{RevieweeEmail: "user_1@example.com", ReviewerEmail: "user_1@example.com", Source: sourceTeam}}
+	if err = cli.CommitAssignments("cycle_1", self); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 committing a self assignment", err)
+	}
+
+	NoErr(t, cli.CommitAssignments("cycle_1", preview[1:]), "committing the rest of the preview")
+	for _, assignment := range preview[1:] {
+		q := `select count(*) from review_requests where status=? and recipient_id=(select id from users where email=?) and reviewer_id=(select id from users where email=?)`
+		NoErr(t, cli.db.QueryRow(q, requestAccepted, assignment.RevieweeEmail, assignment.ReviewerEmail).Scan(&n), "counting requests")
+		if n != 1 {
+			t.Errorf("got %d accepted requests for %+v, want the previewed assignment", n, assignment)
+		}
+	}
+}
+
+func TestAPIReviewCompletion(t *testing.T) {
+	/*
+		Verify outstanding reviews shrink as feedback is submitted, and submitting twice is counted once
+		Verify team completion percentages
+		Verify the submission ledger keeps only the day of a submission
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, cli.InsertTeam("team_a"), "creating team")
+	NoErr(t, cli.InsertTeam("team_b"), "creating team")
+	NoErr(t, cli.AssignTeamToUser("team_a"), "assigning team")
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	NoErr(t, CreateUser(cli.db, "user_2", "user_2@example.com"), "creating user")
+	NoErr(t, CreateUser(cli.db, "user_3", "user_3@example.com"), "creating user")
+	NoErr(t, AssignTeamToUser(cli.db, "user_1@example.com", "team_a"), "assigning team")
+	NoErr(t, AssignTeamToUser(cli.db, "user_2@example.com", "team_a"), "assigning team")
+	NoErr(t, AssignTeamToUser(cli.db, "user_3@example.com", "team_b"), "assigning team")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+
+	outstanding, err := cli.GetOutstandingReviewees("cycle_1")
+	NoErr(t, err, "getting outstanding reviews")
+	if got, want := len(outstanding), 2; got != want {
+		t.Errorf("got %d outstanding reviews, want %d", got, want)
+	}
+
+	for i := 0; i < 2; i++ {
+		NoErr(t, cli.AddReviewForUser("user_1@example.com", "cycle_1", []string{"strong"}, []string{"could grow"}), "adding review")
+	}
+
+	outstanding, err = cli.GetOutstandingReviewees("cycle_1")
+	NoErr(t, err, "getting outstanding reviews after submitting")
+	if len(outstanding) != 1 || outstanding[0].Email != "user_2@example.com" {
+		t.Errorf("got outstanding %v, want only user_2", outstanding)
+	}
+
+	var submittedOn string
+	NoErr(t, cli.db.QueryRow("select submitted_on from review_submissions").Scan(&submittedOn), "reading ledger")
+	if _, err := time.Parse("2006-01-02", submittedOn); err != nil {
+		t.Errorf("got submitted_on %q, want only a date", submittedOn)
+	}
+
+	// a request from a team mate is the same pair, while one from another team adds a reviewee
+	NoErr(t, cli.as("user_1@example.com").AddReviewer(cli.userEmail, "cycle_1"), "requesting review")
+	NoErr(t, cli.as("user_3@example.com").AddReviewer(cli.userEmail, "cycle_1"), "requesting review")
+
+	completion, err := cli.GetTeamCompletion("cycle_1")
+	NoErr(t, err, "getting completion")
+	if len(completion) != 2 {
+		t.Fatalf("got %d teams, want 2 - %+v", len(completion), completion)
+	}
+	// team_a has 3 people who can each review 2 others, and one of them was asked by user_3
+	if got := completion[0]; got.Team != "team_a" || got.Expected != 7 || got.Submitted != 1 {
+		t.Errorf("got %+v, want team_a with 1 of 7 submitted", got)
+	}
+	if got := completion[1]; got.Team != "team_b" || got.Expected != 0 || got.Percent != 100 {
+		t.Errorf("got %+v, want team_b with nothing expected", got)
+	}
+}
+
 func NoErr(t *testing.T, err error, msg string) {
 	_, fl, line, _ := runtime.Caller(1)
 	path := strings.Split(fl, string(os.PathSeparator))
@@ -260,10 +926,22 @@ type testClient struct {
 	userEmail string
 }
 
+// as returns a client signed in as the given user. The user should already exist in the db.
+func (c *testClient) as(email string) *Client {
+	key := RandStringRunes(keyLength)
+	SetAuth(key, email, time.Now().Add(24*time.Hour))
+	return NewClient(c.addr, key)
+}
+
 // setupInstance creates a version of the application and calls its serve method.
 // each invocation of setupInstance creates a new application backed by a new db.
 // the returned function should be called in defer to clean up / remove the db.
 func setupInstance() (*testClient, func() error) {
+	return setupInstanceWith(nil)
+}
+
+// setupInstanceWith is setupInstance, but configure (if not nil) can change the app before it starts serving
+func setupInstanceWith(configure func(*app)) (*testClient, func() error) {
 	r := rand.New(rand.NewSource(randseed))
 	testDB := fmt.Sprintf(".test_db_%d_%d", time.Now().Unix(), r.Intn(100))
 	err := InitDB(testDB)
@@ -272,7 +950,7 @@ func setupInstance() (*testClient, func() error) {
 	}
 
 	a := app{}
-	a.db, err = sql.Open("sqlite3", testDB)
+	a.db, err = OpenDB(testDB)
 	if err != nil {
 		log.Fatalf("unable to open %s - %v", testDB, err)
 	}
@@ -282,12 +960,20 @@ func setupInstance() (*testClient, func() error) {
 		log.Fatal(err)
 	}
 
+	if configure != nil {
+		configure(&a)
+	}
+
 	l, err := net.Listen("tcp", ":0")
 	if err != nil {
 		log.Fatalf("unable to create listener - %v", err)
 	}
 
-	go Serve(a, l, showLogs)
+	served := make(chan struct{})
+	go func() {
+		Serve(a, l, showLogs)
+		close(served)
+	}()
 	port := l.Addr().(*net.TCPAddr).Port
 
 	key := testDB
@@ -297,10 +983,17 @@ func setupInstance() (*testClient, func() error) {
 	if err != nil {
 		log.Fatalf("unable to create test user - %v", err)
 	}
+	// the test user runs the admin endpoints, see TestAdminOnly for everyone else
+	if err = SetUserAdmin(a.db, email, true); err != nil {
+		log.Fatalf("unable to make test user an admin - %v", err)
+	}
 
 	cli := NewClient(fmt.Sprintf("http://localhost:%d", port), key)
 
 	return &testClient{cli, a.db, email}, func() error {
+		// stops Serve and waits for the background jobs it started to stop
+		l.Close()
+		<-served
 		if preserveTestDB {
 			log.Println("keeping db " + testDB)
 		} else {
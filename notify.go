@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// kinds of notification we send. Each has an email template below.
+const (
+	emailReviewRequest   = "review_request"
+	emailCycleOpened     = "cycle_opened"
+	emailCycleClosing    = "cycle_closing"
+	emailResultsReleased = "results_released"
+	emailRequestAccepted = "request_accepted"
+	emailRequestDeclined = "request_declined"
+	emailReminder        = "reminder"
+	emailAdminDigest     = "admin_digest"
+)
+
+// emailFooter is added to every email so people know how to stop them
+const emailFooter = `
+
+--
+You are receiving this because you have an account at {{.BaseURL}}.
+To stop receiving these emails, turn off email notifications from your settings.
+`
+
+// emailTemplates are compiled into the binary to keep the deploy a single file. See README.md.
+var emailTemplates = map[string]struct{ subject, body string }{
+	emailReviewRequest: {
+		subject: "{{.Requester}} asked for your feedback in {{.Cycle}}",
+		body: `{{.Requester}} would like your feedback during the {{.Cycle}} review cycle.
+
+Accept or decline the request at {{.BaseURL}}/dash`,
+	},
+	emailCycleOpened: {
+		subject: "Review cycle {{.Cycle}} is open",
+		body: `The {{.Cycle}} review cycle is open. You can now give feedback to your team mates and anyone who asks for it.
+
+Get started at {{.BaseURL}}/dash`,
+	},
+	emailCycleClosing: {
+		subject: "Review cycle {{.Cycle}} closes soon",
+		body: `The {{.Cycle}} review cycle closes on {{.ClosesAt}}. Make sure you have given the feedback you intended to.
+
+Review what is left at {{.BaseURL}}/dash`,
+	},
+	emailResultsReleased: {
+		subject: "Your feedback from {{.Cycle}} is ready",
+		body: `The {{.Cycle}} review cycle has closed and the feedback you received is ready to read.
+
+See it at {{.BaseURL}}/dash`,
+	},
+	emailRequestAccepted: {
+		subject: "{{.Reviewer}} accepted your review request for {{.Cycle}}",
+		body: `{{.Reviewer}} accepted your request for feedback during the {{.Cycle}} review cycle.
+
+See your requests at {{.BaseURL}}/dash`,
+	},
+	emailRequestDeclined: {
+		subject: "{{.Reviewer}} declined your review request for {{.Cycle}}",
+		body: `{{.Reviewer}} declined your request for feedback during the {{.Cycle}} review cycle.{{if .Reason}}
+
+They said: {{.Reason}}{{end}}
+
+You can ask someone else at {{.BaseURL}}/dash`,
+	},
+	emailReminder: {
+		subject: "Reminder: {{.Cycle}} closes in {{.Days}} day{{if ne .Days 1}}s{{end}}",
+		body: `The {{.Cycle}} review cycle closes on {{.ClosesAt}}. You have not given feedback to:
+{{range .Reviewees}}
+- {{.Name}} ({{.Email}}){{end}}
+
+Give feedback at {{.BaseURL}}/dash`,
+	},
+	emailAdminDigest: {
+		subject: "Peer review weekly digest for {{.Week}}",
+		body: `{{if .Cycles}}Here is how the open review cycles are going.
+{{range .Cycles}}
+{{.Name}}{{if .ClosesAt}} (closes {{.ClosesAt}}){{end}}
+{{range .Teams}}- {{.Team}}: {{.Submitted}} of {{.Expected}} reviews submitted ({{printf "%.0f" .Percent}}%)
+{{else}}- no teams
+{{end}}{{end}}{{else}}There are no open review cycles.
+{{end}}
+See more at {{.BaseURL}}/dash`,
+	},
+}
+
+// smtpConfig is how we reach the mail server. Email is disabled when Host is empty.
+type smtpConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// TLS is one of "starttls", "tls" (implicit TLS, usually port 465), or "none"
+	TLS string
+}
+
+func (c smtpConfig) enabled() bool {
+	return c.Host != ""
+}
+
+// renderEmail fills in the subject and body templates for kind
+func renderEmail(kind string, data map[string]interface{}) (string, string, error) {
+	t, ok := emailTemplates[kind]
+	if !ok {
+		return "", "", fmt.Errorf("unknown email kind %q", kind)
+	}
+	var subject, body bytes.Buffer
+	if err := template.Must(template.New("subject").Parse(t.subject)).Execute(&subject, data); err != nil {
+		return "", "", errors.Wrapf(err, "unable to render %s subject", kind)
+	}
+	if err := template.Must(template.New("body").Parse(t.body+emailFooter)).Execute(&body, data); err != nil {
+		return "", "", errors.Wrapf(err, "unable to render %s body", kind)
+	}
+	return subject.String(), body.String(), nil
+}
+
+// emailPayload is a rendered email waiting to be sent by a send_email job
+type emailPayload struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// QueueEmail renders the email for kind and enqueues a send_email job for each recipient who has not opted out.
+// Either every job is enqueued or none are.
+func QueueEmail(db *sql.DB, kind string, recipients []string, data map[string]interface{}) (err error) {
+	subject, body, err := renderEmail(kind, data)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for QueueEmail")
+	}
+
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on QueueEmail")
+		}
+	}()
+
+	rows, err := tx.Query("select email from users where email_opt_out=1")
+	if err != nil {
+		return errors.Wrap(err, "unable to query opted out users")
+	}
+	defer rows.Close()
+	optedOut := make(map[string]bool)
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return errors.Wrap(err, "unable to scan opted out users")
+		}
+		optedOut[email] = true
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "error post scan of opted out users")
+	}
+
+	now := time.Now()
+	for _, recipient := range recipients {
+		if optedOut[recipient] {
+			continue
+		}
+		if _, err = EnqueueJob(tx, jobSendEmail, emailPayload{To: recipient, Subject: subject, Body: body}, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendEmailJob delivers an email enqueued by QueueEmail
+func sendEmailJob(a app, payload []byte) error {
+	var p emailPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return errors.Wrap(err, "unable to unmarshal email payload")
+	}
+	if !a.smtp.enabled() {
+		return errors.New("smtp is not configured")
+	}
+	return a.smtp.send(p.To, p.Subject, p.Body)
+}
+
+// Notifier delivers notifications to users. Implementations decide how, such as by email. kind is one of the
+// notification kinds above and data fills in its template.
+type Notifier interface {
+	Notify(kind string, recipients []string, data map[string]interface{}) error
+}
+
+// emailNotifier queues notifications as email. It does nothing if smtp is not configured.
+type emailNotifier struct {
+	db   *sql.DB
+	smtp smtpConfig
+}
+
+func (n emailNotifier) Notify(kind string, recipients []string, data map[string]interface{}) error {
+	if !n.smtp.enabled() {
+		return nil
+	}
+	return QueueEmail(n.db, kind, recipients, data)
+}
+
+// defaultNotifier is the notifier used when the app is not given one. Everything goes to the in-app feed, and to email
+// when it is configured.
+func defaultNotifier(a app) Notifier {
+	return multiNotifier{feedNotifier{db: a.db}, emailNotifier{db: a.db, smtp: a.smtp}}
+}
+
+// notify sends a notification. Notifications should never fail the request that caused them, so errors are only
+// logged.
+func (a app) notify(kind string, recipients []string, data map[string]interface{}) {
+	if a.notifier == nil || len(recipients) == 0 {
+		return
+	}
+	data["BaseURL"] = a.baseURL
+	if err := a.notifier.Notify(kind, recipients, data); err != nil {
+		log.Printf("error sending %s notification: %v", kind, err)
+	}
+}
+
+// notifyAll sends a notification to every active user
+func (a app) notifyAll(kind string, data map[string]interface{}) {
+	recipients, err := GetActiveUserEmails(a.db)
+	if err != nil {
+		log.Printf("error getting recipients for %s notification: %v", kind, err)
+		return
+	}
+	a.notify(kind, recipients, data)
+}
+
+// notifyReviewRequest tells a reviewer about a request once it is visible to them
+func (a app) notifyReviewRequest(id int) {
+	rr, err := GetReviewRequest(a.db, id)
+	if err != nil {
+		log.Printf("error getting review request %d to notify the reviewer: %v", id, err)
+		return
+	}
+	if rr.Status != requestPending {
+		return
+	}
+	requester := rr.RequesterName
+	if requester == "" {
+		requester = rr.RequesterEmail
+	}
+	a.notify(emailReviewRequest, []string{rr.ReviewerEmail}, map[string]interface{}{"Requester": requester, "Cycle": rr.Cycle})
+}
+
+// notifyRequestResponse tells a requester their reviewer accepted or declined
+func (a app) notifyRequestResponse(id int) {
+	rr, err := GetReviewRequest(a.db, id)
+	if err != nil {
+		log.Printf("error getting review request %d to notify the requester: %v", id, err)
+		return
+	}
+	kind := emailRequestAccepted
+	if rr.Status == requestDeclined {
+		kind = emailRequestDeclined
+	} else if rr.Status != requestAccepted {
+		return
+	}
+	reviewer := rr.ReviewerName
+	if reviewer == "" {
+		reviewer = rr.ReviewerEmail
+	}
+	a.notify(kind, []string{rr.RequesterEmail}, map[string]interface{}{"Reviewer": reviewer, "Cycle": rr.Cycle, "Reason": rr.DeclineReason})
+}
+
+// notifyCycleChange tells everyone when a cycle opens, or that their results are out when it closes
+func (a app) notifyCycleChange(cycle string, wasOpen bool, isOpen bool) {
+	if wasOpen == isOpen {
+		return
+	}
+	kind := emailCycleOpened
+	if !isOpen {
+		kind = emailResultsReleased
+	}
+	a.notifyAll(kind, map[string]interface{}{"Cycle": cycle})
+}
+
+// closingNoticePayload identifies the close date a closing notice was scheduled for
+type closingNoticePayload struct {
+	Cycle    string    `json:"cycle"`
+	ClosesAt time.Time `json:"closes_at"`
+}
+
+// scheduleClosingNotice enqueues a job to tell everyone a cycle is closing soon, a.closingNotice before it closes
+func (a app) scheduleClosingNotice(cycle string, closesAt time.Time) {
+	// closes_at is stored to the second, so match it when the job compares the two
+	payload := closingNoticePayload{Cycle: cycle, ClosesAt: closesAt.UTC().Truncate(time.Second)}
+	if _, err := EnqueueJob(a.db, jobClosingNotice, payload, closesAt.Add(-a.closingNotice)); err != nil {
+		log.Printf("error scheduling closing notice for %s: %v", cycle, err)
+	}
+}
+
+// closingNoticeJob queues a "closing soon" email to everyone. Notices for a cycle that has since closed or moved its
+// close date are dropped, and each cycle is only announced once per close date.
+func closingNoticeJob(a app, payload []byte) error {
+	var p closingNoticePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return errors.Wrap(err, "unable to unmarshal closing notice payload")
+	}
+	cycle, err := GetCycle(a.db, p.Cycle)
+	if errors.Cause(err) == ErrCycleNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !cycle.IsOpen || cycle.ClosesAt == nil || !cycle.ClosesAt.Equal(p.ClosesAt) || cycle.ClosesAt.Before(time.Now()) {
+		return nil
+	}
+	res, err := a.db.Exec("update review_cycles set closing_notice_sent=1 where name=? and closing_notice_sent=0", cycle.Name)
+	if err != nil {
+		return errors.Wrap(err, "unable to mark closing notice as sent")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "unable to determine if closing notice was sent")
+	} else if n == 0 {
+		// already sent
+		return nil
+	}
+	a.notifyAll(emailCycleClosing, map[string]interface{}{"Cycle": cycle.Name, "ClosesAt": cycle.ClosesAt.Format("Mon Jan 2 15:04 MST")})
+	return nil
+}
+
+// send delivers a single plain text email
+func (c smtpConfig) send(to string, subject string, body string) error {
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	var conn net.Conn
+	var err error
+	if c.TLS == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{ServerName: c.Host})
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to smtp server")
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "unable to start smtp session")
+	}
+	defer client.Close()
+
+	if c.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err = client.StartTLS(&tls.Config{ServerName: c.Host}); err != nil {
+			return errors.Wrap(err, "unable to start tls")
+		}
+	}
+	if c.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return errors.Wrap(err, "unable to authenticate with smtp server")
+		}
+	}
+	if err = client.Mail(c.From); err != nil {
+		return errors.Wrap(err, "smtp server refused sender")
+	}
+	if err = client.Rcpt(to); err != nil {
+		return errors.Wrap(err, "smtp server refused recipient")
+	}
+	w, err := client.Data()
+	if err != nil {
+		return errors.Wrap(err, "unable to start message data")
+	}
+	if _, err = w.Write(buildMessage(c.From, to, subject, body)); err != nil {
+		return errors.Wrap(err, "unable to write message")
+	}
+	if err = w.Close(); err != nil {
+		return errors.Wrap(err, "smtp server did not accept message")
+	}
+	return client.Quit()
+}
+
+// buildMessage formats a plain text email with the headers mail clients expect
+func buildMessage(from string, to string, subject string, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return b.Bytes()
+}
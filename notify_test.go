@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEmailNotifications(t *testing.T) {
+	/*
+		Verify reviewers are emailed when someone asks them for feedback
+		Verify everyone is emailed when a cycle opens, is about to close, and closes
+		Verify users who opt out are not emailed
+	*/
+	server := newFakeSMTP(t)
+	defer server.Close()
+
+	cli, teardown := setupInstanceWith(func(a *app) {
+		a.smtp = smtpConfig{Host: "127.0.0.1", Port: server.port(), From: "peerreview@example.com", TLS: "none"}
+		a.baseURL = "http://peerreview.example.com"
+		a.closingNotice = 48 * time.Hour
+		a.jobs.Poll = 20 * time.Millisecond
+	})
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	NoErr(t, CreateUser(cli.db, "user_2", "user_2@example.com"), "creating user")
+	NoErr(t, cli.as("user_2@example.com").SetEmailOptOut(true), "opting out")
+
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	server.waitFor(t, cli.userEmail, "Review cycle cycle_1 is open")
+	server.waitFor(t, "user_1@example.com", "Review cycle cycle_1 is open")
+
+	NoErr(t, cli.AddReviewer("user_1@example.com", "cycle_1"), "requesting review")
+	msg := server.waitFor(t, "user_1@example.com", "Test User asked for your feedback in cycle_1")
+	if !strings.Contains(msg, "http://peerreview.example.com/dash") {
+		t.Errorf("want a link to the app in the email, got\n%s", msg)
+	}
+
+	closesAt := time.Now().Add(24 * time.Hour)
+	NoErr(t, cli.UpdateCycleSettings("cycle_1", CycleSettings{ClosesAt: &closesAt}), "setting close date")
+	server.waitFor(t, "user_1@example.com", "Review cycle cycle_1 closes soon")
+
+	NoErr(t, cli.EditCycle("cycle_1", false), "closing cycle")
+	server.waitFor(t, "user_1@example.com", "Your feedback from cycle_1 is ready")
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, m := range server.messages {
+		if m.to == "user_2@example.com" {
+			t.Errorf("got email for opted out user\n%s", m.data)
+		}
+	}
+	var closing int
+	for _, m := range server.messages {
+		if m.to == "user_1@example.com" && strings.Contains(m.data, "closes soon") {
+			closing++
+		}
+	}
+	if closing != 1 {
+		t.Errorf("got %d closing soon emails, want 1", closing)
+	}
+}
+
+type fakeMessage struct {
+	to   string
+	data string
+}
+
+// fakeSMTP is just enough of an SMTP server to accept mail from net/smtp without TLS or auth
+type fakeSMTP struct {
+	net.Listener
+	mu       sync.Mutex
+	messages []fakeMessage
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to start fake smtp server - %v", err)
+	}
+	s := &fakeSMTP{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) port() int {
+	return s.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost fake smtp")
+	var to string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			to = strings.Trim(strings.TrimSpace(line)[len("RCPT TO:"):], "<>")
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, fakeMessage{to: to, data: data.String()})
+			s.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// waitFor returns the first message to recipient that contains text, failing the test if none arrives in time
+func (s *fakeSMTP) waitFor(t *testing.T, recipient string, text string) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		for _, m := range s.messages {
+			if m.to == recipient && strings.Contains(m.data, text) {
+				s.mu.Unlock()
+				return m.data
+			}
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no email to %s containing %q", recipient, text)
+	return ""
+}
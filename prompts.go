@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ Prompts are questions a requester asks along with a review request, such as "how was my design doc for X?". A prompt
+ belongs to the requester and cycle, not to the request, so asking several reviewers the same question makes one prompt
+ and their answers are grouped together. Reviewers see the prompts asked of them next to each reviewee, and each strength
+ or growth opportunity they give can answer one of them (reviews.prompt_id). Prompt text is encrypted at rest like
+ feedback (see crypto.go).
+
+ Grouping answers under a prompt says they came from the reviewers asked it, and so does reviews.prompt_id to anyone
+ who can read the db. An answer to a prompt asked of fewer than minPromptAnswers reviewers is stored as plain feedback
+ (NULL prompt_id), and answers are only grouped once at least minPromptAnswers reviewers were asked the prompt and
+ answered it. Until then they are shown with the rest of the feedback. prompts.answers counts the reviewers who
+ answered without saying who they were: a reviewer's answers are counted with their first submission for the reviewee
+ that cycle (see review_submissions), and later answers are not counted again.
+*/
+
+// maxPromptLength is the longest prompt a requester can ask, in characters
+const maxPromptLength = 500
+
+// minPromptAnswers is how many reviewers must have been asked a prompt, and answered it, before answers are grouped
+const minPromptAnswers = 2
+
+// ErrInvalidPrompt is returned when a prompt is too long, or feedback answers a prompt the reviewee was not asked about
+var ErrInvalidPrompt = errors.New("invalid prompt")
+
+// Prompt is a question asked of a reviewer
+type Prompt struct {
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+}
+
+// PromptFeedback is the feedback answering one prompt
+type PromptFeedback struct {
+	PromptID      int      `json:"prompt_id"`
+	Prompt        string   `json:"prompt"`
+	Strengths     []string `json:"strengths"`
+	Opportunities []string `json:"growth_opportunities"`
+}
+
+// addPrompt returns the id of the requester's prompt for cycle with text, adding it if it was not asked before. An empty
+// text is no prompt, and is NULL.
+func addPrompt(tx *sql.Tx, requesterEmail string, cycle string, text string, now time.Time) (sql.NullInt64, error) {
+	var id sql.NullInt64
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return id, nil
+	}
+	if len([]rune(text)) > maxPromptLength {
+		return id, errors.Wrapf(ErrInvalidPrompt, "prompt can not be longer than %d characters", maxPromptLength)
+	}
+
+	// prompts are encrypted with a random data key each, so matching text has to happen after decrypting
+	q := `
+    SELECT prompts.id,
+           prompts.text
+    FROM   prompts
+           JOIN users
+             ON prompts.recipient_id = users.id
+           JOIN review_cycles
+             ON prompts.cycle_id = review_cycles.id
+    WHERE  users.email = ?
+           AND review_cycles.name = ?
+    `
+	rows, err := tx.Query(q, requesterEmail, cycle)
+	if err != nil {
+		return id, errors.Wrap(err, "unable to query prompts")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var existing int64
+		var stored string
+		if err = rows.Scan(&existing, &stored); err != nil {
+			return id, errors.Wrap(err, "unable to scan prompts")
+		}
+		plaintext, err := decryptField(stored)
+		if err != nil {
+			return id, errors.Wrap(err, "unable to decrypt prompt")
+		}
+		if plaintext == text {
+			return sql.NullInt64{Int64: existing, Valid: true}, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return id, errors.Wrap(err, "error post scan in addPrompt")
+	}
+
+	encrypted, err := encryptField(text)
+	if err != nil {
+		return id, errors.Wrap(err, "unable to encrypt prompt")
+	}
+	q = `
+    INSERT INTO prompts
+                (recipient_id,
+                 cycle_id,
+                 text,
+                 created_at)
+    VALUES      ((SELECT id
+                  FROM   users
+                  WHERE  email = ?
+                  LIMIT  1),
+                 (SELECT id
+                  FROM   review_cycles
+                  WHERE  name = ?
+                  LIMIT  1), ?, ?)
+    `
+	res, err := tx.Exec(q, requesterEmail, cycle, encrypted, now.Unix())
+	if err != nil {
+		return id, errors.Wrap(err, "unable to insert prompt")
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return id, errors.Wrap(err, "unable to get prompt id")
+	}
+	return sql.NullInt64{Int64: lastID, Valid: true}, nil
+}
+
+// getRequestPrompts returns the prompts requesterEmail asked of reviewerEmail in open requests during cycle
+func getRequestPrompts(db *sql.DB, requesterEmail string, reviewerEmail string, cycle string) ([]Prompt, error) {
+	q := `
+    SELECT DISTINCT prompts.id,
+                    prompts.text
+    FROM   review_requests
+           JOIN prompts
+             ON review_requests.prompt_id = prompts.id
+           JOIN users requester
+             ON review_requests.recipient_id = requester.id
+           JOIN users reviewer
+             ON review_requests.reviewer_id = reviewer.id
+           JOIN review_cycles
+             ON review_requests.cycle_id = review_cycles.id
+    WHERE  requester.email = ?
+           AND reviewer.email = ?
+           AND review_cycles.name = ?
+           AND review_requests.status IN (?, ?)
+    ORDER  BY prompts.id
+    `
+	return queryPrompts(db, q, requesterEmail, reviewerEmail, cycle, requestPending, requestAccepted)
+}
+
+// getPrompts returns all of the user's prompts, oldest first
+func getPrompts(db *sql.DB, email string) ([]Prompt, error) {
+	q := `
+    SELECT prompts.id,
+           prompts.text
+    FROM   prompts
+           JOIN users
+             ON prompts.recipient_id = users.id
+    WHERE  users.email = ?
+    ORDER  BY prompts.id
+    `
+	return queryPrompts(db, q, email)
+}
+
+// queryPrompts runs q, which selects a prompt's id and text, and decrypts the text
+func queryPrompts(db *sql.DB, q string, args ...interface{}) ([]Prompt, error) {
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query prompts")
+	}
+	defer rows.Close()
+	var prompts []Prompt
+	for rows.Next() {
+		var p Prompt
+		if err = rows.Scan(&p.ID, &p.Text); err != nil {
+			return nil, errors.Wrap(err, "unable to scan prompts")
+		}
+		if p.Text, err = decryptField(p.Text); err != nil {
+			return nil, errors.Wrap(err, "unable to decrypt prompt")
+		}
+		prompts = append(prompts, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in queryPrompts")
+	}
+	return prompts, nil
+}
+
+// checkPrompt returns ErrInvalidPrompt unless the reviewee asked the reviewer prompt id in an open request during cycle
+func checkPrompt(db *sql.DB, reviewerEmail string, revieweeEmail string, cycle string, id int) error {
+	q := `
+    SELECT count(*)
+    FROM   review_requests
+           JOIN users requester
+             ON review_requests.recipient_id = requester.id
+           JOIN users reviewer
+             ON review_requests.reviewer_id = reviewer.id
+           JOIN review_cycles
+             ON review_requests.cycle_id = review_cycles.id
+    WHERE  review_requests.prompt_id = ?
+           AND requester.email = ?
+           AND reviewer.email = ?
+           AND review_cycles.name = ?
+           AND review_requests.status IN (?, ?)
+    `
+	var n int
+	if err := db.QueryRow(q, id, revieweeEmail, reviewerEmail, cycle, requestPending, requestAccepted).Scan(&n); err != nil {
+		return errors.Wrap(err, "unable to look up prompt")
+	}
+	if n == 0 {
+		return errors.Wrapf(ErrInvalidPrompt, "prompt %d was not asked of you by the reviewee this cycle", id)
+	}
+	return nil
+}
+
+// promptAskedOfEnough reports whether prompt id was asked of at least minPromptAnswers reviewers. Every request is
+// counted, whatever its status, because each names a reviewer who could have answered.
+func promptAskedOfEnough(db *sql.DB, id int) (bool, error) {
+	var n int
+	q := "select count(distinct reviewer_id) from review_requests where prompt_id=?"
+	if err := db.QueryRow(q, id).Scan(&n); err != nil {
+		return false, errors.Wrap(err, "unable to count reviewers asked a prompt")
+	}
+	return n >= minPromptAnswers, nil
+}
+
+// countPromptAnswers adds one answer to each prompt in ids. Nothing about who answered is stored.
+func countPromptAnswers(db *sql.DB, ids map[int]bool) error {
+	for id := range ids {
+		if _, err := db.Exec("update prompts set answers=answers+1 where id=?", id); err != nil {
+			return errors.Wrap(err, "unable to count prompt answer")
+		}
+	}
+	return nil
+}
+
+// groupedPrompts returns the ids of the user's prompts whose answers can be grouped: at least minPromptAnswers
+// reviewers were asked the prompt in requests that were not turned down, and at least as many answered it
+func groupedPrompts(db *sql.DB, email string) (map[int]bool, error) {
+	q := `
+    SELECT prompts.id
+    FROM   prompts
+           JOIN users
+             ON prompts.recipient_id = users.id
+    WHERE  users.email = ?
+           AND (SELECT count(DISTINCT review_requests.reviewer_id)
+                FROM   review_requests
+                WHERE  review_requests.prompt_id = prompts.id
+                       AND review_requests.status IN (?, ?)) >= ?
+           AND prompts.answers >= ?
+    `
+	rows, err := db.Query(q, email, requestPending, requestAccepted, minPromptAnswers, minPromptAnswers)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query grouped prompts")
+	}
+	defer rows.Close()
+	grouped := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "unable to scan grouped prompts")
+		}
+		grouped[id] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in groupedPrompts")
+	}
+	return grouped, nil
+}
+
+// promptIDOrNull stores a prompt id of 0, meaning no prompt, as NULL
+func promptIDOrNull(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAPIUserReviewerPrompts(t *testing.T) {
+	/*
+		Verify a review request can carry a prompt that the reviewer sees with the request and next to the requester
+		Verify answers to a prompt are only grouped under it once two reviewers asked it have answered
+		Verify prompts are checked, and feedback can only answer prompts the reviewee asked of the reviewer
+		Verify the db can not tie a prompt answer to its reviewer
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "reviewer 1", "reviewer1@example.com"), "creating user")
+	NoErr(t, CreateUser(cli.db, "reviewer 2", "reviewer2@example.com"), "creating user")
+	NoErr(t, CreateUser(cli.db, "reviewer 3", "reviewer3@example.com"), "creating user")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+
+	prompt := "how was my design doc for the importer?"
+	NoErr(t, cli.AddReviewerWithPrompt("reviewer1@example.com", "cycle_1", prompt), "requesting review")
+	err := cli.AddReviewerWithPrompt("reviewer2@example.com", "cycle_1", strings.Repeat("x", maxPromptLength+1))
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for a prompt that is too long", err)
+	}
+	NoErr(t, cli.AddReviewerWithPrompt("reviewer2@example.com", "cycle_1", " "+prompt+" "), "requesting review")
+	NoErr(t, cli.AddReviewer("reviewer3@example.com", "cycle_1"), "requesting review")
+
+	reviewer1 := cli.as("reviewer1@example.com")
+	incoming, _, err := reviewer1.GetReviewRequests("cycle_1")
+	NoErr(t, err, "getting review requests")
+	if len(incoming) != 1 || incoming[0].Prompt != prompt {
+		t.Errorf("got %+v, want the request with its prompt", incoming)
+	}
+	reviewees, err := reviewer1.GetUserReviewees("cycle_1")
+	NoErr(t, err, "getting reviewees")
+	if len(reviewees) != 1 || len(reviewees[0].Prompts) != 1 || reviewees[0].Prompts[0].Text != prompt {
+		t.Fatalf("got %+v, want the requester with their prompt", reviewees)
+	}
+	promptID := reviewees[0].Prompts[0].ID
+
+	NoErr(t, reviewer1.AddReviewItemsForUser(cli.userEmail, "cycle_1",
+		[]FeedbackItem{{Text: "clear and short", PromptID: promptID}, {Text: "helpful"}},
+		[]FeedbackItem{{Text: "add a rollout plan", PromptID: promptID}}), "adding review")
+
+	// grouping a single reviewer's answers would say who wrote them
+	got := reviewsByCycle(t, cli, cli.userEmail)["cycle_1"]
+	if len(got.Prompts) != 0 || len(got.Strengths) != 2 || len(got.Opportunities) != 1 {
+		t.Errorf("got %+v, want one reviewer's answers with the rest of the feedback", got)
+	}
+
+	err = cli.as("reviewer3@example.com").AddReviewItemsForUser(cli.userEmail, "cycle_1", []FeedbackItem{{Text: "great", PromptID: promptID}}, []FeedbackItem{{Text: "more"}})
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for answering a prompt the reviewer was not asked", err)
+	}
+	NoErr(t, cli.as("reviewer2@example.com").AddReviewItemsForUser(cli.userEmail, "cycle_1",
+		[]FeedbackItem{{Text: "good diagrams", PromptID: promptID}},
+		[]FeedbackItem{{Text: "speak up more"}}), "adding review")
+
+	err = reviewer1.AddReviewItemsForUser("reviewer2@example.com", "cycle_1", []FeedbackItem{{Text: "great", PromptID: promptID}}, []FeedbackItem{{Text: "more"}})
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for answering someone else's prompt", err)
+	}
+	goal, err := cli.AddGoal("write more docs", "", "")
+	NoErr(t, err, "adding goal")
+	err = reviewer1.AddReviewItemsForUser(cli.userEmail, "cycle_1", []FeedbackItem{{Text: "great", PromptID: promptID, GoalID: goal.ID}}, []FeedbackItem{{Text: "more"}})
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for feedback about a goal and a prompt", err)
+	}
+
+	got = reviewsByCycle(t, cli, cli.userEmail)["cycle_1"]
+	if strings.Join(got.Strengths, ",") != "helpful" || strings.Join(got.Opportunities, ",") != "speak up more" {
+		t.Errorf("got %+v, want only the feedback not answering a prompt at the top level", got)
+	}
+	if len(got.Prompts) != 1 || got.Prompts[0].Prompt != prompt || len(got.Prompts[0].Strengths) != 2 ||
+		strings.Join(got.Prompts[0].Opportunities, ",") != "add a rollout plan" {
+		t.Errorf("got %+v, want the answers from both reviewers grouped under the prompt", got.Prompts)
+	}
+
+	// the only thing tying a reviewer to a prompt is being asked it
+	tables, err := cli.db.Query("select name from sqlite_master where type='table'")
+	NoErr(t, err, "listing tables")
+	var names []string
+	for tables.Next() {
+		var name string
+		NoErr(t, tables.Scan(&name), "scanning tables")
+		names = append(names, name)
+	}
+	tables.Close()
+	for _, name := range names {
+		columns, err := cli.db.Query("select name from pragma_table_info(?)", name)
+		NoErr(t, err, "listing columns")
+		has := make(map[string]bool)
+		for columns.Next() {
+			var column string
+			NoErr(t, columns.Scan(&column), "scanning columns")
+			has[column] = true
+		}
+		columns.Close()
+		if has["reviewer_id"] && (has["prompt_id"] || name == "prompts") && name != "review_requests" {
+			t.Errorf("got table %s tying reviewers to prompts", name)
+		}
+	}
+	var answers int
+	NoErr(t, cli.db.QueryRow("select answers from prompts where id=?", promptID).Scan(&answers), "counting answers")
+	if answers != 2 {
+		t.Errorf("got %d answers, want each reviewer counted once", answers)
+	}
+
+	// answers to a prompt asked of one reviewer would name them, so they are stored as plain feedback
+	NoErr(t, cli.AddCycle("cycle_2"), "adding cycle")
+	NoErr(t, cli.AddReviewerWithPrompt("reviewer3@example.com", "cycle_2", "just for you"), "requesting review")
+	reviewees, err = cli.as("reviewer3@example.com").GetUserReviewees("cycle_2")
+	NoErr(t, err, "getting reviewees")
+	if len(reviewees) != 1 || len(reviewees[0].Prompts) != 1 {
+		t.Fatalf("got %+v, want the requester with their prompt", reviewees)
+	}
+	soloID := reviewees[0].Prompts[0].ID
+	NoErr(t, cli.as("reviewer3@example.com").AddReviewItemsForUser(cli.userEmail, "cycle_2",
+		[]FeedbackItem{{Text: "solo answer", PromptID: soloID}},
+		[]FeedbackItem{{Text: "solo growth"}}), "answering a prompt asked of one reviewer")
+	var n int
+	NoErr(t, cli.db.QueryRow("select count(*) from reviews where prompt_id=?", soloID).Scan(&n), "counting answers")
+	if n != 0 {
+		t.Errorf("got %d reviews answering a prompt asked of one reviewer, want none", n)
+	}
+	if got := reviewsByCycle(t, cli, cli.userEmail)["cycle_2"]; strings.Join(got.Strengths, ",") != "solo answer" {
+		t.Errorf("got %+v, want the answer with the rest of the feedback", got)
+	}
+}
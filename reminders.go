@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ Reminders nudge reviewers who still owe feedback as an open cycle's close date gets near, at each of the configured
+ number of days before close. Admins get a weekly digest of how each open cycle is going. Both are checked hourly by
+ the job runner and logged in sent_digests so nobody gets the same digest twice.
+*/
+
+// digest kinds logged in sent_digests
+const (
+	digestReminder = "reminder"
+	digestAdmin    = "admin_weekly"
+)
+
+// parseReminderDays parses a comma separated list of days before a cycle closes, such as "7,3,1"
+func parseReminderDays(s string) ([]int, error) {
+	var days []int
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		d, err := strconv.Atoi(field)
+		if err != nil || d < 1 {
+			return nil, fmt.Errorf("reminder days must be positive whole numbers. Got %q", field)
+		}
+		days = append(days, d)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+	return days, nil
+}
+
+// markDigestSent records that a digest went to a recipient and reports whether it is new. It is recorded before the
+// digest goes out so that a failure part way through can not send it twice.
+func markDigestSent(db *sql.DB, kind string, recipient string, cycle string, period string) (bool, error) {
+	q := "insert or ignore into sent_digests (kind, recipient, cycle, period, sent_at) values (?, ?, ?, ?, ?)"
+	res, err := db.Exec(q, kind, recipient, cycle, period, time.Now().Unix())
+	if err != nil {
+		return false, errors.Wrap(err, "unable to log digest")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "unable to determine if digest was logged")
+	}
+	return n == 1, nil
+}
+
+// reminderDue returns which reminder is due for a cycle closing at closesAt, in days before close, or 0 if none is.
+// Only the nearest reminder is due, so a close date set two days out does not also send the seven day reminder.
+func reminderDue(days []int, closesAt time.Time, now time.Time) int {
+	if !now.Before(closesAt) {
+		return 0
+	}
+	due := 0
+	for _, d := range days {
+		if !now.Before(closesAt.Add(-time.Duration(d)*24*time.Hour)) && (due == 0 || d < due) {
+			due = d
+		}
+	}
+	return due
+}
+
+// sendReminders sends each user a digest of who they still owe feedback in every open cycle with a reminder due
+func sendReminders(a app, now time.Time) error {
+	cycles, err := GetCycles(a.db)
+	if err != nil {
+		return err
+	}
+	users, err := GetActiveUserEmails(a.db)
+	if err != nil {
+		return err
+	}
+	for _, cycle := range cycles {
+		if !cycle.IsOpen || cycle.ClosesAt == nil {
+			continue
+		}
+		due := reminderDue(a.reminderDays, *cycle.ClosesAt, now)
+		if due == 0 {
+			continue
+		}
+		// moving the close date starts the reminders over
+		period := fmt.Sprintf("%s/%dd", cycle.ClosesAt.UTC().Format(time.RFC3339), due)
+		daysLeft := int(math.Ceil(cycle.ClosesAt.Sub(now).Hours() / 24))
+		for _, email := range users {
+			outstanding, err := GetOutstandingReviewees(a.db, email, cycle.Name)
+			if err != nil {
+				return err
+			}
+			if len(outstanding) == 0 {
+				continue
+			}
+			isNew, err := markDigestSent(a.db, digestReminder, email, cycle.Name, period)
+			if err != nil {
+				return err
+			}
+			if !isNew {
+				continue
+			}
+			a.notify(emailReminder, []string{email}, map[string]interface{}{
+				"Cycle":     cycle.Name,
+				"Days":      daysLeft,
+				"ClosesAt":  cycle.ClosesAt.Format("Mon Jan 2 15:04 MST"),
+				"Reviewees": outstanding,
+			})
+		}
+	}
+	return nil
+}
+
+// adminDigestCycle is an open cycle's progress in the admin digest
+type adminDigestCycle struct {
+	Name     string
+	ClosesAt string
+	Teams    []TeamCompletion
+}
+
+// sendAdminDigest sends -admin-emails and users flagged as admins a summary of completion in each open cycle, once per ISO week
+func sendAdminDigest(a app, now time.Time) error {
+	admins, err := GetAdminEmails(a.db)
+	if err != nil {
+		return err
+	}
+	for _, email := range a.adminEmails {
+		if !inList(email, admins) {
+			admins = append(admins, email)
+		}
+	}
+	if len(admins) == 0 {
+		return nil
+	}
+	year, week := now.UTC().ISOWeek()
+	period := fmt.Sprintf("%d-W%02d", year, week)
+
+	var recipients []string
+	for _, email := range admins {
+		isNew, err := markDigestSent(a.db, digestAdmin, email, "", period)
+		if err != nil {
+			return err
+		}
+		if isNew {
+			recipients = append(recipients, email)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	cycles, err := GetCycles(a.db)
+	if err != nil {
+		return err
+	}
+	var open []adminDigestCycle
+	for _, cycle := range cycles {
+		if !cycle.IsOpen {
+			continue
+		}
+		c := adminDigestCycle{Name: cycle.Name}
+		if cycle.ClosesAt != nil {
+			c.ClosesAt = cycle.ClosesAt.Format("Mon Jan 2 15:04 MST")
+		}
+		c.Teams, err = GetTeamCompletion(a.db, cycle.Name)
+		if err != nil {
+			return err
+		}
+		open = append(open, c)
+	}
+	a.notify(emailAdminDigest, recipients, map[string]interface{}{"Week": period, "Cycles": open})
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReminders(t *testing.T) {
+	/*
+		Verify reviewers who owe feedback are reminded once at each configured number of days before close
+		Verify reviewers who are done and closed cycles get no reminder
+		Verify admins get one digest per week with completion stats
+	*/
+	notifier := &recordingNotifier{}
+	var a app
+	cli, teardown := setupInstanceWith(func(inst *app) {
+		inst.notifier = notifier
+		inst.reminderDays = []int{7, 3, 1}
+		inst.adminEmails = []string{"admin@example.com"}
+		a = *inst
+	})
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	NoErr(t, cli.InsertTeam("team_a"), "adding team")
+	NoErr(t, cli.AssignTeamToUser("team_a"), "joining team")
+	NoErr(t, cli.as("user_1@example.com").AssignTeamToUser("team_a"), "joining team")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.AddCycle("cycle_2"), "adding cycle")
+	now := time.Now()
+	closesAt := now.Add(60 * time.Hour)
+	NoErr(t, cli.UpdateCycleSettings("cycle_1", CycleSettings{ClosesAt: &closesAt}), "setting close date")
+	NoErr(t, cli.UpdateCycleSettings("cycle_2", CycleSettings{ClosesAt: &closesAt}), "setting close date")
+	NoErr(t, cli.EditCycle("cycle_2", false), "closing cycle")
+
+	NoErr(t, sendReminders(a, now), "sending reminders")
+	got := notifier.take(emailReminder)
+	if len(got) != 2 {
+		t.Fatalf("got %d reminders, want 2", len(got))
+	}
+	for _, n := range got {
+		if n.data["Cycle"] != "cycle_1" || n.data["Days"] != 3 {
+			t.Errorf("got %v, want the 3 day reminder for cycle_1", n.data)
+		}
+	}
+	_, body, err := renderEmail(emailReminder, got[0].data)
+	NoErr(t, err, "rendering reminder")
+	if !strings.Contains(body, "@example.com)") {
+		t.Errorf("got reminder\n%s\nwant it to list the reviewee", body)
+	}
+
+	NoErr(t, sendReminders(a, now.Add(time.Hour)), "sending reminders again")
+	if got := notifier.take(emailReminder); len(got) != 0 {
+		t.Errorf("got %d reminders, want none as they were already sent", len(got))
+	}
+
+	NoErr(t, cli.as("user_1@example.com").AddReviewForUser(cli.userEmail, "cycle_1", []string{"s"}, []string{"o"}), "adding review")
+	NoErr(t, sendReminders(a, now.Add(48*time.Hour)), "sending 1 day reminders")
+	got = notifier.take(emailReminder)
+	if len(got) != 1 || !reflect.DeepEqual(got[0].recipients, []string{cli.userEmail}) || got[0].data["Days"] != 1 {
+		t.Errorf("got %+v, want a 1 day reminder for only the user who still owes feedback", got)
+	}
+
+	NoErr(t, sendAdminDigest(a, now), "sending admin digest")
+	NoErr(t, sendAdminDigest(a, now), "sending admin digest again")
+	got = notifier.take(emailAdminDigest)
+	// the test user is flagged as an admin, and admin@example.com is one by flag
+	if len(got) != 1 || !reflect.DeepEqual(got[0].recipients, []string{cli.userEmail, "admin@example.com"}) {
+		t.Fatalf("got %+v, want one digest to the admins", got)
+	}
+	_, body, err = renderEmail(emailAdminDigest, got[0].data)
+	NoErr(t, err, "rendering admin digest")
+	if !strings.Contains(body, "cycle_1") || !strings.Contains(body, "team_a: 1 of 2 reviews submitted (50%)") || strings.Contains(body, "cycle_2") {
+		t.Errorf("got digest\n%s\nwant team_a's progress in cycle_1 only", body)
+	}
+	NoErr(t, sendAdminDigest(a, now.Add(7*24*time.Hour)), "sending next week's admin digest")
+	if got := notifier.take(emailAdminDigest); len(got) != 1 {
+		t.Errorf("got %d digests, want one for the next week", len(got))
+	}
+
+	if days, err := parseReminderDays("1, 7,3"); err != nil || !reflect.DeepEqual(days, []int{7, 3, 1}) {
+		t.Errorf("got %v %v, want [7 3 1]", days, err)
+	}
+	if _, err := parseReminderDays("7,soon"); err == nil {
+		t.Error("got no error for bad reminder days")
+	}
+}
+
+type notification struct {
+	kind       string
+	recipients []string
+	data       map[string]interface{}
+}
+
+// recordingNotifier keeps notifications for tests to look at
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []notification
+}
+
+func (n *recordingNotifier) Notify(kind string, recipients []string, data map[string]interface{}) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, notification{kind: kind, recipients: recipients, data: data})
+	return nil
+}
+
+// take removes and returns the notifications of kind
+func (n *recordingNotifier) take(kind string) []notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var taken, kept []notification
+	for _, sent := range n.sent {
+		if sent.kind == kind {
+			taken = append(taken, sent)
+		} else {
+			kept = append(kept, sent)
+		}
+	}
+	n.sent = kept
+	return taken
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ Retention purges feedback text once a cycle is older than -retention-days, measured from when the cycle was created.
+ Open cycles are never purged. Purged reviews keep their row with empty feedback and purged_at set, so how many
+ strengths and growth opportunities each person received per cycle is still known. Every purge that removed feedback
+ is recorded in retention_purges. Dry runs report what would be purged and are not recorded.
+*/
+
+// RetentionCycle is a cycle with feedback to purge
+type RetentionCycle struct {
+	Cycle     string    `json:"cycle"`
+	CreatedAt time.Time `json:"created_at"`
+	Reviews   int       `json:"reviews"`
+}
+
+// RetentionReport describes a purge, or what a dry run would purge
+type RetentionReport struct {
+	Cutoff        time.Time        `json:"cutoff"`
+	DryRun        bool             `json:"dry_run"`
+	Cycles        []RetentionCycle `json:"cycles"`
+	ReviewsPurged int              `json:"reviews_purged"`
+}
+
+// RetentionPurge is the audit record of a purge
+type RetentionPurge struct {
+	ID            int              `json:"id"`
+	PurgedAt      time.Time        `json:"purged_at"`
+	Cutoff        time.Time        `json:"cutoff"`
+	ReviewsPurged int              `json:"reviews_purged"`
+	Cycles        []RetentionCycle `json:"cycles"`
+}
+
+// PurgeExpiredFeedback removes the feedback text of closed cycles created before now less retention, and records the
+// purge. With dryRun, nothing is changed.
+func PurgeExpiredFeedback(db *sql.DB, retention time.Duration, now time.Time, dryRun bool) (report RetentionReport, err error) {
+	report = RetentionReport{Cutoff: now.Add(-retention).UTC(), DryRun: dryRun, Cycles: []RetentionCycle{}}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return report, errors.Wrap(err, "unable to begin tx for PurgeExpiredFeedback")
+	}
+	defer func() {
+		if err != nil || dryRun {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on PurgeExpiredFeedback")
+		}
+	}()
+
+	q := `
+    SELECT review_cycles.name,
+           review_cycles.created_at,
+           count(reviews.id)
+    FROM   review_cycles
+           JOIN reviews
+             ON reviews.review_cycle_id = review_cycles.id
+    WHERE  review_cycles.is_open = 0
+           AND review_cycles.created_at < ?
+           AND reviews.purged_at IS NULL
+    GROUP  BY review_cycles.id
+    ORDER  BY review_cycles.created_at
+    `
+	rows, err := tx.Query(q, report.Cutoff.Unix())
+	if err != nil {
+		return report, errors.Wrap(err, "unable to query expired cycles")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c RetentionCycle
+		var createdAt int64
+		if err = rows.Scan(&c.Cycle, &createdAt, &c.Reviews); err != nil {
+			return report, errors.Wrap(err, "unable to scan expired cycles")
+		}
+		c.CreatedAt = time.Unix(createdAt, 0).UTC()
+		report.Cycles = append(report.Cycles, c)
+		report.ReviewsPurged += c.Reviews
+	}
+	if err = rows.Err(); err != nil {
+		return report, errors.Wrap(err, "error post scan of expired cycles")
+	}
+	if dryRun || report.ReviewsPurged == 0 {
+		return report, nil
+	}
+
+	q = `
+    UPDATE reviews
+    SET    feedback = "",
+           purged_at = ?
+    WHERE  purged_at IS NULL
+           AND review_cycle_id IN (SELECT id
+                                   FROM   review_cycles
+                                   WHERE  is_open = 0
+                                          AND created_at < ?)
+    `
+	if _, err = tx.Exec(q, now.Unix(), report.Cutoff.Unix()); err != nil {
+		return report, errors.Wrap(err, "unable to purge feedback")
+	}
+
+	b, err := json.Marshal(report.Cycles)
+	if err != nil {
+		return report, errors.Wrap(err, "unable to marshal purged cycles")
+	}
+	q = "insert into retention_purges (purged_at, cutoff, reviews_purged, report) values (?, ?, ?, ?)"
+	if _, err = tx.Exec(q, now.Unix(), report.Cutoff.Unix(), report.ReviewsPurged, string(b)); err != nil {
+		return report, errors.Wrap(err, "unable to record retention purge")
+	}
+	return report, nil
+}
+
+// GetRetentionPurges returns the most recent purges, newest first
+func GetRetentionPurges(db *sql.DB, limit int) ([]RetentionPurge, error) {
+	q := "select id, purged_at, cutoff, reviews_purged, report from retention_purges order by id desc limit ?"
+	rows, err := db.Query(q, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query GetRetentionPurges")
+	}
+	defer rows.Close()
+	purges := []RetentionPurge{}
+	for rows.Next() {
+		var p RetentionPurge
+		var purgedAt, cutoff int64
+		var report string
+		if err = rows.Scan(&p.ID, &purgedAt, &cutoff, &p.ReviewsPurged, &report); err != nil {
+			return nil, errors.Wrap(err, "unable to scan GetRetentionPurges")
+		}
+		p.PurgedAt = time.Unix(purgedAt, 0).UTC()
+		p.Cutoff = time.Unix(cutoff, 0).UTC()
+		if err = json.Unmarshal([]byte(report), &p.Cycles); err != nil {
+			return nil, errors.Wrap(err, "unable to unmarshal retention purge report")
+		}
+		purges = append(purges, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetRetentionPurges")
+	}
+	return purges, nil
+}
+
+// retentionTask purges expired feedback when a retention policy is set
+func retentionTask(a app, now time.Time) error {
+	if a.retention == 0 {
+		return nil
+	}
+	report, err := PurgeExpiredFeedback(a.db, a.retention, now, false)
+	if err != nil {
+		return err
+	}
+	if report.ReviewsPurged > 0 {
+		log.Printf("retention purged %d reviews from %d cycles created before %s", report.ReviewsPurged, len(report.Cycles), report.Cutoff.Format(time.RFC3339))
+	}
+	return nil
+}
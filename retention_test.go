@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPurge(t *testing.T) {
+	/*
+		Verify a dry run reports closed cycles older than the retention policy without purging them
+		Verify a purge empties their feedback text, keeps the counts, and is recorded
+		Verify open and recent cycles are left alone, and purging again finds nothing
+	*/
+	var a app
+	cli, teardown := setupInstanceWith(func(inst *app) {
+		inst.retention = 365 * 24 * time.Hour
+		a = *inst
+	})
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "reviewee", "reviewee@example.com"), "creating user")
+	for _, cycle := range []string{"old_closed", "old_open", "recent_closed"} {
+		NoErr(t, cli.AddCycle(cycle), "adding cycle")
+		NoErr(t, cli.AddReviewForUser("reviewee@example.com", cycle, []string{cycle + " strength"}, []string{cycle + " opportunity"}), "adding review")
+	}
+	NoErr(t, cli.EditCycle("old_closed", false), "closing cycle")
+	NoErr(t, cli.EditCycle("recent_closed", false), "closing cycle")
+	twoYearsAgo := time.Now().AddDate(-2, 0, 0).Unix()
+	_, err := cli.db.Exec("update review_cycles set created_at=? where name in ('old_closed', 'old_open')", twoYearsAgo)
+	NoErr(t, err, "aging cycles")
+
+	report, err := cli.PurgeExpiredFeedback(true)
+	NoErr(t, err, "dry run")
+	if !report.DryRun || report.ReviewsPurged != 2 || len(report.Cycles) != 1 || report.Cycles[0].Cycle != "old_closed" {
+		t.Errorf("got %+v, want a dry run of the 2 reviews in old_closed", report)
+	}
+	if got := reviewsByCycle(t, cli, "reviewee@example.com")["old_closed"]; len(got.Strengths) != 1 {
+		t.Errorf("got %+v, want the dry run to keep feedback", got)
+	}
+
+	report, err = cli.PurgeExpiredFeedback(false)
+	NoErr(t, err, "purging")
+	if report.DryRun || report.ReviewsPurged != 2 {
+		t.Errorf("got %+v, want 2 reviews purged", report)
+	}
+	reviews := reviewsByCycle(t, cli, "reviewee@example.com")
+	if got := reviews["old_closed"]; len(got.Strengths)+len(got.Opportunities) != 0 || got.PurgedStrengths != 1 || got.PurgedOpportunities != 1 {
+		t.Errorf("got %+v, want old_closed's text purged and its counts kept", got)
+	}
+	for _, cycle := range []string{"old_open", "recent_closed"} {
+		if got := reviews[cycle]; strings.Join(got.Strengths, ",") != cycle+" strength" || got.PurgedStrengths != 0 {
+			t.Errorf("got %+v, want %s left alone", got, cycle)
+		}
+	}
+	var feedback string
+	NoErr(t, cli.db.QueryRow("select group_concat(feedback, '') from reviews where purged_at is not null").Scan(&feedback), "reading purged rows")
+	if feedback != "" {
+		t.Errorf("got purged feedback %q, want it removed from the db", feedback)
+	}
+
+	NoErr(t, retentionTask(a, time.Now()), "running periodic task")
+	purges, err := cli.GetRetentionPurges(10)
+	NoErr(t, err, "getting purges")
+	if len(purges) != 1 || purges[0].ReviewsPurged != 2 || len(purges[0].Cycles) != 1 || purges[0].Cycles[0].Cycle != "old_closed" {
+		t.Errorf("got %+v, want one recorded purge of old_closed", purges)
+	}
+}
+
+func reviewsByCycle(t *testing.T, cli *testClient, email string) map[string]Review {
+	reviews, err := GetUserReviews(cli.db, email)
+	NoErr(t, err, "getting reviews")
+	m := make(map[string]Review)
+	for _, r := range reviews {
+		m[r.Cycle] = r
+	}
+	return m
+}
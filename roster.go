@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ Admins can onboard people in bulk by importing a CSV with the columns name, email, teams, manager, and admin, and
+ export the same format. Only the email column is required, and the columns can be in any order.
+
+   name     the user's name. Required for users that do not exist yet
+   email    the user's email, which is how they are matched when they sign in
+   teams    teams separated by ";". Teams that do not exist are created. Teams are only ever added, never removed
+   manager  the manager's email. The manager must already exist or be in the same file
+   admin    true or false
+
+ An empty manager or admin cell leaves the user's current value alone. Every row is validated before anything is
+ written, and if any row is invalid nothing is imported.
+*/
+
+// rosterColumns are the columns of an import or export, in export order
+var rosterColumns = []string{"name", "email", "teams", "manager", "admin"}
+
+// ErrInvalidImport is the cause of errors from an import file that can not be read at all, as opposed to a bad row
+var ErrInvalidImport = errors.New("invalid import")
+
+// UserImportRow is the result of importing one row
+type UserImportRow struct {
+	Line  int    `json:"line"`
+	Email string `json:"email"`
+	// Action is create or update, or invalid if the row has errors
+	Action     string   `json:"action"`
+	TeamsAdded []string `json:"teams_added,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+
+	name    string
+	manager string
+	isAdmin *bool
+}
+
+// UserImportReport is the result of validating, and unless it is a dry run or a row is invalid, importing a file
+type UserImportReport struct {
+	Rows         []UserImportRow `json:"rows"`
+	TeamsCreated []string        `json:"teams_created"`
+	Created      int             `json:"created"`
+	Updated      int             `json:"updated"`
+	Invalid      int             `json:"invalid"`
+	Committed    bool            `json:"committed"`
+}
+
+// parseAdminCell reads the admin column. An empty cell is nil, meaning leave it alone.
+func parseAdminCell(cell string) (*bool, error) {
+	var v bool
+	switch strings.ToLower(cell) {
+	case "":
+		return nil, nil
+	case "true", "yes", "y", "1":
+		v = true
+	case "false", "no", "n", "0":
+		v = false
+	default:
+		return nil, fmt.Errorf("admin must be true or false, got %q", cell)
+	}
+	return &v, nil
+}
+
+// ImportUsers creates and updates users from a CSV. With dryRun, or if any row is invalid, the report says what would
+// happen and nothing is written.
+func ImportUsers(db *sql.DB, in io.Reader, dryRun bool) (UserImportReport, error) {
+	report := UserImportReport{Rows: []UserImportRow{}, TeamsCreated: []string{}}
+
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return report, errors.Wrap(ErrInvalidImport, "the file is empty")
+	} else if err != nil {
+		return report, errors.Wrap(ErrInvalidImport, err.Error())
+	}
+	columns := make(map[string]int)
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		if !inList(column, rosterColumns) {
+			return report, errors.Wrapf(ErrInvalidImport, "unknown column %q. Columns are %s", column, strings.Join(rosterColumns, ", "))
+		}
+		if _, ok := columns[column]; ok {
+			return report, errors.Wrapf(ErrInvalidImport, "column %q appears more than once", column)
+		}
+		columns[column] = i
+	}
+	if _, ok := columns["email"]; !ok {
+		return report, errors.Wrap(ErrInvalidImport, "the email column is required")
+	}
+
+	existingTeams, err := GetTeams(db)
+	if err != nil {
+		return report, err
+	}
+	existingUsers, err := GetUserEmails(db)
+	if err != nil {
+		return report, err
+	}
+	// emails in the file are lowercased, so compare them against lowercased users
+	for i := range existingUsers {
+		existingUsers[i] = strings.ToLower(existingUsers[i])
+	}
+	lines := make(map[string]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return report, errors.Wrap(ErrInvalidImport, err.Error())
+		}
+		line, _ := reader.FieldPos(0)
+		cell := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		if strings.Join(record, "") == "" {
+			continue
+		}
+
+		row := UserImportRow{Line: line, Email: strings.ToLower(cell("email")), name: cell("name"), manager: strings.ToLower(cell("manager"))}
+		if row.Email == "" {
+			row.Errors = append(row.Errors, "email is required")
+		} else if !strings.Contains(row.Email, "@") {
+			row.Errors = append(row.Errors, fmt.Sprintf("%q is not an email", row.Email))
+		} else if first, ok := lines[row.Email]; ok {
+			row.Errors = append(row.Errors, fmt.Sprintf("%s is also on line %d", row.Email, first))
+		} else {
+			lines[row.Email] = line
+		}
+
+		row.Action = "update"
+		if !inList(row.Email, existingUsers) {
+			row.Action = "create"
+			if row.name == "" {
+				row.Errors = append(row.Errors, "name is required for a new user")
+			}
+		}
+		if row.manager == row.Email && row.manager != "" {
+			row.Errors = append(row.Errors, "a user can not be their own manager")
+		}
+		if row.isAdmin, err = parseAdminCell(cell("admin")); err != nil {
+			row.Errors = append(row.Errors, err.Error())
+		}
+
+		var currentTeams []string
+		if row.Action == "update" {
+			if currentTeams, err = GetUsersTeams(db, row.Email); err != nil {
+				return report, err
+			}
+		}
+		for _, team := range strings.Split(cell("teams"), ";") {
+			team = strings.TrimSpace(team)
+			if team == "" || inList(team, currentTeams) || inList(team, row.TeamsAdded) {
+				continue
+			}
+			row.TeamsAdded = append(row.TeamsAdded, team)
+			if !inList(team, existingTeams) && !inList(team, report.TeamsCreated) {
+				report.TeamsCreated = append(report.TeamsCreated, team)
+			}
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	// managers can be anywhere in the file, so they are checked once every row has been read
+	for i, row := range report.Rows {
+		if row.manager == "" || inList(row.manager, existingUsers) {
+			continue
+		}
+		if _, ok := lines[row.manager]; !ok {
+			report.Rows[i].Errors = append(report.Rows[i].Errors, fmt.Sprintf("manager %s is not a user and is not in the file", row.manager))
+		}
+	}
+
+	for i, row := range report.Rows {
+		switch {
+		case len(row.Errors) > 0:
+			report.Rows[i].Action = "invalid"
+			report.Invalid++
+		case row.Action == "create":
+			report.Created++
+		default:
+			report.Updated++
+		}
+	}
+	if dryRun || report.Invalid > 0 {
+		return report, nil
+	}
+
+	if err = writeUserImport(db, report); err != nil {
+		return report, err
+	}
+	report.Committed = true
+	return report, nil
+}
+
+// writeUserImport applies a validated report in one transaction so a failed write leaves nothing imported
+func writeUserImport(db *sql.DB, report UserImportReport) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for writeUserImport")
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on writeUserImport")
+		}
+	}()
+
+	for _, team := range report.TeamsCreated {
+		if _, err = tx.Exec("insert into teams (name) values (?)", team); err != nil {
+			return errors.Wrap(err, "unable to insert team on import")
+		}
+	}
+	// every user is created before anything else so managers later in the file exist
+	for _, row := range report.Rows {
+		if row.Action != "create" {
+			continue
+		}
+		if _, err = tx.Exec("insert into users (name, email) values (?, ?)", row.name, row.Email); err != nil {
+			return errors.Wrap(err, "unable to create user on import")
+		}
+	}
+	for _, row := range report.Rows {
+		if row.Action == "update" && row.name != "" {
+			if _, err = tx.Exec("update users set name=? where email=?", row.name, row.Email); err != nil {
+				return errors.Wrap(err, "unable to set user name on import")
+			}
+		}
+		for _, team := range row.TeamsAdded {
+			q := "insert into user_teams (user_id, team_id) values ((select id from users where email=?), (select id from teams where name=?))"
+			if _, err = tx.Exec(q, row.Email, team); err != nil {
+				return errors.Wrap(err, "unable to assign team on import")
+			}
+		}
+		if row.manager != "" {
+			q := "update users set manager_id=(select id from users where email=?) where email=?"
+			if _, err = tx.Exec(q, row.manager, row.Email); err != nil {
+				return errors.Wrap(err, "unable to set manager on import")
+			}
+		}
+		if row.isAdmin != nil {
+			if _, err = tx.Exec("update users set is_admin=? where email=?", bool2int(*row.isAdmin), row.Email); err != nil {
+				return errors.Wrap(err, "unable to set admin flag on import")
+			}
+		}
+	}
+	return nil
+}
+
+// ExportUsers writes every user as a CSV that ImportUsers can read back
+func ExportUsers(db *sql.DB, out io.Writer) error {
+	q := `
+        SELECT users.name,
+               users.email,
+               coalesce(teams.name, ""),
+               coalesce(managers.email, ""),
+               users.is_admin
+        FROM   users
+               LEFT JOIN users managers
+                      ON users.manager_id = managers.id
+               LEFT JOIN user_teams
+                      ON user_teams.user_id = users.id
+               LEFT JOIN teams
+                      ON user_teams.team_id = teams.id
+        ORDER  BY users.email
+    `
+	rows, err := db.Query(q)
+	if err != nil {
+		return errors.Wrap(err, "unable to query ExportUsers")
+	}
+	defer rows.Close()
+
+	var records [][]string
+	var teams []string
+	flush := func() {
+		if len(records) > 0 {
+			sort.Strings(teams)
+			records[len(records)-1][2] = strings.Join(teams, ";")
+		}
+		teams = nil
+	}
+	for rows.Next() {
+		var name, email, team, manager string
+		var isAdmin bool
+		if err = rows.Scan(&name, &email, &team, &manager, &isAdmin); err != nil {
+			return errors.Wrap(err, "unable to scan ExportUsers")
+		}
+		if len(records) == 0 || records[len(records)-1][1] != email {
+			flush()
+			records = append(records, []string{name, email, "", manager, fmt.Sprint(isAdmin)})
+		}
+		if team != "" {
+			teams = append(teams, team)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "error post scan in ExportUsers")
+	}
+	flush()
+
+	w := csv.NewWriter(out)
+	w.Write(rosterColumns)
+	if err = w.WriteAll(records); err != nil {
+		return errors.Wrap(err, "unable to write users csv")
+	}
+	return nil
+}
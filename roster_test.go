@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAPIAdminUsersImport(t *testing.T) {
+	/*
+		Verify a dry run reports what would change without changing anything
+		Verify invalid rows are reported and nothing is imported
+		Verify an import creates users and teams, adds existing users to teams, and sets managers and admins
+		Verify the export can be imported again without changing anything
+		Verify a user stored with capitals is updated, not created again, on re-import
+	*/
+	cli, teardown := setupInstance()
+	defer teardown()
+
+	NoErr(t, cli.InsertTeam("team_a"), "adding team")
+	NoErr(t, cli.AssignTeamToUser("team_a"), "joining team")
+
+	roster := fmt.Sprintf(`Email,Name,Teams,Manager,Admin
+USER_1@example.com,  User One,team_a; team_b,boss@example.com,
+boss@example.com,The Boss,team_b,,yes
+%s,,team_c;team_a,,true
+`, cli.userEmail)
+
+	report, err := cli.ImportUsers(roster, true)
+	NoErr(t, err, "dry run")
+	if report.Committed || report.Created != 2 || report.Updated != 1 || report.Invalid != 0 {
+		t.Errorf("got %+v, want 2 created and 1 updated, uncommitted", report)
+	}
+	if len(report.Rows) != 3 || report.Rows[0].Line != 2 || report.Rows[0].Email != "user_1@example.com" || report.Rows[0].Action != "create" {
+		t.Fatalf("got rows %+v", report.Rows)
+	}
+	if got := strings.Join(report.Rows[2].TeamsAdded, ","); got != "team_c" {
+		t.Errorf("got teams added %q for the existing user, want team_c", got)
+	}
+	if got := strings.Join(report.TeamsCreated, ","); got != "team_b,team_c" {
+		t.Errorf("got teams created %q, want team_b,team_c", got)
+	}
+	if exists, _ := UserExists(cli.db, "user_1@example.com"); exists {
+		t.Error("dry run created a user")
+	}
+	if teams, _ := cli.GetTeams(); len(teams) != 1 {
+		t.Errorf("got teams %v after a dry run, want only team_a", teams)
+	}
+
+	invalid := `email,name,manager,admin
+user_2@example.com,,,
+user_3@example.com,User Three,nobody@example.com,maybe
+not an email,Someone,,
+user_4@example.com,User Four,user_4@example.com,
+user_4@example.com,User Four,,
+`
+	report, err = cli.ImportUsers(invalid, false)
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 importing invalid rows", err)
+	}
+	if report.Committed || report.Invalid != 5 {
+		t.Errorf("got %+v, want 5 invalid rows and nothing committed", report)
+	}
+	wantErrors := []string{
+		"name is required for a new user",
+		`admin must be true or false, got "maybe"; manager nobody@example.com is not a user and is not in the file`,
+		`"not an email" is not an email`,
+		"a user can not be their own manager",
+		"user_4@example.com is also on line 5",
+	}
+	for i, want := range wantErrors {
+		if i >= len(report.Rows) {
+			break
+		}
+		if got := strings.Join(report.Rows[i].Errors, "; "); got != want || report.Rows[i].Action != "invalid" {
+			t.Errorf("line %d: got %q (%s), want %q", report.Rows[i].Line, got, report.Rows[i].Action, want)
+		}
+	}
+	if exists, _ := UserExists(cli.db, "user_2@example.com"); exists {
+		t.Error("an invalid import created a user")
+	}
+
+	if _, err = cli.ImportUsers("name,email,favorite_color\n", false); err == nil || !strings.Contains(err.Error(), `unknown column \"favorite_color\"`) {
+		t.Errorf("got %v, want a 400 for an unknown column", err)
+	}
+	if _, err = cli.ImportUsers("name\nsomeone\n", false); err == nil || !strings.Contains(err.Error(), "email column is required") {
+		t.Errorf("got %v, want a 400 without an email column", err)
+	}
+
+	report, err = cli.ImportUsers(roster, false)
+	NoErr(t, err, "importing")
+	if !report.Committed {
+		t.Errorf("got %+v, want it committed", report)
+	}
+	user, err := GetUser(cli.db, "user_1@example.com")
+	NoErr(t, err, "getting imported user")
+	if user.Name != "User One" || user.Manager != "boss@example.com" || user.IsAdmin || strings.Join(user.Teams, ",") != "team_a,team_b" {
+		t.Errorf("got %+v", user)
+	}
+	me, err := GetUser(cli.db, cli.userEmail)
+	NoErr(t, err, "getting existing user")
+	if me.Name != "Test User" || !me.IsAdmin || len(me.Teams) != 2 {
+		t.Errorf("got %+v, want the name kept, admin set, and team_c added", me)
+	}
+
+	export, err := cli.ExportUsers()
+	NoErr(t, err, "exporting")
+	want := fmt.Sprintf(`name,email,teams,manager,admin
+Test User,%s,team_a;team_c,,true
+The Boss,boss@example.com,team_b,,true
+User One,user_1@example.com,team_a;team_b,boss@example.com,false
+`, cli.userEmail)
+	if export != want {
+		t.Errorf("got export\n%s\nwant\n%s", export, want)
+	}
+
+	report, err = cli.ImportUsers(export, false)
+	NoErr(t, err, "importing the export")
+	if report.Created != 0 || report.Updated != 3 || len(report.TeamsCreated) != 0 {
+		t.Errorf("got %+v, want only updates", report)
+	}
+	for _, row := range report.Rows {
+		if len(row.TeamsAdded) != 0 {
+			t.Errorf("got teams added %v for %s on re-import", row.TeamsAdded, row.Email)
+		}
+	}
+
+	NoErr(t, CreateUser(cli.db, "Mixed Case", "Mixed.Case@Example.com"), "creating a mixed case user")
+	export, err = cli.ExportUsers()
+	NoErr(t, err, "exporting with a mixed case user")
+	report, err = cli.ImportUsers(export, false)
+	NoErr(t, err, "importing the export with a mixed case user")
+	if report.Created != 0 || report.Updated != 4 {
+		t.Errorf("got %+v, want the mixed case user updated", report)
+	}
+	emails, err := GetUserEmails(cli.db)
+	NoErr(t, err, "getting emails")
+	if len(emails) != 4 {
+		t.Errorf("got users %v after re-import, want 4", emails)
+	}
+}
@@ -0,0 +1,1318 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+)
+
+/*
+ SCIM 2.0 (RFC 7643 and 7644) lets an identity provider provision users and teams at /scim/v2. Users are users, with
+ the email as the userName, and Groups are teams, with the team's users as the members. Requests need -scim-token as a
+ bearer token.
+
+ Deleting a user deactivates them rather than deleting them, so reviews they gave and received are kept. Deactivated
+ users can not sign in and their sessions are revoked. Deleting a group deletes the team.
+
+ Filters support eq, ne, co, sw, ew, and pr joined with "and". Attributes this app does not store, such as title or
+ phoneNumbers, are ignored when written.
+*/
+
+const (
+	scimUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema  = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimContentType  = "application/scim+json"
+	// scimMaxCount is the most resources returned in one page
+	scimMaxCount = 1000
+)
+
+// ErrSCIMConflict is the cause of errors from creating or renaming a user or group to one that already exists
+var ErrSCIMConflict = errors.New("already exists")
+
+// ErrSCIMInvalid is the cause of errors from a SCIM request with a bad value, such as a member that does not exist
+var ErrSCIMInvalid = errors.New("invalid value")
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// formatted is the full name, built from the given and family names if the provider did not send one
+func (n scimName) formatted() string {
+	if n.Formatted != "" {
+		return n.Formatted
+	}
+	return strings.TrimSpace(n.GivenName + " " + n.FamilyName)
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// scimRef is a reference to another resource, such as a group's member
+type scimRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+// scimBool is a boolean that some providers send as the string "True" or "False"
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*b = scimBool(v)
+	case string:
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.Wrapf(ErrSCIMInvalid, "%q is not a boolean", v)
+		}
+		*b = scimBool(parsed)
+	default:
+		return errors.Wrapf(ErrSCIMInvalid, "%s is not a boolean", string(data))
+	}
+	return nil
+}
+
+// SCIMUser is a user as SCIM represents it
+type SCIMUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	UserName    string      `json:"userName"`
+	Name        scimName    `json:"name"`
+	DisplayName string      `json:"displayName"`
+	Emails      []scimEmail `json:"emails"`
+	Active      bool        `json:"active"`
+	Groups      []scimRef   `json:"groups"`
+	Meta        scimMeta    `json:"meta"`
+}
+
+// SCIMGroup is a team as SCIM represents it
+type SCIMGroup struct {
+	Schemas     []string  `json:"schemas"`
+	ID          string    `json:"id"`
+	DisplayName string    `json:"displayName"`
+	Members     []scimRef `json:"members,omitempty"`
+	Meta        scimMeta  `json:"meta"`
+}
+
+// scimListResponse is a page of resources
+type scimListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+// scimUserInput is the part of a SCIM user that is written to this app
+type scimUserInput struct {
+	UserName    string      `json:"userName"`
+	Name        scimName    `json:"name"`
+	DisplayName string      `json:"displayName"`
+	Emails      []scimEmail `json:"emails"`
+	Active      *scimBool   `json:"active"`
+}
+
+// email is the user's email. That is the userName unless the provider uses something else, like an employee id, in
+// which case it is the primary email.
+func (u scimUserInput) email() string {
+	if strings.Contains(u.UserName, "@") {
+		return strings.ToLower(u.UserName)
+	}
+	for _, e := range u.Emails {
+		if e.Primary {
+			return strings.ToLower(e.Value)
+		}
+	}
+	if len(u.Emails) > 0 {
+		return strings.ToLower(u.Emails[0].Value)
+	}
+	return ""
+}
+
+func (u scimUserInput) name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Name.formatted()
+}
+
+// scimMember is a user on a team or a team a user is on
+type scimMember struct {
+	ID      int
+	Display string
+}
+
+type scimUserRecord struct {
+	ID     int
+	Name   string
+	Email  string
+	Active bool
+	Teams  []scimMember
+}
+
+type scimGroupRecord struct {
+	ID      int
+	Name    string
+	Members []scimMember
+}
+
+// getSCIMUsers returns every user, or only the user with the given id if it is not 0
+func getSCIMUsers(db *sql.DB, id int) ([]scimUserRecord, error) {
+	q := `
+        SELECT users.id,
+               users.name,
+               users.email,
+               users.is_active,
+               coalesce(teams.id, 0),
+               coalesce(teams.name, "")
+        FROM   users
+               LEFT JOIN user_teams
+                      ON user_teams.user_id = users.id
+               LEFT JOIN teams
+                      ON user_teams.team_id = teams.id
+        WHERE  ? = 0 OR users.id = ?
+        ORDER  BY users.id, teams.name
+    `
+	rows, err := db.Query(q, id, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query getSCIMUsers")
+	}
+	defer rows.Close()
+	var users []scimUserRecord
+	for rows.Next() {
+		var u scimUserRecord
+		var team scimMember
+		if err = rows.Scan(&u.ID, &u.Name, &u.Email, &u.Active, &team.ID, &team.Display); err != nil {
+			return nil, errors.Wrap(err, "unable to scan getSCIMUsers")
+		}
+		if len(users) == 0 || users[len(users)-1].ID != u.ID {
+			users = append(users, u)
+		}
+		if team.ID != 0 {
+			users[len(users)-1].Teams = append(users[len(users)-1].Teams, team)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in getSCIMUsers")
+	}
+	return users, nil
+}
+
+// getSCIMUser returns one user by id
+func getSCIMUser(db *sql.DB, id int) (scimUserRecord, error) {
+	if id == 0 {
+		return scimUserRecord{}, ErrUserNotFound
+	}
+	users, err := getSCIMUsers(db, id)
+	if err != nil {
+		return scimUserRecord{}, err
+	}
+	if len(users) == 0 {
+		return scimUserRecord{}, ErrUserNotFound
+	}
+	return users[0], nil
+}
+
+// getSCIMGroups returns every team, or only the team with the given id if it is not 0
+func getSCIMGroups(db *sql.DB, id int) ([]scimGroupRecord, error) {
+	q := `
+        SELECT teams.id,
+               teams.name,
+               coalesce(users.id, 0),
+               coalesce(users.email, "")
+        FROM   teams
+               LEFT JOIN user_teams
+                      ON user_teams.team_id = teams.id
+               LEFT JOIN users
+                      ON user_teams.user_id = users.id
+        WHERE  ? = 0 OR teams.id = ?
+        ORDER  BY teams.id, users.email
+    `
+	rows, err := db.Query(q, id, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query getSCIMGroups")
+	}
+	defer rows.Close()
+	var groups []scimGroupRecord
+	for rows.Next() {
+		var g scimGroupRecord
+		var member scimMember
+		if err = rows.Scan(&g.ID, &g.Name, &member.ID, &member.Display); err != nil {
+			return nil, errors.Wrap(err, "unable to scan getSCIMGroups")
+		}
+		if len(groups) == 0 || groups[len(groups)-1].ID != g.ID {
+			groups = append(groups, g)
+		}
+		if member.ID != 0 {
+			groups[len(groups)-1].Members = append(groups[len(groups)-1].Members, member)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in getSCIMGroups")
+	}
+	return groups, nil
+}
+
+// getSCIMGroup returns one team by id
+func getSCIMGroup(db *sql.DB, id int) (scimGroupRecord, error) {
+	if id == 0 {
+		return scimGroupRecord{}, ErrTeamNotFound
+	}
+	groups, err := getSCIMGroups(db, id)
+	if err != nil {
+		return scimGroupRecord{}, err
+	}
+	if len(groups) == 0 {
+		return scimGroupRecord{}, ErrTeamNotFound
+	}
+	return groups[0], nil
+}
+
+// createSCIMUser creates a user, failing if one with the email already exists
+func createSCIMUser(db *sql.DB, name string, email string, active bool) (id int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to begin tx for createSCIMUser")
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on createSCIMUser")
+		}
+	}()
+
+	var n int
+	if err = tx.QueryRow("select count(*) from users where email=?", email).Scan(&n); err != nil {
+		return 0, errors.Wrap(err, "unable to look up user in createSCIMUser")
+	}
+	if n > 0 {
+		return 0, errors.Wrapf(ErrSCIMConflict, "user %s already exists", email)
+	}
+	res, err := tx.Exec("insert into users (name, email, is_active) values (?, ?, ?)", name, email, bool2int(active))
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to insert user in createSCIMUser")
+	}
+	newID, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to get new user id in createSCIMUser")
+	}
+	return int(newID), nil
+}
+
+// updateSCIMUser sets a user's name, email, and whether they are active, returning whether they were active before.
+// Inactive users are offboarded the same way DeactivateUser offboards them, and anyone who is deactivated or whose
+// email changes is signed out.
+func updateSCIMUser(db *sql.DB, id int, name string, email string, active bool) (wasActive bool, err error) {
+	var before string
+	tx, err := db.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, "unable to begin tx for updateSCIMUser")
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on updateSCIMUser")
+			return
+		}
+		if !active || !strings.EqualFold(before, email) {
+			RevokeAuth(before)
+		}
+	}()
+
+	err = tx.QueryRow("select email, is_active from users where id=?", id).Scan(&before, &wasActive)
+	if err == sql.ErrNoRows {
+		return false, ErrUserNotFound
+	} else if err != nil {
+		return false, errors.Wrap(err, "unable to look up user in updateSCIMUser")
+	}
+	var n int
+	if err = tx.QueryRow("select count(*) from users where email=? and id!=?", email, id).Scan(&n); err != nil {
+		return false, errors.Wrap(err, "unable to look up user in updateSCIMUser")
+	}
+	if n > 0 {
+		return false, errors.Wrapf(ErrSCIMConflict, "another user has the email %s", email)
+	}
+	if _, err = tx.Exec("update users set name=?, email=? where id=?", name, email, id); err != nil {
+		return false, errors.Wrap(err, "unable to update user in updateSCIMUser")
+	}
+	if !active {
+		_, err = deactivateUser(tx, id)
+		return wasActive, err
+	}
+	if _, err = tx.Exec("update users set is_active=1 where id=?", id); err != nil {
+		return false, errors.Wrap(err, "unable to reactivate user in updateSCIMUser")
+	}
+	return wasActive, nil
+}
+
+// saveSCIMGroup creates a team if id is 0, or renames it otherwise, and sets its members to exactly memberIDs. It
+// returns the team's id and the emails of the users that were added and removed.
+func saveSCIMGroup(db *sql.DB, id int, name string, memberIDs []int) (teamID int, added []string, removed []string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, nil, errors.Wrap(err, "unable to begin tx for saveSCIMGroup")
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on saveSCIMGroup")
+		}
+	}()
+
+	var n int
+	if err = tx.QueryRow("select count(*) from teams where name=? and id!=?", name, id).Scan(&n); err != nil {
+		return 0, nil, nil, errors.Wrap(err, "unable to look up team in saveSCIMGroup")
+	}
+	if n > 0 {
+		return 0, nil, nil, errors.Wrapf(ErrSCIMConflict, "team %s already exists", name)
+	}
+	if id == 0 {
+		res, err := tx.Exec("insert into teams (name) values (?)", name)
+		if err != nil {
+			return 0, nil, nil, errors.Wrap(err, "unable to insert team in saveSCIMGroup")
+		}
+		newID, err := res.LastInsertId()
+		if err != nil {
+			return 0, nil, nil, errors.Wrap(err, "unable to get new team id in saveSCIMGroup")
+		}
+		id = int(newID)
+	} else {
+		res, err := tx.Exec("update teams set name=? where id=?", name, id)
+		if err != nil {
+			return 0, nil, nil, errors.Wrap(err, "unable to rename team in saveSCIMGroup")
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return 0, nil, nil, errors.Wrap(err, "unable to check rename in saveSCIMGroup")
+		} else if n == 0 {
+			return 0, nil, nil, ErrTeamNotFound
+		}
+	}
+
+	current := make(map[int]string)
+	rows, err := tx.Query("select users.id, users.email from user_teams join users on users.id = user_teams.user_id where user_teams.team_id=?", id)
+	if err != nil {
+		return 0, nil, nil, errors.Wrap(err, "unable to query members in saveSCIMGroup")
+	}
+	for rows.Next() {
+		var userID int
+		var email string
+		if err = rows.Scan(&userID, &email); err != nil {
+			rows.Close()
+			return 0, nil, nil, errors.Wrap(err, "unable to scan members in saveSCIMGroup")
+		}
+		current[userID] = email
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, nil, nil, errors.Wrap(err, "error post scan of members in saveSCIMGroup")
+	}
+
+	wanted := make(map[int]bool)
+	for _, userID := range memberIDs {
+		wanted[userID] = true
+		if _, ok := current[userID]; ok {
+			continue
+		}
+		var email string
+		err = tx.QueryRow("select email from users where id=?", userID).Scan(&email)
+		if err == sql.ErrNoRows {
+			return 0, nil, nil, errors.Wrapf(ErrSCIMInvalid, "member %d does not exist", userID)
+		} else if err != nil {
+			return 0, nil, nil, errors.Wrap(err, "unable to look up member in saveSCIMGroup")
+		}
+		if _, err = tx.Exec("insert into user_teams (user_id, team_id) values (?, ?)", userID, id); err != nil {
+			return 0, nil, nil, errors.Wrap(err, "unable to add member in saveSCIMGroup")
+		}
+		current[userID] = email
+		added = append(added, email)
+	}
+	for userID, email := range current {
+		if wanted[userID] {
+			continue
+		}
+		if _, err = tx.Exec("delete from user_teams where user_id=? and team_id=?", userID, id); err != nil {
+			return 0, nil, nil, errors.Wrap(err, "unable to remove member in saveSCIMGroup")
+		}
+		removed = append(removed, email)
+	}
+	sort.Strings(removed)
+	return id, added, removed, nil
+}
+
+// deleteSCIMGroup deletes a team and its memberships, returning the team's name and the emails of its members
+func deleteSCIMGroup(db *sql.DB, id int) (name string, members []string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "unable to begin tx for deleteSCIMGroup")
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on deleteSCIMGroup")
+		}
+	}()
+
+	err = tx.QueryRow("select name from teams where id=?", id).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil, ErrTeamNotFound
+	} else if err != nil {
+		return "", nil, errors.Wrap(err, "unable to look up team in deleteSCIMGroup")
+	}
+	rows, err := tx.Query("select users.email from user_teams join users on users.id=user_teams.user_id where user_teams.team_id=? order by users.email", id)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "unable to get members in deleteSCIMGroup")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return "", nil, errors.Wrap(err, "unable to scan member in deleteSCIMGroup")
+		}
+		members = append(members, email)
+	}
+	if err = rows.Err(); err != nil {
+		return "", nil, errors.Wrap(err, "unable to read members in deleteSCIMGroup")
+	}
+	if _, err = tx.Exec("delete from user_teams where team_id=?", id); err != nil {
+		return "", nil, errors.Wrap(err, "unable to delete memberships in deleteSCIMGroup")
+	}
+	if _, err = tx.Exec("delete from teams where id=?", id); err != nil {
+		return "", nil, errors.Wrap(err, "unable to delete team in deleteSCIMGroup")
+	}
+	return name, members, nil
+}
+
+// scimCondition is one comparison in a filter, such as userName eq "bob@example.com"
+type scimCondition struct {
+	attr  string
+	op    string
+	value string
+}
+
+// scimFilter is a list of conditions that must all match
+type scimFilter []scimCondition
+
+// scimFilterTokens splits a filter on whitespace, keeping quoted strings together and unquoting them
+func scimFilterTokens(filter string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(filter); {
+		switch {
+		case filter[i] == ' ' || filter[i] == '\t':
+			i++
+		case filter[i] == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, errors.New("unterminated string")
+			}
+			s, err := strconv.Unquote(filter[i : end+1])
+			if err != nil {
+				return nil, errors.Wrap(err, "bad string")
+			}
+			tokens = append(tokens, s)
+			i = end + 1
+		default:
+			end := strings.IndexAny(filter[i:], " \t")
+			if end == -1 {
+				end = len(filter) - i
+			}
+			tokens = append(tokens, filter[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+// parseSCIMFilter parses a filter over the given attributes. Only "and" is supported, not "or", "not", or grouping.
+func parseSCIMFilter(filter string, attrs []string) (scimFilter, error) {
+	tokens, err := scimFilterTokens(filter)
+	if err != nil {
+		return nil, err
+	}
+	var f scimFilter
+	for len(tokens) > 0 {
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("expected an operator after %q", tokens[0])
+		}
+		c := scimCondition{attr: strings.ToLower(tokens[0]), op: strings.ToLower(tokens[1])}
+		if !inList(c.attr, attrs) {
+			return nil, fmt.Errorf("filtering on %q is not supported", tokens[0])
+		}
+		tokens = tokens[2:]
+		switch c.op {
+		case "pr":
+		case "eq", "ne", "co", "sw", "ew":
+			if len(tokens) == 0 {
+				return nil, fmt.Errorf("expected a value after %s", c.op)
+			}
+			c.value = strings.ToLower(tokens[0])
+			tokens = tokens[1:]
+		default:
+			return nil, fmt.Errorf("operator %q is not supported", c.op)
+		}
+		f = append(f, c)
+		if len(tokens) > 0 {
+			if strings.ToLower(tokens[0]) != "and" || len(tokens) == 1 {
+				return nil, fmt.Errorf("expected and, got %q", strings.Join(tokens, " "))
+			}
+			tokens = tokens[1:]
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether a resource matches the filter. values are the resource's values for each attribute, and a
+// condition matches if any one of the values does. Comparisons ignore case.
+func (f scimFilter) matches(values map[string][]string) bool {
+	for _, c := range f {
+		var matched bool
+		for _, v := range values[c.attr] {
+			v = strings.ToLower(v)
+			switch c.op {
+			case "pr":
+				matched = v != ""
+			case "eq":
+				matched = v == c.value
+			case "ne":
+				matched = v != c.value
+			case "co":
+				matched = strings.Contains(v, c.value)
+			case "sw":
+				matched = strings.HasPrefix(v, c.value)
+			case "ew":
+				matched = strings.HasSuffix(v, c.value)
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// scimUserAttrs are the attributes users can be filtered on
+var scimUserAttrs = []string{"id", "username", "displayname", "name.formatted", "emails", "emails.value", "active"}
+
+func (u scimUserRecord) filterValues() map[string][]string {
+	return map[string][]string{
+		"id":             {strconv.Itoa(u.ID)},
+		"username":       {u.Email},
+		"displayname":    {u.Name},
+		"name.formatted": {u.Name},
+		"emails":         {u.Email},
+		"emails.value":   {u.Email},
+		"active":         {strconv.FormatBool(u.Active)},
+	}
+}
+
+// scimGroupAttrs are the attributes groups can be filtered on
+var scimGroupAttrs = []string{"id", "displayname", "members", "members.value"}
+
+func (g scimGroupRecord) filterValues() map[string][]string {
+	var members []string
+	for _, m := range g.Members {
+		members = append(members, strconv.Itoa(m.ID))
+	}
+	return map[string][]string{
+		"id":            {strconv.Itoa(g.ID)},
+		"displayname":   {g.Name},
+		"members":       members,
+		"members.value": members,
+	}
+}
+
+// scimPatchOp is one operation of a PATCH request
+type scimPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// scimPatch is the body of a PATCH request
+type scimPatch struct {
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+// applyUserAttr sets one attribute of a user from a PATCH. Attributes this app does not store are ignored.
+func applyUserAttr(u *scimUserRecord, path string, value json.RawMessage) error {
+	var err error
+	switch strings.ToLower(path) {
+	case "active":
+		var active scimBool
+		err = json.Unmarshal(value, &active)
+		u.Active = bool(active)
+	case "username":
+		var userName string
+		if err = json.Unmarshal(value, &userName); err == nil && strings.Contains(userName, "@") {
+			u.Email = strings.ToLower(userName)
+		}
+	case "displayname", "name.formatted":
+		err = json.Unmarshal(value, &u.Name)
+	case "name":
+		var name scimName
+		if err = json.Unmarshal(value, &name); err == nil && name.formatted() != "" {
+			u.Name = name.formatted()
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(ErrSCIMInvalid, "bad value for %s - %v", path, err)
+	}
+	return nil
+}
+
+// scimMemberIDs reads the user ids out of a list of member references
+func scimMemberIDs(value json.RawMessage) ([]int, error) {
+	var refs []scimRef
+	if len(value) > 0 {
+		if err := json.Unmarshal(value, &refs); err != nil {
+			return nil, errors.Wrapf(ErrSCIMInvalid, "members must be a list of {\"value\": id} - %v", err)
+		}
+	}
+	var ids []int
+	for _, ref := range refs {
+		id, err := strconv.Atoi(ref.Value)
+		if err != nil {
+			return nil, errors.Wrapf(ErrSCIMInvalid, "member %q does not exist", ref.Value)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// applyGroupOp applies one PATCH operation to a team's name and members
+func applyGroupOp(name *string, members map[int]bool, op scimPatchOp) error {
+	path := strings.ToLower(op.Path)
+	verb := strings.ToLower(op.Op)
+	if path == "" && verb != "remove" {
+		var value map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return errors.Wrapf(ErrSCIMInvalid, "value must be an object when there is no path - %v", err)
+		}
+		for attr, v := range value {
+			if err := applyGroupOp(name, members, scimPatchOp{Op: op.Op, Path: attr, Value: v}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// remove a single member with a path like members[value eq "2"]
+	if strings.HasPrefix(path, "members[") && strings.HasSuffix(path, "]") && verb == "remove" {
+		f, err := parseSCIMFilter(op.Path[len("members["):len(op.Path)-1], []string{"value"})
+		if err != nil {
+			return errors.Wrapf(ErrSCIMInvalid, "bad path %q - %v", op.Path, err)
+		}
+		for id := range members {
+			if f.matches(map[string][]string{"value": {strconv.Itoa(id)}}) {
+				delete(members, id)
+			}
+		}
+		return nil
+	}
+
+	switch path {
+	case "displayname":
+		if verb == "remove" {
+			return errors.Wrap(ErrSCIMInvalid, "displayName is required")
+		}
+		if err := json.Unmarshal(op.Value, name); err != nil {
+			return errors.Wrapf(ErrSCIMInvalid, "displayName must be a string - %v", err)
+		}
+	case "members":
+		ids, err := scimMemberIDs(op.Value)
+		if err != nil {
+			return err
+		}
+		switch verb {
+		case "add":
+			for _, id := range ids {
+				members[id] = true
+			}
+		case "remove":
+			if len(ids) == 0 {
+				for id := range members {
+					delete(members, id)
+				}
+			}
+			for _, id := range ids {
+				delete(members, id)
+			}
+		case "replace":
+			for id := range members {
+				delete(members, id)
+			}
+			for _, id := range ids {
+				members[id] = true
+			}
+		default:
+			return errors.Wrapf(ErrSCIMInvalid, "unknown op %q", op.Op)
+		}
+	}
+	return nil
+}
+
+func scimRouter(a app) http.Handler {
+	r := chi.NewRouter()
+	r.Use(a.scimAuthMW)
+
+	r.Get("/ServiceProviderConfig", a.scimServiceProviderConfig)
+
+	r.Get("/Users", a.scimUsers)
+	r.Post("/Users", a.scimCreateUser)
+	r.Get("/Users/{id}", a.scimUser)
+	r.Put("/Users/{id}", a.scimUpdateUser)
+	r.Patch("/Users/{id}", a.scimUpdateUser)
+	r.Delete("/Users/{id}", a.scimDeleteUser)
+
+	r.Get("/Groups", a.scimGroups)
+	r.Post("/Groups", a.scimCreateGroup)
+	r.Get("/Groups/{id}", a.scimGroup)
+	r.Put("/Groups/{id}", a.scimUpdateGroup)
+	r.Patch("/Groups/{id}", a.scimUpdateGroup)
+	r.Delete("/Groups/{id}", a.scimDeleteGroup)
+
+	return r
+}
+
+// scimAuthMW checks for -scim-token as a bearer token
+func (a app) scimAuthMW(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if a.scimToken == "" {
+			scimError(w, nil, http.StatusNotFound, "", "SCIM is not configured")
+			return
+		}
+		want := []byte("Bearer " + a.scimToken)
+		if subtle.ConstantTimeCompare(want, []byte(r.Header.Get("Authorization"))) != 1 {
+			scimError(w, nil, http.StatusUnauthorized, "", "invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// scimError reports an error in the SCIM error format. The err is logged and the detail is presented to the caller.
+func scimError(w http.ResponseWriter, err error, code int, scimType string, detail string) {
+	if err != nil || code >= http.StatusInternalServerError {
+		log.Printf("error: scim %s - %v", detail, err)
+	}
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(code),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	scimWrite(w, code, body)
+}
+
+// scimHandleErr maps the errors from SCIM changes to SCIM errors
+func scimHandleErr(w http.ResponseWriter, err error, msg string) {
+	switch errors.Cause(err) {
+	case ErrUserNotFound, ErrTeamNotFound:
+		scimError(w, nil, http.StatusNotFound, "", errors.Cause(err).Error())
+	case ErrSCIMConflict:
+		scimError(w, nil, http.StatusConflict, "uniqueness", err.Error())
+	case ErrSCIMInvalid:
+		scimError(w, nil, http.StatusBadRequest, "invalidValue", err.Error())
+	default:
+		scimError(w, err, http.StatusInternalServerError, "", msg)
+	}
+}
+
+func scimWrite(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error encoding scim response: %v", err)
+	}
+}
+
+// scimID reads the {id} url param
+func scimID(r *http.Request) int {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+// scimPage reads startIndex and count, which are 1 based and default to the first scimMaxCount resources
+func scimPage(r *http.Request, total int) (start int, end int) {
+	startIndex, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 0 || count > scimMaxCount {
+		count = scimMaxCount
+	}
+	start = startIndex - 1
+	if start > total {
+		start = total
+	}
+	end = start + count
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+func (a app) scimLocation(resourceType string, id int) string {
+	return fmt.Sprintf("%s/scim/v2/%ss/%d", strings.TrimRight(a.baseURL, "/"), resourceType, id)
+}
+
+func (a app) scimUserResource(u scimUserRecord) SCIMUser {
+	user := SCIMUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          strconv.Itoa(u.ID),
+		UserName:    u.Email,
+		Name:        scimName{Formatted: u.Name},
+		DisplayName: u.Name,
+		Emails:      []scimEmail{{Value: u.Email, Type: "work", Primary: true}},
+		Active:      u.Active,
+		Groups:      []scimRef{},
+		Meta:        scimMeta{ResourceType: "User", Location: a.scimLocation("User", u.ID)},
+	}
+	for _, team := range u.Teams {
+		user.Groups = append(user.Groups, scimRef{Value: strconv.Itoa(team.ID), Display: team.Display})
+	}
+	return user
+}
+
+func (a app) scimGroupResource(g scimGroupRecord) SCIMGroup {
+	group := SCIMGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          strconv.Itoa(g.ID),
+		DisplayName: g.Name,
+		Members:     []scimRef{},
+		Meta:        scimMeta{ResourceType: "Group", Location: a.scimLocation("Group", g.ID)},
+	}
+	for _, member := range g.Members {
+		group.Members = append(group.Members, scimRef{Value: strconv.Itoa(member.ID), Display: member.Display})
+	}
+	return group
+}
+
+func (a app) scimServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	supported := func(b bool) map[string]bool { return map[string]bool{"supported": b} }
+	scimWrite(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimConfigSchema},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxCount},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]string{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "the -scim-token the app was started with",
+		}},
+	})
+}
+
+func (a app) scimUsers(w http.ResponseWriter, r *http.Request) {
+	f, err := parseSCIMFilter(r.URL.Query().Get("filter"), scimUserAttrs)
+	if err != nil {
+		scimError(w, nil, http.StatusBadRequest, "invalidFilter", err.Error())
+		return
+	}
+	users, err := getSCIMUsers(a.db, 0)
+	if err != nil {
+		scimError(w, err, http.StatusInternalServerError, "", "unable to get users")
+		return
+	}
+	matched := []SCIMUser{}
+	for _, u := range users {
+		if f.matches(u.filterValues()) {
+			matched = append(matched, a.scimUserResource(u))
+		}
+	}
+	start, end := scimPage(r, len(matched))
+	scimWrite(w, http.StatusOK, scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(matched),
+		StartIndex:   start + 1,
+		ItemsPerPage: end - start,
+		Resources:    matched[start:end],
+	})
+}
+
+func (a app) scimUser(w http.ResponseWriter, r *http.Request) {
+	u, err := getSCIMUser(a.db, scimID(r))
+	if err != nil {
+		scimHandleErr(w, err, "unable to get user")
+		return
+	}
+	scimWrite(w, http.StatusOK, a.scimUserResource(u))
+}
+
+func (a app) scimCreateUser(w http.ResponseWriter, r *http.Request) {
+	var payload scimUserInput
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		scimError(w, err, http.StatusBadRequest, "", "unable to read request body")
+		return
+	}
+	if err = json.Unmarshal(b, &payload); err != nil {
+		scimError(w, nil, http.StatusBadRequest, "invalidSyntax", "unable to parse user - "+err.Error())
+		return
+	}
+	email := payload.email()
+	if email == "" {
+		scimError(w, nil, http.StatusBadRequest, "invalidValue", "userName or emails must have an email")
+		return
+	}
+	active := payload.Active == nil || bool(*payload.Active)
+
+	id, err := createSCIMUser(a.db, payload.name(), email, active)
+	if err != nil {
+		scimHandleErr(w, err, "unable to create user")
+		return
+	}
+	u, err := getSCIMUser(a.db, id)
+	if err != nil {
+		scimHandleErr(w, err, "unable to get new user")
+		return
+	}
+	a.emitEvent(eventUserCreated, userEvent{Email: u.Email, Name: u.Name})
+	w.Header().Set("Location", a.scimLocation("User", id))
+	scimWrite(w, http.StatusCreated, a.scimUserResource(u))
+}
+
+// scimUpdateUser handles PUT, which replaces the user, and PATCH, which applies a list of operations. Deactivating a
+// user, or changing their email, signs them out.
+func (a app) scimUpdateUser(w http.ResponseWriter, r *http.Request) {
+	u, err := getSCIMUser(a.db, scimID(r))
+	if err != nil {
+		scimHandleErr(w, err, "unable to get user")
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		scimError(w, err, http.StatusBadRequest, "", "unable to read request body")
+		return
+	}
+
+	if r.Method == "PUT" {
+		var payload scimUserInput
+		if err = json.Unmarshal(b, &payload); err != nil {
+			scimError(w, nil, http.StatusBadRequest, "invalidSyntax", "unable to parse user - "+err.Error())
+			return
+		}
+		if u.Email = payload.email(); u.Email == "" {
+			scimError(w, nil, http.StatusBadRequest, "invalidValue", "userName or emails must have an email")
+			return
+		}
+		u.Name = payload.name()
+		if payload.Active != nil {
+			u.Active = bool(*payload.Active)
+		}
+	} else {
+		var payload scimPatch
+		if err = json.Unmarshal(b, &payload); err != nil {
+			scimError(w, nil, http.StatusBadRequest, "invalidSyntax", "unable to parse patch - "+err.Error())
+			return
+		}
+		for _, op := range payload.Operations {
+			if verb := strings.ToLower(op.Op); verb != "add" && verb != "replace" {
+				// every attribute stored for a user is required, so there is nothing to remove
+				continue
+			}
+			if op.Path != "" {
+				err = applyUserAttr(&u, op.Path, op.Value)
+			} else {
+				var value map[string]json.RawMessage
+				if err = json.Unmarshal(op.Value, &value); err != nil {
+					err = errors.Wrapf(ErrSCIMInvalid, "value must be an object when there is no path - %v", err)
+				}
+				for attr, v := range value {
+					if err = applyUserAttr(&u, attr, v); err != nil {
+						break
+					}
+				}
+			}
+			if err != nil {
+				scimHandleErr(w, err, "unable to apply patch")
+				return
+			}
+		}
+	}
+
+	wasActive, err := updateSCIMUser(a.db, u.ID, u.Name, u.Email, u.Active)
+	if err != nil {
+		scimHandleErr(w, err, "unable to update user")
+		return
+	}
+	if err = a.auditSCIMUser(r, u, wasActive); err != nil {
+		scimHandleErr(w, err, "unable to audit change")
+		return
+	}
+	scimWrite(w, http.StatusOK, a.scimUserResource(u))
+}
+
+// scimDeleteUser deactivates the user so that the reviews they gave and received are kept
+func (a app) scimDeleteUser(w http.ResponseWriter, r *http.Request) {
+	u, err := getSCIMUser(a.db, scimID(r))
+	if err != nil {
+		scimHandleErr(w, err, "unable to get user")
+		return
+	}
+	u.Active = false
+	wasActive, err := updateSCIMUser(a.db, u.ID, u.Name, u.Email, u.Active)
+	if err != nil {
+		scimHandleErr(w, err, "unable to deactivate user")
+		return
+	}
+	if err = a.auditSCIMUser(r, u, wasActive); err != nil {
+		scimHandleErr(w, err, "unable to audit change")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditSCIMUser audits, and emits an event for, a user the SCIM client deactivated or reactivated
+func (a app) auditSCIMUser(r *http.Request, u scimUserRecord, wasActive bool) error {
+	action, event := auditUserDeactivated, eventUserDeactivated
+	if u.Active {
+		action, event = auditUserReactivated, eventUserReactivated
+	}
+	if u.Active == wasActive {
+		return nil
+	}
+	if err := a.auditAs(r, scimActor, action, u.Email, map[string]bool{"is_active": wasActive}, map[string]bool{"is_active": u.Active}); err != nil {
+		return err
+	}
+	a.emitEvent(event, userEvent{Email: u.Email, Name: u.Name})
+	return nil
+}
+
+func (a app) scimGroups(w http.ResponseWriter, r *http.Request) {
+	f, err := parseSCIMFilter(r.URL.Query().Get("filter"), scimGroupAttrs)
+	if err != nil {
+		scimError(w, nil, http.StatusBadRequest, "invalidFilter", err.Error())
+		return
+	}
+	groups, err := getSCIMGroups(a.db, 0)
+	if err != nil {
+		scimError(w, err, http.StatusInternalServerError, "", "unable to get groups")
+		return
+	}
+	// providers that only want to find a group ask to leave out the members, which can be large
+	excludeMembers := strings.Contains(strings.ToLower(r.URL.Query().Get("excludedAttributes")), "members")
+	matched := []SCIMGroup{}
+	for _, g := range groups {
+		if f.matches(g.filterValues()) {
+			group := a.scimGroupResource(g)
+			if excludeMembers {
+				group.Members = nil
+			}
+			matched = append(matched, group)
+		}
+	}
+	start, end := scimPage(r, len(matched))
+	scimWrite(w, http.StatusOK, scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(matched),
+		StartIndex:   start + 1,
+		ItemsPerPage: end - start,
+		Resources:    matched[start:end],
+	})
+}
+
+func (a app) scimGroup(w http.ResponseWriter, r *http.Request) {
+	g, err := getSCIMGroup(a.db, scimID(r))
+	if err != nil {
+		scimHandleErr(w, err, "unable to get group")
+		return
+	}
+	scimWrite(w, http.StatusOK, a.scimGroupResource(g))
+}
+
+// scimGroupInput is the body of creating or replacing a group
+type scimGroupInput struct {
+	DisplayName string          `json:"displayName"`
+	Members     json.RawMessage `json:"members"`
+}
+
+func (a app) scimCreateGroup(w http.ResponseWriter, r *http.Request) {
+	var payload scimGroupInput
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		scimError(w, err, http.StatusBadRequest, "", "unable to read request body")
+		return
+	}
+	if err = json.Unmarshal(b, &payload); err != nil {
+		scimError(w, nil, http.StatusBadRequest, "invalidSyntax", "unable to parse group - "+err.Error())
+		return
+	}
+	a.scimSaveGroup(w, r, scimGroupRecord{}, payload.DisplayName, payload.Members)
+}
+
+// scimUpdateGroup handles PUT, which replaces the name and members, and PATCH, which applies a list of operations
+func (a app) scimUpdateGroup(w http.ResponseWriter, r *http.Request) {
+	g, err := getSCIMGroup(a.db, scimID(r))
+	if err != nil {
+		scimHandleErr(w, err, "unable to get group")
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		scimError(w, err, http.StatusBadRequest, "", "unable to read request body")
+		return
+	}
+
+	if r.Method == "PUT" {
+		var payload scimGroupInput
+		if err = json.Unmarshal(b, &payload); err != nil {
+			scimError(w, nil, http.StatusBadRequest, "invalidSyntax", "unable to parse group - "+err.Error())
+			return
+		}
+		a.scimSaveGroup(w, r, g, payload.DisplayName, payload.Members)
+		return
+	}
+
+	var payload scimPatch
+	if err = json.Unmarshal(b, &payload); err != nil {
+		scimError(w, nil, http.StatusBadRequest, "invalidSyntax", "unable to parse patch - "+err.Error())
+		return
+	}
+	name := g.Name
+	members := make(map[int]bool)
+	for _, m := range g.Members {
+		members[m.ID] = true
+	}
+	for _, op := range payload.Operations {
+		if err = applyGroupOp(&name, members, op); err != nil {
+			scimHandleErr(w, err, "unable to apply patch")
+			return
+		}
+	}
+	var refs []scimRef
+	for id := range members {
+		refs = append(refs, scimRef{Value: strconv.Itoa(id)})
+	}
+	memberJSON, err := json.Marshal(refs)
+	if err != nil {
+		scimError(w, err, http.StatusInternalServerError, "", "unable to collect members")
+		return
+	}
+	a.scimSaveGroup(w, r, g, name, memberJSON)
+}
+
+// scimSaveGroup creates or updates a team with exactly the given members, and responds with the result
+func (a app) scimSaveGroup(w http.ResponseWriter, r *http.Request, g scimGroupRecord, name string, members json.RawMessage) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		scimError(w, nil, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+	memberIDs, err := scimMemberIDs(members)
+	if err != nil {
+		scimHandleErr(w, err, "unable to read members")
+		return
+	}
+	id, added, removed, err := saveSCIMGroup(a.db, g.ID, name, memberIDs)
+	if err != nil {
+		scimHandleErr(w, err, "unable to save group")
+		return
+	}
+	if g.ID == 0 {
+		err = a.auditAs(r, scimActor, auditTeamCreated, name, nil, map[string]string{"team": name})
+	}
+	if err == nil && len(added)+len(removed) > 0 {
+		err = a.auditAs(r, scimActor, auditTeamMembersChanged, name, nil, map[string][]string{"added": added, "removed": removed})
+	}
+	if err != nil {
+		scimHandleErr(w, err, "unable to audit change")
+		return
+	}
+
+	code := http.StatusOK
+	if g.ID == 0 {
+		code = http.StatusCreated
+		a.emitEvent(eventTeamChanged, teamEvent{Team: name, Change: "created"})
+	}
+	for _, email := range added {
+		a.emitEvent(eventTeamChanged, teamEvent{Team: name, Change: "member_added", UserEmail: email})
+	}
+	for _, email := range removed {
+		a.emitEvent(eventTeamChanged, teamEvent{Team: name, Change: "member_removed", UserEmail: email})
+	}
+
+	saved, err := getSCIMGroup(a.db, id)
+	if err != nil {
+		scimHandleErr(w, err, "unable to get saved group")
+		return
+	}
+	if code == http.StatusCreated {
+		w.Header().Set("Location", a.scimLocation("Group", id))
+	}
+	scimWrite(w, code, a.scimGroupResource(saved))
+}
+
+func (a app) scimDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	name, members, err := deleteSCIMGroup(a.db, scimID(r))
+	if err != nil {
+		scimHandleErr(w, err, "unable to delete group")
+		return
+	}
+	if err = a.auditAs(r, scimActor, auditTeamDeleted, name, map[string]interface{}{"team": name, "members": members}, nil); err != nil {
+		scimHandleErr(w, err, "unable to audit change")
+		return
+	}
+	a.emitEvent(eventTeamChanged, teamEvent{Team: name, Change: "deleted"})
+	w.WriteHeader(http.StatusNoContent)
+}
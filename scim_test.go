@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSCIMUsers(t *testing.T) {
+	/*
+		Verify requests need the bearer token
+		Verify users can be created, found with a filter, paged through, and updated with PUT and PATCH
+		Verify deactivating a user revokes their sessions and keeps their reviews
+		Verify deactivations are audited with the SCIM client as the actor
+	*/
+	cli, teardown := setupInstanceWith(func(a *app) {
+		a.scimToken = "scim-secret"
+	})
+	defer teardown()
+
+	if code, _ := scimDo(t, cli, "wrong", "GET", "/Users", ""); code != http.StatusUnauthorized {
+		t.Errorf("got %d, want 401 with the wrong token", code)
+	}
+
+	code, created := scimDo(t, cli, "scim-secret", "POST", "/Users", `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "Ada@Example.com",
+		"name": {"givenName": "Ada", "familyName": "Lovelace"},
+		"emails": [{"value": "ada@example.com", "primary": true}],
+		"title": "Engineer",
+		"active": true
+	}`)
+	if code != http.StatusCreated || created["userName"] != "ada@example.com" || created["displayName"] != "Ada Lovelace" || created["active"] != true {
+		t.Fatalf("got %d %v, want the new user", code, created)
+	}
+	id := created["id"].(string)
+
+	code, conflict := scimDo(t, cli, "scim-secret", "POST", "/Users", `{"userName": "ada@example.com"}`)
+	if code != http.StatusConflict || conflict["scimType"] != "uniqueness" {
+		t.Errorf("got %d %v, want a uniqueness error", code, conflict)
+	}
+
+	code, list := scimDo(t, cli, "scim-secret", "GET", `/Users?filter=userName+eq+%22ADA%40example.com%22+and+active+eq+true`, "")
+	if code != http.StatusOK || list["totalResults"] != 1.0 {
+		t.Errorf("got %d %v, want one user matching the filter", code, list)
+	}
+	code, list = scimDo(t, cli, "scim-secret", "GET", "/Users?startIndex=2&count=1", "")
+	resources, _ := list["Resources"].([]interface{})
+	if code != http.StatusOK || list["totalResults"] != 2.0 || list["startIndex"] != 2.0 || len(resources) != 1 || resources[0].(map[string]interface{})["id"] != id {
+		t.Errorf("got %d %v, want the second of two users", code, list)
+	}
+	code, bad := scimDo(t, cli, "scim-secret", "GET", `/Users?filter=title+eq+%22Engineer%22`, "")
+	if code != http.StatusBadRequest || bad["scimType"] != "invalidFilter" {
+		t.Errorf("got %d %v, want an invalid filter", code, bad)
+	}
+
+	code, replaced := scimDo(t, cli, "scim-secret", "PUT", "/Users/"+id, `{"userName": "ada@example.com", "displayName": "Countess Lovelace"}`)
+	if code != http.StatusOK || replaced["displayName"] != "Countess Lovelace" || replaced["active"] != true {
+		t.Errorf("got %d %v, want the name replaced and still active", code, replaced)
+	}
+
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.as("ada@example.com").AddReviewer(cli.userEmail, "cycle_1"), "requesting review")
+	NoErr(t, cli.AddReviewForUser("ada@example.com", "cycle_1", []string{"thorough"}, []string{"delegate more"}), "adding review")
+
+	SetAuth("ada-session", "ada@example.com", time.Now().Add(time.Hour))
+	// some providers send booleans as strings
+	code, patched := scimDo(t, cli, "scim-secret", "PATCH", "/Users/"+id, `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "Replace", "path": "active", "value": "False"}]
+	}`)
+	if code != http.StatusOK || patched["active"] != false {
+		t.Errorf("got %d %v, want the user deactivated", code, patched)
+	}
+	if _, ok := IsValidAuth("ada-session"); ok {
+		t.Error("got a valid session after deactivating the user")
+	}
+	if active, err := UserIsActive(cli.db, "ada@example.com"); err != nil || active {
+		t.Errorf("got active %t (%v), want the user unable to sign in", active, err)
+	}
+
+	code, _ = scimDo(t, cli, "scim-secret", "DELETE", "/Users/"+id, "")
+	if code != http.StatusNoContent {
+		t.Errorf("got %d, want 204 deleting a user", code)
+	}
+	code, got := scimDo(t, cli, "scim-secret", "GET", "/Users/"+id, "")
+	if code != http.StatusOK || got["active"] != false {
+		t.Errorf("got %d %v, want the deleted user kept and inactive", code, got)
+	}
+	reviews, err := GetUserReviews(cli.db, "ada@example.com")
+	NoErr(t, err, "getting reviews")
+	if len(reviews) != 1 {
+		t.Errorf("got %d reviews, want the deactivated user's review kept", len(reviews))
+	}
+	entries, err := GetAuditEntries(cli.db, AuditFilter{Actor: scimActor, Target: "ada@example.com"})
+	NoErr(t, err, "getting audit log")
+	if len(entries) != 1 || entries[0].Action != auditUserDeactivated || string(entries[0].Before) != `{"is_active":true}` {
+		t.Errorf("got %+v, want one deactivation by the SCIM client", entries)
+	}
+
+	if code, _ := scimDo(t, cli, "scim-secret", "GET", "/Users/9999", ""); code != http.StatusNotFound {
+		t.Errorf("got %d, want 404 for a missing user", code)
+	}
+}
+
+func TestSCIMGroups(t *testing.T) {
+	/*
+		Verify groups are created with members and are teams
+		Verify PATCH can add and remove members and rename the group
+		Verify deleting a group deletes the team and its memberships
+		Verify group changes are audited with the SCIM client as the actor
+	*/
+	cli, teardown := setupInstanceWith(func(a *app) {
+		a.scimToken = "scim-secret"
+	})
+	defer teardown()
+
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	_, list := scimDo(t, cli, "scim-secret", "GET", `/Users?filter=userName+eq+%22user_1%40example.com%22`, "")
+	user1 := list["Resources"].([]interface{})[0].(map[string]interface{})["id"].(string)
+	_, list = scimDo(t, cli, "scim-secret", "GET", `/Users?filter=userName+eq+%22`+strings.Replace(cli.userEmail, "@", "%40", 1)+`%22`, "")
+	me := list["Resources"].([]interface{})[0].(map[string]interface{})["id"].(string)
+
+	code, created := scimDo(t, cli, "scim-secret", "POST", "/Groups", `{"displayName": "platform", "members": [{"value": "`+user1+`"}]}`)
+	if code != http.StatusCreated || created["displayName"] != "platform" || len(created["members"].([]interface{})) != 1 {
+		t.Fatalf("got %d %v, want the new group with one member", code, created)
+	}
+	id := created["id"].(string)
+	if teams, _ := GetUsersTeams(cli.db, "user_1@example.com"); strings.Join(teams, ",") != "platform" {
+		t.Errorf("got teams %v, want platform", teams)
+	}
+
+	code, _ = scimDo(t, cli, "scim-secret", "POST", "/Groups", `{"displayName": "platform"}`)
+	if code != http.StatusConflict {
+		t.Errorf("got %d, want 409 for a duplicate group", code)
+	}
+	code, bad := scimDo(t, cli, "scim-secret", "POST", "/Groups", `{"displayName": "infra", "members": [{"value": "9999"}]}`)
+	if code != http.StatusBadRequest || bad["scimType"] != "invalidValue" {
+		t.Errorf("got %d %v, want an invalid member", code, bad)
+	}
+
+	code, patched := scimDo(t, cli, "scim-secret", "PATCH", "/Groups/"+id, `{"Operations": [
+		{"op": "add", "path": "members", "value": [{"value": "`+me+`"}]},
+		{"op": "remove", "path": "members[value eq \"`+user1+`\"]"},
+		{"op": "replace", "value": {"displayName": "platform-eng"}}
+	]}`)
+	if code != http.StatusOK || patched["displayName"] != "platform-eng" {
+		t.Errorf("got %d %v, want the group renamed", code, patched)
+	}
+	if teams, _ := GetUsersTeams(cli.db, "user_1@example.com"); len(teams) != 0 {
+		t.Errorf("got teams %v for the removed member", teams)
+	}
+	if teams, _ := GetUsersTeams(cli.db, cli.userEmail); strings.Join(teams, ",") != "platform-eng" {
+		t.Errorf("got teams %v for the added member, want platform-eng", teams)
+	}
+
+	code, list = scimDo(t, cli, "scim-secret", "GET", `/Groups?filter=displayName+eq+%22platform-eng%22&excludedAttributes=members`, "")
+	resources, _ := list["Resources"].([]interface{})
+	if code != http.StatusOK || len(resources) != 1 || resources[0].(map[string]interface{})["members"] != nil {
+		t.Errorf("got %d %v, want the group without members", code, list)
+	}
+
+	code, _ = scimDo(t, cli, "scim-secret", "DELETE", "/Groups/"+id, "")
+	if code != http.StatusNoContent {
+		t.Errorf("got %d, want 204 deleting a group", code)
+	}
+	if teams, _ := GetTeams(cli.db); len(teams) != 0 {
+		t.Errorf("got teams %v after deleting the group", teams)
+	}
+	if teams, _ := GetUsersTeams(cli.db, cli.userEmail); len(teams) != 0 {
+		t.Errorf("got teams %v after deleting the group", teams)
+	}
+	entries, err := GetAuditEntries(cli.db, AuditFilter{Actor: scimActor})
+	NoErr(t, err, "getting audit log")
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	if strings.Join(actions, ",") != "team.deleted,team.members_changed,team.members_changed,team.created" {
+		t.Errorf("got actions %v, want the group's creation, member changes, and deletion", actions)
+	}
+	if len(entries) > 0 && !strings.Contains(string(entries[0].Before), cli.userEmail) {
+		t.Errorf("got %s, want the deleted group's members before", entries[0].Before)
+	}
+}
+
+// scimDo makes a SCIM request with a bearer token and decodes the response
+func scimDo(t *testing.T, cli *testClient, token string, method string, uri string, body string) (int, map[string]interface{}) {
+	req, err := http.NewRequest(method, cli.addr+"/scim/v2"+uri, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unable to create request - %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", scimContentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to %s %s - %v", method, uri, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response - %v", err)
+	}
+	var data map[string]interface{}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, &data); err != nil {
+			t.Fatalf("unable to decode %s - %v", b, err)
+		}
+	}
+	return resp.StatusCode, data
+}
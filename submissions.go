@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ review_submissions is a ledger of who has submitted feedback for whom during a cycle. It exists so reviewers can see
+ what they still owe and admins can follow a cycle's progress. To keep feedback anonymous it is written separately from
+ reviews, only keeps the day a submission happened, holds one row per reviewer/reviewee/cycle no matter how many times
+ feedback is added, and must never be joined against reviews.
+*/
+
+// RecordSubmission notes that a reviewer submitted feedback for a reviewee during a cycle
+func RecordSubmission(db *sql.DB, reviewerEmail string, revieweeEmail string, cycle string) error {
+	q := `
+    INSERT OR IGNORE INTO review_submissions
+                (reviewer_id,
+                reviewee_id,
+                cycle_id,
+                submitted_on)
+    VALUES      ((SELECT id
+                FROM   users
+                WHERE  email =?
+                LIMIT  1),
+                (SELECT id
+                FROM   users
+                WHERE  email =?
+                LIMIT  1),
+                (SELECT id
+                FROM   review_cycles
+                WHERE  name =?
+                LIMIT  1),
+                ?)
+    `
+	if _, err := db.Exec(q, reviewerEmail, revieweeEmail, cycle, time.Now().UTC().Format("2006-01-02")); err != nil {
+		return errors.Wrap(err, "unable to record submission")
+	}
+	return nil
+}
+
+// hasSubmitted reports whether a reviewer already submitted feedback for a reviewee during a cycle
+func hasSubmitted(db *sql.DB, reviewerEmail string, revieweeEmail string, cycle string) (bool, error) {
+	q := `
+    SELECT count(*)
+    FROM   review_submissions
+           JOIN users reviewer
+             ON review_submissions.reviewer_id = reviewer.id
+           JOIN users reviewee
+             ON review_submissions.reviewee_id = reviewee.id
+           JOIN review_cycles
+             ON review_submissions.cycle_id = review_cycles.id
+    WHERE  reviewer.email = ?
+           AND reviewee.email = ?
+           AND review_cycles.name = ?
+    `
+	var n int
+	if err := db.QueryRow(q, reviewerEmail, revieweeEmail, cycle).Scan(&n); err != nil {
+		return false, errors.Wrap(err, "unable to look up submission")
+	}
+	return n > 0, nil
+}
+
+// GetOutstandingReviewees returns the reviewees a user can review in a cycle but has not submitted feedback for yet
+func GetOutstandingReviewees(db *sql.DB, email string, cycle string) ([]UserInfoLite, error) {
+	reviewees, err := GetReviewees(db, email, cycle)
+	if err != nil {
+		return nil, err
+	}
+
+	q := `
+    SELECT users.email
+    FROM   review_submissions
+           JOIN users
+             ON review_submissions.reviewee_id = users.id
+           JOIN review_cycles
+             ON review_submissions.cycle_id = review_cycles.id
+    WHERE  review_submissions.reviewer_id = (SELECT id
+                                             FROM   users
+                                             WHERE  email = ?
+                                             LIMIT  1)
+           AND review_cycles.name = ?
+    `
+	rows, err := db.Query(q, email, cycle)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query submissions in GetOutstandingReviewees")
+	}
+	defer rows.Close()
+	submitted := make(map[string]bool)
+	for rows.Next() {
+		var revieweeEmail string
+		if err = rows.Scan(&revieweeEmail); err != nil {
+			return nil, errors.Wrap(err, "unable to scan submissions in GetOutstandingReviewees")
+		}
+		submitted[revieweeEmail] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetOutstandingReviewees")
+	}
+
+	// a team mate can also have requested a review, so skip anyone already listed
+	var outstanding []UserInfoLite
+	for _, reviewee := range reviewees {
+		if submitted[reviewee.Email] {
+			continue
+		}
+		submitted[reviewee.Email] = true
+		outstanding = append(outstanding, reviewee)
+	}
+	return outstanding, nil
+}
+
+// TeamCompletion is how far a team's members are with the reviews they can write during a cycle
+type TeamCompletion struct {
+	Team      string  `json:"team"`
+	Expected  int     `json:"expected"`
+	Submitted int     `json:"submitted"`
+	Percent   float64 `json:"percent"`
+}
+
+// GetTeamCompletion returns each team's progress in a cycle. Expected is the number of reviewer/reviewee pairs where the
+// reviewer is one of the team's active members, so a reviewee counts once for each member who can review them, and
+// Submitted is how many of those pairs have feedback. A team with nothing expected is 100 percent done. The pairs are the
+// ones GetReviewees lists: team mates plus open review requests.
+func GetTeamCompletion(db *sql.DB, cycle string) ([]TeamCompletion, error) {
+	q := `
+    WITH pairs AS
+    (
+           SELECT user_teams.user_id AS reviewer_id,
+                  mates.user_id      AS reviewee_id
+           FROM   user_teams
+                  JOIN user_teams mates
+                    ON mates.team_id = (SELECT team_id
+                                        FROM   user_teams first
+                                        WHERE  first.user_id = user_teams.user_id)
+           WHERE  mates.user_id <> user_teams.user_id
+           UNION
+           SELECT review_requests.reviewer_id,
+                  review_requests.recipient_id
+           FROM   review_requests
+                  JOIN review_cycles
+                    ON review_requests.cycle_id = review_cycles.id
+           WHERE  review_cycles.name = ?
+                  AND review_requests.status IN (?, ?)
+    )
+    SELECT   teams.name,
+             count(reviewee.id),
+             count(review_submissions.reviewer_id)
+    FROM     teams
+             JOIN user_teams
+               ON user_teams.team_id = teams.id
+             JOIN users
+               ON user_teams.user_id = users.id
+             LEFT JOIN pairs
+               ON pairs.reviewer_id = users.id
+             LEFT JOIN users reviewee
+               ON pairs.reviewee_id = reviewee.id
+                  AND reviewee.is_active = 1
+             LEFT JOIN review_submissions
+               ON review_submissions.reviewer_id = users.id
+                  AND review_submissions.reviewee_id = reviewee.id
+                  AND review_submissions.cycle_id = (SELECT id
+                                                     FROM   review_cycles
+                                                     WHERE  name = ?
+                                                     LIMIT  1)
+    WHERE    users.is_active = 1
+    GROUP BY teams.name
+    ORDER BY teams.name
+    `
+	rows, err := db.Query(q, cycle, requestPending, requestAccepted, cycle)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query team completion")
+	}
+	defer rows.Close()
+	var completion []TeamCompletion
+	for rows.Next() {
+		var tc TeamCompletion
+		if err = rows.Scan(&tc.Team, &tc.Expected, &tc.Submitted); err != nil {
+			return nil, errors.Wrap(err, "unable to scan team completion")
+		}
+		tc.Percent = 100
+		if tc.Expected > 0 {
+			tc.Percent = float64(tc.Submitted) * 100 / float64(tc.Expected)
+		}
+		completion = append(completion, tc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan in GetTeamCompletion")
+	}
+	return completion, nil
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+ Webhooks let other tools follow what happens in peerreview without polling. Admins register a url and the events it
+ wants. Each event creates a delivery per subscribed webhook, in the same transaction as the delivery job, and the job
+ runner posts it with retries. Payloads never include feedback, and review.submitted does not say who the reviewer was.
+
+ Every delivery is signed with the webhook's secret: X-PeerReview-Signature is "sha256=" followed by the hex encoded
+ HMAC-SHA256 of the request body.
+*/
+
+// webhook events
+const (
+	eventUserCreated          = "user.created"
+	eventUserDeactivated      = "user.deactivated"
+	eventUserReactivated      = "user.reactivated"
+	eventTeamChanged          = "team.changed"
+	eventCycleChanged         = "cycle.changed"
+	eventReviewRequestCreated = "review_request.created"
+	eventReviewSubmitted      = "review.submitted"
+)
+
+var webhookEvents = []string{eventUserCreated, eventUserDeactivated, eventUserReactivated, eventTeamChanged, eventCycleChanged, eventReviewRequestCreated, eventReviewSubmitted}
+
+// webhook delivery statuses
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+const jobWebhookDelivery = "webhook_delivery"
+
+// signatureHeader carries the HMAC of the body so receivers can check a delivery came from us
+const signatureHeader = "X-PeerReview-Signature"
+
+// webhookClient posts deliveries. A slow receiver should not tie up a job worker for long.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// ErrWebhookNotFound is returned when a webhook does not exist
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// ErrInvalidWebhook is the cause of errors from registering a webhook with a bad url or events
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// Webhook is an endpoint that receives events. Secret is only returned when the webhook is created.
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one attempt to tell a webhook about an event, along with how it went
+type WebhookDelivery struct {
+	ID           int             `json:"id"`
+	WebhookID    int             `json:"webhook_id"`
+	Event        string          `json:"event"`
+	Payload      json.RawMessage `json:"payload"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	ResponseCode int             `json:"response_code"`
+	LastError    string          `json:"last_error"`
+	CreatedAt    time.Time       `json:"created_at"`
+	DeliveredAt  *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// webhookEnvelope is the body posted to webhooks
+type webhookEnvelope struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// event payloads
+
+type userEvent struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+type teamEvent struct {
+	Team string `json:"team"`
+	// Change is one of created, deleted, member_added, or member_removed
+	Change    string `json:"change"`
+	UserEmail string `json:"user_email,omitempty"`
+}
+
+type cycleEvent struct {
+	Cycle string `json:"cycle"`
+	// Change is one of created, opened, closed, or deleted
+	Change string `json:"change"`
+	IsOpen bool   `json:"is_open"`
+}
+
+type reviewRequestEvent struct {
+	ID             int    `json:"id,omitempty"`
+	Cycle          string `json:"cycle"`
+	RequesterEmail string `json:"requester_email"`
+	ReviewerEmail  string `json:"reviewer_email"`
+	Status         string `json:"status"`
+	// Source is set for requests created by reviewer assignment
+	Source string `json:"source,omitempty"`
+}
+
+type reviewSubmittedEvent struct {
+	Cycle         string `json:"cycle"`
+	RevieweeEmail string `json:"reviewee_email"`
+}
+
+// AddWebhook registers a url for the given events. A secret is generated if one is not given.
+func AddWebhook(db *sql.DB, rawURL string, events []string, secret string) (Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, errors.Wrap(ErrInvalidWebhook, "url must be an absolute http or https url")
+	}
+	if len(events) == 0 {
+		return Webhook{}, errors.Wrap(ErrInvalidWebhook, "at least one event is required")
+	}
+	for _, event := range events {
+		if event != "*" && !inList(event, webhookEvents) {
+			return Webhook{}, errors.Wrapf(ErrInvalidWebhook, "unknown event %q. Use * or one of %s", event, strings.Join(webhookEvents, ", "))
+		}
+	}
+	if secret == "" {
+		secret = RandStringRunes(32)
+	}
+	now := time.Now()
+	res, err := db.Exec("insert into webhooks (url, secret, events, created_at) values (?, ?, ?, ?)", rawURL, secret, strings.Join(events, ","), now.Unix())
+	if err != nil {
+		return Webhook{}, errors.Wrap(err, "unable to insert webhook")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Webhook{}, errors.Wrap(err, "unable to get webhook id")
+	}
+	return Webhook{ID: int(id), URL: rawURL, Events: events, Secret: secret, CreatedAt: time.Unix(now.Unix(), 0).UTC()}, nil
+}
+
+// GetWebhooks returns all webhooks without their secrets
+func GetWebhooks(db *sql.DB) ([]Webhook, error) {
+	rows, err := db.Query("select id, url, events, created_at from webhooks order by id")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query webhooks")
+	}
+	defer rows.Close()
+	var hooks []Webhook
+	for rows.Next() {
+		var h Webhook
+		var events string
+		var createdAt int64
+		if err = rows.Scan(&h.ID, &h.URL, &events, &createdAt); err != nil {
+			return nil, errors.Wrap(err, "unable to scan webhooks")
+		}
+		h.Events = strings.Split(events, ",")
+		h.CreatedAt = time.Unix(createdAt, 0).UTC()
+		hooks = append(hooks, h)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of webhooks")
+	}
+	return hooks, nil
+}
+
+// DeleteWebhook removes a webhook and its delivery log. Deliveries still queued are dropped.
+func DeleteWebhook(db *sql.DB, id int) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for DeleteWebhook")
+	}
+
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on DeleteWebhook")
+		}
+	}()
+
+	if _, err = tx.Exec("delete from webhook_deliveries where webhook_id=?", id); err != nil {
+		return errors.Wrap(err, "unable to delete webhook deliveries")
+	}
+	res, err := tx.Exec("delete from webhooks where id=?", id)
+	if err != nil {
+		return errors.Wrap(err, "unable to delete webhook")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to determine if webhook was deleted")
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// GetWebhookDeliveries returns a webhook's most recent deliveries, newest first
+func GetWebhookDeliveries(db *sql.DB, webhookID int, limit int) ([]WebhookDelivery, error) {
+	var exists int
+	err := db.QueryRow("select count(*) from webhooks where id=?", webhookID).Scan(&exists)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to look up webhook")
+	}
+	if exists == 0 {
+		return nil, ErrWebhookNotFound
+	}
+
+	q := `
+    SELECT id,
+           webhook_id,
+           event,
+           payload,
+           status,
+           attempts,
+           response_code,
+           last_error,
+           created_at,
+           delivered_at
+    FROM   webhook_deliveries
+    WHERE  webhook_id = ?
+    ORDER  BY id DESC
+    LIMIT  ?
+    `
+	rows, err := db.Query(q, webhookID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query webhook deliveries")
+	}
+	defer rows.Close()
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+		var createdAt int64
+		var deliveredAt sql.NullInt64
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.LastError, &createdAt, &deliveredAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to scan webhook deliveries")
+		}
+		d.Payload = json.RawMessage(payload)
+		d.CreatedAt = time.Unix(createdAt, 0).UTC()
+		if deliveredAt.Valid {
+			t := time.Unix(deliveredAt.Int64, 0).UTC()
+			d.DeliveredAt = &t
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error post scan of webhook deliveries")
+	}
+	return deliveries, nil
+}
+
+// EmitEvent creates a delivery, and the job to send it, for each webhook subscribed to event
+func EmitEvent(db *sql.DB, event string, data interface{}) (err error) {
+	now := time.Now()
+	// review.submitted only says which day it happened, like review_submissions, so it can not be matched to when a
+	// reviewer was active
+	createdAt := now.UTC()
+	if event == eventReviewSubmitted {
+		createdAt = createdAt.Truncate(24 * time.Hour)
+	}
+	body, err := json.Marshal(webhookEnvelope{Event: event, CreatedAt: createdAt, Data: data})
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal event")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "unable to begin tx for EmitEvent")
+	}
+
+	defer func() {
+		if err != nil {
+			// attempt a rollback and return the original error
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			err = errors.Wrap(err, "error committing tx on EmitEvent")
+		}
+	}()
+
+	rows, err := tx.Query("select id, events from webhooks")
+	if err != nil {
+		return errors.Wrap(err, "unable to query webhooks")
+	}
+	var subscribed []int
+	for rows.Next() {
+		var id int
+		var events string
+		if err = rows.Scan(&id, &events); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "unable to scan webhooks")
+		}
+		list := strings.Split(events, ",")
+		if inList("*", list) || inList(event, list) {
+			subscribed = append(subscribed, id)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "error post scan of webhooks")
+	}
+
+	q := "insert into webhook_deliveries (webhook_id, event, payload, status, created_at) values (?, ?, ?, ?, ?)"
+	for _, id := range subscribed {
+		res, err := tx.Exec(q, id, event, string(body), deliveryPending, createdAt.Unix())
+		if err != nil {
+			return errors.Wrap(err, "unable to insert webhook delivery")
+		}
+		deliveryID, err := res.LastInsertId()
+		if err != nil {
+			return errors.Wrap(err, "unable to get webhook delivery id")
+		}
+		if _, err = EnqueueJob(tx, jobWebhookDelivery, webhookDeliveryPayload{DeliveryID: int(deliveryID)}, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitEvent emits a webhook event. Like notifications, webhooks should never fail the request that caused them.
+func (a app) emitEvent(event string, data interface{}) {
+	if err := EmitEvent(a.db, event, data); err != nil {
+		log.Printf("error emitting %s event: %v", event, err)
+	}
+}
+
+// emitReviewRequestCreated emits a newly created review request
+func (a app) emitReviewRequestCreated(id int) {
+	rr, err := GetReviewRequest(a.db, id)
+	if err != nil {
+		log.Printf("error getting review request %d to emit: %v", id, err)
+		return
+	}
+	a.emitEvent(eventReviewRequestCreated, reviewRequestEvent{
+		ID:             rr.ID,
+		Cycle:          rr.Cycle,
+		RequesterEmail: rr.RequesterEmail,
+		ReviewerEmail:  rr.ReviewerEmail,
+		Status:         rr.Status,
+	})
+}
+
+type webhookDeliveryPayload struct {
+	DeliveryID int `json:"delivery_id"`
+}
+
+// signPayload returns the signature header value for body
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDeliveryJob posts a delivery to its webhook and records the outcome. Anything other than a 2xx is retried.
+func webhookDeliveryJob(a app, payload []byte) error {
+	var p webhookDeliveryPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return errors.Wrap(err, "unable to unmarshal webhook delivery payload")
+	}
+
+	q := `
+    SELECT webhooks.url,
+           webhooks.secret,
+           webhook_deliveries.event,
+           webhook_deliveries.payload,
+           webhook_deliveries.attempts
+    FROM   webhook_deliveries
+           JOIN webhooks
+             ON webhook_deliveries.webhook_id = webhooks.id
+    WHERE  webhook_deliveries.id = ?
+    `
+	var hookURL, secret, event, body string
+	var attempts int
+	err := a.db.QueryRow(q, p.DeliveryID).Scan(&hookURL, &secret, &event, &body, &attempts)
+	if err == sql.ErrNoRows {
+		// the webhook was deleted
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to get webhook delivery")
+	}
+
+	code, sendErr := postWebhook(hookURL, secret, event, p.DeliveryID, []byte(body))
+	attempts++
+	if sendErr == nil {
+		q := "update webhook_deliveries set status=?, attempts=?, response_code=?, last_error='', delivered_at=? where id=?"
+		if _, err := a.db.Exec(q, deliveryDelivered, attempts, code, time.Now().Unix(), p.DeliveryID); err != nil {
+			return errors.Wrap(err, "unable to mark webhook delivered")
+		}
+		return nil
+	}
+
+	// the job runner retries as many times as it allows, so the delivery has failed for good once those are used up
+	status := deliveryPending
+	if attempts >= defaultJobAttempts {
+		status = deliveryFailed
+	}
+	q = "update webhook_deliveries set status=?, attempts=?, response_code=?, last_error=? where id=?"
+	if _, err := a.db.Exec(q, status, attempts, code, sendErr.Error(), p.DeliveryID); err != nil {
+		return errors.Wrap(err, "unable to record failed webhook delivery")
+	}
+	return sendErr
+}
+
+// resetWebhookDelivery gives a delivery a fresh set of attempts when an admin retries its job, so it is not marked failed
+// while the job is still retrying
+func resetWebhookDelivery(tx *sql.Tx, payload []byte) error {
+	var p webhookDeliveryPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return errors.Wrap(err, "unable to unmarshal webhook delivery payload")
+	}
+	q := "update webhook_deliveries set status=?, attempts=0 where id=? and status != ?"
+	if _, err := tx.Exec(q, deliveryPending, p.DeliveryID, deliveryDelivered); err != nil {
+		return errors.Wrap(err, "unable to reset webhook delivery")
+	}
+	return nil
+}
+
+// postWebhook sends a signed delivery and returns the response code, if there was a response
+func postWebhook(hookURL string, secret string, event string, deliveryID int, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", hookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "peerreview-webhooks")
+	req.Header.Set("X-PeerReview-Event", event)
+	req.Header.Set("X-PeerReview-Delivery", fmt.Sprint(deliveryID))
+	req.Header.Set(signatureHeader, signPayload(secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to post webhook")
+	}
+	defer resp.Body.Close()
+	// read a little of the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
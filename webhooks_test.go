@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	/*
+		Verify webhooks only receive the events they subscribe to, signed with their secret
+		Verify review.submitted does not include feedback or the reviewer, and only says which day it happened
+		Verify failed deliveries are retried and show in the delivery log
+		Verify secrets are not listed and bad webhooks are rejected
+	*/
+	receiver := newWebhookReceiver(0)
+	defer receiver.Close()
+	flaky := newWebhookReceiver(1)
+	defer flaky.Close()
+
+	cli, teardown := setupInstanceWith(func(a *app) {
+		// one worker keeps deliveries in order
+		a.jobs.Workers = 1
+		a.jobs.Poll = 10 * time.Millisecond
+		a.jobs.Backoff = time.Millisecond
+	})
+	defer teardown()
+
+	if _, err := cli.AddWebhook("not a url", []string{"*"}, ""); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for a bad url", err)
+	}
+	if _, err := cli.AddWebhook(receiver.URL, []string{"review.deleted"}, ""); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got %v, want a 400 for an unknown event", err)
+	}
+
+	hook, err := cli.AddWebhook(receiver.URL, []string{eventCycleChanged, eventReviewRequestCreated, eventReviewSubmitted}, "s3cret")
+	NoErr(t, err, "adding webhook")
+	flakyHook, err := cli.AddWebhook(flaky.URL, []string{"*"}, "")
+	NoErr(t, err, "adding flaky webhook")
+	if flakyHook.Secret == "" {
+		t.Error("want a generated secret")
+	}
+
+	hooks, err := cli.GetWebhooks()
+	NoErr(t, err, "getting webhooks")
+	if len(hooks) != 2 || hooks[0].Secret != "" {
+		t.Errorf("got %+v, want 2 webhooks without secrets", hooks)
+	}
+
+	NoErr(t, CreateUser(cli.db, "user_1", "user_1@example.com"), "creating user")
+	NoErr(t, cli.InsertTeam("team_a"), "adding team")
+	NoErr(t, cli.AssignTeamToUser("team_a"), "joining team")
+	NoErr(t, cli.AddCycle("cycle_1"), "adding cycle")
+	NoErr(t, cli.AddReviewer("user_1@example.com", "cycle_1"), "requesting review")
+	NoErr(t, cli.as("user_1@example.com").AddReviewForUser(cli.userEmail, "cycle_1", []string{"secret strength"}, []string{"secret opportunity"}), "adding review")
+
+	got := receiver.wait(t, 3)
+	for i, want := range []string{eventCycleChanged, eventReviewRequestCreated, eventReviewSubmitted} {
+		if got[i].event != want {
+			t.Errorf("got event %s, want %s", got[i].event, want)
+		}
+		if got[i].signature != signPayload("s3cret", got[i].body) {
+			t.Errorf("got signature %s, want it to match the body", got[i].signature)
+		}
+	}
+	var envelope struct {
+		Event     string               `json:"event"`
+		CreatedAt time.Time            `json:"created_at"`
+		Data      reviewSubmittedEvent `json:"data"`
+	}
+	NoErr(t, json.Unmarshal(got[2].body, &envelope), "unmarshaling review.submitted")
+	if envelope.Data.RevieweeEmail != cli.userEmail || envelope.Data.Cycle != "cycle_1" {
+		t.Errorf("got %+v, want the reviewee and cycle", envelope)
+	}
+	if !envelope.CreatedAt.Equal(envelope.CreatedAt.Truncate(24 * time.Hour)) {
+		t.Errorf("got created_at %s, want only the day", envelope.CreatedAt)
+	}
+	for _, secret := range []string{"secret strength", "secret opportunity", "user_1@example.com"} {
+		if strings.Contains(string(got[2].body), secret) {
+			t.Errorf("review.submitted contains %q: %s", secret, got[2].body)
+		}
+	}
+
+	// the flaky receiver subscribed to everything, including the team changes, and failed its first delivery
+	flaky.wait(t, 5)
+	var deliveries []WebhookDelivery
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries, err = cli.GetWebhookDeliveries(flakyHook.ID)
+		NoErr(t, err, "getting deliveries")
+		if len(deliveries) == 5 && deliveries[4].Status == deliveryDelivered {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(deliveries) != 5 {
+		t.Fatalf("got %d deliveries, want 5", len(deliveries))
+	}
+	first := deliveries[4]
+	if first.Event != eventTeamChanged || first.Status != deliveryDelivered || first.Attempts != 2 || first.ResponseCode != http.StatusOK {
+		t.Errorf("got %+v, want the team change delivered on the second attempt", first)
+	}
+
+	NoErr(t, cli.DeleteWebhook(hook.ID), "deleting webhook")
+	if _, err := cli.GetWebhookDeliveries(hook.ID); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want a 404 for a deleted webhook's deliveries", err)
+	}
+}
+
+func TestWebhookDeliveryRetry(t *testing.T) {
+	/*
+		Verify retrying a failed delivery's job gives the delivery a fresh set of attempts
+	*/
+	flaky := newWebhookReceiver(1)
+	defer flaky.Close()
+	cli, teardown := setupInstanceWith(func(a *app) {
+		a.jobs.Poll = 10 * time.Millisecond
+		a.jobs.Backoff = time.Millisecond
+	})
+	defer teardown()
+
+	// a delivery whose job used up its attempts
+	now := time.Now().Unix()
+	res, err := cli.db.Exec("insert into webhooks (url, secret, events, created_at) values (?, 's', '*', ?)", flaky.URL, now)
+	NoErr(t, err, "adding webhook")
+	hookID, _ := res.LastInsertId()
+	res, err = cli.db.Exec("insert into webhook_deliveries (webhook_id, event, payload, status, attempts, last_error, created_at) values (?, ?, '{}', ?, ?, 'refused', ?)",
+		hookID, eventCycleChanged, deliveryFailed, defaultJobAttempts, now)
+	NoErr(t, err, "adding delivery")
+	deliveryID, _ := res.LastInsertId()
+	payload, _ := json.Marshal(webhookDeliveryPayload{DeliveryID: int(deliveryID)})
+	res, err = cli.db.Exec("insert into jobs (kind, payload, status, attempts, run_at, created_at, updated_at) values (?, ?, ?, ?, ?, ?, ?)",
+		jobWebhookDelivery, string(payload), jobDead, defaultJobAttempts, now, now, now)
+	NoErr(t, err, "adding job")
+	jobID, _ := res.LastInsertId()
+
+	// the receiver fails the first try after the retry, which must not mark the delivery failed
+	NoErr(t, cli.RetryJob(int(jobID)), "retrying job")
+	flaky.wait(t, 1)
+	var deliveries []WebhookDelivery
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries, err = cli.GetWebhookDeliveries(int(hookID))
+		NoErr(t, err, "getting deliveries")
+		if len(deliveries) == 1 && deliveries[0].Status == deliveryDelivered {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != deliveryDelivered || deliveries[0].Attempts != 2 {
+		t.Errorf("got %+v, want the delivery delivered on the second attempt after the retry", deliveries)
+	}
+}
+
+type webhookRequest struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+// webhookReceiver records webhook deliveries. It fails the first failures deliveries it gets with a 500.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	requests []webhookRequest
+}
+
+func newWebhookReceiver(failures int) *webhookReceiver {
+	wr := &webhookReceiver{failures: failures}
+	wr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		wr.mu.Lock()
+		defer wr.mu.Unlock()
+		if wr.failures > 0 {
+			wr.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		wr.requests = append(wr.requests, webhookRequest{event: r.Header.Get("X-PeerReview-Event"), signature: r.Header.Get(signatureHeader), body: body})
+	}))
+	return wr
+}
+
+// wait returns the first n deliveries in the order they were created, failing the test if they do not arrive in time
+func (wr *webhookReceiver) wait(t *testing.T, n int) []webhookRequest {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		wr.mu.Lock()
+		if len(wr.requests) >= n {
+			got := append([]webhookRequest(nil), wr.requests...)
+			wr.mu.Unlock()
+			return got[:n]
+		}
+		wr.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got fewer than %d webhook deliveries", n)
+	return nil
+}